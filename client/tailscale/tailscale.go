@@ -35,6 +35,11 @@ import (
 // TailscaledSocket is the tailscaled Unix socket.
 var TailscaledSocket = paths.DefaultTailscaledSocket()
 
+// TailscaledPort is the localhost TCP port of tailscaled's IPN server,
+// connected to instead of TailscaledSocket on platforms without unix
+// sockets. It needs to match tailscaled's --ipn-port.
+var TailscaledPort uint16 = 41112
+
 // tsClient does HTTP requests to the local Tailscale daemon.
 var tsClient = &http.Client{
 	Transport: &http.Transport{
@@ -51,7 +56,7 @@ var tsClient = &http.Client{
 					return d.DialContext(ctx, "tcp", "localhost:"+strconv.Itoa(port))
 				}
 			}
-			return safesocket.Connect(TailscaledSocket, 41112)
+			return safesocket.Connect(TailscaledSocket, TailscaledPort)
 		},
 	},
 }
@@ -87,13 +92,23 @@ func bestError(err error, body []byte) error {
 }
 
 func send(ctx context.Context, method, path string, wantStatus int, body io.Reader) ([]byte, error) {
+	slurp, _, _, err := sendWithHeader(ctx, method, path, wantStatus, body, nil)
+	return slurp, err
+}
+
+// sendWithHeader is like send, but also sends the request headers
+// reqHeader and returns the response's headers and status code.
+func sendWithHeader(ctx context.Context, method, path string, wantStatus int, body io.Reader, reqHeader http.Header) (_ []byte, _ http.Header, status int, _ error) {
 	req, err := http.NewRequestWithContext(ctx, method, "http://local-tailscaled.sock"+path, body)
 	if err != nil {
-		return nil, err
+		return nil, nil, 0, err
+	}
+	for k, vv := range reqHeader {
+		req.Header[k] = vv
 	}
 	res, err := DoLocalRequest(req)
 	if err != nil {
-		return nil, err
+		return nil, nil, 0, err
 	}
 	defer res.Body.Close()
 	if server := res.Header.Get("Tailscale-Version"); server != version.Long {
@@ -101,13 +116,13 @@ func send(ctx context.Context, method, path string, wantStatus int, body io.Read
 	}
 	slurp, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		return nil, err
+		return nil, nil, res.StatusCode, err
 	}
 	if res.StatusCode != wantStatus {
 		err := fmt.Errorf("HTTP %s: %s (expected %v)", res.Status, slurp, wantStatus)
-		return nil, bestError(err, slurp)
+		return nil, res.Header, res.StatusCode, bestError(err, slurp)
 	}
-	return slurp, nil
+	return slurp, res.Header, res.StatusCode, nil
 }
 
 func get200(ctx context.Context, path string) ([]byte, error) {
@@ -245,12 +260,44 @@ func GetPrefs(ctx context.Context) (*ipn.Prefs, error) {
 	return &p, nil
 }
 
+// GetPrefsWithETag is like GetPrefs, but also returns an opaque
+// version identifier of the prefs, for use with EditPrefsIfMatch.
+func GetPrefsWithETag(ctx context.Context) (_ *ipn.Prefs, etag string, _ error) {
+	body, h, _, err := sendWithHeader(ctx, "GET", "/localapi/v0/prefs", http.StatusOK, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	var p ipn.Prefs
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, "", fmt.Errorf("invalid prefs JSON: %w", err)
+	}
+	return &p, h.Get("ETag"), nil
+}
+
 func EditPrefs(ctx context.Context, mp *ipn.MaskedPrefs) (*ipn.Prefs, error) {
+	return EditPrefsIfMatch(ctx, mp, "")
+}
+
+// ErrPrefsChanged is returned by EditPrefsIfMatch when the prefs
+// were changed after they were read.
+var ErrPrefsChanged = errors.New("prefs were changed concurrently by another client")
+
+// EditPrefsIfMatch is like EditPrefs, but only applies mp if the
+// prefs haven't changed since GetPrefsWithETag returned etag. If they
+// have, it returns ErrPrefsChanged. An empty etag matches any prefs.
+func EditPrefsIfMatch(ctx context.Context, mp *ipn.MaskedPrefs, etag string) (*ipn.Prefs, error) {
 	mpj, err := json.Marshal(mp)
 	if err != nil {
 		return nil, err
 	}
-	body, err := send(ctx, "PATCH", "/localapi/v0/prefs", http.StatusOK, bytes.NewReader(mpj))
+	var reqHeader http.Header
+	if etag != "" {
+		reqHeader = http.Header{"If-Match": {etag}}
+	}
+	body, _, status, err := sendWithHeader(ctx, "PATCH", "/localapi/v0/prefs", http.StatusOK, bytes.NewReader(mpj), reqHeader)
+	if status == http.StatusPreconditionFailed {
+		return nil, ErrPrefsChanged
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -261,6 +308,25 @@ func EditPrefs(ctx context.Context, mp *ipn.MaskedPrefs) (*ipn.Prefs, error) {
 	return &p, nil
 }
 
+// StartIfMatch starts the backend with opts, but only if the prefs
+// haven't changed since GetPrefsWithETag returned etag. If they have,
+// it returns ErrPrefsChanged. An empty etag matches any prefs.
+func StartIfMatch(ctx context.Context, opts ipn.Options, etag string) error {
+	optsj, err := json.Marshal(opts)
+	if err != nil {
+		return err
+	}
+	var reqHeader http.Header
+	if etag != "" {
+		reqHeader = http.Header{"If-Match": {etag}}
+	}
+	_, _, status, err := sendWithHeader(ctx, "POST", "/localapi/v0/start", http.StatusNoContent, bytes.NewReader(optsj), reqHeader)
+	if status == http.StatusPreconditionFailed {
+		return ErrPrefsChanged
+	}
+	return err
+}
+
 func Logout(ctx context.Context) error {
 	_, err := send(ctx, "POST", "/localapi/v0/logout", http.StatusNoContent, nil)
 	return err
@@ -288,6 +354,73 @@ func SetDNS(ctx context.Context, name, value string) error {
 	return err
 }
 
+// DebugAdvanceClock advances the clock of a tailscaled started with
+// TS_DEBUG_FAKE_CLOCK by d, for tests.
+func DebugAdvanceClock(ctx context.Context, d time.Duration) error {
+	v := url.Values{}
+	v.Set("d", d.String())
+	_, err := send(ctx, "POST", "/localapi/v0/debug-advance-clock?"+v.Encode(), 200, nil)
+	return err
+}
+
+// DebugInjectLinkChange makes a tailscaled started with
+// TS_DEBUG_INJECT_LINK_CHANGE act as if its link monitor saw a network
+// change, for tests.
+func DebugInjectLinkChange(ctx context.Context) error {
+	_, err := send(ctx, "POST", "/localapi/v0/debug-inject-link-change", 200, nil)
+	return err
+}
+
+// SetDNSQueryLogging turns logging of the queries handled by
+// tailscaled's DNS resolver on for d, or off if d is zero or
+// negative. Logging turns itself off again after d.
+func SetDNSQueryLogging(ctx context.Context, d time.Duration) error {
+	v := url.Values{}
+	if d > 0 {
+		v.Set("enable", "true")
+		v.Set("duration", d.String())
+	} else {
+		v.Set("enable", "false")
+	}
+	_, err := send(ctx, "POST", "/localapi/v0/dns-query-log?"+v.Encode(), 200, nil)
+	return err
+}
+
+// DNSQueryLog returns tailscaled's DNS query log.
+func DNSQueryLog(ctx context.Context) (*ipnstate.DNSQueryLog, error) {
+	body, err := send(ctx, "GET", "/localapi/v0/dns-query-log", 200, nil)
+	if err != nil {
+		return nil, err
+	}
+	ql := new(ipnstate.DNSQueryLog)
+	if err := json.Unmarshal(body, ql); err != nil {
+		return nil, err
+	}
+	return ql, nil
+}
+
+// SetWireGuardDeviceLogging turns tailscaled's logging of
+// wireguard-go's verbose device logs (handshakes, keepalives, and
+// such) on or off.
+func SetWireGuardDeviceLogging(ctx context.Context, on bool) error {
+	_, err := send(ctx, "POST", "/localapi/v0/wg-device-logging?enable="+strconv.FormatBool(on), 200, nil)
+	return err
+}
+
+// NetstackConns returns the connections tailscaled's netstack is
+// forwarding and, if withHistory, the last ones to have closed.
+func NetstackConns(ctx context.Context, withHistory bool) (*ipnstate.NetstackConns, error) {
+	body, err := send(ctx, "GET", "/localapi/v0/netstack-conns?history="+strconv.FormatBool(withHistory), 200, nil)
+	if err != nil {
+		return nil, err
+	}
+	conns := new(ipnstate.NetstackConns)
+	if err := json.Unmarshal(body, conns); err != nil {
+		return nil, err
+	}
+	return conns, nil
+}
+
 // CurrentDERPMap returns the current DERPMap that is being used by the local tailscaled.
 // It is intended to be used with netcheck to see availability of DERPs.
 func CurrentDERPMap(ctx context.Context) (*tailcfg.DERPMap, error) {
@@ -0,0 +1,91 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"tailscale.com/derp"
+	"tailscale.com/types/logger"
+)
+
+// certDirPollInterval is how often a --derp-cert-dir is checked for
+// renewed certificates.
+var certDirPollInterval = time.Minute
+
+// certDirWatcher loads the TLS certificate for a hostname from a
+// directory of externally managed certificates (e.g. by certbot),
+// HOSTNAME.crt and HOSTNAME.key, into a DERP server, and reloads it
+// when the files change.
+type certDirWatcher struct {
+	s        *derp.Server
+	logf     logger.Logf
+	certFile string
+	keyFile  string
+
+	lastMod time.Time // latest mtime of certFile and keyFile when last loaded
+}
+
+func newCertDirWatcher(s *derp.Server, logf logger.Logf, dir, hostname string) *certDirWatcher {
+	return &certDirWatcher{
+		s:        s,
+		logf:     logf,
+		certFile: filepath.Join(dir, hostname+".crt"),
+		keyFile:  filepath.Join(dir, hostname+".key"),
+	}
+}
+
+// modTime returns the latest modification time of the cert and key
+// files.
+func (w *certDirWatcher) modTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{w.certFile, w.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if mt := fi.ModTime(); mt.After(latest) {
+			latest = mt
+		}
+	}
+	return latest, nil
+}
+
+// load loads the cert and key into the DERP server if they've changed
+// since the last load. On error, the previous certificate stays in
+// use.
+func (w *certDirWatcher) load() error {
+	mt, err := w.modTime()
+	if err != nil {
+		return err
+	}
+	if mt.Equal(w.lastMod) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(w.certFile, w.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading %s: %w", w.certFile, err)
+	}
+	w.s.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}})
+	if !w.lastMod.IsZero() {
+		w.logf("derper: reloaded TLS certificate from %s", w.certFile)
+	}
+	w.lastMod = mt
+	return nil
+}
+
+// run reloads the certificate whenever it changes. It doesn't return.
+func (w *certDirWatcher) run() {
+	for {
+		time.Sleep(certDirPollInterval)
+		if err := w.load(); err != nil {
+			w.logf("derper: %v; keeping previous TLS certificate", err)
+		}
+	}
+}
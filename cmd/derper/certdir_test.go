@@ -0,0 +1,120 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"tailscale.com/derp"
+	"tailscale.com/types/key"
+)
+
+// writeTestCert writes a self-signed certificate for hostname with
+// the given serial number to dir, with the given modification time.
+func writeTestCert(t *testing.T, dir, hostname string, serial int64, mtime time.Time) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: hostname},
+		DNSNames:     []string{hostname},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		hostname + ".crt": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		hostname + ".key": pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+	}
+	for name, b := range files {
+		f := filepath.Join(dir, name)
+		if err := os.WriteFile(f, b, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(f, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCertDirWatcher(t *testing.T) {
+	const hostname = "derp.example.com"
+	dir := t.TempDir()
+	s := derp.NewServer(key.NewPrivate(), t.Logf)
+	defer s.Close()
+	w := newCertDirWatcher(s, t.Logf, dir, hostname)
+
+	if err := w.load(); err == nil {
+		t.Fatal("load succeeded with no cert files")
+	}
+
+	servedSerial := func() int64 {
+		t.Helper()
+		cert, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: hostname})
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.SerialNumber.Int64()
+	}
+
+	t0 := time.Now().Add(-time.Hour)
+	writeTestCert(t, dir, hostname, 1, t0)
+	if err := w.load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := servedSerial(); got != 1 {
+		t.Fatalf("serving serial %d; want 1", got)
+	}
+
+	// A renewal is picked up.
+	writeTestCert(t, dir, hostname, 2, t0.Add(time.Minute))
+	if err := w.load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := servedSerial(); got != 2 {
+		t.Fatalf("after renewal, serving serial %d; want 2", got)
+	}
+
+	// A broken renewal keeps the previous cert.
+	crt := filepath.Join(dir, hostname+".crt")
+	if err := os.WriteFile(crt, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t1 := t0.Add(2 * time.Minute)
+	if err := os.Chtimes(crt, t1, t1); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.load(); err == nil {
+		t.Error("load of bad cert succeeded")
+	}
+	if got := servedSerial(); got != 2 {
+		t.Fatalf("after bad renewal, serving serial %d; want 2", got)
+	}
+}
@@ -21,7 +21,6 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
-	"time"
 
 	"golang.org/x/crypto/acme/autocert"
 	"tailscale.com/atomicfile"
@@ -40,6 +39,7 @@ var (
 	addr          = flag.String("a", ":443", "server address")
 	configPath    = flag.String("c", "", "config file path")
 	certDir       = flag.String("certdir", tsweb.DefaultCertDir("derper-certs"), "directory to store LetsEncrypt certs, if addr's port is :443")
+	derpCertDir   = flag.String("derp-cert-dir", "", "if non-empty, directory of externally managed TLS certs HOSTNAME.crt and HOSTNAME.key to serve instead of using LetsEncrypt; reloaded when they change")
 	hostname      = flag.String("hostname", "derp.tailscale.com", "LetsEncrypt host name, if addr's port is :443")
 	logCollection = flag.String("logcollection", "", "If non-empty, logtail collection to log to")
 	runSTUN       = flag.Bool("stun", false, "also run a STUN server")
@@ -47,6 +47,7 @@ var (
 	meshWith      = flag.String("mesh-with", "", "optional comma-separated list of hostnames to mesh with; the server's own hostname can be in the list")
 	bootstrapDNS  = flag.String("bootstrap-dns-names", "", "optional comma-separated list of hostnames to make available at /bootstrap-dns")
 	verifyClients = flag.Bool("verify-clients", false, "verify clients to this DERP server through a local tailscaled instance.")
+	maxClientRate = flag.Int64("max-client-bytes-per-sec", 0, "if non-zero, the maximum bandwidth in bytes per second of each client connection, in each direction")
 )
 
 type config struct {
@@ -129,6 +130,7 @@ func main() {
 
 	s := derp.NewServer(key.Private(cfg.PrivateKey), log.Printf)
 	s.SetVerifyClient(*verifyClients)
+	s.SetMaxClientBytesPerSec(*maxClientRate)
 
 	if *meshPSKFile != "" {
 		b, err := ioutil.ReadFile(*meshPSKFile)
@@ -149,6 +151,7 @@ func main() {
 
 	mux := http.NewServeMux()
 	mux.Handle("/derp", derphttp.Handler(s))
+	mux.Handle("/metrics", derphttp.Handler(s))
 	go refreshBootstrapDNSLoop()
 	mux.HandleFunc("/bootstrap-dns", handleBootstrapDNS)
 	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -190,7 +193,16 @@ func main() {
 	}
 
 	var err error
-	if letsEncrypt {
+	if *derpCertDir != "" {
+		w := newCertDirWatcher(s, log.Printf, *derpCertDir, *hostname)
+		if err := w.load(); err != nil {
+			log.Fatalf("derper: --derp-cert-dir: %v", err)
+		}
+		go w.run()
+		log.Printf("derper: serving on %s with TLS certs from %s", *addr, *derpCertDir)
+		httpsrv.TLSConfig = derphttp.TLSConfig(s)
+		err = httpsrv.ListenAndServeTLS("", "")
+	} else if letsEncrypt {
 		if *certDir == "" {
 			log.Fatalf("missing required --certdir flag")
 		}
@@ -256,44 +268,26 @@ func serveSTUN() {
 	stats.Set("counter_addrfamily", stunAddrFamily)
 	expvar.Publish("stun", stats)
 
-	var buf [64 << 10]byte
-	for {
-		n, addr, err := pc.ReadFrom(buf[:])
-		if err != nil {
-			log.Printf("STUN ReadFrom: %v", err)
-			time.Sleep(time.Second)
-			stunReadError.Add(1)
-			continue
-		}
-		ua, ok := addr.(*net.UDPAddr)
-		if !ok {
-			log.Printf("STUN unexpected address %T %v", addr, addr)
+	err = stun.Serve(pc, log.Printf, func(disposition string, from *net.UDPAddr) {
+		switch disposition {
+		case stun.ReadError:
 			stunReadError.Add(1)
-			continue
-		}
-		pkt := buf[:n]
-		if !stun.Is(pkt) {
-			stunNotSTUN.Add(1)
-			continue
-		}
-		txid, err := stun.ParseBindingRequest(pkt)
-		if err != nil {
+			return
+		case stun.NotSTUN:
 			stunNotSTUN.Add(1)
-			continue
+			return
+		case stun.WriteError:
+			stunWriteError.Add(1)
+		case stun.Success:
+			stunSuccess.Add(1)
 		}
-		if ua.IP.To4() != nil {
+		if from.IP.To4() != nil {
 			stunIPv4.Add(1)
 		} else {
 			stunIPv6.Add(1)
 		}
-		res := stun.Response(txid, ua.IP, uint16(ua.Port))
-		_, err = pc.WriteTo(res, addr)
-		if err != nil {
-			stunWriteError.Add(1)
-		} else {
-			stunSuccess.Add(1)
-		}
-	}
+	})
+	log.Fatalf("STUN server: %v", err)
 }
 
 var validProdHostname = regexp.MustCompile(`^derp([^.]*)\.tailscale\.com\.?$`)
@@ -58,15 +58,24 @@ func startMeshWithHost(s *derp.Server, host string) error {
 			ips, _ := r.LookupIP(subCtx, "ip", vpcHost)
 			if len(ips) > 0 {
 				vpcAddr := net.JoinHostPort(ips[0].String(), port)
+				t0 := time.Now()
 				c, err := d.DialContext(subCtx, network, vpcAddr)
 				if err == nil {
+					s.SetMeshPeerLatency(host, time.Since(t0))
 					log.Printf("connected to %v (%v) instead of %v", vpcHost, ips[0], base)
 					return c, nil
 				}
 				log.Printf("failed to connect to %v (%v): %v; trying non-VPC route", vpcHost, ips[0], err)
 			}
 		}
-		return d.DialContext(ctx, network, addr)
+		// A TCP dial takes about one round trip, which is a
+		// good enough latency sample for the metrics.
+		t0 := time.Now()
+		c, err := d.DialContext(ctx, network, addr)
+		if err == nil {
+			s.SetMeshPeerLatency(host, time.Since(t0))
+		}
+		return c, err
 	})
 
 	add := func(k key.Public) { s.AddPacketForwarder(k, c) }
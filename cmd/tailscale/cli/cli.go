@@ -28,6 +28,7 @@ import (
 	"tailscale.com/paths"
 	"tailscale.com/safesocket"
 	"tailscale.com/syncs"
+	"tailscale.com/types/flagtype"
 )
 
 // ActLikeCLI reports whether a GUI application should act like the
@@ -83,7 +84,8 @@ func Run(args []string) error {
 	}
 
 	rootfs := flag.NewFlagSet("tailscale", flag.ExitOnError)
-	rootfs.StringVar(&rootArgs.socket, "socket", paths.DefaultTailscaledSocket(), "path to tailscaled's unix socket")
+	rootfs.StringVar(&rootArgs.socket, "socket", paths.DefaultTailscaledSocket(), `path to tailscaled's unix socket, or "@name" for a Linux abstract socket`)
+	rootfs.Var(flagtype.PortValue(&rootArgs.ipnPort, 41112), "ipn-port", "localhost TCP port of tailscaled's IPN server, on platforms without unix sockets; must match tailscaled's --ipn-port")
 
 	rootCmd := &ffcli.Command{
 		Name:       "tailscale",
@@ -127,6 +129,7 @@ change in the future.
 	}
 
 	tailscale.TailscaledSocket = rootArgs.socket
+	tailscale.TailscaledPort = rootArgs.ipnPort
 
 	err := rootCmd.Run(context.Background())
 	if err == flag.ErrHelp {
@@ -141,13 +144,14 @@ func fatalf(format string, a ...interface{}) {
 }
 
 var rootArgs struct {
-	socket string
+	socket  string
+	ipnPort uint16
 }
 
 var gotSignal syncs.AtomicBool
 
 func connect(ctx context.Context) (net.Conn, *ipn.BackendClient, context.Context, context.CancelFunc) {
-	c, err := safesocket.Connect(rootArgs.socket, 41112)
+	c, err := safesocket.Connect(rootArgs.socket, rootArgs.ipnPort)
 	if err != nil {
 		if runtime.GOOS != "windows" && rootArgs.socket == "" {
 			fatalf("--socket cannot be empty")
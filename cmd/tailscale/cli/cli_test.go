@@ -568,6 +568,23 @@ func TestPrefsFromUpArgs(t *testing.T) {
 			},
 			wantErr: `invalid value --netfilter-mode="bogus"`,
 		},
+		{
+			name:    "error_no_tailnet_ips",
+			args:    upArgsFromOSArgs("linux", "--tailnet-ipv4=false", "--tailnet-ipv6=false"),
+			wantErr: "--tailnet-ipv4=false and --tailnet-ipv6=false can't be used together",
+		},
+		{
+			name: "no_tailnet_ipv6",
+			args: upArgsFromOSArgs("linux", "--tailnet-ipv6=false"),
+			want: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				WantRunning:      true,
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				NoTailnetIPv6:    true,
+				NetfilterMode:    preftype.NetfilterOn,
+			},
+		},
 		{
 			name: "error_exit_node_ip_is_self_ip",
 			args: upArgsT{
@@ -583,6 +600,8 @@ func TestPrefsFromUpArgs(t *testing.T) {
 			goos: "linux",
 			args: upArgsT{
 				netfilterMode: "nodivert",
+				tailnetIPv4:   true,
+				tailnetIPv6:   true,
 			},
 			wantWarn: "netfilter=nodivert; add iptables calls to ts-* chains manually.",
 			want: &ipn.Prefs{
@@ -596,6 +615,8 @@ func TestPrefsFromUpArgs(t *testing.T) {
 			goos: "linux",
 			args: upArgsT{
 				netfilterMode: "off",
+				tailnetIPv4:   true,
+				tailnetIPv6:   true,
 			},
 			wantWarn: "netfilter=off; configure iptables yourself.",
 			want: &ipn.Prefs{
@@ -702,6 +723,8 @@ func TestUpdatePrefs(t *testing.T) {
 		wantSimpleUp   bool
 		wantJustEditMP *ipn.MaskedPrefs
 		wantErrSubtr   string
+		wantControlURL string // if non-empty, the new prefs' ControlURL
+		wantShieldsUp  bool
 	}{
 		{
 			name:  "bare_up_means_up",
@@ -761,6 +784,85 @@ func TestUpdatePrefs(t *testing.T) {
 			wantJustEditMP: &ipn.MaskedPrefs{WantRunningSet: true},
 			wantErrSubtr:   "can't change --login-server without --force-reauth",
 		},
+		{
+			name:  "daemon_login_server",
+			flags: []string{"--hostname=foo"},
+			curPrefs: &ipn.Prefs{
+				ControlURL:       "https://localhost:1000",
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				NetfilterMode:    preftype.NetfilterOn,
+			},
+			env:            upCheckEnv{backendState: "NeedsLogin", defaultControlURL: "https://localhost:1000"},
+			wantControlURL: "https://localhost:1000",
+		},
+		{
+			name:  "override_daemon_login_server",
+			flags: []string{"--login-server=https://localhost:2000"},
+			curPrefs: &ipn.Prefs{
+				ControlURL:       "https://localhost:1000",
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				NetfilterMode:    preftype.NetfilterOn,
+			},
+			env:            upCheckEnv{backendState: "NeedsLogin", defaultControlURL: "https://localhost:1000"},
+			wantControlURL: "https://localhost:2000",
+		},
+		{
+			// Without a daemon --login-server, a control URL left
+			// in the prefs by an earlier up isn't silently kept:
+			// up without --login-server must mention it.
+			name:  "stale_login_server_not_kept",
+			flags: []string{"--hostname=foo"},
+			curPrefs: &ipn.Prefs{
+				ControlURL:       "https://localhost:1000",
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				NetfilterMode:    preftype.NetfilterOn,
+			},
+			env:          upCheckEnv{backendState: "NeedsLogin"},
+			wantErrSubtr: "--login-server=https://localhost:1000",
+		},
+		{
+			name:  "default_login_server",
+			flags: []string{"--hostname=foo"},
+			curPrefs: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				NetfilterMode:    preftype.NetfilterOn,
+			},
+			env:            upCheckEnv{backendState: "NeedsLogin"},
+			wantControlURL: ipn.DefaultControlURL,
+		},
+		{
+			// Before the first login, shields the daemon was
+			// started with stay up.
+			name:  "daemon_shields_up",
+			flags: []string{"--hostname=foo"},
+			curPrefs: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				NetfilterMode:    preftype.NetfilterOn,
+				ShieldsUp:        true,
+			},
+			env:           upCheckEnv{backendState: "NeedsLogin"},
+			wantShieldsUp: true,
+		},
+		{
+			name:  "lower_daemon_shields_up",
+			flags: []string{"--shields-up=false"},
+			curPrefs: &ipn.Prefs{
+				ControlURL:       ipn.DefaultControlURL,
+				AllowSingleHosts: true,
+				CorpDNS:          true,
+				NetfilterMode:    preftype.NetfilterOn,
+				ShieldsUp:        true,
+			},
+			env:           upCheckEnv{backendState: "NeedsLogin"},
+			wantShieldsUp: false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -787,6 +889,12 @@ func TestUpdatePrefs(t *testing.T) {
 			if simpleUp != tt.wantSimpleUp {
 				t.Fatalf("simpleUp=%v, want %v", simpleUp, tt.wantSimpleUp)
 			}
+			if tt.wantControlURL != "" && newPrefs.ControlURL != tt.wantControlURL {
+				t.Fatalf("ControlURL=%q, want %q", newPrefs.ControlURL, tt.wantControlURL)
+			}
+			if newPrefs.ShieldsUp != tt.wantShieldsUp {
+				t.Fatalf("ShieldsUp=%v, want %v", newPrefs.ShieldsUp, tt.wantShieldsUp)
+			}
 			if justEditMP != nil {
 				justEditMP.Prefs = ipn.Prefs{} // uninteresting
 			}
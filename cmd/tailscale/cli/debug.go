@@ -15,10 +15,12 @@ import (
 	"os"
 	"runtime"
 	"strings"
+	"time"
 
 	"github.com/peterbourgon/ff/v2/ffcli"
 	"tailscale.com/client/tailscale"
 	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/paths"
 	"tailscale.com/safesocket"
 )
@@ -36,8 +38,13 @@ var debugCmd = &ffcli.Command{
 		fs.BoolVar(&debugArgs.netMap, "netmap", true, "whether to include netmap in --ipn mode")
 		fs.BoolVar(&debugArgs.localCreds, "local-creds", false, "print how to connect to local tailscaled")
 		fs.StringVar(&debugArgs.file, "file", "", "get, delete:NAME, or NAME")
+		fs.DurationVar(&debugArgs.advanceClock, "advance-clock", 0, "if non-zero, advance the fake clock of a tailscaled run with TS_DEBUG_FAKE_CLOCK by this much")
+		fs.BoolVar(&debugArgs.injectLinkChange, "inject-link-change", false, "if true, make a tailscaled run with TS_DEBUG_INJECT_LINK_CHANGE act as if the network changed")
 		return fs
 	})(),
+	Subcommands: []*ffcli.Command{
+		debugDNSLogCmd,
+	},
 }
 
 var debugArgs struct {
@@ -49,6 +56,9 @@ var debugArgs struct {
 	file       string
 	prefs      bool
 	pretty     bool
+
+	advanceClock     time.Duration
+	injectLinkChange bool
 }
 
 func runDebug(ctx context.Context, args []string) error {
@@ -62,12 +72,18 @@ func runDebug(ctx context.Context, args []string) error {
 			return nil
 		}
 		if runtime.GOOS == "windows" {
-			fmt.Printf("curl http://localhost:41112/localapi/v0/status\n")
+			fmt.Printf("curl http://localhost:%d/localapi/v0/status\n", rootArgs.ipnPort)
 			return nil
 		}
 		fmt.Printf("curl --unix-socket %s http://foo/localapi/v0/status\n", paths.DefaultTailscaledSocket())
 		return nil
 	}
+	if debugArgs.advanceClock != 0 {
+		return tailscale.DebugAdvanceClock(ctx, debugArgs.advanceClock)
+	}
+	if debugArgs.injectLinkChange {
+		return tailscale.DebugInjectLinkChange(ctx)
+	}
 	if debugArgs.prefs {
 		prefs, err := tailscale.GetPrefs(ctx)
 		if err != nil {
@@ -141,3 +157,110 @@ func runDebug(ctx context.Context, args []string) error {
 	}
 	return nil
 }
+
+var debugDNSLogCmd = &ffcli.Command{
+	Name:       "dns-log",
+	ShortUsage: "debug dns-log [flags] <on|off|tail>",
+	ShortHelp:  "Log the queries handled by tailscaled's DNS resolver",
+	LongHelp: strings.TrimSpace(`
+'on' makes tailscaled's DNS resolver keep a log, in memory, of the
+queries it handles: their name and type, how they were answered and
+how long that took. Logging turns itself off after --duration.
+
+'off' turns query logging off.
+
+'tail' prints the logged queries, and new ones as they happen.
+`),
+	Exec: runDebugDNSLog,
+	FlagSet: (func() *flag.FlagSet {
+		fs := flag.NewFlagSet("dns-log", flag.ExitOnError)
+		fs.DurationVar(&dnsLogArgs.duration, "duration", 10*time.Minute, "with 'on', how long to log queries for")
+		return fs
+	})(),
+}
+
+var dnsLogArgs struct {
+	duration time.Duration
+}
+
+func runDebugDNSLog(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: tailscale debug dns-log [flags] <on|off|tail>")
+	}
+	switch args[0] {
+	case "on":
+		if dnsLogArgs.duration <= 0 {
+			return errors.New("--duration must be positive")
+		}
+		if err := tailscale.SetDNSQueryLogging(ctx, dnsLogArgs.duration); err != nil {
+			return err
+		}
+		fmt.Printf("DNS query logging on for %v; see 'tailscale debug dns-log tail'\n", dnsLogArgs.duration)
+		return nil
+	case "off":
+		return tailscale.SetDNSQueryLogging(ctx, 0)
+	case "tail":
+		return tailDNSQueryLog(ctx)
+	}
+	return fmt.Errorf("unknown dns-log command %q; want on, off or tail", args[0])
+}
+
+// tailDNSQueryLog prints the DNS query log, then polls for and
+// prints new entries until ctx is done.
+func tailDNSQueryLog(ctx context.Context) error {
+	var last uint64 // Seq of the last entry printed
+	wasOn := false
+	for first := true; ; first = false {
+		ql, err := tailscale.DNSQueryLog(ctx)
+		if err != nil {
+			return err
+		}
+		if n := len(ql.Entries); n > 0 && ql.Entries[n-1].Seq < last {
+			// tailscaled restarted and is numbering from 1 again.
+			last = 0
+		}
+		for _, e := range ql.Entries {
+			if e.Seq <= last {
+				continue
+			}
+			last = e.Seq
+			printDNSQueryLogEntry(e)
+		}
+		on := !ql.EnabledUntil.IsZero()
+		switch {
+		case on && !wasOn:
+			fmt.Fprintf(os.Stderr, "# DNS query logging on until %v\n", ql.EnabledUntil.Format(time.Kitchen))
+		case !on && wasOn:
+			fmt.Fprintf(os.Stderr, "# DNS query logging turned off\n")
+		case !on && first:
+			fmt.Fprintf(os.Stderr, "# DNS query logging is off; run 'tailscale debug dns-log on'\n")
+		}
+		wasOn = on
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func printDNSQueryLogEntry(e ipnstate.DNSQueryLogEntry) {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s %s %s ", e.Time.Format("15:04:05.000"), e.Type, e.Name)
+	if e.Route == "local" {
+		sb.WriteString("local")
+	} else {
+		fmt.Fprintf(&sb, "route=%s", e.Route)
+		if e.Upstream != "" {
+			fmt.Fprintf(&sb, " upstream=%s", e.Upstream)
+		}
+	}
+	if e.Error != "" {
+		fmt.Fprintf(&sb, ": error: %s", e.Error)
+	} else {
+		fmt.Fprintf(&sb, ": %s", e.Answer)
+	}
+	fmt.Fprintf(&sb, " (%v)", time.Duration(e.LatencySeconds*float64(time.Second)).Round(100*time.Microsecond))
+	fmt.Println(sb.String())
+}
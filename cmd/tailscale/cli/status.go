@@ -182,6 +182,12 @@ func runStatus(ctx context.Context, args []string) error {
 			printPS(ps)
 		}
 	}
+	if len(st.Health) > 0 {
+		f("\n# Health check:\n")
+		for _, m := range st.Health {
+			f("#     - %s\n", m)
+		}
+	}
 	os.Stdout.Write(buf.Bytes())
 	return nil
 }
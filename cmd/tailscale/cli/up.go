@@ -73,6 +73,8 @@ func newUpFlagSet(goos string, upArgs *upArgsT) *flag.FlagSet {
 	upf.StringVar(&upArgs.exitNodeIP, "exit-node", "", "Tailscale IP of the exit node for internet traffic, or empty string to not use an exit node")
 	upf.BoolVar(&upArgs.exitNodeAllowLANAccess, "exit-node-allow-lan-access", false, "Allow direct access to the local network when routing traffic via an exit node")
 	upf.BoolVar(&upArgs.shieldsUp, "shields-up", false, "don't allow incoming connections")
+	upf.BoolVar(&upArgs.tailnetIPv4, "tailnet-ipv4", true, "configure this node's Tailscale IPv4 address and accept IPv4 traffic within the tailnet")
+	upf.BoolVar(&upArgs.tailnetIPv6, "tailnet-ipv6", true, "configure this node's Tailscale IPv6 address and accept IPv6 traffic within the tailnet")
 	upf.StringVar(&upArgs.advertiseTags, "advertise-tags", "", "comma-separated ACL tags to request; each must start with \"tag:\" (e.g. \"tag:eng,tag:montreal,tag:ssh\")")
 	upf.StringVar(&upArgs.authKey, "authkey", "", "node authorization key")
 	upf.StringVar(&upArgs.hostname, "hostname", "", "hostname to use instead of the one provided by the OS")
@@ -107,6 +109,8 @@ type upArgsT struct {
 	exitNodeIP             string
 	exitNodeAllowLANAccess bool
 	shieldsUp              bool
+	tailnetIPv4            bool
+	tailnetIPv6            bool
 	forceReauth            bool
 	forceDaemon            bool
 	advertiseRoutes        string
@@ -220,6 +224,8 @@ func prefsFromUpArgs(upArgs upArgsT, warnf logger.Logf, st *ipnstate.Status, goo
 	prefs.CorpDNS = upArgs.acceptDNS
 	prefs.AllowSingleHosts = upArgs.singleRoutes
 	prefs.ShieldsUp = upArgs.shieldsUp
+	prefs.NoTailnetIPv4 = !upArgs.tailnetIPv4
+	prefs.NoTailnetIPv6 = !upArgs.tailnetIPv6
 	prefs.AdvertiseRoutes = routes
 	prefs.AdvertiseTags = tags
 	prefs.Hostname = upArgs.hostname
@@ -244,6 +250,10 @@ func prefsFromUpArgs(upArgs upArgsT, warnf logger.Logf, st *ipnstate.Status, goo
 			return nil, fmt.Errorf("invalid value --netfilter-mode=%q", upArgs.netfilterMode)
 		}
 	}
+
+	if prefs.NoTailnetIPv4 && prefs.NoTailnetIPv6 {
+		return nil, errors.New("--tailnet-ipv4=false and --tailnet-ipv6=false can't be used together")
+	}
 	return prefs, nil
 }
 
@@ -258,6 +268,18 @@ func prefsFromUpArgs(upArgs upArgsT, warnf logger.Logf, st *ipnstate.Status, goo
 // transition to running from a previously-logged-in but down state,
 // without changing any settings.
 func updatePrefs(prefs, curPrefs *ipn.Prefs, env upCheckEnv) (simpleUp bool, justEditMP *ipn.MaskedPrefs, err error) {
+	if env.defaultControlURL != "" && !flagWasSet(env.flagSet, "login-server") {
+		// The daemon was started with its own --login-server,
+		// which is then the default for ours.
+		prefs.ControlURL = env.defaultControlURL
+	}
+	if (curPrefs.Persist == nil || curPrefs.Persist.LoginName == "") && !flagWasSet(env.flagSet, "shields-up") {
+		// Not logged in yet, so curPrefs are still those the
+		// daemon started with, such as from its --shields-up,
+		// which is then the default for ours.
+		prefs.ShieldsUp = curPrefs.ShieldsUp
+	}
+
 	if !env.upArgs.reset {
 		applyImplicitPrefs(prefs, curPrefs, env.user)
 
@@ -345,7 +367,7 @@ func runUp(ctx context.Context, args []string) error {
 		}
 	}
 
-	curPrefs, err := tailscale.GetPrefs(ctx)
+	curPrefs, prefsETag, err := tailscale.GetPrefsWithETag(ctx)
 	if err != nil {
 		return err
 	}
@@ -357,13 +379,21 @@ func runUp(ctx context.Context, args []string) error {
 		upArgs:        upArgs,
 		backendState:  st.BackendState,
 		curExitNodeIP: exitNodeIP(prefs, st),
+
+		defaultControlURL: st.DefaultControlURL,
 	}
 	simpleUp, justEditMP, err := updatePrefs(prefs, curPrefs, env)
 	if err != nil {
 		fatalf("%s", err)
 	}
 	if justEditMP != nil {
-		_, err := tailscale.EditPrefs(ctx, justEditMP)
+		// Only apply the edit if the prefs it was computed from
+		// are still current, so concurrent "up" commands can't
+		// leave a mix of their flags.
+		_, err := tailscale.EditPrefsIfMatch(ctx, justEditMP, prefsETag)
+		if err == tailscale.ErrPrefsChanged {
+			return errUpPrefsChanged
+		}
 		return err
 	}
 
@@ -472,7 +502,15 @@ func runUp(ctx context.Context, args []string) error {
 			opts.Prefs = prefs
 		}
 
-		bc.Start(opts)
+		// Like the edit above, only start with prefs computed
+		// from curPrefs if those are still current.
+		err := tailscale.StartIfMatch(ctx, opts, prefsETag)
+		if err == tailscale.ErrPrefsChanged {
+			return errUpPrefsChanged
+		}
+		if err != nil {
+			return err
+		}
 		if upArgs.forceReauth {
 			startLoginInteractive()
 		}
@@ -509,6 +547,10 @@ var (
 	prefsOfFlag = map[string][]string{} // "exit-node" => ExitNodeIP, ExitNodeID
 )
 
+// errUpPrefsChanged is returned by "tailscale up" when another client
+// changed the prefs between up reading and writing them.
+var errUpPrefsChanged = errors.New("settings were changed by another command while 'tailscale up' was running; nothing was changed, try again")
+
 func init() {
 	// Both these have the same ipn.Pref:
 	addPrefFlagMapping("advertise-exit-node", "AdvertiseRoutes")
@@ -526,6 +568,8 @@ func init() {
 	addPrefFlagMapping("login-server", "ControlURL")
 	addPrefFlagMapping("netfilter-mode", "NetfilterMode")
 	addPrefFlagMapping("shields-up", "ShieldsUp")
+	addPrefFlagMapping("tailnet-ipv4", "NoTailnetIPv4")
+	addPrefFlagMapping("tailnet-ipv6", "NoTailnetIPv6")
 	addPrefFlagMapping("snat-subnet-routes", "NoSNAT")
 	addPrefFlagMapping("exit-node-allow-lan-access", "ExitNodeAllowLANAccess")
 	addPrefFlagMapping("unattended", "ForceDaemon")
@@ -581,6 +625,10 @@ type upCheckEnv struct {
 	upArgs        upArgsT
 	backendState  string
 	curExitNodeIP netaddr.IP
+
+	// defaultControlURL is the daemon's --login-server, if any,
+	// which is used if our --login-server isn't given.
+	defaultControlURL string
 }
 
 // checkForAccidentalSettingReverts (the "up checker") checks for
@@ -666,6 +714,17 @@ func checkForAccidentalSettingReverts(newPrefs, curPrefs *ipn.Prefs, env upCheck
 	return errors.New(sb.String())
 }
 
+// flagWasSet reports whether the flag named name was given in fs.
+func flagWasSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
 // applyImplicitPrefs mutates prefs to add implicit preferences. Currently
 // this is just the operator user, which only needs to be set if it doesn't
 // match the current user.
@@ -725,6 +784,10 @@ func prefsToFlags(env upCheckEnv, prefs *ipn.Prefs) (flagVal map[string]interfac
 			set(prefs.CorpDNS)
 		case "shields-up":
 			set(prefs.ShieldsUp)
+		case "tailnet-ipv4":
+			set(!prefs.NoTailnetIPv4)
+		case "tailnet-ipv6":
+			set(!prefs.NoTailnetIPv6)
 		case "exit-node":
 			set(exitNodeIPStr())
 		case "exit-node-allow-lan-access":
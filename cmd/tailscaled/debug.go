@@ -5,6 +5,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/json"
@@ -45,6 +46,14 @@ var debugArgs struct {
 var debugModeFunc = debugMode // so it can be addressable
 
 func debugMode(args []string) error {
+	if len(args) > 0 && args[0] == "derper" {
+		return debugDERPer(args[1:])
+	}
+	if len(args) > 0 {
+		if path, ok := debugDaemonPaths[args[0]]; ok {
+			return debugDaemon(args[0], path, args[1:])
+		}
+	}
 	fs := flag.NewFlagSet("debug", flag.ExitOnError)
 	fs.BoolVar(&debugArgs.ifconfig, "ifconfig", false, "If true, print network interface state")
 	fs.BoolVar(&debugArgs.monitor, "monitor", false, "If true, run link monitor forever. Precludes all other options.")
@@ -76,6 +85,67 @@ func debugMode(args []string) error {
 	return errors.New("only --monitor is available at the moment")
 }
 
+// debugDaemonPaths maps the "tailscaled debug" subcommands that
+// query a running tailscaled to the paths they fetch from its debug
+// server (see --debug).
+var debugDaemonPaths = map[string]string{
+	"state":    "/debug/state",
+	"peers":    "/debug/peers",
+	"routes":   "/debug/routes",
+	"dns":      "/debug/dns",
+	"netstack": "/debug/netstack",
+}
+
+// debugDaemon runs the "tailscaled debug <sub>" subcommand, which
+// prints the JSON at path on a running tailscaled's debug server.
+func debugDaemon(sub, path string, args []string) error {
+	fs := flag.NewFlagSet("debug "+sub, flag.ExitOnError)
+	addr := fs.String("addr", os.Getenv("TS_DEBUG_ADDR"), "address ([ip]:port) of the running tailscaled's --debug server; defaults to $TS_DEBUG_ADDR")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(fs.Args()) > 0 {
+		return fmt.Errorf("unknown non-flag arguments to debug %s", sub)
+	}
+	if *addr == "" {
+		return fmt.Errorf("debug %s: --addr (or $TS_DEBUG_ADDR) is required", sub)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return fetchDebugJSON(ctx, *addr, path, os.Stdout)
+}
+
+// fetchDebugJSON fetches path from the debug server at addr and
+// writes the JSON response to w, indented.
+func fetchDebugJSON(ctx context.Context, addr, path string, w io.Writer) error {
+	if strings.HasPrefix(addr, ":") {
+		addr = "localhost" + addr
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+addr+path, nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s: %s", path, res.Status, strings.TrimSpace(string(body)))
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, body, "", "  "); err != nil {
+		return fmt.Errorf("%s: invalid JSON response: %w", path, err)
+	}
+	buf.WriteByte('\n')
+	_, err = buf.WriteTo(w)
+	return err
+}
+
 func runMonitor(ctx context.Context, loop bool) error {
 	dump := func(st *interfaces.State) {
 		j, _ := json.MarshalIndent(st, "", "    ")
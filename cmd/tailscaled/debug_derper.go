@@ -0,0 +1,214 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"tailscale.com/derp"
+	"tailscale.com/derp/derphttp"
+	"tailscale.com/net/stun"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/logger"
+)
+
+var derperArgs struct {
+	listen        string
+	stunPort      int
+	hostname      string
+	certFile      string
+	keyFile       string
+	verifyClients bool
+}
+
+// debugDERPer runs "tailscaled debug derper": a standalone DERP and
+// STUN server for testing DERP reachability within a private
+// network, like the one the integration tests run.
+func debugDERPer(args []string) error {
+	fs := flag.NewFlagSet("derper", flag.ExitOnError)
+	fs.StringVar(&derperArgs.listen, "listen", ":8443", "HTTPS listen address for DERP")
+	fs.IntVar(&derperArgs.stunPort, "stun-port", 3478, "UDP port for STUN; 0 to disable")
+	fs.StringVar(&derperArgs.hostname, "hostname", "", "hostname or IP address clients use to reach this server")
+	fs.StringVar(&derperArgs.certFile, "cert", "", "optional path to a PEM TLS certificate; if empty, a self-signed one is generated")
+	fs.StringVar(&derperArgs.keyFile, "key", "", "path to the PEM private key for --cert")
+	fs.BoolVar(&derperArgs.verifyClients, "verify-clients", false, "only accept clients known to the local tailscaled")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(fs.Args()) > 0 {
+		return errors.New("unknown non-flag derper arguments")
+	}
+	if derperArgs.hostname == "" {
+		return errors.New("--hostname is required")
+	}
+	if (derperArgs.certFile == "") != (derperArgs.keyFile == "") {
+		return errors.New("--cert and --key must be used together")
+	}
+	_, portStr, err := net.SplitHostPort(derperArgs.listen)
+	if err != nil {
+		return fmt.Errorf("--listen: %w", err)
+	}
+	derpPort, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fmt.Errorf("--listen: bad port %q", portStr)
+	}
+
+	var cert tls.Certificate
+	selfSigned := derperArgs.certFile == ""
+	if selfSigned {
+		cert, err = selfSignedCert(derperArgs.hostname)
+	} else {
+		cert, err = tls.LoadX509KeyPair(derperArgs.certFile, derperArgs.keyFile)
+	}
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	logf := logger.WithPrefix(log.Printf, "derper: ")
+	s := derp.NewServer(key.NewPrivate(), logf)
+	s.SetVerifyClient(derperArgs.verifyClients)
+	defer s.Close()
+
+	mux := http.NewServeMux()
+	mux.Handle("/derp", derphttp.Handler(s))
+	mux.Handle("/metrics", derphttp.Handler(s))
+	httpsrv := &http.Server{
+		Addr:      derperArgs.listen,
+		Handler:   mux,
+		ErrorLog:  logger.StdLogger(logf),
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+		// Disable HTTP/2, as DERP upgrades HTTP/1.1 connections.
+		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+	}
+
+	if derperArgs.stunPort != 0 {
+		pc, err := startDebugSTUN(logf, fmt.Sprintf(":%d", derperArgs.stunPort))
+		if err != nil {
+			return fmt.Errorf("STUN listener: %w", err)
+		}
+		defer pc.Close()
+	}
+
+	node := &tailcfg.DERPNode{
+		Name:             "1a",
+		RegionID:         900,
+		HostName:         derperArgs.hostname,
+		DERPPort:         derpPort,
+		STUNPort:         derperArgs.stunPort,
+		InsecureForTests: selfSigned,
+	}
+	if derperArgs.stunPort == 0 {
+		node.STUNPort = -1
+	}
+	if ip := net.ParseIP(derperArgs.hostname); ip != nil {
+		if ip.To4() != nil {
+			node.IPv4 = ip.String()
+		} else {
+			node.IPv6 = ip.String()
+		}
+	}
+	dm := &tailcfg.DERPMap{
+		OmitDefaultRegions: true,
+		Regions: map[int]*tailcfg.DERPRegion{
+			900: {
+				RegionID:   900,
+				RegionCode: "debug",
+				RegionName: "tailscaled debug derper",
+				Nodes:      []*tailcfg.DERPNode{node},
+			},
+		},
+	}
+	j, err := json.MarshalIndent(dm, "", "\t")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("DERP map for clients (e.g. tailscaled --derp-map):\n%s\n", j)
+
+	errc := make(chan error, 1)
+	go func() {
+		logf("DERP listening on %v", derperArgs.listen)
+		errc <- httpsrv.ListenAndServeTLS("", "")
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		logf("shutting down")
+		shutCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return httpsrv.Shutdown(shutCtx)
+	}
+}
+
+// startDebugSTUN starts a STUN server on the UDP address addr. It
+// runs until the returned conn is closed.
+func startDebugSTUN(logf logger.Logf, addr string) (net.PacketConn, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	logf("STUN listening on %v", pc.LocalAddr())
+	go stun.Serve(pc, logf, nil)
+	return pc, nil
+}
+
+// selfSignedCert returns a new self-signed TLS certificate for
+// hostname, valid for a year.
+func selfSignedCert(hostname string) (tls.Certificate, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hostname},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	if ip := net.ParseIP(hostname); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{hostname}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  priv,
+	}, nil
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"tailscale.com/net/tstun"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine"
+	"tailscale.com/wgengine/magicsock"
+)
+
+// readDERPMapFile reads and validates the JSON-encoded tailcfg.DERPMap
+// at path.
+func readDERPMapFile(path string) (*tailcfg.DERPMap, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dm := new(tailcfg.DERPMap)
+	if err := json.Unmarshal(b, dm); err != nil {
+		return nil, fmt.Errorf("parsing DERP map %s: %w", path, err)
+	}
+	if len(dm.Regions) == 0 {
+		return nil, fmt.Errorf("DERP map %s has no regions", path)
+	}
+	for id, r := range dm.Regions {
+		if r == nil {
+			return nil, fmt.Errorf("DERP map %s: region %d is null", path, id)
+		}
+		if len(r.Nodes) == 0 {
+			return nil, fmt.Errorf("DERP map %s: region %d has no nodes", path, id)
+		}
+	}
+	return dm, nil
+}
+
+// staticDERPEngine is a wgengine.Engine that ignores the DERP map
+// sent by the control server and instead uses one loaded from a
+// local file (via --derp-map).
+type staticDERPEngine struct {
+	wgengine.Engine
+	logf logger.Logf
+	path string
+
+	// mu guards dm, and is held while dm is applied to Engine so
+	// that an older map is never applied after a newer one.
+	mu sync.Mutex
+	dm *tailcfg.DERPMap
+}
+
+// newStaticDERPEngine reads the DERP map at path and returns e
+// wrapped such that the file's DERP map is always used.
+func newStaticDERPEngine(logf logger.Logf, e wgengine.Engine, path string) (*staticDERPEngine, error) {
+	dm, err := readDERPMapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	se := &staticDERPEngine{
+		Engine: e,
+		logf:   logf,
+		path:   path,
+		dm:     dm,
+	}
+	e.SetDERPMap(dm)
+	logf("using static DERP map from %s (%d regions)", path, len(dm.Regions))
+	return se, nil
+}
+
+// SetDERPMap implements wgengine.Engine. The provided DERP map (from
+// the control server) is ignored in favor of the static one.
+func (e *staticDERPEngine) SetDERPMap(*tailcfg.DERPMap) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.Engine.SetDERPMap(e.dm)
+}
+
+// GetInternals implements wgengine.InternalsGetter.
+func (e *staticDERPEngine) GetInternals() (tw *tstun.Wrapper, c *magicsock.Conn, ok bool) {
+	if ig, ok := e.Engine.(wgengine.InternalsGetter); ok {
+		return ig.GetInternals()
+	}
+	return
+}
+
+// reload re-reads the DERP map file and, if it's valid, starts
+// using it. On error, the previous DERP map stays in use.
+func (e *staticDERPEngine) reload() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	dm, err := readDERPMapFile(e.path)
+	if err != nil {
+		return err
+	}
+	e.dm = dm
+	e.Engine.SetDERPMap(dm)
+	e.logf("reloaded static DERP map from %s (%d regions)", e.path, len(dm.Regions))
+	return nil
+}
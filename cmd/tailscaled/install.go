@@ -0,0 +1,257 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// installArgs are the flags of the install-system-daemon and
+// uninstall-system-daemon subcommands.
+type installArgs struct {
+	dryRun          bool            // print the unit instead of installing it
+	force           bool            // replace or remove a unit we didn't generate
+	overridePackage bool            // replace or shadow files a package installed
+	unitExtra       []unitDirective // extra [Service] directives
+}
+
+// unitDirective is a systemd unit file "Key=Value" line.
+type unitDirective struct {
+	key, value string
+}
+
+func (d unitDirective) String() string { return d.key + "=" + d.value }
+
+// unitExtraFlag is the repeatable --unit-extra flag.
+type unitExtraFlag struct {
+	dst *[]unitDirective
+}
+
+func (f unitExtraFlag) String() string {
+	if f.dst == nil {
+		return ""
+	}
+	var ss []string
+	for _, d := range *f.dst {
+		ss = append(ss, d.String())
+	}
+	return strings.Join(ss, ",")
+}
+
+func (f unitExtraFlag) Set(s string) error {
+	i := strings.IndexByte(s, '=')
+	if i <= 0 {
+		return fmt.Errorf("%q is not of the form KEY=VALUE", s)
+	}
+	key, value := s[:i], s[i+1:]
+	if strings.ContainsAny(key, " \t[]#;") {
+		return fmt.Errorf("invalid unit directive key %q", key)
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("unit directive %s value contains a newline", key)
+	}
+	*f.dst = append(*f.dst, unitDirective{key, value})
+	return nil
+}
+
+// parseInstallArgs parses the arguments to the install (if install
+// is true) or uninstall subcommand cmd.
+func parseInstallArgs(cmd string, args []string, install bool) (ia installArgs, err error) {
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	if install {
+		fs.BoolVar(&ia.dryRun, "dry-run", false, "print the service definition that would be installed, and exit")
+		fs.Var(unitExtraFlag{&ia.unitExtra}, "unit-extra", "extra KEY=VALUE directive for the systemd unit's [Service] section; may be repeated")
+		fs.BoolVar(&ia.force, "force", false, "replace an existing service definition that wasn't generated by tailscaled")
+		fs.BoolVar(&ia.overridePackage, "override-package", false, "replace the tailscaled binary and shadow the systemd unit even if they were installed by a dpkg or rpm package")
+	} else {
+		fs.BoolVar(&ia.force, "force", false, "remove the service definition even if it wasn't generated by tailscaled")
+	}
+	if err := fs.Parse(args); err != nil {
+		return ia, err
+	}
+	if fs.NArg() > 0 {
+		return ia, fmt.Errorf("%s takes no arguments, got %q", cmd, fs.Args())
+	}
+	return ia, nil
+}
+
+// generatedMarker is written in a comment at the top of every
+// service definition that install-system-daemon writes, so
+// uninstall-system-daemon can tell them from ones it didn't write.
+const generatedMarker = "Generated by tailscaled install-system-daemon"
+
+//go:embed tailscaled.service
+var systemdUnitBase string
+
+// renderSystemdUnit returns the systemd unit to install, which is
+// tailscaled.service with extra appended to its [Service] section.
+func renderSystemdUnit(extra []unitDirective) string {
+	var b strings.Builder
+	b.WriteString("# " + generatedMarker + ".\n")
+	b.WriteString("# Changes will be lost when it's reinstalled; use --unit-extra or a drop-in instead.\n")
+
+	lines := strings.SplitAfter(strings.TrimLeft(systemdUnitBase, "\n"), "\n")
+	section := ""
+	var pendingBlank int // blank lines held back until we know the section continues
+	flushExtra := func() {
+		for _, d := range extra {
+			b.WriteString(d.String() + "\n")
+		}
+		extra = nil
+	}
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			pendingBlank++
+			continue
+		}
+		if strings.HasPrefix(trimmed, "[") {
+			if section == "[Service]" {
+				flushExtra()
+			}
+			section = trimmed
+		}
+		b.WriteString(strings.Repeat("\n", pendingBlank))
+		pendingBlank = 0
+		b.WriteString(line)
+	}
+	if section == "[Service]" {
+		flushExtra()
+	}
+	return b.String()
+}
+
+// unitFileStatus is the state of an installed service definition
+// relative to the one install-system-daemon would write.
+type unitFileStatus int
+
+const (
+	unitMissing unitFileStatus = iota // no file
+	unitCurrent                       // the same as what we'd write
+	unitStale                         // written by us, but differs
+	unitForeign                       // not written by us
+)
+
+// checkUnitFile reports the state of the service definition at path,
+// compared to want. legacy, if non-empty, is what older versions
+// wrote without a marker.
+func checkUnitFile(path string, want []byte, legacy string) (unitFileStatus, error) {
+	got, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return unitMissing, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case bytes.Equal(got, want):
+		return unitCurrent, nil
+	case isGeneratedUnit(got, legacy):
+		return unitStale, nil
+	default:
+		return unitForeign, nil
+	}
+}
+
+// isGeneratedUnit reports whether contents were written by
+// install-system-daemon.
+func isGeneratedUnit(contents []byte, legacy string) bool {
+	return bytes.Contains(contents, []byte(generatedMarker)) ||
+		(legacy != "" && string(contents) == legacy)
+}
+
+// errForeignUnit is returned when asked to replace or remove a service
+// definition that install-system-daemon didn't write.
+var errForeignUnit = errors.New("wasn't generated by tailscaled install-system-daemon; use --force to replace or remove it anyway")
+
+// packageOwner returns the name of the dpkg or rpm package that
+// installed the file at path, or "" if none did or neither package
+// manager is present.
+var packageOwner = func(path string) string {
+	if out, err := exec.Command("dpkg-query", "-S", path).Output(); err == nil {
+		// "tailscale: /usr/sbin/tailscaled"
+		if i := bytes.IndexByte(out, ':'); i > 0 {
+			return string(out[:i])
+		}
+	}
+	if out, err := exec.Command("rpm", "-qf", "--queryformat", "%{NAME}", path).Output(); err == nil {
+		return strings.TrimSpace(string(out))
+	}
+	return ""
+}
+
+// checkNotPackaged returns an error if any of paths exists and was
+// installed by a package, which install-system-daemon would replace
+// or shadow behind the package manager's back.
+func checkNotPackaged(paths ...string) error {
+	for _, p := range paths {
+		if _, err := os.Stat(p); err != nil {
+			continue
+		}
+		if pkg := packageOwner(p); pkg != "" {
+			return fmt.Errorf("%s was installed by the %s package; upgrade it with your package manager, or use --override-package to replace it anyway", p, pkg)
+		}
+	}
+	return nil
+}
+
+// sameFileContents reports whether files a and b both exist and have
+// the same contents.
+func sameFileContents(a, b string) bool {
+	ab, err := ioutil.ReadFile(a)
+	if err != nil {
+		return false
+	}
+	bb, err := ioutil.ReadFile(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(ab, bb)
+}
+
+// copySelfTo copies the running executable to targetBin, atomically
+// replacing any file already there.
+func copySelfTo(targetBin string) error {
+	if err := os.MkdirAll(filepath.Dir(targetBin), 0755); err != nil {
+		return err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find our own executable path: %w", err)
+	}
+	tmpBin := targetBin + ".tmp"
+	f, err := os.Create(tmpBin)
+	if err != nil {
+		return err
+	}
+	self, err := os.Open(exe)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	_, err = io.Copy(f, self)
+	self.Close()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpBin, 0755); err != nil {
+		return err
+	}
+	return os.Rename(tmpBin, targetBin)
+}
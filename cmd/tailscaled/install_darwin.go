@@ -7,11 +7,10 @@ package main
 import (
 	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
-	"path/filepath"
+	"strings"
 )
 
 func init() {
@@ -45,15 +44,32 @@ const darwinLaunchdPlist = `
 </plist>
 `
 
+// renderLaunchdPlist returns darwinLaunchdPlist with the
+// generatedMarker comment added.
+func renderLaunchdPlist() string {
+	const plistStart = "<plist "
+	i := strings.Index(darwinLaunchdPlist, plistStart)
+	return darwinLaunchdPlist[:i] + "<!-- " + generatedMarker + ". -->\n" + darwinLaunchdPlist[i:]
+}
+
 const sysPlist = "/Library/LaunchDaemons/com.tailscale.tailscaled.plist"
 const targetBin = "/usr/local/bin/tailscaled"
 const service = "com.tailscale.tailscaled"
 
-func uninstallSystemDaemonDarwin(args []string) (ret error) {
-	if len(args) > 0 {
-		return errors.New("uninstall subcommand takes no arguments")
+func uninstallSystemDaemonDarwin(args []string) error {
+	ia, err := parseInstallArgs("uninstall-system-daemon", args, false)
+	if err != nil {
+		return err
 	}
+	if b, err := ioutil.ReadFile(sysPlist); err == nil && !isGeneratedUnit(b, darwinLaunchdPlist) && !ia.force {
+		return fmt.Errorf("%s %w", sysPlist, errForeignUnit)
+	}
+	return removeDarwinDaemon()
+}
 
+// removeDarwinDaemon stops tailscaled and removes its launchd plist
+// and binary.
+func removeDarwinDaemon() (ret error) {
 	plist, err := exec.Command("launchctl", "list", "com.tailscale.tailscaled").Output()
 	_ = plist // parse it? https://github.com/DHowett/go-plist if we need something.
 	running := err == nil
@@ -93,8 +109,17 @@ func uninstallSystemDaemonDarwin(args []string) (ret error) {
 }
 
 func installSystemDaemonDarwin(args []string) (err error) {
-	if len(args) > 0 {
-		return errors.New("install subcommand takes no arguments")
+	ia, err := parseInstallArgs("install-system-daemon", args, true)
+	if err != nil {
+		return err
+	}
+	if len(ia.unitExtra) > 0 {
+		return errors.New("--unit-extra is only supported for systemd units")
+	}
+	plist := renderLaunchdPlist()
+	if ia.dryRun {
+		fmt.Print(plist)
+		return nil
 	}
 	defer func() {
 		if err != nil && os.Getuid() != 0 {
@@ -102,44 +127,35 @@ func installSystemDaemonDarwin(args []string) (err error) {
 		}
 	}()
 
-	// Best effort:
-	uninstallSystemDaemonDarwin(nil)
-
-	// Copy ourselves to /usr/local/bin/tailscaled.
-	if err := os.MkdirAll(filepath.Dir(targetBin), 0755); err != nil {
+	st, err := checkUnitFile(sysPlist, []byte(plist), darwinLaunchdPlist)
+	if err != nil {
 		return err
 	}
 	exe, err := os.Executable()
 	if err != nil {
 		return fmt.Errorf("failed to find our own executable path: %w", err)
 	}
-	tmpBin := targetBin + ".tmp"
-	f, err := os.Create(tmpBin)
-	if err != nil {
-		return err
-	}
-	self, err := os.Open(exe)
-	if err != nil {
-		f.Close()
-		return err
-	}
-	_, err = io.Copy(f, self)
-	self.Close()
-	if err != nil {
-		f.Close()
-		return err
-	}
-	if err := f.Close(); err != nil {
-		return err
-	}
-	if err := os.Chmod(tmpBin, 0755); err != nil {
-		return err
+	switch st {
+	case unitForeign:
+		if !ia.force {
+			return fmt.Errorf("%s %w", sysPlist, errForeignUnit)
+		}
+	case unitCurrent:
+		if sameFileContents(exe, targetBin) && exec.Command("launchctl", "list", service).Run() == nil {
+			fmt.Printf("%s is already installed and running\n", service)
+			return nil
+		}
 	}
-	if err := os.Rename(tmpBin, targetBin); err != nil {
+
+	// Best effort:
+	removeDarwinDaemon()
+
+	// Copy ourselves to /usr/local/bin/tailscaled.
+	if err := copySelfTo(targetBin); err != nil {
 		return err
 	}
 
-	if err := ioutil.WriteFile(sysPlist, []byte(darwinLaunchdPlist), 0700); err != nil {
+	if err := ioutil.WriteFile(sysPlist, []byte(plist), 0700); err != nil {
 		return err
 	}
 
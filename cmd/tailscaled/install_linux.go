@@ -0,0 +1,143 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+)
+
+func init() {
+	installSystemDaemon = installSystemDaemonLinux
+	uninstallSystemDaemon = uninstallSystemDaemonLinux
+}
+
+//go:embed tailscaled.defaults
+var linuxDefaults string
+
+const (
+	systemdUnitPath  = "/etc/systemd/system/tailscaled.service"
+	linuxDefaultsEnv = "/etc/default/tailscaled"
+	linuxTargetBin   = "/usr/sbin/tailscaled"
+	systemdService   = "tailscaled.service"
+)
+
+// packagedUnitPaths are where packages install tailscaled's unit,
+// which one at systemdUnitPath takes precedence over.
+var packagedUnitPaths = []string{
+	"/lib/systemd/system/tailscaled.service",
+	"/usr/lib/systemd/system/tailscaled.service",
+}
+
+func installSystemDaemonLinux(args []string) (err error) {
+	ia, err := parseInstallArgs("install-system-daemon", args, true)
+	if err != nil {
+		return err
+	}
+	unit := renderSystemdUnit(ia.unitExtra)
+	if ia.dryRun {
+		fmt.Print(unit)
+		return nil
+	}
+	defer func() {
+		if err != nil && os.Getuid() != 0 {
+			err = fmt.Errorf("%w; try running tailscaled with sudo", err)
+		}
+	}()
+	if _, err := exec.LookPath("systemctl"); err != nil {
+		return errors.New("install-system-daemon requires systemd")
+	}
+
+	st, err := checkUnitFile(systemdUnitPath, []byte(unit), "")
+	if err != nil {
+		return err
+	}
+	if st == unitForeign && !ia.force {
+		return fmt.Errorf("%s %w", systemdUnitPath, errForeignUnit)
+	}
+	if !ia.overridePackage {
+		if err := checkNotPackaged(append([]string{linuxTargetBin}, packagedUnitPaths...)...); err != nil {
+			return err
+		}
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find our own executable path: %w", err)
+	}
+	binChanged := !sameFileContents(exe, linuxTargetBin)
+	if binChanged {
+		if err := copySelfTo(linuxTargetBin); err != nil {
+			return err
+		}
+	}
+	if _, err := os.Stat(linuxDefaultsEnv); os.IsNotExist(err) {
+		if err := ioutil.WriteFile(linuxDefaultsEnv, []byte(linuxDefaults), 0644); err != nil {
+			return err
+		}
+	}
+	if st == unitCurrent && !binChanged {
+		fmt.Printf("%s is already installed\n", systemdUnitPath)
+	} else if st != unitCurrent {
+		if err := ioutil.WriteFile(systemdUnitPath, []byte(unit), 0644); err != nil {
+			return err
+		}
+		if out, err := exec.Command("systemctl", "daemon-reload").CombinedOutput(); err != nil {
+			return fmt.Errorf("error running systemctl daemon-reload: %v, %s", err, out)
+		}
+	}
+
+	if out, err := exec.Command("systemctl", "enable", systemdService).CombinedOutput(); err != nil {
+		return fmt.Errorf("error running systemctl enable %s: %v, %s", systemdService, err, out)
+	}
+	// Restart if anything changed, so the running daemon matches
+	// what's installed; otherwise just make sure it's running.
+	verb := "start"
+	if st != unitCurrent || binChanged {
+		verb = "restart"
+	}
+	if out, err := exec.Command("systemctl", verb, systemdService).CombinedOutput(); err != nil {
+		return fmt.Errorf("error running systemctl %s %s: %v, %s", verb, systemdService, err, out)
+	}
+	return nil
+}
+
+func uninstallSystemDaemonLinux(args []string) (ret error) {
+	ia, err := parseInstallArgs("uninstall-system-daemon", args, false)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(systemdUnitPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !isGeneratedUnit(b, "") && !ia.force {
+		return fmt.Errorf("%s %w", systemdUnitPath, errForeignUnit)
+	}
+
+	if out, err := exec.Command("systemctl", "disable", "--now", systemdService).CombinedOutput(); err != nil {
+		fmt.Printf("systemctl disable --now %s: %v, %s\n", systemdService, err, out)
+		ret = err
+	}
+	if err := os.Remove(systemdUnitPath); err != nil && ret == nil {
+		ret = err
+	}
+	if out, err := exec.Command("systemctl", "daemon-reload").CombinedOutput(); err != nil {
+		fmt.Printf("systemctl daemon-reload: %v, %s\n", err, out)
+		if ret == nil {
+			ret = err
+		}
+	}
+	// The binary and /etc/default/tailscaled are left in place, as
+	// they may belong to a package.
+	return ret
+}
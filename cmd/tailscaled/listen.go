@@ -0,0 +1,235 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main // import "tailscale.com/cmd/tailscaled"
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/types/logger"
+)
+
+// lookupIPFunc resolves host to its IP addresses.
+type lookupIPFunc func(ctx context.Context, host string) ([]netaddr.IP, error)
+
+// defaultLookupIP is the lookupIPFunc using the system resolver.
+func defaultLookupIP(ctx context.Context, host string) ([]netaddr.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var ret []netaddr.IP
+	for _, a := range addrs {
+		if ip, ok := netaddr.FromStdIP(a.IP); ok {
+			ret = append(ret, ip.WithZone(a.Zone))
+		}
+	}
+	return ret, nil
+}
+
+// listenAddrs returns the TCP addresses to bind for the listen address
+// addr, of the form "[host]:port" used by --socks5-server and --debug.
+//
+// An empty host or "*" is the dual-stack wildcard, an IP literal is
+// just that address, and a host name is every address it resolves
+// to.
+func listenAddrs(ctx context.Context, addr string, lookupIP lookupIPFunc) ([]string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return nil, fmt.Errorf("invalid port in %q", addr)
+	}
+	if host == "" || host == "*" {
+		return []string{net.JoinHostPort("", port)}, nil
+	}
+	if ip, err := netaddr.ParseIP(host); err == nil {
+		return []string{net.JoinHostPort(ip.String(), port)}, nil
+	}
+	ips, err := lookupIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("%q has no addresses", host)
+	}
+	var ret []string
+	seen := map[netaddr.IP]bool{}
+	for _, ip := range ips {
+		if seen[ip] {
+			continue
+		}
+		seen[ip] = true
+		ret = append(ret, net.JoinHostPort(ip.String(), port))
+	}
+	return ret, nil
+}
+
+// listenAll listens on TCP on every address listenAddrs returns for
+// addr, logging each bound address with what (such as "SOCKS5")
+// before it, and returns a listener accepting connections from all of
+// them. For port 0, the port chosen for the first address is used for
+// the rest. It fails only if no address could be bound.
+func listenAll(logf logger.Logf, what, addr string, lookupIP lookupIPFunc) (net.Listener, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	addrs, err := listenAddrs(ctx, addr, lookupIP)
+	if err != nil {
+		return nil, err
+	}
+	var lns []net.Listener
+	var firstErr error
+	for _, a := range addrs {
+		if len(lns) > 0 {
+			host, port, _ := net.SplitHostPort(a)
+			if port == "0" {
+				_, chosen, _ := net.SplitHostPort(lns[0].Addr().String())
+				a = net.JoinHostPort(host, chosen)
+			}
+		}
+		ln, err := net.Listen("tcp", a)
+		if err != nil {
+			logf("%s: not listening on %v: %v", what, a, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		logf("%s listening on %v", what, ln.Addr())
+		lns = append(lns, ln)
+	}
+	if len(lns) == 0 {
+		return nil, firstErr
+	}
+	return newMultiListener(logf, what, lns), nil
+}
+
+// multiListener is a net.Listener that accepts connections from
+// several listeners. Its Addr is that of the first.
+//
+// A listener that fails, as when its interface address goes away, is
+// logged and dropped; Accept only fails once all of them have, or
+// after Close.
+type multiListener struct {
+	logf   logger.Logf
+	what   string
+	lns    []net.Listener
+	conns  chan net.Conn
+	errc   chan error    // temporary Accept errors
+	failed chan struct{} // closed once every listener has failed
+	closed chan struct{}
+
+	mu      sync.Mutex
+	live    int   // listeners still accepting
+	lastErr error // error of the last listener to fail
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// newMultiListener returns a listener accepting connections from all
+// of lns, which must not be empty. Listeners that fail are logged
+// with logf, with what before it.
+func newMultiListener(logf logger.Logf, what string, lns []net.Listener) net.Listener {
+	if len(lns) == 1 {
+		return lns[0]
+	}
+	m := &multiListener{
+		logf:   logf,
+		what:   what,
+		lns:    lns,
+		conns:  make(chan net.Conn),
+		errc:   make(chan error),
+		failed: make(chan struct{}),
+		closed: make(chan struct{}),
+		live:   len(lns),
+	}
+	for _, ln := range lns {
+		go m.acceptLoop(ln)
+	}
+	return m
+}
+
+func (m *multiListener) acceptLoop(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				select {
+				case m.errc <- err:
+					continue
+				case <-m.closed:
+					return
+				}
+			}
+			m.dropListener(ln, err)
+			return
+		}
+		select {
+		case m.conns <- c:
+		case <-m.closed:
+			c.Close()
+			return
+		}
+	}
+}
+
+// dropListener notes that ln failed with err and accepts no more
+// connections.
+func (m *multiListener) dropListener(ln net.Listener, err error) {
+	select {
+	case <-m.closed:
+		return
+	default:
+	}
+	m.logf("%s: stopped listening on %v: %v", m.what, ln.Addr(), err)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.live--
+	m.lastErr = err
+	if m.live == 0 {
+		close(m.failed)
+	}
+}
+
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-m.conns:
+		return c, nil
+	case err := <-m.errc:
+		return nil, err
+	case <-m.closed:
+		return nil, net.ErrClosed
+	case <-m.failed:
+		select {
+		case <-m.closed:
+			return nil, net.ErrClosed
+		default:
+		}
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return nil, m.lastErr
+	}
+}
+
+func (m *multiListener) Close() error {
+	m.closeOnce.Do(func() {
+		close(m.closed)
+		for _, ln := range m.lns {
+			if err := ln.Close(); err != nil && m.closeErr == nil {
+				m.closeErr = err
+			}
+		}
+	})
+	return m.closeErr
+}
+
+func (m *multiListener) Addr() net.Addr { return m.lns[0].Addr() }
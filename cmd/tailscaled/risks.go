@@ -0,0 +1,103 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main // import "tailscale.com/cmd/tailscaled"
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"tailscale.com/types/logger"
+)
+
+// Risks that --accept-risk acknowledges.
+const (
+	// riskLANAccess is an unauthenticated listener (the SOCKS5 or
+	// debug server) reachable from other hosts.
+	riskLANAccess = "lan-access"
+
+	// riskUserspaceNetworking is userspace networking on a
+	// platform that normally uses TUN, where other programs on the
+	// machine can't reach the tailnet except through a proxy.
+	riskUserspaceNetworking = "userspace-networking"
+)
+
+var knownRisks = map[string]bool{
+	riskLANAccess:           true,
+	riskUserspaceNetworking: true,
+}
+
+// risk is a risky part of tailscaled's configuration.
+type risk struct {
+	name string // for --accept-risk
+	what string // human-readable description of the risk
+}
+
+// parseAcceptedRisks parses the comma-separated --accept-risk value.
+// Names are case-insensitive.
+func parseAcceptedRisks(s string) (map[string]bool, error) {
+	ret := map[string]bool{}
+	for _, f := range strings.Split(s, ",") {
+		f = strings.ToLower(strings.TrimSpace(f))
+		if f == "" {
+			continue
+		}
+		if !knownRisks[f] {
+			var names []string
+			for n := range knownRisks {
+				names = append(names, n)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("unknown risk %q; want one of %s", f, strings.Join(names, ", "))
+		}
+		ret[f] = true
+	}
+	return ret, nil
+}
+
+// configRisks returns the risks of running on goos with the given
+// --tun, --socks5-server and --debug values.
+func configRisks(goos, tunname, socksAddr, debugAddr string) []risk {
+	var ret []risk
+	if socksAddr != "" && !isLoopbackAddr(socksAddr) {
+		ret = append(ret, risk{riskLANAccess, fmt.Sprintf("--socks5-server=%s accepts unauthenticated SOCKS5 connections from other hosts", socksAddr)})
+	}
+	if debugAddr != "" && !isLoopbackAddr(debugAddr) {
+		ret = append(ret, risk{riskLANAccess, fmt.Sprintf("--debug=%s serves unauthenticated debug pages to other hosts", debugAddr)})
+	}
+	if (goos == "linux" || goos == "windows") && tunname == "userspace-networking" {
+		ret = append(ret, risk{riskUserspaceNetworking, fmt.Sprintf("userspace networking on %s; programs on this machine can only reach Tailscale peers through --socks5-server", goos)})
+	}
+	return ret
+}
+
+// isLoopbackAddr reports whether the [ip]:port listen address addr
+// only accepts connections from this machine.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// warnRisks logs a warning for each of risks not in accepted, and
+// returns how many it logged.
+func warnRisks(logf logger.Logf, risks []risk, accepted map[string]bool) int {
+	n := 0
+	for _, r := range risks {
+		if accepted[r.name] {
+			continue
+		}
+		logf("WARNING: %s; to acknowledge this, use --accept-risk=%s", r.what, r.name)
+		n++
+	}
+	return n
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main // import "tailscale.com/cmd/tailscaled"
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"tailscale.com/ipn"
+	"tailscale.com/types/logger"
+)
+
+// migrateUserState copies the most recently modified valid state
+// file of candidates, the per-user state files from before state was
+// machine-global, to dst, if dst doesn't exist yet.
+//
+// secure, if non-nil, is called on the new file before the state is
+// written to it, to restrict who can read it.
+//
+// The migration is attempted at most once per dst: once it has
+// completed, whether or not there was anything to copy, a marker
+// file next to dst records that, and later calls do nothing even if
+// dst has since been removed.
+func migrateUserState(logf logger.Logf, dst string, candidates []string, secure func(path string) error) error {
+	marker := dst + ".migrated"
+	if _, err := os.Stat(marker); err == nil {
+		return nil
+	}
+	if _, err := os.Stat(dst); err == nil || !os.IsNotExist(err) {
+		return err
+	}
+
+	var (
+		best    string
+		bestMod time.Time
+		bestBuf []byte
+	)
+	for _, p := range candidates {
+		if p == dst {
+			continue
+		}
+		fi, err := os.Stat(p)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				logf("state migration: skipping %s: %v", p, err)
+			}
+			continue
+		}
+		buf, err := ioutil.ReadFile(p)
+		if err != nil {
+			logf("state migration: skipping %s: %v", p, err)
+			continue
+		}
+		if err := validState(buf); err != nil {
+			logf("state migration: skipping %s: %v", p, err)
+			continue
+		}
+		if best != "" {
+			if !fi.ModTime().After(bestMod) {
+				logf("state migration: skipping %s; %s is newer", p, best)
+				continue
+			}
+			logf("state migration: skipping %s; %s is newer", best, p)
+		}
+		best, bestMod, bestBuf = p, fi.ModTime(), buf
+	}
+
+	if best != "" {
+		if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+			return err
+		}
+		if err := writeStateFile(dst, bestBuf, secure); err != nil {
+			return fmt.Errorf("copying %s: %w", best, err)
+		}
+		logf("state migration: copied per-user state %s (modified %v) to %s", best, bestMod.Format(time.RFC3339), dst)
+	} else {
+		logf("state migration: no per-user state to migrate to %s", dst)
+	}
+	return ioutil.WriteFile(marker, []byte(best+"\n"), 0600)
+}
+
+// validState reports whether buf is plausibly an ipn.FileStore state
+// file with something in it.
+func validState(buf []byte) error {
+	var m map[ipn.StateKey][]byte
+	if err := json.Unmarshal(buf, &m); err != nil {
+		return fmt.Errorf("invalid state: %w", err)
+	}
+	if len(m) == 0 {
+		return fmt.Errorf("empty state")
+	}
+	return nil
+}
+
+// writeStateFile writes buf to path, which mustn't exist, via a
+// temporary file that's passed to secure, if non-nil, before anything
+// is written to it.
+func writeStateFile(path string, buf []byte, secure func(string) error) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp) // no-op once renamed
+	if secure != nil {
+		if err := secure(tmp); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -11,36 +11,45 @@ package main // import "tailscale.com/cmd/tailscaled"
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/http/pprof"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
 	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/go-multierror/multierror"
+	"inet.af/netaddr"
+	"tailscale.com/embedded"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnserver"
 	"tailscale.com/logpolicy"
 	"tailscale.com/net/dns"
+	"tailscale.com/net/netns"
 	"tailscale.com/net/socks5/tssocks"
-	"tailscale.com/net/tstun"
 	"tailscale.com/paths"
 	"tailscale.com/types/flagtype"
 	"tailscale.com/types/logger"
 	"tailscale.com/util/osshare"
+	"tailscale.com/util/systemd"
 	"tailscale.com/version"
 	"tailscale.com/version/distro"
 	"tailscale.com/wgengine"
+	"tailscale.com/wgengine/magicsock"
 	"tailscale.com/wgengine/monitor"
 	"tailscale.com/wgengine/netstack"
 	"tailscale.com/wgengine/router"
@@ -69,17 +78,78 @@ func defaultTunName() string {
 
 var args struct {
 	// tunname is a /dev/net/tun tunnel name ("tailscale0"), the
-	// string "userspace-networking", "tap:TAPNAME[:BRIDGENAME]"
+	// string "userspace-networking", "tap:TAPNAME[:BRIDGENAME][;OPTIONS]"
 	// or comma-separated list thereof.
 	tunname string
 
-	cleanup    bool
-	debug      string
-	port       uint16
-	statepath  string
-	socketpath string
-	verbose    int
-	socksAddr  string // listen address for SOCKS5 server
+	// netstack forces userspace networking, as if
+	// --tun=userspace-networking were given.
+	netstack bool
+
+	tunRetryCount int           // attempts per --tun name before trying the next
+	tunRetryDelay time.Duration // delay between attempts on the same name
+
+	// tunSecondary, if non-empty, is a second TUN device name
+	// (Linux only) that gets the traffic for tunSecondaryRoutes,
+	// a comma-separated list of CIDRs.
+	tunSecondary         string
+	tunSecondaryRoutes   string
+	tunSecondaryPrefixes []netaddr.IPPrefix // parsed tunSecondaryRoutes
+
+	cleanup       bool
+	debug         string
+	port          uint16
+	ipnPort       uint16 // localhost TCP port for the IPN server, where used; 0 means automatic
+	statepath     string
+	socketpath    string
+	verbose       int
+	socksAddr     string        // listen address for SOCKS5 server
+	socksIdle     time.Duration // if non-zero, close SOCKS5 connections idle this long
+	socksLife     time.Duration // if non-zero, close SOCKS5 connections open this long
+	idleExit      time.Duration // if non-zero, exit after this long idle
+	skipGoingAway bool          // don't tell control we're disconnecting on shutdown
+	socketNetNS   string        // if non-empty, Linux network namespace for outbound sockets
+	noDNS         bool          // don't configure the OS DNS settings
+	verboseNet    bool          // log every packet, independent of verbose
+
+	// derpMap, if non-empty, is the path to a JSON tailcfg.DERPMap
+	// file to use instead of the control server's DERP map.
+	derpMap       string
+	derpMapReload bool // re-read derpMap on SIGHUP
+
+	logtailBuffer     string        // logpolicy.ParseBufferSpec format
+	logtailMaxUpload  int64         // bytes/sec; 0 means unlimited
+	logtailMaxBackoff time.Duration // 0 means logtail's default
+
+	logFile        string // if non-empty, also write logs to this file
+	logFileMaxSize int64  // rotate logFile at this size
+	logFileKeep    int    // number of rotated logFiles to keep
+
+	exitNode string // Tailscale IP or MagicDNS name of exit node to use once up
+
+	// netstackForward is a comma-separated list of
+	// netstack.ParseForwardRule rules.
+	netstackForward string
+
+	// netstackForwardAllow is a comma-separated list of CIDRs of
+	// non-loopback targets that forward rules set at runtime via
+	// the LocalAPI may use.
+	netstackForwardAllow string
+
+	// Bootstrap prefs, only applied on first start.
+	acceptDNS   bool
+	loginServer string
+	shieldsUp   bool
+
+	// authKey and authKeyFile are the --authkey and --authkey-file
+	// flags; see resolveAuthKey.
+	authKey     string
+	authKeyFile string
+
+	// acceptRisk is the comma-separated --accept-risk list of
+	// risks (see configRisks) to not warn about.
+	acceptRisk    string
+	acceptedRisks map[string]bool // parsed acceptRisk
 }
 
 var (
@@ -103,14 +173,46 @@ func main() {
 	}
 
 	printVersion := false
-	flag.IntVar(&args.verbose, "verbose", 0, "log verbosity level; 0 is default, 1 or higher are increasingly verbose")
+	flag.IntVar(&args.verbose, "verbose", 0, "log verbosity level; 0 is default, 1 or higher are increasingly verbose, and 2 or higher also logs WireGuard handshakes")
 	flag.BoolVar(&args.cleanup, "cleanup", false, "clean up system state and exit")
-	flag.StringVar(&args.debug, "debug", "", "listen address ([ip]:port) of optional debug server")
-	flag.StringVar(&args.socksAddr, "socks5-server", "", `optional [ip]:port to run a SOCK5 server (e.g. "localhost:1080")`)
+	flag.StringVar(&args.debug, "debug", "", `listen address ([host]:port) of optional debug server; a host name binds all its addresses, and "*" means all interfaces`)
+	flag.StringVar(&args.socksAddr, "socks5-server", "", `optional [host]:port to run a SOCK5 server (e.g. "localhost:1080"); a host name binds all its addresses, and "*" means all interfaces`)
+	flag.DurationVar(&args.socksIdle, "socks5-idle-timeout", 0, "if non-zero, close SOCKS5 connections with no traffic in either direction for this long")
+	flag.DurationVar(&args.socksLife, "socks5-max-lifetime", 0, "if non-zero, close SOCKS5 connections that have been open this long")
 	flag.StringVar(&args.tunname, "tun", defaultTunName(), `tunnel interface name; use "userspace-networking" (beta) to not use TUN`)
+	flag.BoolVar(&args.netstack, "netstack", false, "use userspace networking (netstack) instead of a TUN device, on any OS; same as --tun=userspace-networking")
+	flag.BoolVar(&args.netstack, "userspace-networking", false, "alias for --netstack")
+	flag.IntVar(&args.tunRetryCount, "tun-retry-count", 3, "number of attempts to create each --tun device before trying the next one")
+	flag.DurationVar(&args.tunRetryDelay, "tun-retry-delay", 500*time.Millisecond, "delay between attempts to create the same --tun device")
+	flag.StringVar(&args.tunSecondary, "tun-secondary", "", "optional second tunnel interface name (Linux only) for the traffic to --tun-secondary-routes, e.g. to place it in a different VRF")
+	flag.StringVar(&args.tunSecondaryRoutes, "tun-secondary-routes", "", "comma-separated CIDRs whose traffic uses the --tun-secondary interface")
 	flag.Var(flagtype.PortValue(&args.port, 0), "port", "UDP port to listen on for WireGuard and peer-to-peer traffic; 0 means automatically select")
+	flag.Var(flagtype.PortValue(&args.ipnPort, defaultIPNPort), "ipn-port", "localhost TCP port for the IPN server to listen on, on platforms without unix sockets; 0 means automatically select")
 	flag.StringVar(&args.statepath, "state", paths.DefaultTailscaledStateFile(), "path of state file")
-	flag.StringVar(&args.socketpath, "socket", paths.DefaultTailscaledSocket(), "path of the service unix socket")
+	flag.StringVar(&args.socketpath, "socket", paths.DefaultTailscaledSocket(), `path of the service unix socket; on Linux, a name beginning with "@" (e.g. "@tailscale") is an abstract socket, with no file`)
+	flag.DurationVar(&args.idleExit, "idle-exit", 0, "if non-zero, exit after this long with no CLI/GUI connections or peer traffic, for starting on demand with socket activation")
+	flag.BoolVar(&args.skipGoingAway, "skip-going-away", false, "on shutdown, don't tell the control server the node is disconnecting (which lets peers stop trying to reach it directly)")
+	flag.BoolVar(&args.verboseNet, "verbose-network", false, "log every packet's addresses, protocol and length, without raising --verbose for everything else")
+	flag.BoolVar(&args.noDNS, "no-dns", false, "never change the system DNS configuration (e.g. /etc/resolv.conf), for systems that manage it out of band")
+	flag.StringVar(&args.socketNetNS, "socket-netns", "", `Linux only: path of a network namespace (e.g. "/proc/1/ns/net") in which to create WireGuard, DERP, STUN and control sockets, while the TUN device stays in the current one`)
+	flag.StringVar(&args.derpMap, "derp-map", "", "optional path to a JSON DERP map file to use instead of the control server's DERP map")
+	flag.StringVar(&args.derpMap, "derp-map-file", "", "alias for --derp-map")
+	flag.BoolVar(&args.derpMapReload, "derp-map-reload", false, "re-read the --derp-map file on SIGHUP")
+	flag.StringVar(&args.logtailBuffer, "logtail-buffer", "", `where to buffer logs until uploaded: "memory" or "file:PATH[,maxsize=SIZE]"; empty means the default on-disk buffer`)
+	flag.Var(flagtype.ByteSizeValue(&args.logtailMaxUpload, 0), "logtail-max-upload-rate", `maximum log upload rate in bytes per second (e.g. "64KB"); 0 means unlimited`)
+	flag.DurationVar(&args.logtailMaxBackoff, "logtail-max-backoff", 0, "maximum delay between failed log upload attempts; 0 means the default")
+	flag.StringVar(&args.logFile, "log-file", "", "optional path of a local file to also write logs to, rotated by size")
+	flag.Var(flagtype.ByteSizeValue(&args.logFileMaxSize, 10<<20), "log-file-max-size", "size at which to rotate the --log-file")
+	flag.IntVar(&args.logFileKeep, "log-file-keep", 3, "number of rotated --log-file files to keep; must be at least 1")
+	flag.StringVar(&args.exitNode, "exit-node", "", "optional Tailscale IP or MagicDNS name of a peer to use as an exit node once connected")
+	flag.StringVar(&args.netstackForward, "netstack-forward", "", `comma-separated inbound TCP forwards for netstack, each "tcp/PORT:IP:PORT[;proxy-proto=v2]"`)
+	flag.StringVar(&args.netstackForwardAllow, "netstack-forward-allow", "", "comma-separated CIDRs of non-loopback targets that forwards changed at runtime via 'tailscale' may use")
+	flag.BoolVar(&args.acceptDNS, "accept-dns", true, "on first start, whether to accept DNS configuration from the admin panel; later changed with 'tailscale up'")
+	flag.BoolVar(&args.shieldsUp, "shields-up", false, "on first start, whether to block incoming connections, for outbound-only nodes; later changed with 'tailscale up'")
+	flag.StringVar(&args.loginServer, "login-server", "", "base URL of the control server to use on first start, and for 'tailscale up' when it isn't given --login-server")
+	flag.StringVar(&args.authKey, "authkey", "", "on first start, node auth key with which to log in; visible to other local users in the process list, so prefer --authkey-file or $TS_AUTHKEY")
+	flag.StringVar(&args.authKeyFile, "authkey-file", "", "on first start, path of a file containing the node auth key with which to log in; takes precedence over $TS_AUTHKEY and --authkey")
+	flag.StringVar(&args.acceptRisk, "accept-risk", "", `comma-separated risky configurations to not warn about: "lan-access" (SOCKS5 or debug server reachable from other hosts), "userspace-networking"`)
 	flag.BoolVar(&printVersion, "version", false, "print version information and exit")
 
 	if len(os.Args) > 1 {
@@ -142,17 +244,72 @@ func main() {
 		os.Exit(0)
 	}
 
+	tunSet := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "tun" {
+			tunSet = true
+		}
+	})
+	mode, err := resolveNetstackMode(args.netstack, args.tunname, tunSet, os.Getenv("TS_DEBUG_WRAP_NETSTACK"), defaultWrapNetstack())
+	if err != nil {
+		log.SetFlags(0)
+		log.Fatal(err)
+	}
+	args.tunname = mode.tun
+	wrapNetstack = mode.wrap
+	netstackWhy = mode.why
+
 	if runtime.GOOS == "darwin" && os.Getuid() != 0 && !strings.Contains(args.tunname, "userspace-networking") && !args.cleanup {
 		log.SetFlags(0)
 		log.Fatalf("tailscaled requires root; use sudo tailscaled (or use --tun=userspace-networking)")
 	}
 
+	if args.derpMapReload && args.derpMap == "" {
+		log.SetFlags(0)
+		log.Fatalf("--derp-map-reload requires --derp-map")
+	}
+
+	if args.tunSecondary != "" || args.tunSecondaryRoutes != "" {
+		var err error
+		args.tunSecondaryPrefixes, err = checkSecondaryTUN(args.tunname, args.tunSecondary, args.tunSecondaryRoutes)
+		if err != nil {
+			log.SetFlags(0)
+			log.Fatalf("--tun-secondary: %v", err)
+		}
+	}
+
+	if args.loginServer != "" {
+		if err := checkLoginServer(args.loginServer); err != nil {
+			log.SetFlags(0)
+			log.Fatalf("--login-server: %v", err)
+		}
+	}
+
 	if args.socketpath == "" && runtime.GOOS != "windows" {
 		log.SetFlags(0)
 		log.Fatalf("--socket is required")
 	}
 
-	err := run()
+	if args.logFileKeep < 1 {
+		// logpolicy.LogFile treats zero as its default, so
+		// rather than quietly keeping 3, refuse.
+		log.SetFlags(0)
+		log.Fatalf("--log-file-keep must be at least 1")
+	}
+
+	args.acceptedRisks, err = parseAcceptedRisks(args.acceptRisk)
+	if err != nil {
+		log.SetFlags(0)
+		log.Fatalf("--accept-risk: %v", err)
+	}
+
+	authKey, err = resolveAuthKey(args.authKey, args.authKeyFile, os.Getenv)
+	if err != nil {
+		log.SetFlags(0)
+		log.Fatal(err)
+	}
+
+	err = run()
 
 	// Remove file sharing from Windows shell (noop in non-windows)
 	osshare.SetFileSharingEnabled(false, logger.Discard)
@@ -191,6 +348,100 @@ func trySynologyMigration(p string) error {
 	return nil
 }
 
+// tryCorruptStateRecovery moves aside the state file at p if it
+// isn't valid JSON, as can happen if tailscaled was killed (say, by
+// the OOM killer) while writing it on a filesystem without atomic
+// renames. tailscaled then starts with fresh state, as on first run,
+// rather than failing to start at all.
+func tryCorruptStateRecovery(p string) error {
+	bs, err := os.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(bs) == 0 || json.Valid(bs) {
+		// Empty files are handled by ipn.NewFileStore.
+		return nil
+	}
+	bad := p + ".corrupt"
+	log.Printf("state file %s is corrupt; moving it to %s and starting with fresh state", p, bad)
+	return os.Rename(p, bad)
+}
+
+// cleanup removes, best effort, the system state that a tailscaled
+// which didn't exit cleanly may have left behind: its DNS and routing
+// configuration (including firewall rules) and its unix socket.
+func cleanup(logf logger.Logf) {
+	dns.Cleanup(logf, args.tunname)
+	router.Cleanup(logf, args.tunname)
+	if runtime.GOOS != "windows" {
+		cleanupSocket(logf, args.socketpath)
+	}
+}
+
+// cleanupSocket removes the unix socket at path, unless a tailscaled
+// is still listening on it.
+func cleanupSocket(logf logger.Logf, path string) {
+	if path == "" || (runtime.GOOS == "linux" && strings.HasPrefix(path, "@")) {
+		// Nothing to do; abstract sockets have no file.
+		return
+	}
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		logf("cleanup: %v", err)
+		return
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		logf("cleanup: %s is not a socket; leaving it", path)
+		return
+	}
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		logf("cleanup: tailscaled is still listening on %s; leaving it", path)
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		logf("cleanup: removing socket: %v", err)
+		return
+	}
+	logf("cleanup: removed stale socket %s", path)
+}
+
+// socketActivationListener returns the unix socket passed to
+// tailscaled by systemd socket activation, or nil if there's none.
+func socketActivationListener(logf logger.Logf) (net.Listener, error) {
+	lns, err := systemd.Listeners()
+	if err != nil || len(lns) == 0 {
+		return nil, err
+	}
+	var ret net.Listener
+	for _, ln := range lns {
+		if ret == nil && ln.Addr().Network() == "unix" {
+			ret = ln
+			continue
+		}
+		logf("ignoring extra socket-activated listener %v/%v", ln.Addr().Network(), ln.Addr())
+		ln.Close()
+	}
+	if ret == nil {
+		return nil, errors.New("no unix socket among the activated sockets")
+	}
+	if addr := ret.Addr().String(); addr != args.socketpath {
+		logf("using socket-activated %s instead of --socket=%s; clients need --socket=%s", addr, args.socketpath, addr)
+	} else {
+		logf("using socket-activated %s", addr)
+	}
+	return ret, nil
+}
+
+// defaultIPNPort is the default --ipn-port.
+const defaultIPNPort = 41112
+
 func ipnServerOpts() (o ipnserver.Options) {
 	// Allow changing the OS-specific IPN behavior for tests
 	// so we can e.g. test Windows-specific behaviors on Linux.
@@ -199,9 +450,15 @@ func ipnServerOpts() (o ipnserver.Options) {
 		goos = runtime.GOOS
 	}
 
-	o.Port = 41112
+	o.Port = int(args.ipnPort)
 	o.StatePath = args.statepath
 	o.SocketPath = args.socketpath // even for goos=="windows", for tests
+	o.ExitNode = args.exitNode
+	o.IdleExit = args.idleExit
+	o.SkipGoingAway = args.skipGoingAway
+	o.BootstrapPrefs = bootstrapPrefs()
+	o.DefaultControlURL = args.loginServer
+	o.AuthKey = authKey
 
 	switch goos {
 	default:
@@ -213,10 +470,102 @@ func ipnServerOpts() (o ipnserver.Options) {
 	return o
 }
 
+// bootstrapPrefs returns the prefs edits to apply on first start, or
+// nil if there are none.
+func bootstrapPrefs() *ipn.MaskedPrefs {
+	mp := new(ipn.MaskedPrefs)
+	var set bool
+	if !args.acceptDNS {
+		mp.CorpDNS = false
+		mp.CorpDNSSet = true
+		set = true
+	}
+	if args.shieldsUp {
+		mp.ShieldsUp = true
+		mp.ShieldsUpSet = true
+		set = true
+	}
+	if args.loginServer != "" {
+		mp.ControlURL = args.loginServer
+		mp.ControlURLSet = true
+		set = true
+	}
+	if authKey != "" {
+		mp.WantRunning = true
+		mp.WantRunningSet = true
+		set = true
+	}
+	if !set {
+		return nil
+	}
+	return mp
+}
+
+// authKey is the node auth key for the bootstrap login, from
+// resolveAuthKey, or empty.
+var authKey string
+
+// resolveAuthKey returns the node auth key with which to log in on
+// first start, from the first of these that's set: the file named by
+// file (--authkey-file), the TS_AUTHKEY environment variable, or
+// flagKey (--authkey). Surrounding whitespace is trimmed. It returns
+// an empty key if none is set.
+func resolveAuthKey(flagKey, file string, getenv func(string) string) (string, error) {
+	if file != "" {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("--authkey-file: %w", err)
+		}
+		key := strings.TrimSpace(string(b))
+		if key == "" {
+			return "", fmt.Errorf("--authkey-file: %s is empty", file)
+		}
+		return key, nil
+	}
+	if v := strings.TrimSpace(getenv("TS_AUTHKEY")); v != "" {
+		return v, nil
+	}
+	return strings.TrimSpace(flagKey), nil
+}
+
+// checkLoginServer reports whether s is a valid --login-server URL.
+func checkLoginServer(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%q: scheme must be http or https", s)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%q: missing host", s)
+	}
+	return nil
+}
+
 func run() error {
 	var err error
 
-	pol := logpolicy.New("tailnode.log.tailscale.io")
+	if args.socketNetNS != "" {
+		if err := netns.SetSocketNetNS(args.socketNetNS); err != nil {
+			log.Fatalf("--socket-netns: %v", err)
+		}
+	}
+
+	logBuf, err := logpolicy.ParseBufferSpec(args.logtailBuffer)
+	if err != nil {
+		log.Fatalf("--logtail-buffer: %v", err)
+	}
+	pol := logpolicy.NewWithOptions("tailnode.log.tailscale.io", logpolicy.Options{
+		Buffer:             logBuf,
+		MaxUploadBandwidth: int(args.logtailMaxUpload),
+		MaxBackoff:         args.logtailMaxBackoff,
+		LogFile: logpolicy.LogFile{
+			Path:    args.logFile,
+			MaxSize: args.logFileMaxSize,
+			Keep:    args.logFileKeep,
+		},
+	})
 	pol.SetVerbosityLevel(args.verbose)
 	defer func() {
 		// Finish uploading logs after closing everything else.
@@ -245,17 +594,27 @@ func run() error {
 		if os.Getenv("TS_PLEASE_PANIC") != "" {
 			panic("TS_PLEASE_PANIC asked us to panic")
 		}
-		dns.Cleanup(logf, args.tunname)
-		router.Cleanup(logf, args.tunname)
+		cleanup(logf)
 		return nil
 	}
 
 	if args.statepath == "" {
 		log.Fatalf("--state is required")
 	}
+	warnRisks(logf, configRisks(runtime.GOOS, args.tunname, args.socksAddr, args.debug), args.acceptedRisks)
 	if err := trySynologyMigration(args.statepath); err != nil {
 		log.Printf("error in synology migration: %v", err)
 	}
+	if err := tryCorruptStateRecovery(args.statepath); err != nil {
+		log.Printf("error recovering corrupt state file: %v", err)
+	}
+
+	// Adopt a socket passed by systemd socket activation before
+	// anything else runs, so it isn't leaked to child processes.
+	activatedLn, err := socketActivationListener(logf)
+	if err != nil {
+		log.Fatalf("socket activation: %v", err)
+	}
 
 	var debugMux *http.ServeMux
 	if args.debug != "" {
@@ -272,36 +631,64 @@ func run() error {
 	var socksListener net.Listener
 	if args.socksAddr != "" {
 		var err error
-		socksListener, err = net.Listen("tcp", args.socksAddr)
+		// listenAll logs each bound address, which also lets
+		// integration tests find a kernel-selected port portably.
+		socksListener, err = listenAll(log.Printf, "SOCKS5", args.socksAddr, defaultLookupIP)
 		if err != nil {
 			log.Fatalf("SOCKS5 listener: %v", err)
 		}
-		if strings.HasSuffix(args.socksAddr, ":0") {
-			// Log kernel-selected port number so integration tests
-			// can find it portably.
-			log.Printf("SOCKS5 listening on %v", socksListener.Addr())
-		}
 	}
 
+	logf("netstack mode: %s", netstackWhy)
 	e, useNetstack, err := createEngine(logf, linkMon)
 	if err != nil {
 		logf("wgengine.New: %v", err)
 		return err
 	}
 
+	if debugMux != nil {
+		if ig, ok := e.(wgengine.InternalsGetter); ok {
+			if _, mc, ok := ig.GetInternals(); ok {
+				debugMux.HandleFunc("/debug/engine", debugEngineHandler(e, mc))
+			}
+		}
+	}
+
 	var ns *netstack.Impl
 	if useNetstack || wrapNetstack {
 		onlySubnets := wrapNetstack && !useNetstack
 		ns = mustStartNetstack(logf, e, onlySubnets)
 	}
+	if args.netstackForward != "" {
+		if !useNetstack {
+			log.Fatalf("--netstack-forward requires netstack (--netstack or --tun=userspace-networking)")
+		}
+		rules, err := parseForwardRules(args.netstackForward)
+		if err != nil {
+			log.Fatalf("--netstack-forward: %v", err)
+		}
+		ns.SetForwardRules(rules)
+	}
 
 	if socksListener != nil {
 		srv := tssocks.NewServer(logger.WithPrefix(logf, "socks5: "), e, ns)
+		srv.IdleTimeout = args.socksIdle
+		srv.MaxLifetime = args.socksLife
 		go func() {
 			log.Fatalf("SOCKS5 server exited: %v", srv.Serve(socksListener))
 		}()
 	}
 
+	var staticDERP *staticDERPEngine
+	if args.derpMap != "" {
+		staticDERP, err = newStaticDERPEngine(logf, e, args.derpMap)
+		if err != nil {
+			logf("--derp-map: %v", err)
+			return err
+		}
+		e = staticDERP
+	}
+
 	e = wgengine.NewWatchdog(e)
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -322,9 +709,40 @@ func run() error {
 			// continue
 		}
 	}()
+	if staticDERP != nil && args.derpMapReload {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for {
+				select {
+				case <-hup:
+					if err := staticDERP.reload(); err != nil {
+						logf("reloading --derp-map: %v; keeping previous DERP map", err)
+					}
+				case <-ctx.Done():
+					signal.Stop(hup)
+					return
+				}
+			}
+		}()
+	}
 
 	opts := ipnServerOpts()
 	opts.DebugMux = debugMux
+	opts.Listener = activatedLn
+	if ns != nil {
+		opts.NetstackConns = ns.Conns
+	}
+	if useNetstack {
+		fw := &netstackForwarder{ns: ns}
+		if args.netstackForwardAllow != "" {
+			fw.allow, err = parsePrefixes(args.netstackForwardAllow)
+			if err != nil {
+				log.Fatalf("--netstack-forward-allow: %v", err)
+			}
+		}
+		opts.NetstackForwarder = fw
+	}
 	err = ipnserver.Run(ctx, logf, pol.PublicID.String(), ipnserver.FixedEngine(e), opts)
 	// Cancelation is not an error: it is the only way to stop ipnserver.
 	if err != nil && err != context.Canceled {
@@ -339,29 +757,100 @@ func createEngine(logf logger.Logf, linkMon *monitor.Mon) (e wgengine.Engine, us
 	if args.tunname == "" {
 		return nil, false, errors.New("no --tun value specified")
 	}
+	attempts := args.tunRetryCount
+	if attempts < 1 {
+		attempts = 1
+	}
 	var errs []error
-	for _, name := range strings.Split(args.tunname, ",") {
+	for _, name := range splitTunNames(args.tunname) {
 		logf("wgengine.NewUserspaceEngine(tun %q) ...", name)
-		e, useNetstack, err = tryEngine(logf, linkMon, name)
-		if err == nil {
-			return e, useNetstack, nil
+		for try := 1; try <= attempts; try++ {
+			if try > 1 {
+				logf("[v1] wgengine.NewUserspaceEngine(tun %q): retry %d/%d in %v", name, try, attempts, args.tunRetryDelay)
+				time.Sleep(args.tunRetryDelay)
+			}
+			e, useNetstack, err = tryEngine(logf, linkMon, name)
+			if err == nil {
+				return e, useNetstack, nil
+			}
+			logf("wgengine.NewUserspaceEngine(tun %q) error: %v", name, err)
+			if name == "userspace-networking" {
+				// Not a transient device failure; no point retrying.
+				break
+			}
 		}
-		logf("wgengine.NewUserspaceEngine(tun %q) error: %v", name, err)
 		errs = append(errs, err)
 	}
 	return nil, false, multierror.New(errs)
 }
 
+// wrapNetstack is whether a TUN device's router is wrapped with
+// netstack to also handle subnet routes. main updates it from the
+// flags; the initial value is for the Windows service, which doesn't
+// parse them.
 var wrapNetstack = shouldWrapNetstack()
 
+// netstackWhy describes how the netstack mode was chosen, for
+// logging at startup.
+var netstackWhy string
+
 func shouldWrapNetstack() bool {
-	if e := os.Getenv("TS_DEBUG_WRAP_NETSTACK"); e != "" {
-		v, err := strconv.ParseBool(e)
+	mode, err := resolveNetstackMode(false, defaultTunName(), false, os.Getenv("TS_DEBUG_WRAP_NETSTACK"), defaultWrapNetstack())
+	if err != nil {
+		log.Fatal(err)
+	}
+	return mode.wrap
+}
+
+// netstackMode is the result of resolveNetstackMode.
+type netstackMode struct {
+	tun  string // --tun value to use
+	wrap bool   // value for wrapNetstack
+	why  string // how the mode was chosen, for logging
+}
+
+// resolveNetstackMode decides how tailscaled uses netstack. In order
+// of precedence:
+//
+//   - netstackFlag (--netstack) forces userspace networking, and is
+//     an error if tunSet reports that --tun was also explicitly set to
+//     anything else.
+//   - otherwise the tun value (--tun) is used as given, and if it
+//     names a TUN device, wrapEnv (TS_DEBUG_WRAP_NETSTACK), if
+//     non-empty, or else wrapDefault decides whether netstack also
+//     handles subnet routes.
+func resolveNetstackMode(netstackFlag bool, tun string, tunSet bool, wrapEnv string, wrapDefault bool) (netstackMode, error) {
+	if netstackFlag {
+		if tunSet && tun != "userspace-networking" {
+			return netstackMode{}, fmt.Errorf("--netstack conflicts with --tun=%q; use one or the other", tun)
+		}
+		why := "userspace networking (--netstack)"
+		if wrapEnv != "" {
+			why += "; ignoring TS_DEBUG_WRAP_NETSTACK"
+		}
+		return netstackMode{tun: "userspace-networking", why: why}, nil
+	}
+	wrap, wrapFrom := wrapDefault, "default for OS"
+	if wrapEnv != "" {
+		v, err := strconv.ParseBool(wrapEnv)
 		if err != nil {
-			log.Fatalf("invalid TS_DEBUG_WRAP_NETSTACK value: %v", err)
+			return netstackMode{}, fmt.Errorf("invalid TS_DEBUG_WRAP_NETSTACK value: %v", err)
 		}
-		return v
+		wrap, wrapFrom = v, "TS_DEBUG_WRAP_NETSTACK"
 	}
+	if tun == "userspace-networking" {
+		return netstackMode{tun: tun, wrap: wrap, why: "userspace networking (--tun)"}, nil
+	}
+	return netstackMode{
+		tun:  tun,
+		wrap: wrap,
+		why:  fmt.Sprintf("--tun=%q; netstack subnet routing %v (%s)", tun, wrap, wrapFrom),
+	}, nil
+}
+
+// defaultWrapNetstack reports whether this platform wraps TUN
+// routers with netstack by default.
+func defaultWrapNetstack() bool {
 	if distro.Get() == distro.Synology {
 		return true
 	}
@@ -375,44 +864,43 @@ func shouldWrapNetstack() bool {
 }
 
 func tryEngine(logf logger.Logf, linkMon *monitor.Mon, name string) (e wgengine.Engine, useNetstack bool, err error) {
-	conf := wgengine.Config{
-		ListenPort:  args.port,
-		LinkMonitor: linkMon,
+	return embedded.NewEngine(logf, embedded.EngineConfig{
+		Tun:               name,
+		ListenPort:        args.port,
+		LinkMonitor:       linkMon,
+		SecondaryTun:      args.tunSecondary,
+		SecondaryPrefixes: args.tunSecondaryPrefixes,
+		WrapNetstack:      wrapNetstack,
+		StateDir:          stateDir(),
+		DeviceLogging:     args.verbose >= 2,
+		NoDNS:             args.noDNS,
+		PacketLogging:     args.verboseNet,
+	})
+}
+
+// stateDir returns the directory of the --state file, or the empty
+// string if there's no state file.
+func stateDir() string {
+	if args.statepath == "" {
+		return ""
 	}
-	useNetstack = name == "userspace-networking"
-	if !useNetstack {
-		dev, devName, err := tstun.New(logf, name)
-		if err != nil {
-			tstun.Diagnose(logf, name)
-			return nil, false, err
-		}
-		conf.Tun = dev
-		if strings.HasPrefix(name, "tap:") {
-			conf.IsTAP = true
-			e, err := wgengine.NewUserspaceEngine(logf, conf)
-			return e, false, err
-		}
+	return filepath.Dir(args.statepath)
+}
 
-		r, err := router.New(logf, dev, linkMon)
-		if err != nil {
-			dev.Close()
-			return nil, false, err
-		}
-		d, err := dns.NewOSConfigurator(logf, devName)
-		if err != nil {
-			return nil, false, err
-		}
-		conf.DNS = d
-		conf.Router = r
-		if wrapNetstack {
-			conf.Router = netstack.NewSubnetRouterWrapper(conf.Router)
+// splitTunNames splits the comma-separated list of --tun names to try.
+// The options of a TAP device spec (see tstun.ParseTAPConfig) have
+// commas of their own, so a piece of the form key=value belongs to
+// the name before it.
+func splitTunNames(s string) []string {
+	var names []string
+	for _, f := range strings.Split(s, ",") {
+		if strings.Contains(f, "=") && len(names) > 0 {
+			names[len(names)-1] += "," + f
+			continue
 		}
+		names = append(names, f)
 	}
-	e, err = wgengine.NewUserspaceEngine(logf, conf)
-	if err != nil {
-		return nil, useNetstack, err
-	}
-	return e, useNetstack, nil
+	return names
 }
 
 func newDebugMux() *http.ServeMux {
@@ -422,27 +910,173 @@ func newDebugMux() *http.ServeMux {
 	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
 	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/runtime", debugRuntime)
 	return mux
 }
 
+// debugRuntime serves /debug/runtime, which reports the goroutine
+// count and heap size as JSON, for leak checks in tests. With ?gc=1,
+// it first runs a garbage collection, so the heap size is less noisy.
+func debugRuntime(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("gc") == "1" {
+		runtime.GC()
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Goroutines int
+		HeapAlloc  uint64 // bytes
+	}{runtime.NumGoroutine(), ms.HeapAlloc})
+}
+
+// debugEngineHandler returns the handler for /debug/engine, which
+// reports the engine's DERP connections and their latencies, and the
+// outcome of its last Reconfig and router and DNS changes.
+func debugEngineHandler(e wgengine.Engine, mc *magicsock.Conn) http.HandlerFunc {
+	type derpRegion struct {
+		RegionID       int
+		RegionCode     string `json:",omitempty"`
+		Connected      bool
+		LatencySeconds float64 `json:",omitempty"` // zero if not yet measured
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		lat := mc.DERPLatencies()
+		var regions []derpRegion
+		if dm := mc.DERPMap(); dm != nil {
+			for _, id := range dm.RegionIDs() {
+				d, connected := lat[id]
+				regions = append(regions, derpRegion{
+					RegionID:       id,
+					RegionCode:     dm.Regions[id].RegionCode,
+					Connected:      connected,
+					LatencySeconds: d.Seconds(),
+				})
+			}
+		}
+		var ops map[string]wgengine.OpStatus
+		if g, ok := e.(wgengine.OpStatusGetter); ok {
+			ops = g.LastOps()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "\t")
+		enc.Encode(struct {
+			DERPRegions []derpRegion
+			Ops         map[string]wgengine.OpStatus `json:",omitempty"`
+		}{regions, ops})
+	}
+}
+
 func runDebugServer(mux *http.ServeMux, addr string) {
+	ln, err := listenAll(log.Printf, "debug server", addr, defaultLookupIP)
+	if err != nil {
+		log.Fatalf("debug listener: %v", err)
+	}
 	srv := &http.Server{
-		Addr:    addr,
 		Handler: mux,
 	}
-	if err := srv.ListenAndServe(); err != nil {
+	if err := srv.Serve(ln); err != nil {
 		log.Fatal(err)
 	}
 }
 
-func mustStartNetstack(logf logger.Logf, e wgengine.Engine, onlySubnets bool) *netstack.Impl {
-	tunDev, magicConn, ok := e.(wgengine.InternalsGetter).GetInternals()
-	if !ok {
-		log.Fatalf("%T is not a wgengine.InternalsGetter", e)
+// checkSecondaryTUN validates the --tun-secondary flags and returns
+// the parsed secondary routes.
+func checkSecondaryTUN(tunname, secondary, routes string) ([]netaddr.IPPrefix, error) {
+	if runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("not supported on %s", runtime.GOOS)
+	}
+	if secondary == "" || routes == "" {
+		return nil, errors.New("--tun-secondary and --tun-secondary-routes must be used together")
+	}
+	if strings.Contains(tunname, ",") || tunname == "userspace-networking" || strings.HasPrefix(tunname, "tap:") {
+		return nil, fmt.Errorf("requires a single TUN device for --tun, not %q", tunname)
+	}
+	if secondary == tunname {
+		return nil, fmt.Errorf("must differ from --tun %q", tunname)
+	}
+	var ret []netaddr.IPPrefix
+	for _, s := range strings.Split(routes, ",") {
+		p, err := netaddr.ParseIPPrefix(strings.TrimSpace(s))
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, p.Masked())
+	}
+	return ret, nil
+}
+
+func parseForwardRules(s string) ([]netstack.ForwardRule, error) {
+	var rules []netstack.ForwardRule
+	for _, f := range strings.Split(s, ",") {
+		r, err := netstack.ParseForwardRule(strings.TrimSpace(f))
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// parsePrefixes parses a comma-separated list of CIDRs.
+func parsePrefixes(s string) ([]netaddr.IPPrefix, error) {
+	var ret []netaddr.IPPrefix
+	for _, f := range strings.Split(s, ",") {
+		p, err := netaddr.ParseIPPrefix(strings.TrimSpace(f))
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, p.Masked())
+	}
+	return ret, nil
+}
+
+// netstackForwarder is the ipnlocal.NetstackForwarder for ns, letting
+// the LocalAPI change its forward rules. Rules set through it may only
+// forward to loopback or to addresses in allow.
+type netstackForwarder struct {
+	ns    forwardRuleSetter
+	allow []netaddr.IPPrefix
+}
+
+// forwardRuleSetter is the subset of *netstack.Impl used by
+// netstackForwarder.
+type forwardRuleSetter interface {
+	ForwardRules() []netstack.ForwardRule
+	SetForwardRules([]netstack.ForwardRule)
+}
+
+func (f *netstackForwarder) ForwardRules() []string {
+	rules := f.ns.ForwardRules()
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Port < rules[j].Port })
+	ret := make([]string, len(rules))
+	for i, r := range rules {
+		ret[i] = r.String()
+	}
+	return ret
+}
+
+func (f *netstackForwarder) SetForwardRules(rules []string) error {
+	parsed := make([]netstack.ForwardRule, 0, len(rules))
+	for _, s := range rules {
+		r, err := netstack.ParseForwardRule(strings.TrimSpace(s))
+		if err != nil {
+			return err
+		}
+		parsed = append(parsed, r)
 	}
-	ns, err := netstack.Create(logf, tunDev, e, magicConn, onlySubnets)
+	if err := netstack.CheckForwardRules(parsed, f.allow); err != nil {
+		return err
+	}
+	f.ns.SetForwardRules(parsed)
+	return nil
+}
+
+func mustStartNetstack(logf logger.Logf, e wgengine.Engine, onlySubnets bool) *netstack.Impl {
+	ns, err := embedded.NewNetstack(logf, e, onlySubnets)
 	if err != nil {
-		log.Fatalf("netstack.Create: %v", err)
+		log.Fatalf("netstack: %v", err)
 	}
 	if err := ns.Start(); err != nil {
 		log.Fatalf("failed to start netstack: %v", err)
@@ -0,0 +1,966 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/stun"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/flagtype"
+	"tailscale.com/wgengine"
+	"tailscale.com/wgengine/netstack"
+)
+
+func TestResolveNetstackMode(t *testing.T) {
+	tests := []struct {
+		name        string
+		netstack    bool
+		tun         string
+		tunSet      bool
+		wrapEnv     string
+		wrapDefault bool
+
+		wantTun  string
+		wantWrap bool
+		wantErr  bool
+	}{
+		{
+			name:    "default_tun",
+			tun:     "tailscale0",
+			wantTun: "tailscale0",
+		},
+		{
+			name:        "default_tun_os_wraps",
+			tun:         "tailscale0",
+			wrapDefault: true,
+			wantTun:     "tailscale0",
+			wantWrap:    true,
+		},
+		{
+			name:        "env_overrides_os_default",
+			tun:         "tailscale0",
+			wrapEnv:     "false",
+			wrapDefault: true,
+			wantTun:     "tailscale0",
+		},
+		{
+			name:     "env_enables_wrap",
+			tun:      "tailscale0",
+			wrapEnv:  "1",
+			wantTun:  "tailscale0",
+			wantWrap: true,
+		},
+		{
+			name:    "bad_env",
+			tun:     "tailscale0",
+			wrapEnv: "maybe",
+			wantErr: true,
+		},
+		{
+			name:    "tun_userspace",
+			tun:     "userspace-networking",
+			tunSet:  true,
+			wantTun: "userspace-networking",
+		},
+		{
+			name:     "netstack_flag_overrides_default_tun",
+			netstack: true,
+			tun:      "tailscale0,userspace-networking",
+			wantTun:  "userspace-networking",
+		},
+		{
+			name:     "netstack_flag_with_matching_tun",
+			netstack: true,
+			tun:      "userspace-networking",
+			tunSet:   true,
+			wantTun:  "userspace-networking",
+		},
+		{
+			name:     "netstack_flag_conflicts_with_tun",
+			netstack: true,
+			tun:      "tailscale0",
+			tunSet:   true,
+			wantErr:  true,
+		},
+		{
+			name:        "netstack_flag_ignores_env",
+			netstack:    true,
+			tun:         "tailscale0",
+			wrapEnv:     "true",
+			wrapDefault: true,
+			wantTun:     "userspace-networking",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveNetstackMode(tt.netstack, tt.tun, tt.tunSet, tt.wrapEnv, tt.wrapDefault)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v; want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got.tun != tt.wantTun || got.wrap != tt.wantWrap {
+				t.Errorf("got tun %q, wrap %v; want tun %q, wrap %v", got.tun, got.wrap, tt.wantTun, tt.wantWrap)
+			}
+			if got.why == "" {
+				t.Errorf("empty why")
+			}
+		})
+	}
+}
+
+func TestSplitTunNames(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"tailscale0", []string{"tailscale0"}},
+		{"tailscale0,userspace-networking", []string{"tailscale0", "userspace-networking"}},
+		{"tap:tap0:br0", []string{"tap:tap0:br0"}},
+		{
+			"tap:tap0:br0;dhcp=192.168.100.10-192.168.100.100,gw=192.168.100.1,dns=magicdns",
+			[]string{"tap:tap0:br0;dhcp=192.168.100.10-192.168.100.100,gw=192.168.100.1,dns=magicdns"},
+		},
+		{
+			"tap:tap0;dhcp=10.0.0.10-10.0.0.20,gw=10.0.0.1,userspace-networking",
+			[]string{"tap:tap0;dhcp=10.0.0.10-10.0.0.20,gw=10.0.0.1", "userspace-networking"},
+		},
+	}
+	for _, tt := range tests {
+		if got := splitTunNames(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitTunNames(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCleanupSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no unix sockets")
+	}
+	dir := t.TempDir()
+	exists := func(path string) bool {
+		_, err := os.Lstat(path)
+		return err == nil
+	}
+
+	stale := filepath.Join(dir, "stale.sock")
+	ln, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	if !exists(stale) {
+		t.Fatal("stale socket file not left behind")
+	}
+	cleanupSocket(t.Logf, stale)
+	if exists(stale) {
+		t.Error("stale socket not removed")
+	}
+
+	live := filepath.Join(dir, "live.sock")
+	ln, err = net.Listen("unix", live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	cleanupSocket(t.Logf, live)
+	if !exists(live) {
+		t.Error("live socket removed")
+	}
+
+	notSocket := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(notSocket, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cleanupSocket(t.Logf, notSocket)
+	if !exists(notSocket) {
+		t.Error("non-socket file removed")
+	}
+
+	cleanupSocket(t.Logf, filepath.Join(dir, "missing.sock")) // no-op
+}
+
+func TestReadDERPMapFile(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		json    string
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			json: `{"Regions": {"900": {"RegionID": 900, "RegionCode": "home", "Nodes": [{"Name": "900a", "RegionID": 900, "HostName": "derp.example.com"}]}}}`,
+		},
+		{name: "not_json", json: `{"Regions":`, wantErr: true},
+		{name: "no_regions", json: `{"Regions": {}}`, wantErr: true},
+		{name: "null_region", json: `{"Regions": {"900": null}}`, wantErr: true},
+		{name: "no_nodes", json: `{"Regions": {"900": {"RegionID": 900, "Nodes": []}}}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name+".json")
+			if err := ioutil.WriteFile(path, []byte(tt.json), 0600); err != nil {
+				t.Fatal(err)
+			}
+			dm, err := readDERPMapFile(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readDERPMapFile error = %v; want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			r := dm.Regions[900]
+			if r == nil || r.RegionCode != "home" || len(r.Nodes) != 1 || r.Nodes[0].HostName != "derp.example.com" {
+				t.Errorf("got DERP map %+v", dm)
+			}
+		})
+	}
+
+	if _, err := readDERPMapFile(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("readDERPMapFile of missing file succeeded")
+	}
+}
+
+// derpMapEngine is a wgengine.Engine that records the last DERP map
+// set on it. Its other methods panic.
+type derpMapEngine struct {
+	wgengine.Engine
+
+	mu   sync.Mutex
+	last *tailcfg.DERPMap
+}
+
+func (e *derpMapEngine) SetDERPMap(dm *tailcfg.DERPMap) {
+	runtime.Gosched() // widen the window for racing callers
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.last = dm
+}
+
+func (e *derpMapEngine) lastRegionCode() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.last == nil || e.last.Regions[900] == nil {
+		return ""
+	}
+	return e.last.Regions[900].RegionCode
+}
+
+func TestStaticDERPEngineReloadRace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "derp.json")
+	writeMap := func(code string) {
+		t.Helper()
+		json := fmt.Sprintf(`{"Regions": {"900": {"RegionID": 900, "RegionCode": %q, "Nodes": [{"Name": "900a", "RegionID": 900, "HostName": "derp.example.com"}]}}}`, code)
+		if err := ioutil.WriteFile(path, []byte(json), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeMap("v0")
+	fe := new(derpMapEngine)
+	se, err := newStaticDERPEngine(t.Logf, fe, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A DERP map from control racing a SIGHUP reload must never
+	// leave the older file's map applied.
+	for i := 1; i <= 200; i++ {
+		code := fmt.Sprintf("v%d", i)
+		writeMap(code)
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			se.SetDERPMap(nil)
+		}()
+		go func() {
+			defer wg.Done()
+			if err := se.reload(); err != nil {
+				t.Error(err)
+			}
+		}()
+		wg.Wait()
+		if got := fe.lastRegionCode(); got != code {
+			t.Fatalf("iteration %d: applied DERP map %q; want %q", i, got, code)
+		}
+	}
+}
+
+func TestResolveAuthKey(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "authkey")
+	if err := ioutil.WriteFile(keyFile, []byte("  tskey-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	emptyFile := filepath.Join(dir, "empty")
+	if err := ioutil.WriteFile(emptyFile, []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		flag    string
+		file    string
+		env     string
+		want    string
+		wantErr bool
+	}{
+		{name: "none", want: ""},
+		{name: "flag", flag: "tskey-flag", want: "tskey-flag"},
+		{name: "env_over_flag", flag: "tskey-flag", env: " tskey-env\n", want: "tskey-env"},
+		{name: "file_over_env", flag: "tskey-flag", env: "tskey-env", file: keyFile, want: "tskey-file"},
+		{name: "blank_env", flag: "tskey-flag", env: " ", want: "tskey-flag"},
+		{name: "missing_file", env: "tskey-env", file: filepath.Join(dir, "missing"), wantErr: true},
+		{name: "empty_file", env: "tskey-env", file: emptyFile, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			getenv := func(k string) string {
+				if k == "TS_AUTHKEY" {
+					return tt.env
+				}
+				return ""
+			}
+			got, err := resolveAuthKey(tt.flag, tt.file, getenv)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveAuthKey error = %v; want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("resolveAuthKey = %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMigrateUserState(t *testing.T) {
+	// userState writes a per-user state file for user under
+	// profiles, laid out as on Windows, modified at mod.
+	userState := func(t *testing.T, profiles, user, contents string, mod time.Time) string {
+		t.Helper()
+		p := filepath.Join(profiles, user, "AppData", "Local", "Tailscale", "server-state.conf")
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	migrate := func(t *testing.T, dst string, candidates []string) (secured []string) {
+		t.Helper()
+		secure := func(p string) error {
+			secured = append(secured, p)
+			return nil
+		}
+		if err := migrateUserState(t.Logf, dst, candidates, secure); err != nil {
+			t.Fatal(err)
+		}
+		return secured
+	}
+	readFile := func(t *testing.T, p string) string {
+		t.Helper()
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	recent := time.Now().Add(-time.Hour)
+
+	t.Run("one_user", func(t *testing.T) {
+		dir := t.TempDir()
+		alice := userState(t, filepath.Join(dir, "Users"), "alice", `{"_daemon":"YWxpY2U="}`, old)
+		dst := filepath.Join(dir, "system", "Tailscale", "server-state.conf")
+
+		secured := migrate(t, dst, []string{alice})
+		if got := readFile(t, dst); got != `{"_daemon":"YWxpY2U="}` {
+			t.Errorf("migrated state = %q", got)
+		}
+		if len(secured) != 1 {
+			t.Errorf("secure called %d times; want 1", len(secured))
+		}
+		if got := readFile(t, alice); got != `{"_daemon":"YWxpY2U="}` {
+			t.Errorf("per-user state changed to %q", got)
+		}
+	})
+
+	t.Run("many_users", func(t *testing.T) {
+		dir := t.TempDir()
+		profiles := filepath.Join(dir, "Users")
+		candidates := []string{
+			userState(t, profiles, "alice", `{"_daemon":"YWxpY2U="}`, old),
+			userState(t, profiles, "bob", `{"_daemon":"Ym9i"}`, recent),
+			userState(t, profiles, "corrupt", `{"_daemon":`, time.Now()),
+			userState(t, profiles, "empty", `{}`, time.Now()),
+			filepath.Join(profiles, "nobody", "AppData", "Local", "Tailscale", "server-state.conf"),
+		}
+		dst := filepath.Join(dir, "system", "Tailscale", "server-state.conf")
+
+		migrate(t, dst, candidates)
+		if got := readFile(t, dst); got != `{"_daemon":"Ym9i"}` {
+			t.Errorf("migrated state = %q; want bob's", got)
+		}
+	})
+
+	t.Run("global_exists", func(t *testing.T) {
+		dir := t.TempDir()
+		alice := userState(t, filepath.Join(dir, "Users"), "alice", `{"_daemon":"YWxpY2U="}`, old)
+		dst := filepath.Join(dir, "server-state.conf")
+		if err := ioutil.WriteFile(dst, []byte(`{"_daemon":"Z2xvYmFs"}`), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if secured := migrate(t, dst, []string{alice}); len(secured) != 0 {
+			t.Errorf("migrated with existing global state")
+		}
+		if got := readFile(t, dst); got != `{"_daemon":"Z2xvYmFs"}` {
+			t.Errorf("global state changed to %q", got)
+		}
+	})
+
+	t.Run("only_once", func(t *testing.T) {
+		dir := t.TempDir()
+		profiles := filepath.Join(dir, "Users")
+		dst := filepath.Join(dir, "server-state.conf")
+
+		// Nothing to migrate yet; that still counts.
+		migrate(t, dst, nil)
+		alice := userState(t, profiles, "alice", `{"_daemon":"YWxpY2U="}`, old)
+		if secured := migrate(t, dst, []string{alice}); len(secured) != 0 {
+			t.Fatalf("migration ran twice")
+		}
+		if _, err := os.Stat(dst); !os.IsNotExist(err) {
+			t.Errorf("global state created on second run; stat err = %v", err)
+		}
+
+		// And with something to migrate.
+		dir = t.TempDir()
+		dst = filepath.Join(dir, "server-state.conf")
+		migrate(t, dst, []string{alice})
+		if err := os.Remove(dst); err != nil {
+			t.Fatal(err)
+		}
+		if secured := migrate(t, dst, []string{alice}); len(secured) != 0 {
+			t.Errorf("migration ran again after global state was removed")
+		}
+	})
+}
+
+func TestFetchDebugJSON(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/peers", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"peer":{"Online":true}}`)
+	})
+	mux.HandleFunc("/debug/netstack", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not using netstack", http.StatusNotFound)
+	})
+	mux.HandleFunc("/debug/bad", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "<html>")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	addr := strings.TrimPrefix(ts.URL, "http://")
+	ctx := context.Background()
+
+	var buf bytes.Buffer
+	if err := fetchDebugJSON(ctx, addr, "/debug/peers", &buf); err != nil {
+		t.Fatal(err)
+	}
+	const want = "{\n  \"peer\": {\n    \"Online\": true\n  }\n}\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	err := fetchDebugJSON(ctx, addr, "/debug/netstack", ioutil.Discard)
+	if err == nil || !strings.Contains(err.Error(), "not using netstack") {
+		t.Errorf("netstack error = %v; want the server's message", err)
+	}
+	if err := fetchDebugJSON(ctx, addr, "/debug/bad", ioutil.Discard); err == nil {
+		t.Error("non-JSON response: got no error")
+	}
+}
+
+type fakeForwardRules []netstack.ForwardRule
+
+func (f *fakeForwardRules) ForwardRules() []netstack.ForwardRule {
+	return append([]netstack.ForwardRule(nil), *f...)
+}
+
+func (f *fakeForwardRules) SetForwardRules(rules []netstack.ForwardRule) { *f = rules }
+
+func TestNetstackForwarder(t *testing.T) {
+	ns := new(fakeForwardRules)
+	fw := &netstackForwarder{
+		ns:    ns,
+		allow: []netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.0.0.0/8")},
+	}
+	want := []string{"tcp/22:127.0.0.1:22", "tcp/80:10.1.2.3:8080;proxy-proto=v2"}
+	if err := fw.SetForwardRules([]string{want[1], " " + want[0]}); err != nil {
+		t.Fatal(err)
+	}
+	if got := fw.ForwardRules(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ForwardRules = %q; want %q", got, want)
+	}
+
+	for _, bad := range [][]string{
+		{"tcp/22:127.0.0.1:22", "tcp/22:127.0.0.1:2222"}, // duplicate port
+		{"tcp/22:192.168.1.1:22"},                        // not allowed
+		{"udp/53:127.0.0.1:53"},                          // unparseable
+	} {
+		if err := fw.SetForwardRules(bad); err == nil {
+			t.Errorf("SetForwardRules(%q) succeeded; want error", bad)
+		}
+		if got := fw.ForwardRules(); !reflect.DeepEqual(got, want) {
+			t.Errorf("after failed SetForwardRules(%q), ForwardRules = %q; want unchanged %q", bad, got, want)
+		}
+	}
+}
+
+func TestIPNServerOptsPort(t *testing.T) {
+	defer func(old uint16) { args.ipnPort = old }(args.ipnPort)
+
+	tests := []struct {
+		name  string
+		flags []string
+		want  int
+	}{
+		{name: "default", want: defaultIPNPort},
+		{name: "auto", flags: []string{"--ipn-port=0"}, want: 0},
+		{name: "explicit", flags: []string{"--ipn-port=41113"}, want: 41113},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("tailscaled", flag.ContinueOnError)
+			fs.Var(flagtype.PortValue(&args.ipnPort, defaultIPNPort), "ipn-port", "")
+			if err := fs.Parse(tt.flags); err != nil {
+				t.Fatal(err)
+			}
+			if got := ipnServerOpts().Port; got != tt.want {
+				t.Errorf("ipnServerOpts().Port = %d; want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseInstallArgs(t *testing.T) {
+	ia, err := parseInstallArgs("install-system-daemon", []string{
+		"--dry-run",
+		"--unit-extra=LimitNOFILE=65536",
+		"--unit-extra=Environment=TS_DEBUG=1 FOO=a=b",
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []unitDirective{
+		{"LimitNOFILE", "65536"},
+		{"Environment", "TS_DEBUG=1 FOO=a=b"},
+	}
+	if !ia.dryRun || ia.force || ia.overridePackage || !reflect.DeepEqual(ia.unitExtra, want) {
+		t.Errorf("got %+v", ia)
+	}
+	if ia, err := parseInstallArgs("install-system-daemon", []string{"--override-package"}, true); err != nil || !ia.overridePackage {
+		t.Errorf("install --override-package = %+v, %v", ia, err)
+	}
+
+	for _, args := range [][]string{
+		{"--unit-extra=NoEquals"},
+		{"--unit-extra==value"},
+		{"--unit-extra=[Unit]=x"},
+		{"--unit-extra=Key=a\nb"},
+		{"positional"},
+	} {
+		if _, err := parseInstallArgs("install-system-daemon", args, true); err == nil {
+			t.Errorf("parseInstallArgs(%q) succeeded; want error", args)
+		}
+	}
+	if _, err := parseInstallArgs("uninstall-system-daemon", []string{"--dry-run"}, false); err == nil {
+		t.Error("uninstall accepted --dry-run")
+	}
+	if ia, err := parseInstallArgs("uninstall-system-daemon", []string{"--force"}, false); err != nil || !ia.force {
+		t.Errorf("uninstall --force = %+v, %v", ia, err)
+	}
+}
+
+func TestCheckNotPackaged(t *testing.T) {
+	dir := t.TempDir()
+	ours := filepath.Join(dir, "ours")
+	packaged := filepath.Join(dir, "packaged")
+	missing := filepath.Join(dir, "missing")
+	for _, p := range []string{ours, packaged} {
+		if err := ioutil.WriteFile(p, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func(old func(string) string) { packageOwner = old }(packageOwner)
+	packageOwner = func(path string) string {
+		if path == packaged || path == missing {
+			return "tailscale"
+		}
+		return ""
+	}
+
+	if err := checkNotPackaged(ours, missing); err != nil {
+		t.Errorf("unpackaged or missing files: %v", err)
+	}
+	err := checkNotPackaged(ours, packaged)
+	if err == nil || !strings.Contains(err.Error(), "tailscale package") {
+		t.Errorf("packaged file: got %v; want error naming the package", err)
+	}
+}
+
+func TestRenderSystemdUnit(t *testing.T) {
+	unit := renderSystemdUnit(nil)
+	if !strings.HasPrefix(unit, "# "+generatedMarker) {
+		t.Errorf("unit doesn't start with marker:\n%s", unit)
+	}
+	if !strings.Contains(unit, strings.TrimLeft(systemdUnitBase, "\n")) {
+		t.Errorf("unit without extras differs from tailscaled.service:\n%s", unit)
+	}
+
+	unit = renderSystemdUnit([]unitDirective{
+		{"LimitNOFILE", "65536"},
+		{"MemoryMax", "256M"},
+	})
+	svc := strings.Index(unit, "[Service]\n")
+	install := strings.Index(unit, "[Install]\n")
+	extra := strings.Index(unit, "LimitNOFILE=65536\nMemoryMax=256M\n")
+	if svc < 0 || install < 0 || extra < svc || extra > install {
+		t.Errorf("extras not at end of [Service] section:\n%s", unit)
+	}
+	if !strings.Contains(unit, "MemoryMax=256M\n\n[Install]\n") {
+		t.Errorf("extras not followed by section break:\n%s", unit)
+	}
+}
+
+func TestCheckUnitFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tailscaled.service")
+	want := []byte(renderSystemdUnit(nil))
+	const legacy = "<plist>old</plist>\n"
+
+	tests := []struct {
+		name     string
+		contents string // empty means no file
+		want     unitFileStatus
+	}{
+		{"missing", "", unitMissing},
+		{"current", string(want), unitCurrent},
+		{"stale", renderSystemdUnit([]unitDirective{{"Nice", "5"}}), unitStale},
+		{"legacy", legacy, unitStale},
+		{"foreign", "[Unit]\nDescription=from a package\n", unitForeign},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(path)
+			if tt.contents != "" {
+				if err := ioutil.WriteFile(path, []byte(tt.contents), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := checkUnitFile(path, want, legacy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("checkUnitFile = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWarnRisks(t *testing.T) {
+	tests := []struct {
+		name       string
+		goos       string
+		tun        string
+		socks      string
+		debug      string
+		acceptRisk string
+		wantWarn   []string // substrings of each warning, in order
+	}{
+		{
+			name:  "loopback",
+			goos:  "linux",
+			tun:   "tailscale0",
+			socks: "localhost:1080",
+			debug: "127.0.0.1:8080",
+		},
+		{
+			name:     "socks-lan",
+			goos:     "linux",
+			tun:      "tailscale0",
+			socks:    "0.0.0.0:1080",
+			wantWarn: []string{"--socks5-server=0.0.0.0:1080"},
+		},
+		{
+			name:     "debug-all-interfaces",
+			goos:     "linux",
+			tun:      "tailscale0",
+			debug:    ":8080",
+			wantWarn: []string{"--debug=:8080"},
+		},
+		{
+			name:       "lan-accepted",
+			goos:       "linux",
+			tun:        "tailscale0",
+			socks:      "[::]:1080",
+			debug:      "192.168.1.2:8080",
+			acceptRisk: "LAN-access",
+		},
+		{
+			name:     "userspace-linux",
+			goos:     "linux",
+			tun:      "userspace-networking",
+			wantWarn: []string{"userspace networking"},
+		},
+		{
+			name: "userspace-darwin",
+			goos: "darwin",
+			tun:  "userspace-networking",
+		},
+		{
+			name:       "partly-accepted",
+			goos:       "windows",
+			tun:        "userspace-networking",
+			socks:      "0.0.0.0:1080",
+			acceptRisk: "userspace-networking",
+			wantWarn:   []string{"--socks5-server"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			accepted, err := parseAcceptedRisks(tt.acceptRisk)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var logs []string
+			logf := func(format string, a ...interface{}) {
+				logs = append(logs, fmt.Sprintf(format, a...))
+			}
+			n := warnRisks(logf, configRisks(tt.goos, tt.tun, tt.socks, tt.debug), accepted)
+			if n != len(tt.wantWarn) || len(logs) != len(tt.wantWarn) {
+				t.Fatalf("warnRisks = %d, logged %q; want %d warnings", n, logs, len(tt.wantWarn))
+			}
+			for i, want := range tt.wantWarn {
+				if !strings.HasPrefix(logs[i], "WARNING: ") || !strings.Contains(logs[i], want) || !strings.Contains(logs[i], "--accept-risk=") {
+					t.Errorf("warning %d = %q; want WARNING containing %q and --accept-risk", i, logs[i], want)
+				}
+			}
+		})
+	}
+
+	if _, err := parseAcceptedRisks("lan-access,bogus"); err == nil {
+		t.Error("parseAcceptedRisks with unknown risk succeeded; want error")
+	}
+}
+
+func TestListenAddrs(t *testing.T) {
+	fakeLookup := func(ctx context.Context, host string) ([]netaddr.IP, error) {
+		switch host {
+		case "v4only":
+			return []netaddr.IP{netaddr.MustParseIP("127.0.0.1")}, nil
+		case "v6only":
+			return []netaddr.IP{netaddr.MustParseIP("::1")}, nil
+		case "dualstack":
+			return []netaddr.IP{netaddr.MustParseIP("::1"), netaddr.MustParseIP("127.0.0.1"), netaddr.MustParseIP("::1")}, nil
+		case "noaddrs":
+			return nil, nil
+		}
+		return nil, fmt.Errorf("no such host %q", host)
+	}
+	tests := []struct {
+		addr    string
+		want    []string
+		wantErr bool
+	}{
+		{addr: "v4only:1080", want: []string{"127.0.0.1:1080"}},
+		{addr: "v6only:1080", want: []string{"[::1]:1080"}},
+		{addr: "dualstack:1080", want: []string{"[::1]:1080", "127.0.0.1:1080"}},
+		{addr: "*:1080", want: []string{":1080"}},
+		{addr: ":1080", want: []string{":1080"}},
+		{addr: "[::1]:0", want: []string{"[::1]:0"}},
+		{addr: "10.0.0.1:1080", want: []string{"10.0.0.1:1080"}},
+		{addr: "noaddrs:1080", wantErr: true},
+		{addr: "unknown:1080", wantErr: true},
+		{addr: "v4only:http", wantErr: true},
+		{addr: "v4only:70000", wantErr: true},
+		{addr: "v4only", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := listenAddrs(context.Background(), tt.addr, fakeLookup)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("listenAddrs(%q) error = %v; want error %v", tt.addr, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("listenAddrs(%q) = %q; want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestListenAll(t *testing.T) {
+	dualstack := func(ctx context.Context, host string) ([]netaddr.IP, error) {
+		return []netaddr.IP{netaddr.MustParseIP("127.0.0.1"), netaddr.MustParseIP("::1")}, nil
+	}
+	var mu sync.Mutex
+	var logs []string
+	logf := func(format string, a ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		logs = append(logs, fmt.Sprintf(format, a...))
+	}
+	ln, err := listenAll(logf, "test", "dualstack:0", dualstack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// ::1 may be unavailable here, so only require the addresses
+	// that were logged as bound to work, and to share a port.
+	var bound []string
+	port := ""
+	for _, line := range logs {
+		const prefix = "test listening on "
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		addr := strings.TrimPrefix(line, prefix)
+		_, p, err := net.SplitHostPort(addr)
+		if err != nil {
+			t.Fatalf("bad logged address %q: %v", addr, err)
+		}
+		if port != "" && p != port {
+			t.Errorf("bound %v with port %v; want the first address's port %v", addr, p, port)
+		}
+		port = p
+		bound = append(bound, addr)
+	}
+	if len(bound) == 0 {
+		t.Fatalf("no bound addresses logged; logs: %q", logs)
+	}
+	for _, addr := range bound {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dial %v: %v", addr, err)
+		}
+		sc, err := ln.Accept()
+		if err != nil {
+			t.Fatalf("Accept for %v: %v", addr, err)
+		}
+		if got, want := sc.RemoteAddr().String(), c.LocalAddr().String(); got != want {
+			t.Errorf("accepted conn from %v; want %v", got, want)
+		}
+		sc.Close()
+		c.Close()
+	}
+}
+
+func TestMultiListenerDropsFailed(t *testing.T) {
+	var lns []net.Listener
+	for i := 0; i < 2; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		lns = append(lns, ln)
+	}
+	ml := newMultiListener(t.Logf, "test", lns)
+	defer ml.Close()
+
+	// One listener failing mustn't stop the others.
+	lns[0].Close()
+	c, err := net.Dial("tcp", lns[1].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	sc, err := ml.Accept()
+	if err != nil {
+		t.Fatalf("Accept after one listener failed: %v", err)
+	}
+	sc.Close()
+
+	// Once all have failed, Accept does too.
+	lns[1].Close()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := ml.Accept()
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Fatalf("Accept after all listeners failed = %v; want error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept didn't fail after all listeners failed")
+	}
+
+	ml.Close()
+	if _, err := ml.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Accept after Close = %v; want net.ErrClosed", err)
+	}
+}
+
+func TestDebugDERPerSTUN(t *testing.T) {
+	pc, err := startDebugSTUN(t.Logf, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	c, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	txid := stun.NewTxID()
+	if _, err := c.Write(stun.Request(txid)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatalf("reading STUN response: %v", err)
+	}
+	gotTxID, ip, port, err := stun.ParseResponse(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotTxID != txid {
+		t.Errorf("response txid = %x; want %x", gotTxID, txid)
+	}
+	la := c.LocalAddr().(*net.UDPAddr)
+	if !net.IP(ip).Equal(la.IP) || int(port) != la.Port {
+		t.Errorf("response address = %v:%d; want %v", net.IP(ip), port, la)
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"time"
 
 	"golang.org/x/sys/windows"
@@ -257,6 +258,10 @@ func startIPNServer(ctx context.Context, logid string) error {
 			return nil, fmt.Errorf("%w\n\nlogid: %v", res.Err, logid)
 		}
 	}
+	if err := tryWindowsStateMigration(logf, args.statepath); err != nil {
+		logf("error in Windows state migration: %v", err)
+	}
+
 	err := ipnserver.Run(ctx, logf, logid, getEngine, ipnServerOpts())
 	if err != nil {
 		logf("ipnserver.Run: %v", err)
@@ -264,6 +269,40 @@ func startIPNServer(ctx context.Context, logid string) error {
 	return err
 }
 
+// tryWindowsStateMigration copies the most recently used per-user
+// state file, from when tailscaled kept state in the logged-in user's
+// profile, to the machine-global state file p, if p doesn't exist
+// yet. The copy is readable only by SYSTEM and Administrators.
+//
+// It's only called from the service subprocess, which runs as SYSTEM.
+func tryWindowsStateMigration(logf logger.Logf, p string) error {
+	profiles := filepath.Join(os.Getenv("SystemDrive")+`\`, "Users")
+	if pub := os.Getenv("PUBLIC"); pub != "" {
+		profiles = filepath.Dir(pub)
+	}
+	candidates, err := filepath.Glob(filepath.Join(profiles, "*", "AppData", "Local", "Tailscale", "server-state.conf"))
+	if err != nil {
+		return err
+	}
+	return migrateUserState(logf, p, candidates, restrictToAdmins)
+}
+
+// restrictToAdmins replaces the DACL of the file at path with one
+// granting full access to only SYSTEM and Administrators.
+func restrictToAdmins(path string) error {
+	sd, err := windows.SecurityDescriptorFromString("D:P(A;;FA;;;SY)(A;;FA;;;BA)")
+	if err != nil {
+		return err
+	}
+	dacl, _, err := sd.DACL()
+	if err != nil {
+		return err
+	}
+	return windows.SetNamedSecurityInfo(path, windows.SE_FILE_OBJECT,
+		windows.DACL_SECURITY_INFORMATION|windows.PROTECTED_DACL_SECURITY_INFORMATION,
+		nil, nil, dacl, nil)
+}
+
 var (
 	kernel32           = windows.NewLazySystemDLL("kernel32.dll")
 	getTickCount64Proc = kernel32.NewProc("GetTickCount64")
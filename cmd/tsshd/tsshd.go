@@ -5,19 +5,28 @@
 //go:build !windows
 // +build !windows
 
-// The tsshd binary is an SSH server that accepts connections
-// from anybody on the same Tailscale network.
+// The tsshd binary is an SSH server that accepts connections from
+// the Tailscale network.
 //
-// It does not use passwords or SSH public key.
+// It does not use passwords or SSH public key. Instead, it's off until
+// given a --port, and then only accepts connections from the tailnet
+// logins allowed by --allow-logins, for the user names allowed by
+// --allow-local-users.
 //
-// Any user name is accepted; users are logged in as whoever is
-// running this daemon.
+// Nodes can't be allowed by ACL tag. The network map in this tree
+// carries no tags verified by control, only the ones a node requests
+// for itself in its Hostinfo, which any node could claim. So tagged
+// nodes, which have no login of their own, are always rejected, and
+// "tag:" entries in --allow-logins are refused at startup.
+//
+// Users are logged in as whoever is running this daemon.
 //
 // Warning: use at your own risk. This code has had very few eyeballs
 // on it.
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
@@ -26,6 +35,8 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 	"unsafe"
@@ -34,20 +45,46 @@ import (
 	"github.com/gliderlabs/ssh"
 	gossh "golang.org/x/crypto/ssh"
 	"inet.af/netaddr"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/net/interfaces"
 	"tailscale.com/net/tsaddr"
 )
 
 var (
-	port    = flag.Int("port", 2200, "port to listen on")
+	port    = flag.Int("port", 0, "port (1-65535) to listen on; the server is off unless set, and needn't be 22 if the host's sshd uses that")
 	hostKey = flag.String("hostkey", "", "SSH host key")
+
+	allowLocalUsers = flag.String("allow-local-users", "", "comma-separated local user names that clients may log in as, or * for any")
+	allowLogins     = flag.String("allow-logins", "", "comma-separated tailnet login names (such as alice@example.com) that may connect; ACL tags aren't supported, as there are no control-verified tags to check them against")
+
+	allowAgentForwarding = flag.Bool("allow-agent-forwarding", false, "allow clients to forward their SSH agent to sessions")
 )
 
+// policy is the sshPolicy from the command-line flags, set by main.
+var policy sshPolicy
+
 func main() {
 	flag.Parse()
+	if *port == 0 {
+		log.Fatalf("no --port given; the SSH server is off")
+	}
+	if err := checkPort(*port); err != nil {
+		log.Fatal(err)
+	}
 	if *hostKey == "" {
 		log.Fatalf("missing required --hostkey")
 	}
+	policy = sshPolicy{
+		localUsers: splitList(*allowLocalUsers),
+		logins:     splitList(*allowLogins),
+	}
+	if err := checkLogins(policy.logins); err != nil {
+		log.Fatalf("--allow-logins: %v", err)
+	}
+	if len(policy.localUsers) == 0 || len(policy.logins) == 0 {
+		log.Printf("warning: no --allow-local-users or --allow-logins; all sessions will be rejected")
+	}
 	hostKey, err := ioutil.ReadFile(*hostKey)
 	if err != nil {
 		log.Fatal(err)
@@ -83,13 +120,8 @@ func main() {
 				break
 			}
 		}
-		listen := net.JoinHostPort(addr.String(), fmt.Sprint(*port))
-		log.Printf("tailscale ssh server listening on %v, %v", iface.Name, listen)
-		s := &ssh.Server{
-			Addr:    listen,
-			Handler: handleSSH,
-		}
-		s.AddHostKey(signer)
+		s := newServer(addr, uint16(*port), signer)
+		log.Printf("tailscale ssh server listening on %v, %v", iface.Name, s.Addr)
 
 		err = s.ListenAndServe()
 		log.Fatalf("tailscale sshd failed: %v", err)
@@ -97,8 +129,26 @@ func main() {
 
 }
 
+// checkPort returns an error if p isn't a valid --port.
+func checkPort(p int) error {
+	if p < 1 || p > 65535 {
+		return fmt.Errorf("invalid --port %d; want 1-65535", p)
+	}
+	return nil
+}
+
+// newServer returns the SSH server for the Tailscale address ip and
+// port, with the host key signer.
+func newServer(ip netaddr.IP, port uint16, signer ssh.Signer) *ssh.Server {
+	s := &ssh.Server{
+		Addr:    netaddr.IPPortFrom(ip, port).String(),
+		Handler: handleSSH,
+	}
+	s.AddHostKey(signer)
+	return s
+}
+
 func handleSSH(s ssh.Session) {
-	user := s.User()
 	addr := s.RemoteAddr()
 	ta, ok := addr.(*net.TCPAddr)
 	if !ok {
@@ -118,25 +168,165 @@ func handleSSH(s ssh.Session) {
 		return
 	}
 
-	log.Printf("new session for %q from %v", user, ta)
-	defer log.Printf("closing session for %q from %v", user, ta)
-	ptyReq, winCh, isPty := s.Pty()
-	if !isPty {
-		fmt.Fprintf(s, "TODO scp etc")
+	serveSession(s, netaddr.IPPortFrom(tanetaddr, uint16(ta.Port)))
+}
+
+// serveSession checks the session s from the Tailscale address src
+// against policy, logging the decision, and runs it if it's allowed.
+func serveSession(s ssh.Session, src netaddr.IPPort) {
+	user := s.User()
+	pi, known := resolvePeer(src)
+	peer := describePeer(src, pi, known)
+	if ok, why := policy.check(user, pi, known); !ok {
+		log.Printf("rejecting session for %q from %v: %s", user, peer, why)
+		fmt.Fprintln(s.Stderr(), "tsshd: access denied")
 		s.Exit(1)
 		return
 	}
+	log.Printf("new session for %q from %v", user, peer)
+	defer log.Printf("closing session for %q from %v", user, peer)
+	handleSession(s)
+}
+
+// peerInfo is what tailscaled knows about the node at a Tailscale
+// address.
+type peerInfo struct {
+	node  string // node name, without trailing dot
+	login string // login name of the node's user, or empty
+}
+
+// resolvePeer returns what the local tailscaled knows about the node
+// at the Tailscale address src. It reports false if the node is
+// unknown.
+//
+// It's a variable for tests.
+var resolvePeer = func(src netaddr.IPPort) (pi peerInfo, ok bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	res, err := tailscale.WhoIs(ctx, src.String())
+	if err != nil {
+		return peerInfo{}, false
+	}
+	return peerInfoFromWhoIs(res)
+}
+
+// peerInfoFromWhoIs returns the peerInfo for the WhoIs response res.
+// It reports false if res doesn't name a node.
+//
+// Only identity assigned by control is used. In particular, the tags
+// in res.Node.Hostinfo.RequestTags are set by the peer itself and are
+// ignored.
+func peerInfoFromWhoIs(res *apitype.WhoIsResponse) (pi peerInfo, ok bool) {
+	if res == nil || res.Node == nil {
+		return peerInfo{}, false
+	}
+	pi.node = strings.TrimSuffix(res.Node.Name, ".")
+	if res.UserProfile != nil {
+		pi.login = res.UserProfile.LoginName
+	}
+	return pi, true
+}
+
+// describePeer returns src, with its node name and login prepended if
+// they're known, for logging.
+func describePeer(src netaddr.IPPort, pi peerInfo, known bool) string {
+	switch {
+	case !known:
+		return src.String()
+	case pi.login == "":
+		return fmt.Sprintf("%s (%v)", pi.node, src)
+	default:
+		return fmt.Sprintf("%s/%s (%v)", pi.login, pi.node, src)
+	}
+}
+
+// sshPolicy is which sessions tsshd accepts. The zero value rejects
+// everything.
+type sshPolicy struct {
+	localUsers []string // user names clients may log in as; "*" means any
+	logins     []string // tailnet login names that may connect
+}
+
+// check reports whether a session for the local user user may be
+// started by the peer pi, which is known if tailscaled could resolve
+// it. If not, why says why not.
+func (p *sshPolicy) check(user string, pi peerInfo, known bool) (ok bool, why string) {
+	if !contains(p.localUsers, user) && !contains(p.localUsers, "*") {
+		return false, fmt.Sprintf("local user %q not allowed", user)
+	}
+	if !known {
+		return false, "unknown peer"
+	}
+	if pi.login != "" && contains(p.logins, pi.login) {
+		return true, ""
+	}
+	return false, "peer's login not allowed"
+}
 
-	userWantsShell := len(s.Command()) == 0
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// checkLogins returns an error if logins, the --allow-logins list,
+// names an ACL tag, which would never match.
+func checkLogins(logins []string) error {
+	for _, l := range logins {
+		if strings.HasPrefix(l, "tag:") {
+			return fmt.Errorf("%q is an ACL tag; nodes can't be allowed by tag, as there are no control-verified tags to check", l)
+		}
+	}
+	return nil
+}
 
-	if userWantsShell {
-		shell, err := shellOfUser(s.User())
+// splitList splits the comma-separated flag value s, ignoring empty
+// elements and surrounding space.
+func splitList(s string) []string {
+	var ret []string
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			ret = append(ret, f)
+		}
+	}
+	return ret
+}
+
+// handleSession runs the shell or command requested by s, under a pty
+// if the client asked for one, and exits s with its exit code.
+//
+// The ssh package calls the handler once per session channel, so a
+// client multiplexing several sessions over one connection (as with
+// OpenSSH's ControlMaster) gets an independent process, pty and exit
+// code for each; nothing here is shared between sessions.
+func handleSession(s ssh.Session) {
+	shell, err := shellOfUser(s.User())
+	if err != nil {
+		fmt.Fprintf(s, "failed to find shell: %v\n", err)
+		s.Exit(1)
+		return
+	}
+	var cmd *exec.Cmd
+	if rawCmd := s.RawCommand(); rawCmd != "" {
+		cmd = exec.Command(shell, "-c", rawCmd)
+	} else {
+		cmd = exec.Command(shell)
+	}
+	if *allowAgentForwarding && ssh.AgentRequested(s) {
+		sock, cleanup, err := forwardAgent(s)
 		if err != nil {
-			fmt.Fprintf(s, "failed to find shell: %v\n", err)
-			s.Exit(1)
-			return
+			log.Printf("forwarding agent: %v", err)
+		} else {
+			defer cleanup()
+			cmd.Env = append(cmd.Env, "SSH_AUTH_SOCK="+sock)
 		}
-		cmd := exec.Command(shell)
+	}
+
+	ptyReq, winCh, isPty := s.Pty()
+	if isPty {
 		cmd.Env = append(cmd.Env, fmt.Sprintf("TERM=%s", ptyReq.Term))
 		f, err := pty.Start(cmd)
 		if err != nil {
@@ -155,15 +345,57 @@ func handleSSH(s ssh.Session) {
 		}()
 		io.Copy(s, f) // stdout
 		cmd.Process.Kill()
-		if err := cmd.Wait(); err != nil {
+	} else {
+		// Copy stdin ourselves, rather than setting cmd.Stdin,
+		// so Wait doesn't wait for a client that never closes
+		// its end.
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			log.Printf("running command: %v", err)
 			s.Exit(1)
+			return
 		}
-		s.Exit(0)
-		return
+		cmd.Stdout = s
+		cmd.Stderr = s.Stderr()
+		if err := cmd.Start(); err != nil {
+			fmt.Fprintf(s.Stderr(), "failed to start command: %v\n", err)
+			s.Exit(1)
+			return
+		}
+		go func() {
+			io.Copy(stdin, s)
+			stdin.Close()
+		}()
+	}
+	s.Exit(exitCode(cmd.Wait()))
+}
+
+// exitCode returns the exit code to report for a command that
+// finished with err, as returned by exec.Cmd.Wait.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if ee, ok := err.(*exec.ExitError); ok && ee.ExitCode() >= 0 {
+		return ee.ExitCode()
 	}
+	return 1
+}
 
-	fmt.Fprintf(s, "TODO: args\n")
-	s.Exit(1)
+// forwardAgent starts forwarding connections on a new unix socket to
+// the client's SSH agent over s. It returns the socket's path and a
+// func to remove it when the session ends.
+func forwardAgent(s ssh.Session) (sock string, cleanup func(), err error) {
+	l, err := ssh.NewAgentListener()
+	if err != nil {
+		return "", nil, err
+	}
+	sock = l.Addr().String()
+	go ssh.ForwardAgentConnections(l, s)
+	return sock, func() {
+		l.Close()
+		os.RemoveAll(filepath.Dir(sock))
+	}, nil
 }
 
 func shellOfUser(user string) (string, error) {
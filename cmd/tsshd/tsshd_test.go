@@ -0,0 +1,453 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"inet.af/netaddr"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+func TestForwardAgent(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	sockc := make(chan string, 1)
+	srv := &ssh.Server{
+		Handler: func(s ssh.Session) {
+			if !ssh.AgentRequested(s) {
+				fmt.Fprintln(s, "agent not requested")
+				s.Exit(1)
+				return
+			}
+			sock, cleanup, err := forwardAgent(s)
+			if err != nil {
+				fmt.Fprintln(s, err)
+				s.Exit(1)
+				return
+			}
+			defer cleanup()
+			sockc <- sock
+
+			// Dialing the socket opens an agent channel back to the
+			// client.
+			c, err := net.Dial("unix", sock)
+			if err != nil {
+				fmt.Fprintln(s, err)
+				s.Exit(1)
+				return
+			}
+			defer c.Close()
+			keys, err := agent.NewClient(c).List()
+			if err != nil {
+				fmt.Fprintln(s, err)
+				s.Exit(1)
+				return
+			}
+			fmt.Fprintf(s, "%d keys", len(keys))
+			s.Exit(0)
+		},
+	}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: priv}); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := gossh.Dial("tcp", ln.Addr().String(), &gossh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := agent.ForwardToAgent(client, keyring); err != nil {
+		t.Fatal(err)
+	}
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	if err := agent.RequestAgentForwarding(sess); err != nil {
+		t.Fatalf("agent forwarding request rejected: %v", err)
+	}
+	out, err := sess.CombinedOutput("")
+	if err != nil {
+		t.Fatalf("session: %v, %s", err, out)
+	}
+	if got, want := string(out), "1 keys"; got != want {
+		t.Errorf("output = %q; want %q", got, want)
+	}
+
+	// The agent socket is removed when the session ends, which
+	// may be just after the client sees the exit status.
+	sock := <-sockc
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := os.Stat(sock)
+		if os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("agent socket %s still exists after session end; stat err = %v", sock, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNonDefaultPort(t *testing.T) {
+	// Find a free port, which won't be 22.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := uint16(ln.Addr().(*net.TCPAddr).Port)
+	ln.Close()
+	if err := checkPort(int(port)); err != nil {
+		t.Fatal(err)
+	}
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(netaddr.IPv4(127, 0, 0, 1), port, signer)
+	if want := fmt.Sprintf("127.0.0.1:%d", port); srv.Addr != want {
+		t.Fatalf("Addr = %q; want %q", srv.Addr, want)
+	}
+	srv.Handler = func(s ssh.Session) {
+		fmt.Fprint(s, "hello")
+		s.Exit(0)
+	}
+	go srv.ListenAndServe()
+	defer srv.Close()
+
+	var client *gossh.Client
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		client, err = gossh.Dial("tcp", srv.Addr, &gossh.ClientConfig{
+			User:            "test",
+			HostKeyCallback: gossh.FixedHostKey(signer.PublicKey()),
+		})
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("dialing %v: %v", srv.Addr, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer client.Close()
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	out, err := sess.CombinedOutput("")
+	if err != nil {
+		t.Fatalf("session: %v, %s", err, out)
+	}
+	if got, want := string(out), "hello"; got != want {
+		t.Errorf("output = %q; want %q", got, want)
+	}
+}
+
+func TestCheckPort(t *testing.T) {
+	for _, p := range []int{1, 22, 2222, 65535} {
+		if err := checkPort(p); err != nil {
+			t.Errorf("checkPort(%d) = %v; want nil", p, err)
+		}
+	}
+	for _, p := range []int{-1, 0, 65536, 100000} {
+		if err := checkPort(p); err == nil {
+			t.Errorf("checkPort(%d) = nil; want error", p)
+		}
+	}
+}
+
+func TestConcurrentSessions(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	srv := &ssh.Server{Handler: handleSession}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	client, err := gossh.Dial("tcp", ln.Addr().String(), &gossh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Two sessions on the one connection, overlapping in time,
+	// each with its own output and exit code.
+	tests := []struct {
+		cmd      string
+		wantOut  string
+		wantCode int
+	}{
+		{"sleep 0.5; echo one; exit 3", "one\n", 3},
+		{"echo two", "two\n", 0},
+	}
+	type result struct {
+		out  string
+		code int
+		err  error
+	}
+	results := make([]chan result, len(tests))
+	for i, tt := range tests {
+		results[i] = make(chan result, 1)
+		sess, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer sess.Close()
+		go func(sess *gossh.Session, cmd string, resc chan<- result) {
+			out, err := sess.Output(cmd)
+			code := 0
+			if ee, ok := err.(*gossh.ExitError); ok {
+				code, err = ee.ExitStatus(), nil
+			}
+			resc <- result{string(out), code, err}
+		}(sess, tt.cmd, results[i])
+	}
+	for i, tt := range tests {
+		res := <-results[i]
+		if res.err != nil {
+			t.Errorf("%q: %v", tt.cmd, res.err)
+			continue
+		}
+		if res.out != tt.wantOut || res.code != tt.wantCode {
+			t.Errorf("%q: output %q, exit code %d; want %q, %d", tt.cmd, res.out, res.code, tt.wantOut, tt.wantCode)
+		}
+	}
+}
+
+func TestSessionLogsPeerName(t *testing.T) {
+	defer func(old func(netaddr.IPPort) (peerInfo, bool)) { resolvePeer = old }(resolvePeer)
+	known := netaddr.MustParseIPPort("100.101.102.103:41000")
+	resolvePeer = func(src netaddr.IPPort) (peerInfo, bool) {
+		if src == known {
+			return peerInfo{node: "laptop.example.ts.net", login: "alice@example.com"}, true
+		}
+		return peerInfo{}, false
+	}
+	defer func(old sshPolicy) { policy = old }(policy)
+	policy = sshPolicy{localUsers: []string{"*"}, logins: []string{"alice@example.com"}}
+
+	var buf syncBuffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// Each session claims to come from the address named by its
+	// user, as the listener's remote addresses are all loopback.
+	srv := &ssh.Server{Handler: func(s ssh.Session) {
+		serveSession(s, netaddr.MustParseIPPort(s.User()))
+	}}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	unknown := netaddr.MustParseIPPort("100.64.0.9:41001")
+	for _, src := range []netaddr.IPPort{known, unknown} {
+		client, err := gossh.Dial("tcp", ln.Addr().String(), &gossh.ClientConfig{
+			User:            src.String(),
+			HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sess, err := client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := sess.CombinedOutput("true")
+		if src == known && err != nil {
+			t.Fatalf("session: %v, %s", err, out)
+		}
+		if src == unknown && err == nil {
+			t.Fatalf("session from unknown peer succeeded")
+		}
+		client.Close()
+	}
+
+	// The closing line is logged after the client sees the exit
+	// status, so wait for it.
+	want := []string{
+		`new session for "100.101.102.103:41000" from alice@example.com/laptop.example.ts.net (100.101.102.103:41000)`,
+		`closing session for "100.101.102.103:41000" from alice@example.com/laptop.example.ts.net (100.101.102.103:41000)`,
+		`rejecting session for "100.64.0.9:41001" from 100.64.0.9:41001: unknown peer`,
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := buf.String()
+		missing := ""
+		for _, w := range want {
+			if !strings.Contains(got, w) {
+				missing = w
+				break
+			}
+		}
+		if missing == "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("log missing %q; got:\n%s", missing, got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSSHPolicy(t *testing.T) {
+	p := sshPolicy{
+		localUsers: []string{"deploy", "root"},
+		logins:     []string{"alice@example.com"},
+	}
+	alice := peerInfo{node: "laptop", login: "alice@example.com"}
+	bob := peerInfo{node: "desktop", login: "bob@example.com"}
+	// Tagged nodes have no verified tags to be allowed by, so
+	// they're rejected however they're tagged.
+	tagged := peerInfo{node: "ci", login: "tagged-devices"}
+	tests := []struct {
+		name   string
+		policy sshPolicy
+		user   string
+		peer   peerInfo
+		known  bool
+		want   bool
+	}{
+		{"allowed_login", p, "deploy", alice, true, true},
+		{"allowed_user_disallowed_login", p, "deploy", bob, true, false},
+		{"disallowed_user_allowed_login", p, "mallory", alice, true, false},
+		{"tagged_node", p, "deploy", tagged, true, false},
+		{"tagged_node_any_user", sshPolicy{localUsers: []string{"*"}, logins: p.logins}, "deploy", tagged, true, false},
+		{"unknown_source_ip", p, "deploy", peerInfo{}, false, false},
+		{"any_user", sshPolicy{localUsers: []string{"*"}, logins: p.logins}, "mallory", alice, true, true},
+		{"zero_policy", sshPolicy{}, "deploy", alice, true, false},
+		{"no_sources", sshPolicy{localUsers: []string{"*"}}, "deploy", alice, true, false},
+	}
+	for _, tt := range tests {
+		ok, why := tt.policy.check(tt.user, tt.peer, tt.known)
+		if ok != tt.want {
+			t.Errorf("%s: check = %v (%q); want %v", tt.name, ok, why, tt.want)
+		}
+		if !ok && why == "" {
+			t.Errorf("%s: rejected without a reason", tt.name)
+		}
+	}
+}
+
+func TestPeerInfoIgnoresRequestedTags(t *testing.T) {
+	// A node may put any tag it likes in its Hostinfo.RequestTags;
+	// that's a request to control, not a grant, so it mustn't let
+	// the node in.
+	res := &apitype.WhoIsResponse{
+		Node: &tailcfg.Node{
+			Name: "mallory.example.ts.net.",
+			Hostinfo: tailcfg.Hostinfo{
+				RequestTags: []string{"tag:admin"},
+			},
+		},
+		UserProfile: &tailcfg.UserProfile{LoginName: "mallory@example.com"},
+	}
+	pi, ok := peerInfoFromWhoIs(res)
+	if !ok {
+		t.Fatal("peerInfoFromWhoIs = false; want true")
+	}
+	if want := (peerInfo{node: "mallory.example.ts.net", login: "mallory@example.com"}); pi != want {
+		t.Errorf("peerInfoFromWhoIs = %+v; want %+v", pi, want)
+	}
+	p := sshPolicy{
+		localUsers: []string{"*"},
+		logins:     []string{"alice@example.com"},
+	}
+	if ok, _ := p.check("root", pi, true); ok {
+		t.Error("peer that only requested tag:admin was allowed")
+	}
+
+	if _, ok := peerInfoFromWhoIs(&apitype.WhoIsResponse{}); ok {
+		t.Error("peerInfoFromWhoIs of response without node = true; want false")
+	}
+}
+
+func TestCheckLogins(t *testing.T) {
+	if err := checkLogins([]string{"alice@example.com", "bob@example.com"}); err != nil {
+		t.Errorf("logins: %v", err)
+	}
+	if err := checkLogins([]string{"alice@example.com", "tag:admin"}); err == nil {
+		t.Error("tag:admin accepted; want error")
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	got := splitList(" a@example.com, ,tag:x,")
+	want := []string{"a@example.com", "tag:x"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("splitList = %q; want %q", got, want)
+	}
+	if got := splitList(""); got != nil {
+		t.Errorf("splitList(\"\") = %q; want nil", got)
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
@@ -676,6 +676,19 @@ func (c *Auto) UpdateEndpoints(localPort uint16, endpoints []tailcfg.Endpoint) {
 	}
 }
 
+// GoingAway implements Client.GoingAway. It does nothing if the client
+// isn't logged in or has already been shut down.
+func (c *Auto) GoingAway(ctx context.Context) error {
+	c.mu.Lock()
+	loggedIn := c.loggedIn
+	closed := c.closed
+	c.mu.Unlock()
+	if !loggedIn || closed {
+		return nil
+	}
+	return c.direct.SendGoingAway(ctx)
+}
+
 func (c *Auto) Shutdown() {
 	c.logf("client.Shutdown()")
 
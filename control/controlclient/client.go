@@ -77,4 +77,9 @@ type Client interface {
 	// SetDNS sends the SetDNSRequest request to the control plane server,
 	// requesting a DNS record be created or updated.
 	SetDNS(context.Context, *tailcfg.SetDNSRequest) error
+	// GoingAway tells the control server, on a best effort basis,
+	// that this node is about to disconnect, so its peers stop trying
+	// to reach it directly. It's meant to be called just before
+	// Shutdown.
+	GoingAway(context.Context) error
 }
@@ -47,6 +47,7 @@ import (
 	"tailscale.com/types/opt"
 	"tailscale.com/types/persist"
 	"tailscale.com/types/wgkey"
+	"tailscale.com/util/crashpoint"
 	"tailscale.com/util/systemd"
 	"tailscale.com/wgengine/monitor"
 )
@@ -546,6 +547,16 @@ func (c *Direct) SendLiteMapUpdate(ctx context.Context) error {
 	return c.sendMapRequest(ctx, 1, nil)
 }
 
+// SendGoingAway sends a lite map update with no endpoints, telling the
+// server that this node is about to disconnect so its peers stop
+// trying to reach it directly.
+func (c *Direct) SendGoingAway(ctx context.Context) error {
+	c.mu.Lock()
+	c.endpoints = nil
+	c.mu.Unlock()
+	return c.SendLiteMapUpdate(ctx)
+}
+
 // If we go more than pollTimeout without hearing from the server,
 // end the long poll. We should be receiving a keep alive ping
 // every minute.
@@ -751,6 +762,7 @@ func (c *Direct) sendMapRequest(ctx context.Context, maxPolls int, cb func(*netm
 			vlogf("netmap: got keep-alive")
 		} else {
 			vlogf("netmap: got new map")
+			crashpoint.Reached(crashpoint.MapResponse)
 		}
 		select {
 		case timeoutReset <- struct{}{}:
@@ -61,6 +61,7 @@ Login:
 Steady state:
 * server occasionally sends frameKeepAlive (or framePing)
 * client responds to any framePing with a framePong
+* client may send framePing; server responds with a framePong
 * client sends frameSendPacket
 * server then sends frameRecvPacket to recipient
 */
@@ -0,0 +1,50 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package derp
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// SetMeshPeerLatency records the latest measured round-trip latency
+// to the mesh peer (another DERP server in the same region) at host,
+// for the derp_regional_latency_seconds metric.
+func (s *Server) SetMeshPeerLatency(host string, d time.Duration) {
+	s.meshLatencyMu.Lock()
+	defer s.meshLatencyMu.Unlock()
+	if s.meshLatency == nil {
+		s.meshLatency = map[string]time.Duration{}
+	}
+	s.meshLatency[host] = d
+}
+
+// WritePrometheusMetrics writes the server's metrics to w in the
+// Prometheus text exposition format.
+func (s *Server) WritePrometheusMetrics(w io.Writer) {
+	metric := func(name, typ, help string, v int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, typ, name, v)
+	}
+	metric("derp_connections_total", "counter", "Total client connections accepted.", s.accepts.Value())
+	metric("derp_connections_current", "gauge", "Current client connections.", s.curClients.Value())
+	metric("derp_bytes_forwarded_total", "counter", "Total packet bytes forwarded to clients.", s.bytesSent.Value())
+	metric("derp_unknown_client_drops_total", "counter", "Total packets dropped because their destination client was unknown.",
+		s.packetsDroppedReasonCounters[dropReasonUnknownDest].Value()+s.packetsDroppedReasonCounters[dropReasonUnknownDestOnFwd].Value())
+
+	s.meshLatencyMu.Lock()
+	hosts := make([]string, 0, len(s.meshLatency))
+	for h := range s.meshLatency {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+	fmt.Fprintf(w, "# HELP derp_regional_latency_seconds Latest round-trip latency to each mesh peer in the region.\n# TYPE derp_regional_latency_seconds gauge\n")
+	for _, h := range hosts {
+		fmt.Fprintf(w, "derp_regional_latency_seconds{peer=%s} %v\n", strconv.Quote(h), s.meshLatency[h].Seconds())
+	}
+	s.meshLatencyMu.Unlock()
+}
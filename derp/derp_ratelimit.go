@@ -0,0 +1,94 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package derp
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/time/rate"
+	"tailscale.com/types/logger"
+)
+
+// rateLimitLogAfter is how long a client must be continuously rate
+// limited before it's logged. It's then logged at most once a minute.
+const rateLimitLogAfter = 5 * time.Second
+
+// minRateLimitBurst is the smallest token bucket size for a client's
+// bandwidth limit, so the largest frame a client can legitimately
+// send (a forwarded packet) always fits.
+const minRateLimitBurst = frameHeaderLen + 2*keyLen + MaxPacketSize
+
+// bandwidthLimiter delays a client's frames in one direction to keep
+// them within the server's per-client bandwidth limit. Frames are
+// delayed, never dropped. A nil *bandwidthLimiter means no limit.
+//
+// It's not safe for concurrent use; each direction of a client
+// connection is owned by one goroutine.
+type bandwidthLimiter struct {
+	lim  *rate.Limiter
+	dir  string // "receive" or "send", for logs
+	logf logger.Logf
+
+	limitedSince time.Time // when frames began being delayed continuously; zero if not
+	lastLog      time.Time // when the rate limiting was last logged
+}
+
+func newBandwidthLimiter(bytesPerSec int64, dir string, logf logger.Logf) *bandwidthLimiter {
+	burst := int(bytesPerSec)
+	if burst < minRateLimitBurst {
+		burst = minRateLimitBurst
+	}
+	return &bandwidthLimiter{
+		lim:  rate.NewLimiter(rate.Limit(bytesPerSec), burst),
+		dir:  dir,
+		logf: logf,
+	}
+}
+
+// reserve takes n bytes from the limit and returns how long to wait
+// before using them.
+func (l *bandwidthLimiter) reserve(n int) time.Duration {
+	if l == nil {
+		return 0
+	}
+	if b := l.lim.Burst(); n > b {
+		n = b
+	}
+	now := timeNow()
+	d := l.lim.ReserveN(now, n).DelayFrom(now)
+	if d == 0 {
+		l.limitedSince = time.Time{}
+		return 0
+	}
+	if l.limitedSince.IsZero() {
+		l.limitedSince = now
+	} else if limitedFor := now.Sub(l.limitedSince); limitedFor >= rateLimitLogAfter && now.Sub(l.lastLog) >= time.Minute {
+		l.lastLog = now
+		l.logf("rate limited to %v bytes/sec on %s for %v", l.lim.Limit(), l.dir, limitedFor.Round(time.Second))
+	}
+	return d
+}
+
+// wait blocks until n more bytes are within the limit, or until ctx
+// is done.
+func (l *bandwidthLimiter) wait(ctx context.Context, n int) error {
+	return sleepCtx(ctx, l.reserve(n))
+}
+
+// sleepCtx sleeps for d, or until ctx is done.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"context"
 	"crypto/ed25519"
 	crand "crypto/rand"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/json"
@@ -89,7 +90,8 @@ type Server struct {
 	memSys0     uint64 // runtime.MemStats.Sys at start (or early-ish)
 	meshKey     string
 	limitedLogf logger.Logf
-	metaCert    []byte // the encoded x509 cert to send after LetsEncrypt cert+intermediate
+	metaCert    []byte       // the encoded x509 cert to send after LetsEncrypt cert+intermediate
+	tlsConfig   atomic.Value // of *tls.Config; set by SetTLSConfig
 
 	// Counters:
 	_                            pad32.Four
@@ -123,10 +125,17 @@ type Server struct {
 	removePktForwardOther        expvar.Int
 	avgQueueDuration             *uint64 // In milliseconds; accessed atomically
 
+	meshLatencyMu sync.Mutex
+	meshLatency   map[string]time.Duration // mesh peer host => last measured latency
+
 	// verifyClients only accepts client connections to the DERP server if the clientKey is a
 	// known peer in the network, as specified by a running tailscaled's client's local api.
 	verifyClients bool
 
+	// maxClientBytesPerSec, if non-zero, limits the bandwidth of
+	// each non-mesh client connection in each direction.
+	maxClientBytesPerSec int64
+
 	mu       sync.Mutex
 	closed   bool
 	netConns map[Conn]chan struct{} // chan is closed when conn closes
@@ -224,6 +233,16 @@ func (s *Server) SetVerifyClient(v bool) {
 	s.verifyClients = v
 }
 
+// SetMaxClientBytesPerSec limits the bandwidth of each client
+// connection, separately in each direction, to v bytes per second.
+// Frames over the limit are delayed rather than dropped. Zero, the
+// default, means unlimited. Mesh peers aren't limited.
+//
+// It must be called before serving begins.
+func (s *Server) SetMaxClientBytesPerSec(v int64) {
+	s.maxClientBytesPerSec = v
+}
+
 // HasMeshKey reports whether the server is configured with a mesh key.
 func (s *Server) HasMeshKey() bool { return s.meshKey != "" }
 
@@ -342,6 +361,43 @@ func (s *Server) initMetacert() {
 // TLS server to let the client skip a round trip during start-up.
 func (s *Server) MetaCert() []byte { return s.metaCert }
 
+// SetTLSConfig sets the TLS config whose certificate GetCertificate
+// returns. Unlike the other setters, it may be called while serving,
+// to rotate certificates without a restart: new TLS handshakes use
+// cfg, while established connections are unaffected.
+func (s *Server) SetTLSConfig(cfg *tls.Config) {
+	s.tlsConfig.Store(cfg)
+}
+
+// GetCertificate returns the certificate for a TLS handshake from the
+// config most recently passed to SetTLSConfig, with the server's
+// metacert (see MetaCert) appended. It's for use as a
+// tls.Config.GetCertificate func.
+func (s *Server) GetCertificate(hi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cfg, _ := s.tlsConfig.Load().(*tls.Config)
+	if cfg == nil {
+		return nil, errors.New("derp: no TLS config set")
+	}
+	var cert *tls.Certificate
+	if cfg.GetCertificate != nil {
+		var err error
+		cert, err = cfg.GetCertificate(hi)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cert == nil {
+		if len(cfg.Certificates) == 0 {
+			return nil, errors.New("derp: TLS config has no certificates")
+		}
+		cert = &cfg.Certificates[0]
+	}
+	// Append to a copy, as cert may be shared by other handshakes.
+	c := *cert
+	c.Certificate = append(c.Certificate[:len(c.Certificate):len(c.Certificate)], s.metaCert)
+	return &c, nil
+}
+
 // registerClient notes that client c is now authenticated and ready for packets.
 //
 // If c's public key was already connected with a different
@@ -502,6 +558,7 @@ func (s *Server) accept(nc Conn, brw *bufio.ReadWriter, remoteAddr string, connN
 		sendQueue:      make(chan pkt, perClientSendQueueDepth),
 		discoSendQueue: make(chan pkt, perClientSendQueueDepth),
 		peerGone:       make(chan key.Public),
+		sendPongCh:     make(chan [8]byte, 1),
 		canMesh:        clientInfo.MeshKey != "" && clientInfo.MeshKey == s.meshKey,
 
 		// Allow kicking out previous connections once a
@@ -514,6 +571,10 @@ func (s *Server) accept(nc Conn, brw *bufio.ReadWriter, remoteAddr string, connN
 	if c.canMesh {
 		c.meshUpdate = make(chan struct{})
 	}
+	if v := s.maxClientBytesPerSec; v > 0 && !c.canMesh {
+		c.recvLimiter = newBandwidthLimiter(v, "receive", c.logf)
+		c.sendLimiter = newBandwidthLimiter(v, "send", c.logf)
+	}
 	if clientInfo != nil {
 		c.info = *clientInfo
 	}
@@ -570,6 +631,9 @@ func (c *sclient) run(ctx context.Context) error {
 			}
 			return fmt.Errorf("client %x: readFrameHeader: %w", c.key, err)
 		}
+		if err := c.recvLimiter.wait(ctx, frameHeaderLen+int(fl)); err != nil {
+			return nil // server or connection closing
+		}
 		switch ft {
 		case frameNotePreferred:
 			err = c.handleFrameNotePreferred(ft, fl)
@@ -581,6 +645,8 @@ func (c *sclient) run(ctx context.Context) error {
 			err = c.handleFrameWatchConns(ft, fl)
 		case frameClosePeer:
 			err = c.handleFrameClosePeer(ft, fl)
+		case framePing:
+			err = c.handleFramePing(ft, fl)
 		default:
 			err = c.handleUnknownFrame(ft, fl)
 		}
@@ -595,6 +661,27 @@ func (c *sclient) handleUnknownFrame(ft frameType, fl uint32) error {
 	return err
 }
 
+func (c *sclient) handleFramePing(ft frameType, fl uint32) error {
+	var m PingMessage
+	if fl < uint32(len(m)) {
+		return fmt.Errorf("short ping: %v", fl)
+	}
+	if _, err := io.ReadFull(c.br, m[:]); err != nil {
+		return err
+	}
+	if extra := int64(fl) - int64(len(m)); extra > 0 {
+		if _, err := io.CopyN(ioutil.Discard, c.br, extra); err != nil {
+			return err
+		}
+	}
+	select {
+	case c.sendPongCh <- [8]byte(m):
+	default:
+		// They're pinging faster than we can reply. Drop it.
+	}
+	return nil
+}
+
 func (c *sclient) handleFrameNotePreferred(ft frameType, fl uint32) error {
 	if fl != 1 {
 		return fmt.Errorf("frameNotePreferred wrong size")
@@ -986,6 +1073,7 @@ type sclient struct {
 	discoSendQueue chan pkt        // important packets queued to this client; never closed
 	peerGone       chan key.Public // write request that a previous sender has disconnected (not used by mesh peers)
 	meshUpdate     chan struct{}   // write request to write peerStateChange
+	sendPongCh     chan [8]byte    // pong replies to send to the client; never closed
 	canMesh        bool            // clientInfo had correct mesh token for inter-region routing
 
 	// replaceLimiter controls how quickly two connections with
@@ -997,9 +1085,11 @@ type sclient struct {
 	br          *bufio.Reader
 	connectedAt time.Time
 	preferred   bool
+	recvLimiter *bandwidthLimiter // nil means unlimited
 
 	// Owned by sender, not thread-safe.
-	bw *lazyBufioWriter
+	bw          *lazyBufioWriter
+	sendLimiter *bandwidthLimiter // nil means unlimited
 
 	// Guarded by s.mu
 	//
@@ -1114,13 +1204,14 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 		case <-c.meshUpdate:
 			werr = c.sendMeshUpdates()
 			continue
+		case data := <-c.sendPongCh:
+			werr = c.sendPong(data)
+			continue
 		case msg := <-c.sendQueue:
-			werr = c.sendPacket(msg.src, msg.bs)
-			c.recordQueueTime(msg.enqueuedAt)
+			werr = c.sendQueuedPacket(ctx, msg)
 			continue
 		case msg := <-c.discoSendQueue:
-			werr = c.sendPacket(msg.src, msg.bs)
-			c.recordQueueTime(msg.enqueuedAt)
+			werr = c.sendQueuedPacket(ctx, msg)
 			continue
 		case <-keepAliveTick.C:
 			werr = c.sendKeepAlive()
@@ -1142,18 +1233,36 @@ func (c *sclient) sendLoop(ctx context.Context) error {
 		case <-c.meshUpdate:
 			werr = c.sendMeshUpdates()
 			continue
+		case data := <-c.sendPongCh:
+			werr = c.sendPong(data)
 		case msg := <-c.sendQueue:
-			werr = c.sendPacket(msg.src, msg.bs)
-			c.recordQueueTime(msg.enqueuedAt)
+			werr = c.sendQueuedPacket(ctx, msg)
 		case msg := <-c.discoSendQueue:
-			werr = c.sendPacket(msg.src, msg.bs)
-			c.recordQueueTime(msg.enqueuedAt)
+			werr = c.sendQueuedPacket(ctx, msg)
 		case <-keepAliveTick.C:
 			werr = c.sendKeepAlive()
 		}
 	}
 }
 
+// sendQueuedPacket sends p, without flushing, after first waiting
+// for the client's bandwidth limit, if any. Writes buffered so far
+// are flushed before waiting.
+func (c *sclient) sendQueuedPacket(ctx context.Context, p pkt) error {
+	if d := c.sendLimiter.reserve(frameHeaderLen + keyLen + len(p.bs)); d > 0 {
+		if err := c.bw.Flush(); err != nil {
+			return err
+		}
+		if err := sleepCtx(ctx, d); err != nil {
+			c.s.recordDrop(p.bs, p.src, c.key, dropReasonGone)
+			return nil // sendLoop sees ctx is done
+		}
+	}
+	err := c.sendPacket(p.src, p.bs)
+	c.recordQueueTime(p.enqueuedAt)
+	return err
+}
+
 func (c *sclient) setWriteDeadline() {
 	c.nc.SetWriteDeadline(time.Now().Add(writeTimeout))
 }
@@ -1164,6 +1273,16 @@ func (c *sclient) sendKeepAlive() error {
 	return writeFrameHeader(c.bw.bw(), frameKeepAlive, 0)
 }
 
+// sendPong sends a pong reply, without flushing.
+func (c *sclient) sendPong(data [8]byte) error {
+	c.setWriteDeadline()
+	if err := writeFrameHeader(c.bw.bw(), framePong, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err := c.bw.Write(data[:])
+	return err
+}
+
 // sendPeerGone sends a peerGone frame, without flushing.
 func (c *sclient) sendPeerGone(peer key.Public) error {
 	c.s.peerGoneFrames.Add(1)
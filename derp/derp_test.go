@@ -9,6 +9,7 @@ import (
 	"bytes"
 	"context"
 	crand "crypto/rand"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
 	"errors"
@@ -1091,3 +1092,94 @@ func TestParseSSOutput(t *testing.T) {
 		t.Errorf("parseSSOutput expected non-empty map")
 	}
 }
+
+func TestBandwidthLimiter(t *testing.T) {
+	defer func() { timeNow = time.Now }()
+	now := time.Unix(123, 0)
+	timeNow = func() time.Time { return now }
+
+	var logs []string
+	logf := func(format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+
+	const bps = 1 << 20
+	l := newBandwidthLimiter(bps, "send", logf)
+	if d := l.reserve(bps); d != 0 {
+		t.Fatalf("first burst delayed %v; want 0", d)
+	}
+	if d := l.reserve(bps / 2); d != 500*time.Millisecond {
+		t.Fatalf("over limit delayed %v; want 500ms", d)
+	}
+
+	// Stay over the limit for a while; the limiter should log,
+	// but only once.
+	for i := 0; i < 20; i++ {
+		now = now.Add(500 * time.Millisecond)
+		if d := l.reserve(bps); d == 0 {
+			t.Fatalf("step %d: not delayed", i)
+		}
+	}
+	if len(logs) != 1 {
+		t.Errorf("got %d logs; want 1: %q", len(logs), logs)
+	}
+
+	// Once the client slows down, it isn't delayed.
+	now = now.Add(time.Minute)
+	if d := l.reserve(1000); d != 0 {
+		t.Errorf("after idle delayed %v; want 0", d)
+	}
+
+	// Frames larger than the bucket are still allowed through.
+	small := newBandwidthLimiter(1, "receive", logf)
+	if d := small.reserve(frameHeaderLen + keyLen + MaxPacketSize); d != 0 {
+		t.Errorf("max frame delayed %v on fresh limiter; want 0", d)
+	}
+
+	var nilLimiter *bandwidthLimiter
+	if err := nilLimiter.wait(context.Background(), 1<<30); err != nil {
+		t.Errorf("nil limiter wait: %v", err)
+	}
+}
+
+func TestServerGetCertificate(t *testing.T) {
+	s := NewServer(newPrivateKey(t), t.Logf)
+	defer s.Close()
+
+	if _, err := s.GetCertificate(&tls.ClientHelloInfo{}); err == nil {
+		t.Fatal("got certificate before SetTLSConfig")
+	}
+
+	check := func(want byte) {
+		t.Helper()
+		cert, err := s.GetCertificate(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cert.Certificate) != 2 {
+			t.Fatalf("got %d certs; want leaf and metacert", len(cert.Certificate))
+		}
+		if got := cert.Certificate[0][0]; got != want {
+			t.Errorf("leaf = %d; want %d", got, want)
+		}
+		if !bytes.Equal(cert.Certificate[1], s.MetaCert()) {
+			t.Errorf("second cert isn't the metacert")
+		}
+	}
+
+	cfg1 := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{{1}}}}}
+	s.SetTLSConfig(cfg1)
+	check(1)
+	check(1)
+	if n := len(cfg1.Certificates[0].Certificate); n != 1 {
+		t.Errorf("SetTLSConfig's config was modified; has %d certs", n)
+	}
+
+	// Rotating takes effect for the next handshake.
+	s.SetTLSConfig(&tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &tls.Certificate{Certificate: [][]byte{{2}}}, nil
+		},
+	})
+	check(2)
+}
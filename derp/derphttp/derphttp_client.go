@@ -13,6 +13,7 @@ package derphttp
 import (
 	"bufio"
 	"context"
+	crand "crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
@@ -56,6 +57,19 @@ type Client struct {
 	logf       logger.Logf
 	dialer     func(ctx context.Context, network, addr string) (net.Conn, error)
 
+	// lookupIP, if non-nil, resolves DERP node hostnames instead of
+	// the system resolver. It's for tests.
+	lookupIP func(ctx context.Context, host string) ([]netaddr.IP, error)
+
+	// dialNodeAddr, if non-nil, dials DERP nodes instead of the
+	// system dialer. It's for tests.
+	dialNodeAddr func(ctx context.Context, proto, addr string) (net.Conn, error)
+
+	// addrMu guards nodeAddrs. It's separate from mu because mu is
+	// held for the duration of connect, including dials.
+	addrMu    sync.Mutex
+	nodeAddrs map[string]*nodeAddrState // keyed by DERP node hostname
+
 	// Either url or getRegion is non-nil:
 	url       *url.URL
 	getRegion func() *tailcfg.DERPRegion
@@ -71,6 +85,45 @@ type Client struct {
 	client       *derp.Client
 	connGen      int // incremented once per new connection; valid values are >0
 	serverPubKey key.Public
+	pingOut      map[[8]byte]chan struct{} // outstanding pings, closed on pong
+	latency      time.Duration             // EWMA of ping round-trip times; 0 until measured
+
+	pingLoopOnce sync.Once
+}
+
+const (
+	// latencyPingInterval is how often a connected Client pings
+	// the server to update its Latency.
+	latencyPingInterval = 30 * time.Second
+
+	// latencyPingTimeout is how long the periodic pings wait for
+	// their pong.
+	latencyPingTimeout = 5 * time.Second
+
+	// latencyEWMAAlpha is the weight of each new round-trip time
+	// sample in Latency.
+	latencyEWMAAlpha = 0.25
+)
+
+const (
+	// reresolveAfterFailures is how many consecutive failed
+	// connections to a DERP node make the client stop trusting the
+	// node's static IPs (or its last resolution) and resolve its
+	// hostname again.
+	reresolveAfterFailures = 2
+
+	// nodeAddrTTL is how long a DERP node's resolved addresses are
+	// used before its hostname is resolved again.
+	nodeAddrTTL = 10 * time.Minute
+)
+
+// nodeAddrState is what a Client knows about the addresses of one
+// DERP node.
+type nodeAddrState struct {
+	fails   int        // consecutive failed connections
+	useDNS  bool       // whether to dial v4/v6 rather than the DERPMap's static IPs
+	v4, v6  netaddr.IP // last resolution of the hostname; zero if none
+	expires time.Time  // when v4 and v6 need resolving again; zero means now
 }
 
 // NewRegionClient returns a new DERP-over-HTTP client. It connects lazily.
@@ -231,6 +284,14 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 	}()
 
 	var node *tailcfg.DERPNode // nil when using c.url to dial
+	defer func() {
+		// Once a node's dialed, count whether the rest of the
+		// connection setup worked too: a stale IP may now belong
+		// to some other server.
+		if node != nil && c.ctx.Err() == nil {
+			c.noteNodeResult(node, err == nil)
+		}
+	}()
 	if c.url != nil {
 		c.logf("%s: connecting to %v", caller, c.url)
 		tcpConn, err = c.dialURL(ctx)
@@ -361,6 +422,7 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 	c.client = derpClient
 	c.netConn = tcpConn
 	c.connGen++
+	c.pingLoopOnce.Do(func() { go c.pingLoop() })
 	return c.client, c.connGen, nil
 }
 
@@ -474,7 +536,157 @@ func (c *Client) DialRegionTLS(ctx context.Context, reg *tailcfg.DERPRegion) (tl
 	}
 }
 
+// NoteNetworkChange reports that the network changed. Failures seen
+// on the old network no longer count against nodes' static IPs, which
+// are dialed again, and nodes without them have their hostnames
+// resolved again before their next dial. The current connection, if
+// any, is closed so that the next Send or Recv redials from the new
+// network.
+func (c *Client) NoteNetworkChange() {
+	c.addrMu.Lock()
+	for _, st := range c.nodeAddrs {
+		st.fails = 0
+		st.useDNS = false
+		st.expires = time.Time{}
+	}
+	c.addrMu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.netConn != nil {
+		c.netConn.Close()
+		c.netConn = nil
+	}
+	c.client = nil
+}
+
+// nodeAddrStateLocked returns the address state for the node with
+// hostname host, creating it if needed.
+//
+// c.addrMu must be held.
+func (c *Client) nodeAddrStateLocked(host string) *nodeAddrState {
+	st, ok := c.nodeAddrs[host]
+	if !ok {
+		if c.nodeAddrs == nil {
+			c.nodeAddrs = make(map[string]*nodeAddrState)
+		}
+		st = new(nodeAddrState)
+		c.nodeAddrs[host] = st
+	}
+	return st
+}
+
+// noteNodeResult records whether connecting to n worked. After
+// reresolveAfterFailures failures in a row, n's hostname is resolved
+// again and its addresses used in place of the DERPMap's static IPs,
+// which are only hints: self-hosted DERP servers may be behind
+// dynamic DNS.
+func (c *Client) noteNodeResult(n *tailcfg.DERPNode, ok bool) {
+	if !hasDialableHostName(n) {
+		return
+	}
+	c.addrMu.Lock()
+	defer c.addrMu.Unlock()
+	st := c.nodeAddrStateLocked(n.HostName)
+	if ok {
+		st.fails = 0
+		return
+	}
+	st.fails++
+	if st.fails < reresolveAfterFailures {
+		return
+	}
+	c.logf("derphttp: %d failed connections to %s; resolving it again", st.fails, n.HostName)
+	st.fails = 0
+	st.useDNS = true
+	st.expires = time.Time{}
+}
+
+// hasDialableHostName reports whether n has a hostname that needs
+// resolving, rather than none or an IP address.
+func hasDialableHostName(n *tailcfg.DERPNode) bool {
+	if n.HostName == "" {
+		return false
+	}
+	_, err := netaddr.ParseIP(n.HostName)
+	return err != nil
+}
+
+// nodeDialAddrs returns the IPv4 and IPv6 addresses to dial for n,
+// where empty means to dial n's hostname.
+//
+// Nodes without static IPs, and nodes whose static IPs stopped
+// working (see noteNodeResult), are dialed at the addresses their
+// hostname resolved to, which are resolved again once they're older
+// than nodeAddrTTL or after a network change.
+func (c *Client) nodeDialAddrs(ctx context.Context, n *tailcfg.DERPNode) (v4, v6 string) {
+	v4, v6 = n.IPv4, n.IPv6
+	if !hasDialableHostName(n) {
+		return v4, v6
+	}
+
+	c.addrMu.Lock()
+	st := c.nodeAddrStateLocked(n.HostName)
+	useDNS := st.useDNS || (v4 == "" && v6 == "")
+	stale := !time.Now().Before(st.expires)
+	c.addrMu.Unlock()
+	if !useDNS {
+		return v4, v6
+	}
+
+	if stale {
+		ips, err := c.lookupNodeIP(ctx, n.HostName)
+		c.addrMu.Lock()
+		if err != nil {
+			// Keep using the last resolution, if any.
+			c.logf("derphttp: resolving %s: %v", n.HostName, err)
+		} else {
+			st.v4, st.v6 = netaddr.IP{}, netaddr.IP{}
+			for _, ip := range ips {
+				if ip.Is4() && st.v4.IsZero() {
+					st.v4 = ip
+				}
+				if ip.Is6() && st.v6.IsZero() {
+					st.v6 = ip
+				}
+			}
+			st.expires = time.Now().Add(nodeAddrTTL)
+		}
+		c.addrMu.Unlock()
+	}
+
+	c.addrMu.Lock()
+	defer c.addrMu.Unlock()
+	if !st.v4.IsZero() && shouldDialProto(v4, netaddr.IP.Is4) {
+		v4 = st.v4.String()
+	}
+	if !st.v6.IsZero() && shouldDialProto(v6, netaddr.IP.Is6) {
+		v6 = st.v6.String()
+	}
+	return v4, v6
+}
+
+func (c *Client) lookupNodeIP(ctx context.Context, host string) ([]netaddr.IP, error) {
+	if c.lookupIP != nil {
+		return c.lookupIP(ctx, host)
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var ips []netaddr.IP
+	for _, a := range addrs {
+		if ip, ok := netaddr.FromStdIP(a.IP); ok {
+			ips = append(ips, ip)
+		}
+	}
+	return ips, nil
+}
+
 func (c *Client) dialContext(ctx context.Context, proto, addr string) (net.Conn, error) {
+	if c.dialNodeAddr != nil {
+		return c.dialNodeAddr(ctx, proto, addr)
+	}
 	return netns.NewDialer().DialContext(ctx, proto, addr)
 }
 
@@ -498,7 +710,7 @@ const dialNodeTimeout = 1500 * time.Millisecond
 //
 // TODO(bradfitz): longer if no options remain perhaps? ...  Or longer
 // overall but have dialRegion start overlapping races?
-func (c *Client) dialNode(ctx context.Context, n *tailcfg.DERPNode) (net.Conn, error) {
+func (c *Client) dialNode(ctx context.Context, n *tailcfg.DERPNode) (_ net.Conn, err error) {
 	// First see if we need to use an HTTP proxy.
 	proxyReq := &http.Request{
 		Method: "GET", // doesn't really matter
@@ -517,6 +729,15 @@ func (c *Client) dialNode(ctx context.Context, n *tailcfg.DERPNode) (net.Conn, e
 		err error
 	}
 	resc := make(chan res) // must be unbuffered
+	addr4, addr6 := c.nodeDialAddrs(ctx, n)
+	defer func(parent context.Context) {
+		// Only count failures that weren't due to the caller
+		// giving up. Successes are counted by connect, once the
+		// whole DERP handshake worked.
+		if err != nil && parent.Err() == nil {
+			c.noteNodeResult(n, false)
+		}
+	}(ctx)
 	ctx, cancel := context.WithTimeout(ctx, dialNodeTimeout)
 	defer cancel()
 
@@ -543,10 +764,10 @@ func (c *Client) dialNode(ctx context.Context, n *tailcfg.DERPNode) (net.Conn, e
 		}()
 	}
 	if shouldDialProto(n.IPv4, netaddr.IP.Is4) {
-		startDial(n.IPv4, "tcp4")
+		startDial(addr4, "tcp4")
 	}
 	if shouldDialProto(n.IPv6, netaddr.IP.Is6) {
-		startDial(n.IPv6, "tcp6")
+		startDial(addr6, "tcp6")
 	}
 	if nwait == 0 {
 		return nil, errors.New("both IPv4 and IPv6 are explicitly disabled for node")
@@ -688,6 +909,102 @@ func (c *Client) SendPong(data [8]byte) error {
 	return dc.SendPong(data)
 }
 
+// Measure sends a ping to the server and returns the time until its
+// pong was received. The measurement is also folded into Latency.
+//
+// Pongs are read by Recv, so Measure only returns successfully while
+// another goroutine is calling Recv or RecvDetail.
+func (c *Client) Measure(ctx context.Context) (time.Duration, error) {
+	client, _, err := c.connect(ctx, "derphttp.Client.Measure")
+	if err != nil {
+		return 0, err
+	}
+	var data [8]byte
+	if _, err := crand.Read(data[:]); err != nil {
+		return 0, err
+	}
+	gotPong := make(chan struct{})
+	c.mu.Lock()
+	if c.pingOut == nil {
+		c.pingOut = map[[8]byte]chan struct{}{}
+	}
+	c.pingOut[data] = gotPong
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pingOut, data)
+		c.mu.Unlock()
+	}()
+
+	t0 := time.Now()
+	if err := client.SendPing(data); err != nil {
+		c.closeForReconnect(client)
+		return 0, err
+	}
+	select {
+	case <-gotPong:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+	rtt := time.Since(t0)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.latency == 0 {
+		c.latency = rtt
+	} else {
+		c.latency = time.Duration(latencyEWMAAlpha*float64(rtt) + (1-latencyEWMAAlpha)*float64(c.latency))
+	}
+	return rtt, nil
+}
+
+// Latency returns the exponentially weighted moving average of the
+// round-trip times to the server, as measured by Measure and by the
+// pings a connected Client sends periodically. It returns zero if
+// no measurement has completed yet.
+func (c *Client) Latency() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.latency
+}
+
+// pingLoop periodically measures the latency to the server while
+// the client is connected, until the client is closed.
+func (c *Client) pingLoop() {
+	t := time.NewTicker(latencyPingInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-t.C:
+		}
+		c.mu.Lock()
+		connected := c.client != nil
+		c.mu.Unlock()
+		if !connected {
+			// Don't reconnect just to measure.
+			continue
+		}
+		ctx, cancel := context.WithTimeout(c.ctx, latencyPingTimeout)
+		c.Measure(ctx)
+		cancel()
+	}
+}
+
+// handlePong reports whether m is the reply to a ping sent by
+// Measure, waking up Measure if so.
+func (c *Client) handlePong(m derp.PongMessage) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch, ok := c.pingOut[[8]byte(m)]
+	if ok {
+		delete(c.pingOut, [8]byte(m))
+		close(ch)
+	}
+	return ok
+}
+
 // SetCanAckPings sets whether this client will reply to ping requests from the server.
 //
 // This only affects future connections.
@@ -756,19 +1073,27 @@ func (c *Client) Recv() (derp.ReceivedMessage, error) {
 
 // RecvDetail is like Recv, but additional returns the connection generation on each message.
 // The connGen value is incremented every time the derphttp.Client reconnects to the server.
+//
+// Replies to pings sent by Measure are consumed and not returned.
 func (c *Client) RecvDetail() (m derp.ReceivedMessage, connGen int, err error) {
-	client, connGen, err := c.connect(context.TODO(), "derphttp.Client.Recv")
-	if err != nil {
-		return nil, 0, err
-	}
-	m, err = client.Recv()
-	if err != nil {
-		c.closeForReconnect(client)
-		if c.isClosed() {
-			err = ErrClientClosed
+	for {
+		client, connGen, err := c.connect(context.TODO(), "derphttp.Client.Recv")
+		if err != nil {
+			return nil, 0, err
+		}
+		m, err := client.Recv()
+		if err != nil {
+			c.closeForReconnect(client)
+			if c.isClosed() {
+				err = ErrClientClosed
+			}
+			return m, connGen, err
+		}
+		if pm, ok := m.(derp.PongMessage); ok && c.handlePong(pm) {
+			continue
 		}
+		return m, connGen, nil
 	}
-	return m, connGen, err
 }
 
 func (c *Client) isClosed() bool {
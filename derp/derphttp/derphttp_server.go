@@ -5,9 +5,11 @@
 package derphttp
 
 import (
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
 
 	"tailscale.com/derp"
 )
@@ -18,8 +20,30 @@ import (
 // following its HTTP request.
 const fastStartHeader = "Derp-Fast-Start"
 
+// TLSConfig returns the TLS config for an HTTPS server serving
+// Handler(s). It looks up the certificate on each handshake with
+// s.GetCertificate, so certificates rotated with s.SetTLSConfig take
+// effect without restarting the HTTPS server.
+func TLSConfig(s *derp.Server) *tls.Config {
+	return &tls.Config{
+		GetCertificate: s.GetCertificate,
+		// DERP upgrades HTTP/1.1 connections; don't offer HTTP/2.
+		NextProtos: []string{"http/1.1"},
+	}
+}
+
+// Handler returns an http.Handler that serves DERP connections for
+// s, and s's Prometheus metrics for requests to a path ending in
+// "/metrics".
 func Handler(s *derp.Server) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/metrics") && r.Header.Get("Upgrade") == "" {
+			// No auth: DERP servers' metrics aren't sensitive,
+			// and they're typically firewalled.
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			s.WritePrometheusMetrics(w)
+			return
+		}
 		if p := r.Header.Get("Upgrade"); p != "WebSocket" && p != "DERP" {
 			http.Error(w, "DERP requires connection upgrade", http.StatusUpgradeRequired)
 			return
@@ -7,13 +7,21 @@ package derphttp
 import (
 	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"inet.af/netaddr"
 	"tailscale.com/derp"
+	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
 )
 
@@ -154,3 +162,285 @@ func waitConnect(t testing.TB, c *Client) {
 		t.Fatalf("client first Recv was unexpected type %T", v)
 	}
 }
+
+func TestMetricsHandler(t *testing.T) {
+	s := derp.NewServer(key.NewPrivate(), t.Logf)
+	defer s.Close()
+	s.SetMeshPeerLatency("derp1b.example.com", 1500*time.Millisecond)
+
+	ts := httptest.NewServer(Handler(s))
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("status = %v", res.Status)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"derp_connections_total 0\n",
+		"derp_connections_current 0\n",
+		"derp_bytes_forwarded_total 0\n",
+		"derp_unknown_client_drops_total 0\n",
+		`derp_regional_latency_seconds{peer="derp1b.example.com"} 1.5` + "\n",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics missing %q; got:\n%s", want, body)
+		}
+	}
+}
+
+func TestMeasureLatency(t *testing.T) {
+	s := derp.NewServer(key.NewPrivate(), t.Logf)
+	defer s.Close()
+	ts := httptest.NewServer(Handler(s))
+	defer ts.Close()
+
+	c, err := NewClient(key.NewPrivate(), ts.URL, t.Logf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	waitConnect(t, c)
+
+	if got := c.Latency(); got != 0 {
+		t.Errorf("Latency before Measure = %v; want 0", got)
+	}
+
+	// Pongs are delivered by Recv, which must not return them.
+	recvErr := make(chan error, 1)
+	go func() {
+		m, err := c.Recv()
+		if err == nil {
+			err = fmt.Errorf("Recv returned unexpected %T", m)
+		}
+		recvErr <- err
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		rtt, err := c.Measure(ctx)
+		if err != nil {
+			t.Fatalf("Measure: %v", err)
+		}
+		if rtt <= 0 {
+			t.Errorf("Measure = %v; want positive", rtt)
+		}
+	}
+	if got := c.Latency(); got <= 0 {
+		t.Errorf("Latency after Measure = %v; want positive", got)
+	}
+
+	c.Close()
+	if err := <-recvErr; err != ErrClientClosed {
+		t.Errorf("Recv error = %v; want ErrClientClosed", err)
+	}
+}
+
+func TestNodeReresolve(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		answer  = "192.0.2.2"
+		lookups int
+		dialed  []string
+	)
+	setAnswer := func(ip string) {
+		mu.Lock()
+		defer mu.Unlock()
+		answer = ip
+	}
+	c := NewRegionClient(key.NewPrivate(), t.Logf, func() *tailcfg.DERPRegion { return nil })
+	defer c.Close()
+	c.lookupIP = func(ctx context.Context, host string) ([]netaddr.IP, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		lookups++
+		return []netaddr.IP{netaddr.MustParseIP(answer)}, nil
+	}
+	c.dialNodeAddr = func(ctx context.Context, proto, addr string) (net.Conn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		dialed = append(dialed, addr)
+		c1, c2 := net.Pipe()
+		c2.Close()
+		return c1, nil
+	}
+	n := &tailcfg.DERPNode{HostName: "derp.example.com", IPv4: "192.0.2.1", IPv6: "none"}
+
+	// check dials n and checks that it dialed want.
+	check := func(step, want string, wantLookups int) {
+		t.Helper()
+		conn, err := c.dialNode(context.Background(), n)
+		if err != nil {
+			t.Fatalf("%s: %v", step, err)
+		}
+		conn.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		want = net.JoinHostPort(want, "443")
+		if len(dialed) != 1 || dialed[0] != want || lookups != wantLookups {
+			t.Errorf("%s: dialed %q after %d lookups; want %q after %d", step, dialed, lookups, want, wantLookups)
+		}
+		dialed = nil
+	}
+
+	check("initial", "192.0.2.1", 0)
+	c.noteNodeResult(n, false)
+	check("one failure", "192.0.2.1", 0)
+	c.noteNodeResult(n, false)
+	check("two failures", "192.0.2.2", 1)
+	check("cached", "192.0.2.2", 1)
+
+	// The static IP may work from the new network.
+	setAnswer("192.0.2.3")
+	c.NoteNetworkChange()
+	check("network change", "192.0.2.1", 1)
+	c.noteNodeResult(n, false)
+	c.noteNodeResult(n, false)
+	check("failures after network change", "192.0.2.3", 2)
+
+	setAnswer("192.0.2.4")
+	c.noteNodeResult(n, false)
+	c.noteNodeResult(n, true)
+	c.noteNodeResult(n, false)
+	check("failures not in a row", "192.0.2.3", 2)
+	c.noteNodeResult(n, false)
+	check("server moved", "192.0.2.4", 3)
+
+	// A node without static IPs is resolved again after a network
+	// change.
+	n2 := &tailcfg.DERPNode{HostName: "derp2.example.com", IPv6: "none"}
+	c.nodeDialAddrs(context.Background(), n2)
+	c.nodeDialAddrs(context.Background(), n2)
+	c.NoteNetworkChange()
+	c.nodeDialAddrs(context.Background(), n2)
+	mu.Lock()
+	defer mu.Unlock()
+	if lookups != 5 {
+		t.Errorf("%d lookups; want 5, with one for n2 after the network change", lookups)
+	}
+}
+
+// TestNetworkChangeRedials tests that a network change closes the
+// current connection and that the next connect dials the node's
+// static IP again, even after failures on the old network had
+// switched it to its resolved address.
+func TestNetworkChangeRedials(t *testing.T) {
+	s := derp.NewServer(key.NewPrivate(), t.Logf)
+	defer s.Close()
+	srv := httptest.NewUnstartedServer(Handler(s))
+	srv.Config.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	srv.StartTLS()
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+
+	region := &tailcfg.DERPRegion{
+		RegionID:   1,
+		RegionCode: "test",
+		Nodes: []*tailcfg.DERPNode{{
+			Name:             "1a",
+			RegionID:         1,
+			HostName:         "derp.example.com",
+			IPv4:             "192.0.2.1",
+			IPv6:             "none",
+			DERPPort:         portNum,
+			InsecureForTests: true,
+		}},
+	}
+	c := NewRegionClient(key.NewPrivate(), t.Logf, func() *tailcfg.DERPRegion { return region })
+	defer c.Close()
+	c.lookupIP = func(ctx context.Context, host string) ([]netaddr.IP, error) {
+		return []netaddr.IP{netaddr.MustParseIP("192.0.2.2")}, nil
+	}
+	var (
+		mu           sync.Mutex
+		staticBroken bool
+		dialed       []string
+	)
+	c.dialNodeAddr = func(ctx context.Context, proto, addr string) (net.Conn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		dialed = append(dialed, addr)
+		if staticBroken && strings.HasPrefix(addr, "192.0.2.1:") {
+			return nil, errors.New("unreachable")
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, proto, srv.Listener.Addr().String())
+	}
+	// connect connects c, returning the connection's generation,
+	// or 0 if it failed, and the addresses dialed.
+	connect := func() (gen int, addrs []string) {
+		t.Helper()
+		_, gen, err := c.connect(context.Background(), "test")
+		mu.Lock()
+		defer mu.Unlock()
+		addrs, dialed = dialed, nil
+		if err != nil {
+			t.Logf("connect: %v", err)
+			return 0, addrs
+		}
+		return gen, addrs
+	}
+	static := net.JoinHostPort("192.0.2.1", port)
+	resolved := net.JoinHostPort("192.0.2.2", port)
+
+	gen1, addrs := connect()
+	if gen1 == 0 || len(addrs) != 1 || addrs[0] != static {
+		t.Fatalf("first connect: gen %d, dialed %q; want a connection to %v", gen1, addrs, static)
+	}
+
+	// The static IP stops working, as when the server moved, so
+	// after two failures the client switches to the resolved one.
+	mu.Lock()
+	staticBroken = true
+	mu.Unlock()
+	c.mu.Lock()
+	broken := c.client
+	c.mu.Unlock()
+	c.closeForReconnect(broken)
+	connect()
+	connect()
+	gen2, addrs := connect()
+	if gen2 == 0 || len(addrs) != 1 || addrs[0] != resolved {
+		t.Fatalf("connect after failures: gen %d, dialed %q; want a connection to %v", gen2, addrs, resolved)
+	}
+
+	// From a new network, the static IP works again. The network
+	// change must drop the current connection, so connecting makes a
+	// new one.
+	mu.Lock()
+	staticBroken = false
+	mu.Unlock()
+	c.NoteNetworkChange()
+	gen3, addrs := connect()
+	if gen3 == 0 || gen3 == gen2 || len(addrs) != 1 || addrs[0] != static {
+		t.Fatalf("connect after network change: gen %d (was %d), dialed %q; want a new connection to %v", gen3, gen2, addrs, static)
+	}
+}
+
+func TestNodeDialAddrsNoStaticIPs(t *testing.T) {
+	c := NewRegionClient(key.NewPrivate(), t.Logf, func() *tailcfg.DERPRegion { return nil })
+	defer c.Close()
+	c.lookupIP = func(ctx context.Context, host string) ([]netaddr.IP, error) {
+		return []netaddr.IP{netaddr.MustParseIP("2001:db8::1"), netaddr.MustParseIP("192.0.2.1")}, nil
+	}
+	v4, v6 := c.nodeDialAddrs(context.Background(), &tailcfg.DERPNode{HostName: "derp.example.com"})
+	if v4 != "192.0.2.1" || v6 != "2001:db8::1" {
+		t.Errorf("got %q, %q; want resolved addresses", v4, v6)
+	}
+	v4, v6 = c.nodeDialAddrs(context.Background(), &tailcfg.DERPNode{HostName: "127.0.0.1"})
+	if v4 != "" || v6 != "" {
+		t.Errorf("IP hostname: got %q, %q; want empty", v4, v6)
+	}
+}
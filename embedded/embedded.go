@@ -0,0 +1,303 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package embedded runs a Tailscale node inside a Go program, using
+// userspace networking, rather than as a separate tailscaled process.
+//
+// It's also where tailscaled gets its engine and netstack from, so
+// the two stay in sync.
+package embedded
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+
+	"tailscale.com/control/controlclient"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnlocal"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/smallzstd"
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine"
+	"tailscale.com/wgengine/netstack"
+)
+
+// Config configures a node started with Start.
+type Config struct {
+	// StateStore stores the node's state, including its keys, so
+	// it keeps its identity across restarts. If nil, the state is
+	// only kept in memory, and each Start creates a new node.
+	StateStore ipn.StateStore
+
+	// Hostname is the node's hostname. If empty, the OS hostname
+	// is used.
+	Hostname string
+
+	// AuthKey, if non-empty, is a node auth key used to authorize
+	// a new node without user interaction. Without one, Start fails
+	// if the control server requires an interactive login.
+	AuthKey string
+
+	// ControlURL is the base URL of the control server. If empty,
+	// ipn.DefaultControlURL is used.
+	ControlURL string
+
+	// Logf, if non-nil, is where the node logs. If nil, log.Printf
+	// is used.
+	Logf logger.Logf
+}
+
+// Node is a Tailscale node running in this process.
+type Node struct {
+	logf logger.Logf
+	e    wgengine.Engine
+	ns   *netstack.Impl
+	lb   *ipnlocal.LocalBackend // nil until Start has created it
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[uint16]*listener // by port
+}
+
+// Start starts a node and waits until it's connected to the tailnet,
+// or ctx is done.
+func Start(ctx context.Context, conf Config) (*Node, error) {
+	logf := conf.Logf
+	if logf == nil {
+		logf = log.Printf
+	}
+	store := conf.StateStore
+	if store == nil {
+		store = new(ipn.MemoryStore)
+	}
+
+	e, _, err := NewEngine(logf, EngineConfig{Tun: "userspace-networking"})
+	if err != nil {
+		return nil, fmt.Errorf("embedded: creating engine: %w", err)
+	}
+	n := &Node{
+		logf:      logf,
+		e:         e,
+		listeners: map[uint16]*listener{},
+	}
+	n.ns, err = NewNetstack(logf, e, false)
+	if err != nil {
+		n.Close()
+		return nil, fmt.Errorf("embedded: creating netstack: %w", err)
+	}
+	n.ns.ForwardTCPIn = n.forwardTCPIn
+	if err := n.ns.Start(); err != nil {
+		n.Close()
+		return nil, fmt.Errorf("embedded: starting netstack: %w", err)
+	}
+
+	lb, err := ipnlocal.NewLocalBackend(logf, "", store, e)
+	if err != nil {
+		n.Close()
+		return nil, fmt.Errorf("embedded: NewLocalBackend: %w", err)
+	}
+	lb.SetDecompressor(func() (controlclient.Decompressor, error) {
+		return smallzstd.NewDecoder(nil)
+	})
+	n.mu.Lock()
+	n.lb = lb
+	n.mu.Unlock()
+
+	running := make(chan struct{})
+	authURL := make(chan string, 1)
+	var loginOnce, runningOnce sync.Once
+	lb.SetNotifyCallback(func(not ipn.Notify) {
+		if not.State != nil {
+			switch *not.State {
+			case ipn.NeedsLogin:
+				// As "tailscale up" does; with an auth key, this
+				// logs in without interaction.
+				loginOnce.Do(func() { go lb.StartLoginInteractive() })
+			case ipn.Running:
+				runningOnce.Do(func() { close(running) })
+			}
+		}
+		if not.BrowseToURL != nil {
+			select {
+			case authURL <- *not.BrowseToURL:
+			default:
+			}
+		}
+	})
+
+	prefs := ipn.NewPrefs()
+	prefs.Hostname = conf.Hostname
+	if conf.ControlURL != "" {
+		prefs.ControlURL = conf.ControlURL
+	}
+	prefs.WantRunning = true
+	err = lb.Start(ipn.Options{
+		StateKey:    ipn.GlobalDaemonStateKey,
+		UpdatePrefs: prefs,
+		AuthKey:     conf.AuthKey,
+	})
+	if err != nil {
+		n.Close()
+		return nil, fmt.Errorf("embedded: starting backend: %w", err)
+	}
+
+	select {
+	case <-running:
+		return n, nil
+	case u := <-authURL:
+		n.Close()
+		return nil, fmt.Errorf("embedded: node needs interactive login at %s; use Config.AuthKey", u)
+	case <-ctx.Done():
+		n.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// Status returns the node's current status.
+func (n *Node) Status() *ipnstate.Status {
+	return n.lb.Status()
+}
+
+// Dial connects to addr on the tailnet, with network "tcp", "tcp4",
+// "tcp6", "udp", "udp4" or "udp6". The host in addr may be a MagicDNS
+// name.
+func (n *Node) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		c, err := n.ns.DialContextTCP(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	case "udp", "udp4", "udp6":
+		c, err := n.ns.DialContextUDP(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	return nil, fmt.Errorf("embedded: unsupported network %q", network)
+}
+
+// Listen announces on all of the node's Tailscale IPs. Only network
+// "tcp" is supported, and addr must be of the form ":port".
+//
+// Connections to ports without a listener are refused.
+func (n *Node) Listen(network, addr string) (net.Listener, error) {
+	if network != "tcp" {
+		return nil, fmt.Errorf("embedded: unsupported network %q", network)
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if host != "" {
+		return nil, fmt.Errorf("embedded: listen address %q must not have a host", addr)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil || port == 0 {
+		return nil, fmt.Errorf("embedded: invalid port in listen address %q", addr)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return nil, net.ErrClosed
+	}
+	if _, ok := n.listeners[uint16(port)]; ok {
+		return nil, fmt.Errorf("embedded: port %d already in use", port)
+	}
+	ln := &listener{
+		n:     n,
+		port:  uint16(port),
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	n.listeners[ln.port] = ln
+	return ln, nil
+}
+
+// forwardTCPIn is the netstack.Impl.ForwardTCPIn hook, handing an
+// inbound connection to port's listener, if any.
+func (n *Node) forwardTCPIn(c net.Conn, port uint16) {
+	n.mu.Lock()
+	ln := n.listeners[port]
+	n.mu.Unlock()
+	if ln == nil {
+		c.Close()
+		return
+	}
+	select {
+	case ln.conns <- c:
+	case <-ln.done:
+		c.Close()
+	}
+}
+
+// Close closes the node's listeners and shuts it down.
+func (n *Node) Close() error {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return errors.New("embedded: node already closed")
+	}
+	n.closed = true
+	lb := n.lb
+	var lns []*listener
+	for _, ln := range n.listeners {
+		lns = append(lns, ln)
+	}
+	n.mu.Unlock()
+
+	for _, ln := range lns {
+		ln.Close()
+	}
+	if lb != nil {
+		// Also closes the engine.
+		lb.Shutdown()
+	} else {
+		n.e.Close()
+	}
+	return nil
+}
+
+// listener is a net.Listener for a port on a Node's Tailscale IPs.
+type listener struct {
+	n     *Node
+	port  uint16
+	conns chan net.Conn
+
+	closeOnce sync.Once
+	done      chan struct{} // closed by Close
+}
+
+func (ln *listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-ln.conns:
+		return c, nil
+	case <-ln.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ln *listener) Close() error {
+	ln.closeOnce.Do(func() {
+		ln.n.mu.Lock()
+		if ln.n.listeners[ln.port] == ln {
+			delete(ln.n.listeners, ln.port)
+		}
+		ln.n.mu.Unlock()
+		close(ln.done)
+	})
+	return nil
+}
+
+func (ln *listener) Addr() net.Addr {
+	return &net.TCPAddr{Port: int(ln.port)}
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package embedded
+
+import (
+	"context"
+	"flag"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/dns"
+	"tailscale.com/tstest/integration"
+	"tailscale.com/tstest/integration/testcontrol"
+	"tailscale.com/types/logger"
+)
+
+var verboseNodes = flag.Bool("verbose-nodes", false, "log the embedded nodes' output")
+
+func TestTwoNodesHTTP(t *testing.T) {
+	derpMap := integration.RunDERPAndSTUN(t, logger.Discard, "127.0.0.1")
+	control := &testcontrol.Server{
+		DERPMap:     derpMap,
+		RequireAuth: true,
+		AuthKeys:    []string{"tskey-test"},
+	}
+	control.HTTPTestServer = httptest.NewUnstartedServer(control)
+	control.HTTPTestServer.Start()
+	defer control.HTTPTestServer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	start := func(hostname string) *Node {
+		t.Helper()
+		logf := logger.Discard
+		if *verboseNodes {
+			logf = logger.WithPrefix(t.Logf, hostname+": ")
+		}
+		n, err := Start(ctx, Config{
+			Hostname:   hostname,
+			AuthKey:    "tskey-test",
+			ControlURL: control.HTTPTestServer.URL,
+			Logf:       logf,
+		})
+		if err != nil {
+			t.Fatalf("Start(%s): %v", hostname, err)
+		}
+		t.Cleanup(func() { n.Close() })
+		return n
+	}
+	client := start("client")
+	server := start("server")
+
+	ln, err := server.Listen("tcp", ":80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello from server")
+	}))
+
+	var serverIP netaddr.IP
+	for _, ip := range server.Status().TailscaleIPs {
+		if ip.Is4() {
+			serverIP = ip
+		}
+	}
+	if serverIP.IsZero() {
+		t.Fatal("server has no Tailscale IPv4 address")
+	}
+
+	hc := &http.Client{Transport: &http.Transport{DialContext: client.Dial}}
+	url := "http://" + serverIP.String() + "/"
+	// The client may not have the server in its netmap yet, so
+	// retry until ctx expires.
+	for {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := hc.Do(req)
+		if err == nil {
+			var body []byte
+			body, err = ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			if err == nil {
+				if got, want := string(body), "hello from server"; got != want {
+					t.Fatalf("got body %q; want %q", got, want)
+				}
+				return
+			}
+		}
+		if ctx.Err() != nil {
+			t.Fatalf("GET %s: %v", url, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestNoDNS(t *testing.T) {
+	created := 0
+	defer func(old func(logger.Logf, string) (dns.OSConfigurator, error)) { newOSConfigurator = old }(newOSConfigurator)
+	newOSConfigurator = func(logger.Logf, string) (dns.OSConfigurator, error) {
+		created++
+		return nil, nil
+	}
+
+	if _, err := osConfigurator(t.Logf, EngineConfig{NoDNS: true}, "tailscale0"); err != nil {
+		t.Fatal(err)
+	}
+	if created != 0 {
+		t.Errorf("with NoDNS, created %d OS DNS configurators; want 0", created)
+	}
+	if _, err := osConfigurator(t.Logf, EngineConfig{}, "tailscale0"); err != nil {
+		t.Fatal(err)
+	}
+	if created != 1 {
+		t.Errorf("without NoDNS, created %d OS DNS configurators; want 1", created)
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package embedded
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/tun"
+	"inet.af/netaddr"
+	"tailscale.com/net/dns"
+	"tailscale.com/net/tstun"
+	"tailscale.com/types/logger"
+	"tailscale.com/wgengine"
+	"tailscale.com/wgengine/monitor"
+	"tailscale.com/wgengine/netstack"
+	"tailscale.com/wgengine/router"
+)
+
+// EngineConfig configures NewEngine.
+type EngineConfig struct {
+	// Tun is the name of the TUN device to create, a
+	// "tap:TAPNAME[:BRIDGENAME][;OPTIONS]" TAP device (see
+	// tstun.ParseTAPConfig), or
+	// "userspace-networking" to use netstack instead of a device.
+	//
+	// On the BSDs, a TUN name with a unit number, like "tun3",
+	// requests that specific device, while OpenBSD's "tun" means
+	// any free one (see tstun.New).
+	Tun string
+
+	// ListenPort is the UDP port to listen on for WireGuard and
+	// peer-to-peer traffic. Zero means to pick one automatically.
+	ListenPort uint16
+
+	// LinkMonitor optionally provides an existing link monitor to
+	// re-use. If nil, the engine creates its own.
+	LinkMonitor *monitor.Mon
+
+	// SecondaryTun, if non-empty, is a second TUN device name
+	// (Linux only) for the traffic to SecondaryPrefixes.
+	SecondaryTun      string
+	SecondaryPrefixes []netaddr.IPPrefix
+
+	// WrapNetstack is whether the TUN device's router is wrapped
+	// with netstack so netstack also handles subnet routes.
+	WrapNetstack bool
+
+	// StateDir, if non-empty, is the directory to keep the leases
+	// of a TAP device's DHCP server in. If empty, they're only kept
+	// in memory.
+	StateDir string
+
+	// DeviceLogging is whether wireguard-go's verbose device
+	// logging starts out on.
+	DeviceLogging bool
+
+	// PacketLogging is whether to log every packet, as
+	// wgengine.Config.PacketLogging.
+	PacketLogging bool
+
+	// NoDNS is whether to leave the OS DNS configuration alone,
+	// for systems that manage it some other way. MagicDNS names
+	// still resolve through the engine's own resolver at
+	// 100.100.100.100, but the OS isn't pointed at it.
+	NoDNS bool
+}
+
+// newOSConfigurator is dns.NewOSConfigurator, or a fake in tests.
+var newOSConfigurator = dns.NewOSConfigurator
+
+// osConfigurator returns the OS DNS configurator for the TUN device
+// devName, or nil (meaning one that does nothing) if conf.NoDNS.
+func osConfigurator(logf logger.Logf, conf EngineConfig, devName string) (dns.OSConfigurator, error) {
+	if conf.NoDNS {
+		logf("not configuring OS DNS, per NoDNS")
+		return nil, nil
+	}
+	return newOSConfigurator(logf, devName)
+}
+
+// NewEngine returns a new userspace WireGuard engine for conf.
+// useNetstack reports whether conf.Tun asked for userspace networking,
+// in which case the caller needs to run netstack (see NewNetstack) to
+// handle the engine's traffic.
+func NewEngine(logf logger.Logf, conf EngineConfig) (e wgengine.Engine, useNetstack bool, err error) {
+	wconf := wgengine.Config{
+		ListenPort:    conf.ListenPort,
+		LinkMonitor:   conf.LinkMonitor,
+		DeviceLogging: conf.DeviceLogging,
+		PacketLogging: conf.PacketLogging,
+	}
+	useNetstack = conf.Tun == "userspace-networking"
+	if !useNetstack {
+		isTAP := strings.HasPrefix(conf.Tun, "tap:")
+		var dev tun.Device
+		var devName string
+		var err error
+		if isTAP {
+			dev, devName, err = tstun.NewTAP(logf, conf.Tun, conf.StateDir)
+		} else {
+			dev, devName, err = tstun.New(logf, conf.Tun)
+		}
+		if err != nil {
+			tstun.Diagnose(logf, conf.Tun)
+			return nil, false, err
+		}
+		wconf.Tun = dev
+		if isTAP {
+			wconf.IsTAP = true
+			e, err := wgengine.NewUserspaceEngine(logf, wconf)
+			return e, false, err
+		}
+
+		var r router.Router
+		var dev2 tun.Device
+		if conf.SecondaryTun != "" {
+			dev2, _, err = tstun.New(logf, conf.SecondaryTun)
+			if err != nil {
+				tstun.Diagnose(logf, conf.SecondaryTun)
+				dev.Close()
+				return nil, false, err
+			}
+			wconf.SecondaryTun = dev2
+			wconf.SecondaryPrefixes = conf.SecondaryPrefixes
+			r, err = router.NewWithSecondary(logf, dev, dev2, conf.SecondaryPrefixes, conf.LinkMonitor)
+			if err != nil {
+				dev.Close()
+				dev2.Close()
+				return nil, false, err
+			}
+		} else {
+			r, err = router.New(logf, dev, conf.LinkMonitor)
+			if err != nil {
+				dev.Close()
+				return nil, false, err
+			}
+		}
+		d, err := osConfigurator(logf, conf, devName)
+		if err != nil {
+			r.Close()
+			dev.Close()
+			if dev2 != nil {
+				dev2.Close()
+			}
+			return nil, false, err
+		}
+		wconf.DNS = d
+		wconf.Router = r
+		if conf.WrapNetstack {
+			wconf.Router = netstack.NewSubnetRouterWrapper(wconf.Router)
+		}
+	}
+	e, err = wgengine.NewUserspaceEngine(logf, wconf)
+	if err != nil {
+		return nil, useNetstack, err
+	}
+	return e, useNetstack, nil
+}
+
+// NewNetstack returns a new netstack for e, which must have been
+// returned by NewEngine. If onlySubnets is true, netstack only
+// handles subnet routes, with the TUN device handling the rest. The
+// caller must call Start on the result after configuring it.
+func NewNetstack(logf logger.Logf, e wgengine.Engine, onlySubnets bool) (*netstack.Impl, error) {
+	ig, ok := e.(wgengine.InternalsGetter)
+	if !ok {
+		return nil, fmt.Errorf("%T is not a wgengine.InternalsGetter", e)
+	}
+	tunDev, magicConn, ok := ig.GetInternals()
+	if !ok {
+		return nil, fmt.Errorf("%T is not a wgengine.InternalsGetter", e)
+	}
+	return netstack.Create(logf, tunDev, e, magicConn, onlySubnets)
+}
@@ -23,6 +23,7 @@ var (
 	mu sync.Mutex
 
 	sysErr   = map[Subsystem]error{}                     // error key => err (or nil for no error)
+	errSince = map[Subsystem]time.Time{}                 // error key => when it became unhealthy
 	watchers = map[*watchHandle]func(Subsystem, error){} // opt func to run if error state changes
 	timer    *time.Timer
 
@@ -58,6 +59,14 @@ const (
 	// the Windows network adapter's "category" (public, private, domain).
 	// If it's unhealthy, the Windows firewall rules won't match.
 	SysNetworkCategory = Subsystem("network-category")
+
+	// SysStateStore is the name of the subsystem that persists
+	// tailscaled's state to disk.
+	SysStateStore = Subsystem("state-store")
+
+	// SysDNSForwarder is the name of the subsystem that forwards
+	// DNS queries to DNS-over-HTTPS upstreams.
+	SysDNSForwarder = Subsystem("dns-forwarder")
 )
 
 type watchHandle byte
@@ -103,6 +112,21 @@ func SetNetworkCategoryHealth(err error) { set(SysNetworkCategory, err) }
 
 func NetworkCategoryHealth() error { return get(SysNetworkCategory) }
 
+// SetStateStoreHealth sets the state of writing the ipn.StateStore to
+// disk.
+func SetStateStoreHealth(err error) { set(SysStateStore, err) }
+
+// StateStoreHealth returns the ipn.StateStore error state.
+func StateStoreHealth() error { return get(SysStateStore) }
+
+// SetDNSForwarderHealth sets the state of the DNS forwarder's
+// DNS-over-HTTPS upstreams.
+func SetDNSForwarderHealth(err error) { set(SysDNSForwarder, err) }
+
+// DNSForwarderHealth returns the DNS forwarder's DNS-over-HTTPS
+// upstream error state.
+func DNSForwarderHealth() error { return get(SysDNSForwarder) }
+
 func get(key Subsystem) error {
 	mu.Lock()
 	defer mu.Unlock()
@@ -123,6 +147,11 @@ func setLocked(key Subsystem, err error) {
 		selfCheckLocked()
 		return
 	}
+	if err == nil {
+		delete(errSince, key)
+	} else if old == nil {
+		errSince[key] = time.Now()
+	}
 	if ok && (old == nil) == (err == nil) {
 		// No change in overall error status (nil-vs-not), so
 		// don't run callbacks, but exact error might've
@@ -139,6 +168,34 @@ func setLocked(key Subsystem, err error) {
 	}
 }
 
+// sysDescription is how Warnings describes each subsystem, if not by
+// its name.
+var sysDescription = map[Subsystem]string{
+	SysRouter: "route configuration",
+	SysDNS:    "DNS configuration",
+}
+
+// Warnings returns a human-readable line for each subsystem that's
+// currently unhealthy, saying since when, sorted. It doesn't include
+// SysOverall.
+func Warnings() []string {
+	mu.Lock()
+	defer mu.Unlock()
+	var ret []string
+	for sys, err := range sysErr {
+		if err == nil || sys == SysOverall {
+			continue
+		}
+		desc := sysDescription[sys]
+		if desc == "" {
+			desc = string(sys)
+		}
+		ret = append(ret, fmt.Sprintf("%s failing since %s: %v", desc, errSince[sys].Format("15:04"), err))
+	}
+	sort.Strings(ret)
+	return ret
+}
+
 // GotStreamedMapResponse notes that we got a tailcfg.MapResponse
 // message in streaming mode, even if it's just a keep-alive message.
 func GotStreamedMapResponse() {
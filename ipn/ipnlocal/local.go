@@ -7,6 +7,7 @@ package ipnlocal
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -39,6 +40,7 @@ import (
 	"tailscale.com/paths"
 	"tailscale.com/portlist"
 	"tailscale.com/tailcfg"
+	"tailscale.com/tstime"
 	"tailscale.com/types/dnstype"
 	"tailscale.com/types/empty"
 	"tailscale.com/types/key"
@@ -47,6 +49,7 @@ import (
 	"tailscale.com/types/persist"
 	"tailscale.com/types/preftype"
 	"tailscale.com/types/wgkey"
+	"tailscale.com/util/crashpoint"
 	"tailscale.com/util/deephash"
 	"tailscale.com/util/dnsname"
 	"tailscale.com/util/osshare"
@@ -62,6 +65,20 @@ import (
 
 var controlDebugFlags = getControlDebugFlags()
 
+// debugFakeClock is whether to run on a tstime.FakeClock that only
+// advances when told to through DebugAdvanceClock, for integration
+// tests of timers.
+var debugFakeClock, _ = strconv.ParseBool(os.Getenv("TS_DEBUG_FAKE_CLOCK"))
+
+// debugInjectLinkChange is whether DebugInjectLinkChange is allowed,
+// for integration tests of roaming.
+var debugInjectLinkChange, _ = strconv.ParseBool(os.Getenv("TS_DEBUG_INJECT_LINK_CHANGE"))
+
+// debugDoHRoutes are DNS-over-HTTPS routes to add to the DNS
+// config, for testing DoH without control's help. See parseDoHRoutes
+// for the format.
+var debugDoHRoutes = os.Getenv("TS_DEBUG_DOH_ROUTES")
+
 func getControlDebugFlags() []string {
 	if e := os.Getenv("TS_DEBUG_CONTROL_FLAGS"); e != "" {
 		return strings.Split(e, ",")
@@ -96,6 +113,12 @@ type LocalBackend struct {
 	gotPortPollRes        chan struct{}    // closed upon first readPoller result
 	serverURL             string           // tailcontrol URL
 	newDecompressor       func() (controlclient.Decompressor, error)
+	netstackConns         func(withHistory bool) *ipnstate.NetstackConns // or nil
+	netstackForwarder     NetstackForwarder                              // or nil
+	netstackForwardsMu    sync.Mutex                                     // serializes EditNetstackForwardRules
+	ifMatchMu             sync.Mutex                                     // serializes EditPrefsIfMatch and StartIfMatch calls with an etag
+	defaultControlURL     string                                         // or empty; see SetDefaultControlURL
+	clock                 tstime.Clock
 
 	filterHash deephash.Sum
 
@@ -109,6 +132,7 @@ type LocalBackend struct {
 	userID         string       // current controlling user ID (for Windows, primarily)
 	prefs          *ipn.Prefs
 	inServerMode   bool
+	goingAway      bool // whether Shutdown tells control we're going away
 	machinePrivKey wgkey.Private
 	state          ipn.State
 	capFileSharing bool // whether netMap contains the file sharing capability
@@ -120,6 +144,7 @@ type LocalBackend struct {
 	activeLogin      string // last logged LoginName from netMap
 	engineStatus     ipn.EngineStatus
 	endpoints        []tailcfg.Endpoint
+	keyExpiryTimer   tstime.Timer // or nil; rechecks state when netMap's key expires
 	blocked          bool
 	authURL          string // cleared on Notify
 	authURLSticky    string // not cleared on Notify
@@ -167,10 +192,17 @@ func NewLocalBackend(logf logger.Logf, logid string, store ipn.StateStore, e wge
 		logf("skipping portlist: %s", err)
 	}
 
+	var clock tstime.Clock = tstime.StdClock{}
+	if debugFakeClock {
+		logf("using fake clock (TS_DEBUG_FAKE_CLOCK)")
+		clock = tstime.NewFakeClock(time.Now())
+	}
+
 	b := &LocalBackend{
 		ctx:            ctx,
 		ctxCancel:      cancel,
 		logf:           logf,
+		clock:          clock,
 		keyLogf:        logger.LogOnChange(logf, 5*time.Minute, time.Now),
 		statsLogf:      logger.LogOnChange(logf, 5*time.Minute, time.Now),
 		e:              e,
@@ -274,10 +306,14 @@ func (b *LocalBackend) onHealthChange(sys health.Subsystem, err error) {
 func (b *LocalBackend) Shutdown() {
 	b.mu.Lock()
 	cc := b.cc
+	goingAway := b.goingAway && b.state == ipn.Running
 	b.mu.Unlock()
 
 	b.unregisterLinkMon()
 	b.unregisterHealthWatch()
+	if cc != nil && goingAway {
+		b.sendGoingAway(cc)
+	}
 	if cc != nil {
 		cc.Shutdown()
 	}
@@ -286,10 +322,50 @@ func (b *LocalBackend) Shutdown() {
 	b.e.Wait()
 }
 
+// goingAwayTimeout is how long Shutdown waits for the control server
+// to acknowledge that the node is going away.
+const goingAwayTimeout = 2 * time.Second
+
+// SetGoingAwayOnShutdown sets whether Shutdown first tells the control
+// server that this node is disconnecting, so its peers stop trying to
+// reach it directly instead of waiting for it to time out.
+func (b *LocalBackend) SetGoingAwayOnShutdown(v bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.goingAway = v
+}
+
+// sendGoingAway tells the control server, bounded by goingAwayTimeout,
+// that this node is going away. Failures are only logged.
+func (b *LocalBackend) sendGoingAway(cc controlclient.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), goingAwayTimeout)
+	defer cancel()
+	if err := cc.GoingAway(ctx); err != nil {
+		b.logf("going away: %v", err)
+		return
+	}
+	b.logf("going away: told control")
+}
+
 // Prefs returns a copy of b's current prefs, with any private keys removed.
 func (b *LocalBackend) Prefs() *ipn.Prefs {
+	p, _ := b.PrefsWithETag()
+	return p
+}
+
+// PrefsWithETag is like Prefs, but also returns an opaque version
+// identifier for the prefs, for use with EditPrefsIfMatch.
+func (b *LocalBackend) PrefsWithETag() (p *ipn.Prefs, etag string) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
+	return b.redactedPrefsLocked(), b.prefsETagLocked()
+}
+
+// redactedPrefsLocked returns a copy of the prefs without private
+// keys, as given to frontends.
+//
+// b.mu must be held.
+func (b *LocalBackend) redactedPrefsLocked() *ipn.Prefs {
 	p := b.prefs.Clone()
 	if p != nil && p.Persist != nil {
 		p.Persist.LegacyFrontendPrivateMachineKey = wgkey.Private{}
@@ -299,6 +375,14 @@ func (b *LocalBackend) Prefs() *ipn.Prefs {
 	return p
 }
 
+// prefsETagLocked returns the version identifier of the current
+// prefs. It changes whenever the prefs do.
+//
+// b.mu must be held.
+func (b *LocalBackend) prefsETagLocked() string {
+	return deephash.Hash(b.redactedPrefsLocked()).String()
+}
+
 // Status returns the latest status of the backend and its
 // sub-components.
 func (b *LocalBackend) Status() *ipnstate.Status {
@@ -331,6 +415,8 @@ func (b *LocalBackend) updateStatus(sb *ipnstate.StatusBuilder, extraLocked func
 		s.Version = version.Long
 		s.BackendState = b.state.String()
 		s.AuthURL = b.authURLSticky
+		s.Health = health.Warnings()
+		s.DefaultControlURL = b.defaultControlURL
 		if b.netMap != nil {
 			s.MagicDNSSuffix = b.netMap.MagicDNSSuffix()
 			s.CertDomains = append([]string(nil), b.netMap.DNS.CertDomains...)
@@ -432,6 +518,98 @@ func (b *LocalBackend) SetDecompressor(fn func() (controlclient.Decompressor, er
 	b.newDecompressor = fn
 }
 
+// SetNetstackConnsFunc sets the func that returns netstack's table
+// of forwarded connections, such as netstack.Impl.Conns. It must be
+// called before Start, and only if netstack is in use.
+func (b *LocalBackend) SetNetstackConnsFunc(fn func(withHistory bool) *ipnstate.NetstackConns) {
+	b.netstackConns = fn
+}
+
+// NetstackForwarder gets and replaces netstack's inbound TCP forward
+// rules, in the "tcp/PORT:IP:PORT[;proxy-proto=v2]" form of
+// netstack.ParseForwardRule.
+type NetstackForwarder interface {
+	// ForwardRules returns the current rules.
+	ForwardRules() []string
+
+	// SetForwardRules replaces the current rules with rules if
+	// they're all valid, and otherwise returns an error and
+	// changes nothing.
+	SetForwardRules(rules []string) error
+}
+
+// SetNetstackForwarder sets how netstack's forward rules are read and
+// changed, and applies any rules saved by an earlier
+// EditNetstackForwardRules. It must be called before Start, and only
+// if netstack is in use.
+func (b *LocalBackend) SetNetstackForwarder(f NetstackForwarder) {
+	b.netstackForwarder = f
+	bs, err := b.store.ReadState(ipn.NetstackForwardsStateKey)
+	if err != nil {
+		if err != ipn.ErrStateNotExist {
+			b.logf("reading saved netstack forwards: %v", err)
+		}
+		return
+	}
+	var rules []string
+	if err := json.Unmarshal(bs, &rules); err != nil {
+		b.logf("reading saved netstack forwards: %v", err)
+		return
+	}
+	if err := f.SetForwardRules(rules); err != nil {
+		b.logf("applying saved netstack forwards: %v", err)
+		return
+	}
+	b.logf("applied %d saved netstack forwards", len(rules))
+}
+
+// NetstackForwardRules returns netstack's current inbound TCP forward
+// rules.
+func (b *LocalBackend) NetstackForwardRules() ([]string, error) {
+	if b.netstackForwarder == nil {
+		return nil, errors.New("not using netstack")
+	}
+	return b.netstackForwarder.ForwardRules(), nil
+}
+
+// EditNetstackForwardRules atomically replaces netstack's inbound TCP
+// forward rules with the result of calling edit on the current ones,
+// and saves them in the state store so they survive restarts. If they
+// can't be saved, the previous rules stay in effect.
+func (b *LocalBackend) EditNetstackForwardRules(edit func(rules []string) ([]string, error)) ([]string, error) {
+	if b.netstackForwarder == nil {
+		return nil, errors.New("not using netstack")
+	}
+	b.netstackForwardsMu.Lock()
+	defer b.netstackForwardsMu.Unlock()
+	old := b.netstackForwarder.ForwardRules()
+	rules, err := edit(append([]string(nil), old...))
+	if err != nil {
+		return nil, err
+	}
+	if rules == nil {
+		rules = []string{}
+	}
+	bs, err := json.Marshal(rules)
+	if err != nil {
+		return nil, err
+	}
+	// Apply the rules before saving them, as applying validates
+	// them, but put the old ones back if saving fails, so that what
+	// runs always matches what a restart would load.
+	if err := b.netstackForwarder.SetForwardRules(rules); err != nil {
+		return nil, err
+	}
+	if err := b.store.WriteState(ipn.NetstackForwardsStateKey, bs); err != nil {
+		if rerr := b.netstackForwarder.SetForwardRules(old); rerr != nil {
+			b.logf("restoring netstack forwards %q: %v", old, rerr)
+		}
+		return nil, fmt.Errorf("saving netstack forwards: %w", err)
+	}
+	b.logf("netstack forwards set to %q", rules)
+	return b.netstackForwarder.ForwardRules(), nil
+}
+
 // setClientStatus is the callback invoked by the control client whenever it posts a new status.
 // Among other things, this is where we update the netmap, packet filters, DNS and DERP maps.
 func (b *LocalBackend) setClientStatus(st controlclient.Status) {
@@ -483,9 +661,12 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 		prefs.ControlURL = prefs.ControlURLOrDefault()
 		prefsChanged = true
 	}
+	nodeKeyChanged := false
 	if st.Persist != nil {
 		if !b.prefs.Persist.Equals(st.Persist) {
 			prefsChanged = true
+			newKey := st.Persist.PrivateNodeKey
+			nodeKeyChanged = !newKey.IsZero() && (b.prefs.Persist == nil || !b.prefs.Persist.PrivateNodeKey.Equal(newKey))
 			b.prefs.Persist = st.Persist.Clone()
 		}
 	}
@@ -518,6 +699,9 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 
 	// Now complete the lock-free parts of what we started while locked.
 	if prefsChanged {
+		if nodeKeyChanged {
+			crashpoint.Reached(crashpoint.PersistNodeKey)
+		}
 		if stateKey != "" {
 			if err := b.store.WriteState(stateKey, prefs.ToBytes()); err != nil {
 				b.logf("Failed to save new controlclient state: %v", err)
@@ -536,7 +720,7 @@ func (b *LocalBackend) setClientStatus(st controlclient.Status) {
 		}
 
 		b.updateFilter(st.NetMap, prefs)
-		b.e.SetNetworkMap(st.NetMap)
+		b.e.SetNetworkMap(withoutDisabledTailnetFamilies(st.NetMap, prefs))
 		b.e.SetDERPMap(st.NetMap.DERPMap)
 
 		b.send(ipn.Notify{NetMap: st.NetMap})
@@ -700,6 +884,31 @@ func (b *LocalBackend) startIsNoopLocked(opts ipn.Options) bool {
 // actually a supported operation (it should be, but it's very unclear
 // from the following whether or not that is a safe transition).
 func (b *LocalBackend) Start(opts ipn.Options) error {
+	return b.StartIfMatch(opts, "")
+}
+
+// StartIfMatch is like Start, but only starts if the prefs are still
+// those that PrefsWithETag returned etag for, so that a client that
+// computed opts.UpdatePrefs from the prefs it read doesn't overwrite
+// a concurrent change. If they've changed, it returns
+// ErrPrefsChanged. An empty etag matches any prefs.
+func (b *LocalBackend) StartIfMatch(opts ipn.Options, etag string) error {
+	if etag != "" {
+		// Hold ifMatchMu for the whole start, as Start drops
+		// b.mu part way through.
+		b.ifMatchMu.Lock()
+		defer b.ifMatchMu.Unlock()
+		b.mu.Lock()
+		match := etag == b.prefsETagLocked()
+		b.mu.Unlock()
+		if !match {
+			return ErrPrefsChanged
+		}
+	}
+	return b.start(opts)
+}
+
+func (b *LocalBackend) start(opts ipn.Options) error {
 	if opts.Prefs == nil && opts.StateKey == "" {
 		return errors.New("no state key or prefs provided")
 	}
@@ -844,6 +1053,7 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 		ServerURL:            b.serverURL,
 		AuthKey:              opts.AuthKey,
 		Hostinfo:             hostinfo,
+		TimeNow:              b.clock.Now,
 		KeepAlive:            true,
 		NewDecompressor:      b.newDecompressor,
 		HTTPTestClient:       httpTestClient,
@@ -907,6 +1117,7 @@ func (b *LocalBackend) updateFilter(netMap *netmap.NetworkMap, prefs *ipn.Prefs)
 		logNetsB     netaddr.IPSetBuilder
 		shieldsUp    = prefs == nil || prefs.ShieldsUp // Be conservative when not ready
 	)
+	netMap = withoutDisabledTailnetFamilies(netMap, prefs)
 	// Log traffic for Tailscale IPs.
 	logNetsB.AddPrefix(tsaddr.CGNATRange())
 	logNetsB.AddPrefix(tsaddr.TailscaleULARange())
@@ -966,6 +1177,66 @@ func (b *LocalBackend) updateFilter(netMap *netmap.NetworkMap, prefs *ipn.Prefs)
 	}
 }
 
+// withoutDisabledTailnetFamilies returns nm without the Tailscale
+// IPv4 or IPv6 addresses of the node and its peers, as disabled by
+// prefs.NoTailnetIPv4 and prefs.NoTailnetIPv6. It's what the engine,
+// router and packet filter see; b.netMap keeps the addresses as
+// control assigned them.
+//
+// If neither family is disabled, nm is returned as is. Otherwise nm
+// isn't modified; the returned netmap is a shallow copy of it with
+// copies of the nodes whose addresses changed.
+func withoutDisabledTailnetFamilies(nm *netmap.NetworkMap, prefs *ipn.Prefs) *netmap.NetworkMap {
+	if nm == nil || prefs == nil || (!prefs.NoTailnetIPv4 && !prefs.NoTailnetIPv6) {
+		return nm
+	}
+	keep := func(p netaddr.IPPrefix) bool {
+		if !p.IsSingleIP() || !tsaddr.IsTailscaleIP(p.IP()) {
+			return true
+		}
+		if p.IP().Is4() {
+			return !prefs.NoTailnetIPv4
+		}
+		return !prefs.NoTailnetIPv6
+	}
+	filter := func(ps []netaddr.IPPrefix) (ret []netaddr.IPPrefix, changed bool) {
+		for _, p := range ps {
+			if keep(p) {
+				ret = append(ret, p)
+			} else {
+				changed = true
+			}
+		}
+		if !changed {
+			return ps, false
+		}
+		return ret, true
+	}
+	filterNode := func(n *tailcfg.Node) *tailcfg.Node {
+		if n == nil {
+			return nil
+		}
+		addrs, addrsChanged := filter(n.Addresses)
+		allowed, allowedChanged := filter(n.AllowedIPs)
+		if !addrsChanged && !allowedChanged {
+			return n
+		}
+		n2 := *n // shallow copy; only the two slices are replaced
+		n2.Addresses = addrs
+		n2.AllowedIPs = allowed
+		return &n2
+	}
+
+	nm2 := *nm
+	nm2.Addresses, _ = filter(nm.Addresses)
+	nm2.SelfNode = filterNode(nm.SelfNode)
+	nm2.Peers = make([]*tailcfg.Node, len(nm.Peers))
+	for i, p := range nm.Peers {
+		nm2.Peers[i] = filterNode(p)
+	}
+	return &nm2
+}
+
 var removeFromDefaultRoute = []netaddr.IPPrefix{
 	// RFC1918 LAN ranges
 	netaddr.MustParseIPPrefix("192.168.0.0/16"),
@@ -1452,6 +1723,50 @@ func (b *LocalBackend) StartLoginInteractive() {
 	}
 }
 
+// resetKeyExpiryTimerLocked arranges for the state machine to run
+// when b.netMap's node key expires, as nothing else may happen then
+// to move it to NeedsLogin.
+//
+// b.mu must be held.
+func (b *LocalBackend) resetKeyExpiryTimerLocked() {
+	if b.keyExpiryTimer != nil {
+		b.keyExpiryTimer.Stop()
+		b.keyExpiryTimer = nil
+	}
+	if b.netMap == nil || b.netMap.Expiry.IsZero() {
+		return
+	}
+	if d := b.netMap.Expiry.Sub(b.clock.Now()); d > 0 {
+		b.keyExpiryTimer = b.clock.AfterFunc(d, b.stateMachine)
+	}
+}
+
+// DebugAdvanceClock moves the backend's fake clock forward by d,
+// firing any timers that are then due. It fails unless tailscaled
+// was started with TS_DEBUG_FAKE_CLOCK.
+func (b *LocalBackend) DebugAdvanceClock(d time.Duration) error {
+	fc, ok := b.clock.(*tstime.FakeClock)
+	if !ok {
+		return errors.New("not using a fake clock; set TS_DEBUG_FAKE_CLOCK=1")
+	}
+	b.logf("advancing fake clock by %v", d)
+	fc.Advance(d)
+	return nil
+}
+
+// DebugInjectLinkChange makes the engine's link monitor act as if it
+// saw a network change, re-checking the network and notifying the
+// engine, which then redoes endpoint discovery. It fails unless
+// tailscaled was started with TS_DEBUG_INJECT_LINK_CHANGE.
+func (b *LocalBackend) DebugInjectLinkChange() error {
+	if !debugInjectLinkChange {
+		return errors.New("link change injection disabled; set TS_DEBUG_INJECT_LINK_CHANGE=1")
+	}
+	b.logf("injecting link change")
+	b.e.GetLinkMonitor().InjectEvent()
+	return nil
+}
+
 // FakeExpireAfter implements Backend.
 func (b *LocalBackend) FakeExpireAfter(x time.Duration) {
 	b.logf("FakeExpireAfter: %v", x)
@@ -1467,8 +1782,8 @@ func (b *LocalBackend) FakeExpireAfter(x time.Duration) {
 	// so we prefer to fully copy the netmap over introducing in-place modification here.
 	mapCopy := *b.netMap
 	e := mapCopy.Expiry
-	if e.IsZero() || time.Until(e) > x {
-		mapCopy.Expiry = time.Now().Add(x)
+	if e.IsZero() || e.Sub(b.clock.Now()) > x {
+		mapCopy.Expiry = b.clock.Now().Add(x)
 	}
 	b.setNetMapLocked(&mapCopy)
 	b.send(ipn.Notify{NetMap: b.netMap})
@@ -1530,6 +1845,14 @@ func (b *LocalBackend) shouldUploadServices() bool {
 	return !b.prefs.ShieldsUp && b.netMap.CollectServices
 }
 
+// SetDefaultControlURL sets the control server URL that the daemon
+// was configured with, which frontends use when they're not given
+// one. It's reported in the status. It must be called before b is
+// used.
+func (b *LocalBackend) SetDefaultControlURL(url string) {
+	b.defaultControlURL = url
+}
+
 func (b *LocalBackend) SetCurrentUserID(uid string) {
 	b.mu.Lock()
 	b.userID = uid
@@ -1537,7 +1860,28 @@ func (b *LocalBackend) SetCurrentUserID(uid string) {
 }
 
 func (b *LocalBackend) EditPrefs(mp *ipn.MaskedPrefs) (*ipn.Prefs, error) {
+	return b.EditPrefsIfMatch(mp, "")
+}
+
+// ErrPrefsChanged is returned by EditPrefsIfMatch when the prefs
+// changed after the caller read them.
+var ErrPrefsChanged = errors.New("prefs were changed concurrently by another client")
+
+// EditPrefsIfMatch is like EditPrefs, but only applies mp if the
+// prefs are still those that PrefsWithETag returned etag for, so that
+// a client's read-modify-write of the prefs happens as one
+// transaction. If they've changed, it returns ErrPrefsChanged. An
+// empty etag matches any prefs.
+func (b *LocalBackend) EditPrefsIfMatch(mp *ipn.MaskedPrefs, etag string) (*ipn.Prefs, error) {
+	if etag != "" {
+		b.ifMatchMu.Lock()
+		defer b.ifMatchMu.Unlock()
+	}
 	b.mu.Lock()
+	if etag != "" && etag != b.prefsETagLocked() {
+		b.mu.Unlock()
+		return nil, ErrPrefsChanged
+	}
 	p0 := b.prefs.Clone()
 	p1 := b.prefs.Clone()
 	p1.ApplyEdits(mp)
@@ -1621,6 +1965,12 @@ func (b *LocalBackend) setPrefsLockedOnEntry(caller string, newp *ipn.Prefs) {
 
 	if netMap != nil {
 		b.e.SetDERPMap(netMap.DERPMap)
+		if oldp.NoTailnetIPv4 != newp.NoTailnetIPv4 || oldp.NoTailnetIPv6 != newp.NoTailnetIPv6 {
+			// Let the engine's netmap watchers (such as netstack)
+			// add or remove the addresses now; authReconfig below
+			// does the same for the router.
+			b.e.SetNetworkMap(withoutDisabledTailnetFamilies(netMap, newp))
+		}
 	}
 
 	if !oldp.WantRunning && newp.WantRunning {
@@ -1738,6 +2088,7 @@ func (b *LocalBackend) authReconfig() {
 		b.logf("authReconfig: skipping because !WantRunning.")
 		return
 	}
+	nm = withoutDisabledTailnetFamilies(nm, uc)
 
 	var flags netmap.WGConfigFlags
 	if uc.RouteAll {
@@ -1762,8 +2113,10 @@ func (b *LocalBackend) authReconfig() {
 	rcfg := b.routerConfig(cfg, uc)
 
 	dcfg := dns.Config{
-		Routes: map[dnsname.FQDN][]netaddr.IPPort{},
-		Hosts:  map[dnsname.FQDN][]netaddr.IP{},
+		Routes:       map[dnsname.FQDN][]netaddr.IPPort{},
+		DoHRoutes:    map[dnsname.FQDN][]string{},
+		DoHBootstrap: map[string][]netaddr.IP{},
+		Hosts:        map[dnsname.FQDN][]netaddr.IP{},
 	}
 
 	// Populate MagicDNS records. We do this unconditionally so that
@@ -1820,8 +2173,18 @@ func (b *LocalBackend) authReconfig() {
 	}
 
 	if uc.CorpDNS {
+		addDoHBootstrap := func(resolver dnstype.Resolver) {
+			if len(resolver.BootstrapResolution) > 0 {
+				dcfg.DoHBootstrap[resolver.Addr] = resolver.BootstrapResolution
+			}
+		}
 		addDefault := func(resolvers []dnstype.Resolver) {
 			for _, resolver := range resolvers {
+				if isDoHResolver(resolver) {
+					dcfg.DoHRoutes["."] = append(dcfg.DoHRoutes["."], resolver.Addr)
+					addDoHBootstrap(resolver)
+					continue
+				}
 				res, err := parseResolver(resolver)
 				if err != nil {
 					b.logf("skipping bad resolver: %v", err.Error())
@@ -1849,6 +2212,11 @@ func (b *LocalBackend) authReconfig() {
 			dcfg.Routes[fqdn] = make([]netaddr.IPPort, 0, len(resolvers))
 
 			for _, resolver := range resolvers {
+				if isDoHResolver(resolver) {
+					dcfg.DoHRoutes[fqdn] = append(dcfg.DoHRoutes[fqdn], resolver.Addr)
+					addDoHBootstrap(resolver)
+					continue
+				}
 				res, err := parseResolver(resolver)
 				if err != nil {
 					b.logf(err.Error())
@@ -1857,6 +2225,15 @@ func (b *LocalBackend) authReconfig() {
 				dcfg.Routes[fqdn] = append(dcfg.Routes[fqdn], res)
 			}
 		}
+		if debugDoHRoutes != "" {
+			routes, err := parseDoHRoutes(debugDoHRoutes)
+			if err != nil {
+				b.logf("ignoring TS_DEBUG_DOH_ROUTES: %v", err)
+			}
+			for suffix, urls := range routes {
+				dcfg.DoHRoutes[suffix] = append(dcfg.DoHRoutes[suffix], urls...)
+			}
+		}
 		for _, dom := range nm.DNS.Domains {
 			fqdn, err := dnsname.ToFQDN(dom)
 			if err != nil {
@@ -1877,6 +2254,9 @@ func (b *LocalBackend) authReconfig() {
 		switch {
 		case len(dcfg.DefaultResolvers) != 0:
 			// Default resolvers already set.
+		case len(dcfg.DoHRoutes["."]) != 0:
+			// Default DoH resolvers set; they'll fall back to the
+			// OS's resolvers if they fail.
 		case !uc.ExitNodeID.IsZero():
 			// When using exit nodes, it's very likely the LAN
 			// resolvers will become unreachable. So, force use of the
@@ -1890,7 +2270,7 @@ func (b *LocalBackend) authReconfig() {
 			//
 			// https://github.com/tailscale/tailscale/issues/1713
 			addDefault(nm.DNS.FallbackResolvers)
-		case len(dcfg.Routes) == 0:
+		case len(dcfg.Routes) == 0 && len(dcfg.DoHRoutes) == 0:
 			// No settings requiring split DNS, no problem.
 		case version.OS() == "android":
 			// We don't support split DNS at all on Android yet.
@@ -1907,6 +2287,36 @@ func (b *LocalBackend) authReconfig() {
 	b.initPeerAPIListener()
 }
 
+// isDoHResolver reports whether cfg is a DNS-over-HTTPS resolver,
+// whose Addr is its URL.
+func isDoHResolver(cfg dnstype.Resolver) bool {
+	return strings.HasPrefix(cfg.Addr, "https://")
+}
+
+// parseDoHRoutes parses a comma-separated list of DNS-over-HTTPS
+// routes of the form "suffix=url", such as
+// "corp.example=https://dns.corp.example/dns-query", with a suffix of
+// "." for the default route.
+func parseDoHRoutes(s string) (map[dnsname.FQDN][]string, error) {
+	ret := map[dnsname.FQDN][]string{}
+	for _, r := range strings.Split(s, ",") {
+		i := strings.IndexByte(r, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("DoH route %q is not of the form suffix=url", r)
+		}
+		suffix, u := r[:i], r[i+1:]
+		fqdn, err := dnsname.ToFQDN(suffix)
+		if err != nil {
+			return nil, fmt.Errorf("DoH route %q: %w", r, err)
+		}
+		if !isDoHResolver(dnstype.Resolver{Addr: u}) {
+			return nil, fmt.Errorf("DoH route %q: URL must start with https://", r)
+		}
+		ret[fqdn] = append(ret[fqdn], u)
+	}
+	return ret, nil
+}
+
 func parseResolver(cfg dnstype.Resolver) (netaddr.IPPort, error) {
 	ip, err := netaddr.ParseIP(cfg.Addr)
 	if err != nil {
@@ -2348,7 +2758,7 @@ func (b *LocalBackend) nextState() ipn.State {
 		}
 	case !wantRunning:
 		return ipn.Stopped
-	case !netMap.Expiry.IsZero() && time.Until(netMap.Expiry) <= 0:
+	case !netMap.Expiry.IsZero() && !b.clock.Now().Before(netMap.Expiry):
 		return ipn.NeedsLogin
 	case netMap.MachineStatus != tailcfg.MachineAuthorized:
 		// TODO(crawshaw): handle tailcfg.MachineInvalid
@@ -2521,6 +2931,7 @@ func (b *LocalBackend) setNetMapLocked(nm *netmap.NetworkMap) {
 		}
 	}
 	b.netMap = nm
+	b.resetKeyExpiryTimerLocked()
 	if login != b.activeLogin {
 		b.logf("active login: %v", login)
 		b.activeLogin = login
@@ -2827,6 +3238,55 @@ func (b *LocalBackend) PeerDialControlFunc() func(network, address string, c sys
 	return nil
 }
 
+// PathHistory returns the recent path changes and latency samples
+// for each peer, or nil if the engine doesn't track them.
+func (b *LocalBackend) PathHistory() []ipnstate.PeerPathHistory {
+	if ig, ok := b.e.(wgengine.InternalsGetter); ok {
+		if _, mc, ok := ig.GetInternals(); ok {
+			return mc.PathHistory()
+		}
+	}
+	return nil
+}
+
+// SetDNSQueryLogging turns logging of the queries handled by the
+// in-daemon DNS resolver on for d, or off if d is zero or negative.
+func (b *LocalBackend) SetDNSQueryLogging(d time.Duration) {
+	if d > 0 {
+		b.logf("DNS query logging on for %v", d)
+	} else {
+		b.logf("DNS query logging off")
+	}
+	b.e.SetDNSQueryLogging(d)
+}
+
+// DNSQueryLog returns the in-daemon DNS resolver's query log.
+func (b *LocalBackend) DNSQueryLog() ipnstate.DNSQueryLog {
+	return b.e.DNSQueryLog()
+}
+
+// SetWireGuardDeviceLogging turns wireguard-go's verbose device
+// logging on or off.
+func (b *LocalBackend) SetWireGuardDeviceLogging(on bool) {
+	b.logf("wireguard-go device logging on: %v", on)
+	b.e.SetDeviceLogging(on)
+}
+
+// WireGuardDeviceLogging reports whether wireguard-go's verbose
+// device logging is on.
+func (b *LocalBackend) WireGuardDeviceLogging() bool {
+	return b.e.DeviceLogging()
+}
+
+// NetstackConns returns the connections netstack is forwarding and,
+// if withHistory, the last ones to have closed.
+func (b *LocalBackend) NetstackConns(withHistory bool) (*ipnstate.NetstackConns, error) {
+	if b.netstackConns == nil {
+		return nil, errors.New("not using netstack")
+	}
+	return b.netstackConns(withHistory), nil
+}
+
 // DERPMap returns the current DERPMap in use, or nil if not connected.
 func (b *LocalBackend) DERPMap() *tailcfg.DERPMap {
 	b.mu.Lock()
@@ -5,6 +5,7 @@
 package ipnlocal
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"reflect"
@@ -18,6 +19,7 @@ import (
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/netmap"
+	"tailscale.com/util/dnsname"
 	"tailscale.com/wgengine"
 	"tailscale.com/wgengine/wgcfg"
 )
@@ -298,6 +300,84 @@ func TestPeerRoutes(t *testing.T) {
 
 }
 
+func TestWithoutDisabledTailnetFamilies(t *testing.T) {
+	pp := netaddr.MustParseIPPrefix
+	var (
+		self4   = pp("100.64.0.1/32")
+		self6   = pp("fd7a:115c:a1e0::1/128")
+		peer4   = pp("100.64.0.2/32")
+		peer6   = pp("fd7a:115c:a1e0::2/128")
+		subnet4 = pp("10.0.0.0/24")
+		subnet6 = pp("2001:db8::/64")
+	)
+	newNetmap := func() *netmap.NetworkMap {
+		return &netmap.NetworkMap{
+			Addresses: []netaddr.IPPrefix{self4, self6},
+			SelfNode: &tailcfg.Node{
+				Addresses:  []netaddr.IPPrefix{self4, self6},
+				AllowedIPs: []netaddr.IPPrefix{self4, self6},
+			},
+			Peers: []*tailcfg.Node{
+				{
+					Addresses:  []netaddr.IPPrefix{peer4, peer6},
+					AllowedIPs: []netaddr.IPPrefix{peer4, peer6, subnet4, subnet6},
+				},
+			},
+		}
+	}
+	tests := []struct {
+		name      string
+		prefs     *ipn.Prefs
+		wantAddrs []netaddr.IPPrefix // of nm and SelfNode
+		wantPeer  []netaddr.IPPrefix // peer's AllowedIPs
+	}{
+		{
+			name:      "nil_prefs",
+			wantAddrs: []netaddr.IPPrefix{self4, self6},
+			wantPeer:  []netaddr.IPPrefix{peer4, peer6, subnet4, subnet6},
+		},
+		{
+			name:      "both",
+			prefs:     &ipn.Prefs{},
+			wantAddrs: []netaddr.IPPrefix{self4, self6},
+			wantPeer:  []netaddr.IPPrefix{peer4, peer6, subnet4, subnet6},
+		},
+		{
+			name:      "no_v4",
+			prefs:     &ipn.Prefs{NoTailnetIPv4: true},
+			wantAddrs: []netaddr.IPPrefix{self6},
+			wantPeer:  []netaddr.IPPrefix{peer6, subnet4, subnet6},
+		},
+		{
+			name:      "no_v6",
+			prefs:     &ipn.Prefs{NoTailnetIPv6: true},
+			wantAddrs: []netaddr.IPPrefix{self4},
+			wantPeer:  []netaddr.IPPrefix{peer4, subnet4, subnet6},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nm := newNetmap()
+			got := withoutDisabledTailnetFamilies(nm, tt.prefs)
+			if !reflect.DeepEqual(got.Addresses, tt.wantAddrs) {
+				t.Errorf("Addresses = %v; want %v", got.Addresses, tt.wantAddrs)
+			}
+			if !reflect.DeepEqual(got.SelfNode.Addresses, tt.wantAddrs) {
+				t.Errorf("SelfNode.Addresses = %v; want %v", got.SelfNode.Addresses, tt.wantAddrs)
+			}
+			if !reflect.DeepEqual(got.SelfNode.AllowedIPs, tt.wantAddrs) {
+				t.Errorf("SelfNode.AllowedIPs = %v; want %v", got.SelfNode.AllowedIPs, tt.wantAddrs)
+			}
+			if !reflect.DeepEqual(got.Peers[0].AllowedIPs, tt.wantPeer) {
+				t.Errorf("peer AllowedIPs = %v; want %v", got.Peers[0].AllowedIPs, tt.wantPeer)
+			}
+			if !reflect.DeepEqual(nm, newNetmap()) {
+				t.Errorf("input netmap was modified")
+			}
+		})
+	}
+}
+
 func TestPeerAPIBase(t *testing.T) {
 	tests := []struct {
 		name string
@@ -493,3 +573,109 @@ func TestFileTargets(t *testing.T) {
 	}
 	// (other cases handled by TestPeerAPIBase above)
 }
+
+func TestParseDoHRoutes(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    map[dnsname.FQDN][]string
+		wantErr bool
+	}{
+		{
+			in:   "corp.example=https://dns.corp.example/dns-query",
+			want: map[dnsname.FQDN][]string{"corp.example.": {"https://dns.corp.example/dns-query"}},
+		},
+		{
+			in: ".=https://a.example/dns-query,.=https://b.example/dns-query,corp.example.=https://c.example/q",
+			want: map[dnsname.FQDN][]string{
+				".":             {"https://a.example/dns-query", "https://b.example/dns-query"},
+				"corp.example.": {"https://c.example/q"},
+			},
+		},
+		{in: "corp.example", wantErr: true},
+		{in: "corp.example=http://dns.corp.example/dns-query", wantErr: true},
+		{in: "corp..example=https://dns.corp.example/dns-query", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseDoHRoutes(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseDoHRoutes(%q) error = %v; want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseDoHRoutes(%q) = %v; want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+// fakeNetstackForwarder is a NetstackForwarder that accepts any rules
+// without a "bad" one.
+type fakeNetstackForwarder struct {
+	rules []string
+}
+
+func (f *fakeNetstackForwarder) ForwardRules() []string {
+	return append([]string(nil), f.rules...)
+}
+
+func (f *fakeNetstackForwarder) SetForwardRules(rules []string) error {
+	for _, r := range rules {
+		if r == "bad" {
+			return errors.New("bad rule")
+		}
+	}
+	f.rules = append([]string(nil), rules...)
+	return nil
+}
+
+// failingStore is an ipn.StateStore whose writes fail.
+type failingStore struct {
+	ipn.MemoryStore
+}
+
+func (*failingStore) WriteState(ipn.StateKey, []byte) error {
+	return errors.New("disk full")
+}
+
+func TestEditNetstackForwardRules(t *testing.T) {
+	add := func(rule string) func([]string) ([]string, error) {
+		return func(rules []string) ([]string, error) {
+			return append(rules, rule), nil
+		}
+	}
+
+	fwd := &fakeNetstackForwarder{rules: []string{"tcp/80:10.0.0.1:80"}}
+	store := new(ipn.MemoryStore)
+	b := &LocalBackend{logf: t.Logf, store: store, netstackForwarder: fwd}
+	got, err := b.EditNetstackForwardRules(add("tcp/443:10.0.0.1:443"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"tcp/80:10.0.0.1:80", "tcp/443:10.0.0.1:443"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("rules = %q; want %q", got, want)
+	}
+	saved, err := store.ReadState(ipn.NetstackForwardsStateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, w := string(saved), `["tcp/80:10.0.0.1:80","tcp/443:10.0.0.1:443"]`; g != w {
+		t.Errorf("saved %s; want %s", g, w)
+	}
+
+	// Invalid rules are neither applied nor saved.
+	if _, err := b.EditNetstackForwardRules(add("bad")); err == nil {
+		t.Error("adding bad rule succeeded")
+	}
+	if !reflect.DeepEqual(fwd.rules, want) {
+		t.Errorf("after bad rule, rules = %q; want %q", fwd.rules, want)
+	}
+
+	// If saving fails, the rules that were in effect stay so.
+	b.store = new(failingStore)
+	if _, err := b.EditNetstackForwardRules(add("tcp/22:10.0.0.1:22")); err == nil {
+		t.Error("edit with failing store succeeded")
+	}
+	if !reflect.DeepEqual(fwd.rules, want) {
+		t.Errorf("after failed save, rules = %q; want %q", fwd.rules, want)
+	}
+}
@@ -253,6 +253,12 @@ func (*mockControl) SetDNS(context.Context, *tailcfg.SetDNSRequest) error {
 	panic("unexpected SetDNS call")
 }
 
+func (cc *mockControl) GoingAway(context.Context) error {
+	cc.logf("GoingAway")
+	cc.called("GoingAway")
+	return nil
+}
+
 // A very precise test of the sequence of function calls generated by
 // ipnlocal.Local into its controlclient instance, and the events it
 // produces upstream into the UI.
@@ -0,0 +1,86 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"strings"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn"
+	"tailscale.com/types/netmap"
+)
+
+// findExitNodeIP returns the Tailscale IP of the peer in nm named by
+// want, which is either one of the peer's Tailscale IPs or its
+// MagicDNS name (either fully qualified, or just the first label).
+func findExitNodeIP(nm *netmap.NetworkMap, want string) (ip netaddr.IP, ok bool) {
+	if nm == nil {
+		return ip, false
+	}
+	wantIP, err := netaddr.ParseIP(want)
+	isIP := err == nil
+	want = strings.TrimSuffix(want, ".")
+	for _, peer := range nm.Peers {
+		if isIP {
+			for _, addr := range peer.Addresses {
+				if addr.IsSingleIP() && addr.IP() == wantIP {
+					return wantIP, true
+				}
+			}
+			continue
+		}
+		name := strings.TrimSuffix(peer.Name, ".")
+		if name == "" {
+			continue
+		}
+		if !strings.EqualFold(name, want) && !strings.EqualFold(strings.Split(name, ".")[0], want) {
+			continue
+		}
+		for _, addr := range peer.Addresses {
+			if addr.IsSingleIP() {
+				return addr.IP(), true
+			}
+		}
+	}
+	return ip, false
+}
+
+// maybeApplyExitNode sets the exit node requested by
+// Options.ExitNode, if it's still pending and the peer is in nm.
+func (s *server) maybeApplyExitNode(nm *netmap.NetworkMap) {
+	s.mu.Lock()
+	want := s.exitNodeWant
+	warned := s.exitNodeWarned
+	s.mu.Unlock()
+	if want == "" || nm == nil {
+		return
+	}
+	ip, ok := findExitNodeIP(nm, want)
+	if !ok {
+		if !warned {
+			s.logf("ipnserver: [warning] exit node %q not found in peer list yet; will retry on next netmap", want)
+			s.mu.Lock()
+			s.exitNodeWarned = true
+			s.mu.Unlock()
+		}
+		return
+	}
+	s.mu.Lock()
+	if s.exitNodeWant == "" {
+		// Another netmap got here first.
+		s.mu.Unlock()
+		return
+	}
+	s.exitNodeWant = ""
+	s.mu.Unlock()
+
+	s.logf("ipnserver: using exit node %q (%v)", want, ip)
+	if _, err := s.b.EditPrefs(&ipn.MaskedPrefs{
+		Prefs:         ipn.Prefs{ExitNodeIP: ip},
+		ExitNodeIPSet: true,
+	}); err != nil {
+		s.logf("ipnserver: setting exit node %q: %v", want, err)
+	}
+}
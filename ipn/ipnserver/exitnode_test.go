@@ -0,0 +1,61 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/netmap"
+)
+
+func TestFindExitNodeIP(t *testing.T) {
+	nm := &netmap.NetworkMap{
+		Peers: []*tailcfg.Node{
+			{
+				Name: "foo.example.ts.net.",
+				Addresses: []netaddr.IPPrefix{
+					netaddr.MustParseIPPrefix("100.64.0.1/32"),
+					netaddr.MustParseIPPrefix("fd7a:115c:a1e0::1/128"),
+				},
+			},
+			{
+				Name: "bar.example.ts.net.",
+				Addresses: []netaddr.IPPrefix{
+					netaddr.MustParseIPPrefix("100.64.0.2/32"),
+				},
+			},
+		},
+	}
+	tests := []struct {
+		want   string
+		wantIP string // or empty if not found
+	}{
+		{"100.64.0.1", "100.64.0.1"},
+		{"fd7a:115c:a1e0::1", "fd7a:115c:a1e0::1"},
+		{"100.64.0.3", ""},
+		{"bar", "100.64.0.2"},
+		{"BAR", "100.64.0.2"},
+		{"bar.example.ts.net", "100.64.0.2"},
+		{"bar.example.ts.net.", "100.64.0.2"},
+		{"baz", ""},
+	}
+	for _, tt := range tests {
+		ip, ok := findExitNodeIP(nm, tt.want)
+		if tt.wantIP == "" {
+			if ok {
+				t.Errorf("findExitNodeIP(%q) = %v; want not found", tt.want, ip)
+			}
+			continue
+		}
+		if !ok || ip != netaddr.MustParseIP(tt.wantIP) {
+			t.Errorf("findExitNodeIP(%q) = %v, %v; want %v", tt.want, ip, ok, tt.wantIP)
+		}
+	}
+	if _, ok := findExitNodeIP(nil, "bar"); ok {
+		t.Errorf("findExitNodeIP(nil) found a node")
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"context"
+	"time"
+)
+
+// idleTrafficThreshold is the most peer traffic, in bytes, that can
+// pass between two idle checks with the server still considered
+// idle. It leaves room for keepalives and the like.
+const idleTrafficThreshold = 64 << 10
+
+// idleCheckInterval returns how often to check for activity when
+// exiting after timeout of idleness.
+func idleCheckInterval(timeout time.Duration) time.Duration {
+	d := timeout / 10
+	if d < 100*time.Millisecond {
+		d = 100 * time.Millisecond
+	}
+	if d > time.Minute {
+		d = time.Minute
+	}
+	return d
+}
+
+// idleActivity is a snapshot of what keeps the server busy.
+type idleActivity struct {
+	conns     int    // open frontend connections
+	peerBytes int64  // total bytes sent to and received from peers
+	authURL   string // non-empty while an interactive login is in progress
+	state     string // backend state, for logging
+}
+
+// idleTracker implements Options.IdleExit. It's fed periodic
+// snapshots of the server's activity and decides when the server
+// has been idle long enough to exit.
+type idleTracker struct {
+	timeout time.Duration
+
+	idleSince time.Time // when the server became idle; zero if busy
+	lastBytes int64     // peerBytes at the previous observation
+	observed  bool      // whether lastBytes is valid
+}
+
+// observe records activity a seen at now and reports whether the
+// server has now been idle for the tracker's timeout.
+func (t *idleTracker) observe(now time.Time, a idleActivity) bool {
+	busyTraffic := t.observed && a.peerBytes-t.lastBytes > idleTrafficThreshold
+	t.lastBytes = a.peerBytes
+	t.observed = true
+	if a.conns > 0 || a.authURL != "" || busyTraffic {
+		t.idleSince = time.Time{}
+		return false
+	}
+	if t.idleSince.IsZero() {
+		t.idleSince = now
+	}
+	return now.Sub(t.idleSince) >= t.timeout
+}
+
+// activity returns a snapshot of the server's current activity.
+func (s *server) activity() idleActivity {
+	s.mu.Lock()
+	conns := len(s.allClients)
+	s.mu.Unlock()
+
+	st := s.b.Status()
+	a := idleActivity{
+		conns:   conns,
+		authURL: st.AuthURL,
+		state:   st.BackendState,
+	}
+	for _, ps := range st.Peer {
+		a.peerBytes += ps.RxBytes + ps.TxBytes
+	}
+	return a
+}
+
+// runIdleExit calls exit once the server has been idle for timeout,
+// or returns early when ctx is done.
+func (s *server) runIdleExit(ctx context.Context, timeout time.Duration, exit func()) {
+	interval := idleCheckInterval(timeout)
+	t := &idleTracker{timeout: timeout}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		a := s.activity()
+		if t.observe(time.Now(), a) {
+			s.logf("ipnserver: idle for %v (no frontend connections, no login in progress, peer traffic under %d bytes per %v, backend state %v); exiting",
+				timeout, idleTrafficThreshold, interval, a.state)
+			exit()
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+	}
+}
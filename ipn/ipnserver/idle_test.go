@@ -0,0 +1,87 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnserver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIdleTracker(t *testing.T) {
+	const timeout = time.Minute
+	start := time.Unix(1000, 0)
+	type step struct {
+		at   time.Duration // since start
+		a    idleActivity
+		want bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "idle",
+			steps: []step{
+				{0, idleActivity{}, false},
+				{30 * time.Second, idleActivity{}, false},
+				{60 * time.Second, idleActivity{}, true},
+			},
+		},
+		{
+			name: "frontend_connected",
+			steps: []step{
+				{0, idleActivity{}, false},
+				{50 * time.Second, idleActivity{conns: 1}, false},
+				{70 * time.Second, idleActivity{}, false},
+				{110 * time.Second, idleActivity{}, false},
+				{130 * time.Second, idleActivity{}, true},
+			},
+		},
+		{
+			name: "mid_login",
+			steps: []step{
+				{0, idleActivity{authURL: "https://login.example.com/a/1"}, false},
+				{90 * time.Second, idleActivity{authURL: "https://login.example.com/a/1"}, false},
+				{100 * time.Second, idleActivity{}, false},
+				{160 * time.Second, idleActivity{}, true},
+			},
+		},
+		{
+			name: "peer_traffic",
+			steps: []step{
+				{0, idleActivity{peerBytes: 5 << 20}, false}, // first sample isn't traffic
+				{30 * time.Second, idleActivity{peerBytes: 6 << 20}, false},
+				{60 * time.Second, idleActivity{peerBytes: 7 << 20}, false},
+				{90 * time.Second, idleActivity{peerBytes: 7<<20 + 100}, false}, // just keepalives
+				{150 * time.Second, idleActivity{peerBytes: 7<<20 + 200}, true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := &idleTracker{timeout: timeout}
+			for i, st := range tt.steps {
+				if got := tr.observe(start.Add(st.at), st.a); got != st.want {
+					t.Fatalf("step %d (%v): observe = %v; want %v", i, st.at, got, st.want)
+				}
+			}
+		})
+	}
+}
+
+func TestIdleCheckInterval(t *testing.T) {
+	tests := []struct {
+		timeout, want time.Duration
+	}{
+		{time.Second, 100 * time.Millisecond},
+		{10 * time.Second, time.Second},
+		{30 * time.Minute, time.Minute},
+	}
+	for _, tt := range tests {
+		if got := idleCheckInterval(tt.timeout); got != tt.want {
+			t.Errorf("idleCheckInterval(%v) = %v; want %v", tt.timeout, got, tt.want)
+		}
+	}
+}
@@ -33,12 +33,14 @@ import (
 	"tailscale.com/control/controlclient"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnlocal"
+	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/ipn/localapi"
 	"tailscale.com/log/filelogger"
 	"tailscale.com/logtail/backoff"
 	"tailscale.com/net/netstat"
 	"tailscale.com/safesocket"
 	"tailscale.com/smallzstd"
+	"tailscale.com/tailcfg"
 	"tailscale.com/types/logger"
 	"tailscale.com/util/groupmember"
 	"tailscale.com/util/pidowner"
@@ -51,13 +53,22 @@ import (
 // Options is the configuration of the Tailscale node agent.
 type Options struct {
 	// SocketPath, on unix systems, is the unix socket path to listen
-	// on for frontend connections.
+	// on for frontend connections. On Linux, a path beginning with
+	// "@" (e.g. "@tailscale") is instead the name of an abstract
+	// socket, which has no file and so can't be left behind stale.
 	SocketPath string
 
 	// Port, on windows, is the localhost TCP port to listen on for
-	// frontend connections.
+	// frontend connections. If zero, a free port is chosen and
+	// logged.
 	Port int
 
+	// Listener, if non-nil, is an already listening socket to
+	// accept frontend connections on, such as one passed by systemd
+	// socket activation. SocketPath and Port are then not used to
+	// create one. Connections already queued on it are served.
+	Listener net.Listener
+
 	// StatePath is the path to the stored agent state.
 	StatePath string
 
@@ -85,6 +96,57 @@ type Options struct {
 	// DebugMux, if non-nil, specifies an HTTP ServeMux in which
 	// to register a debug handler.
 	DebugMux *http.ServeMux
+
+	// BootstrapPrefs, if non-nil, are edits applied to the
+	// default prefs on first start, when no prefs have been saved
+	// yet for AutostartStateKey. They're ignored if
+	// AutostartStateKey is empty or prefs already exist.
+	BootstrapPrefs *ipn.MaskedPrefs
+
+	// DefaultControlURL, if non-empty, is the control server URL
+	// that frontends use when not told otherwise, such as
+	// "tailscale up" without --login-server.
+	DefaultControlURL string
+
+	// AuthKey, if non-empty, is a node auth key with which to log
+	// in on first start, when BootstrapPrefs are written. It's
+	// ignored once the node has saved prefs, so a node that was
+	// logged out stays logged out across restarts.
+	AuthKey string
+
+	// ExitNode, if non-empty, is the Tailscale IP or MagicDNS name
+	// of a peer to use as an exit node. It's applied to the prefs
+	// once a network map containing that peer arrives, as peers
+	// may not be known at startup.
+	ExitNode string
+
+	// IdleExit, if non-zero, makes Run return nil once the server
+	// has been idle for that long: no frontend connections, no
+	// interactive login in progress, and next to no traffic with
+	// peers. It's meant for on-demand use with socket activation,
+	// where the service manager starts the daemon again on the
+	// next frontend connection.
+	//
+	// With SurviveDisconnects, exiting also takes the node off the
+	// tailnet until then, so inbound connections from peers that
+	// haven't sent traffic recently will fail.
+	IdleExit time.Duration
+
+	// SkipGoingAway, if true, makes shutdown skip telling the
+	// control server that the node is disconnecting. By default
+	// the server tells control, bounded by a short timeout, so
+	// peers stop trying to reach the node directly.
+	SkipGoingAway bool
+
+	// NetstackConns, if non-nil, returns the table of connections
+	// netstack is forwarding, for the LocalAPI. It's set when
+	// netstack is in use.
+	NetstackConns func(withHistory bool) *ipnstate.NetstackConns
+
+	// NetstackForwarder, if non-nil, reads and changes netstack's
+	// inbound TCP forward rules, for the LocalAPI. It's set when
+	// netstack is in use.
+	NetstackForwarder ipnlocal.NetstackForwarder
 }
 
 // server is an IPN backend and its set of 0 or more active connections
@@ -109,6 +171,9 @@ type server struct {
 	allClients     map[net.Conn]connIdentity    // HTTP or IPN
 	clients        map[net.Conn]bool            // subset of allClients; only IPN protocol
 	disconnectSub  map[chan<- struct{}]struct{} // keys are subscribers of disconnects
+	exitNodeWant   string                       // Options.ExitNode, until applied
+	exitNodeWarned bool                         // whether we logged that exitNodeWant wasn't found
+	bootstrapLogin bool                         // whether to log in with Options.AuthKey once the backend needs it
 }
 
 // connIdentity represents the owner of a localhost TCP or unix socket connection.
@@ -556,6 +621,18 @@ func (s *server) writeToClients(n ipn.Notify) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if n.State != nil && *n.State == ipn.NeedsLogin && s.bootstrapLogin {
+		s.bootstrapLogin = false
+		s.logf("ipnserver: logging in with auth key")
+		go s.b.StartLoginInteractive()
+	}
+
+	if n.NetMap != nil && s.exitNodeWant != "" {
+		// In a new goroutine, as EditPrefs sends notifications
+		// of its own.
+		go s.maybeApplyExitNode(n.NetMap)
+	}
+
 	if inServerMode {
 		if s.serverModeUser == nil {
 			s.setServerModeUserLocked()
@@ -585,18 +662,32 @@ func (s *server) writeToClients(n ipn.Notify) {
 // The getEngine func is called repeatedly, once per connection, until it returns an engine successfully.
 func Run(ctx context.Context, logf logger.Logf, logid string, getEngine func() (wgengine.Engine, error), opts Options) error {
 	getEngine = getEngineUntilItWorksWrapper(getEngine)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	runDone := make(chan struct{})
 	defer close(runDone)
 
-	listen, _, err := safesocket.Listen(opts.SocketPath, uint16(opts.Port))
-	if err != nil {
-		return fmt.Errorf("safesocket.Listen: %v", err)
+	listen := opts.Listener
+	var err error
+	if listen == nil {
+		if runtime.GOOS == "linux" && strings.HasPrefix(opts.SocketPath, "@") {
+			opts.SocketPath = "\x00" + opts.SocketPath[1:]
+		}
+		var gotPort uint16
+		listen, gotPort, err = safesocket.Listen(opts.SocketPath, uint16(opts.Port))
+		if err != nil {
+			return fmt.Errorf("safesocket.Listen: %v", err)
+		}
+		if opts.Port == 0 && gotPort != 0 {
+			logf("IPN server listening on localhost port %d", gotPort)
+		}
 	}
 
 	server := &server{
 		backendLogID: logid,
 		logf:         logf,
 		resetOnZero:  !opts.SurviveDisconnects,
+		exitNodeWant: opts.ExitNode,
 	}
 
 	// When the context is closed or when we return, whichever is first, close our listner
@@ -638,6 +729,13 @@ func Run(ctx context.Context, logf logger.Logf, logid string, getEngine func() (
 	} else {
 		store = &ipn.MemoryStore{}
 	}
+	var bootstrapped bool // whether this is the first start, for opts.AuthKey
+	if opts.BootstrapPrefs != nil && opts.AutostartStateKey != "" {
+		bootstrapped, err = writeBootstrapPrefs(logf, store, opts.AutostartStateKey, opts.BootstrapPrefs)
+		if err != nil {
+			return err
+		}
+	}
 
 	bo := backoff.NewBackoff("ipnserver", logf, 30*time.Second)
 	var unservedConn net.Conn // if non-nil, accepted, but hasn't served yet
@@ -678,28 +776,78 @@ func Run(ctx context.Context, logf logger.Logf, logid string, getEngine func() (
 		return fmt.Errorf("NewLocalBackend: %v", err)
 	}
 	defer b.Shutdown()
+	b.SetGoingAwayOnShutdown(!opts.SkipGoingAway)
 	b.SetDecompressor(func() (controlclient.Decompressor, error) {
 		return smallzstd.NewDecoder(nil)
 	})
+	if opts.NetstackConns != nil {
+		b.SetNetstackConnsFunc(opts.NetstackConns)
+	}
+	if opts.NetstackForwarder != nil {
+		b.SetNetstackForwarder(opts.NetstackForwarder)
+	}
+	b.SetDefaultControlURL(opts.DefaultControlURL)
 
 	if opts.DebugMux != nil {
 		opts.DebugMux.HandleFunc("/debug/ipn", func(w http.ResponseWriter, r *http.Request) {
 			serveHTMLStatus(w, b)
 		})
+		opts.DebugMux.HandleFunc("/debug/prefs", func(w http.ResponseWriter, r *http.Request) {
+			// Prefs are returned without their private keys.
+			serveDebugJSON(w, b.Prefs())
+		})
+		opts.DebugMux.HandleFunc("/debug/status", func(w http.ResponseWriter, r *http.Request) {
+			serveDebugJSON(w, b.Status())
+		})
+		opts.DebugMux.HandleFunc("/debug/state", func(w http.ResponseWriter, r *http.Request) {
+			serveDebugJSON(w, b.StatusWithoutPeers())
+		})
+		opts.DebugMux.HandleFunc("/debug/peers", func(w http.ResponseWriter, r *http.Request) {
+			serveDebugJSON(w, b.Status().Peer)
+		})
+		opts.DebugMux.HandleFunc("/debug/routes", func(w http.ResponseWriter, r *http.Request) {
+			serveDebugJSON(w, debugRoutes(b))
+		})
+		opts.DebugMux.HandleFunc("/debug/dns", func(w http.ResponseWriter, r *http.Request) {
+			serveDebugJSON(w, debugDNS(b))
+		})
+		opts.DebugMux.HandleFunc("/debug/netstack", func(w http.ResponseWriter, r *http.Request) {
+			conns, err := b.NetstackConns(true)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			serveDebugJSON(w, conns)
+		})
 	}
 
 	server.b = b
 	server.bs = ipn.NewBackendServer(logf, b, server.writeToClients)
 
 	if opts.AutostartStateKey != "" {
+		startOpts := ipn.Options{StateKey: opts.AutostartStateKey}
+		if bootstrapped && opts.AuthKey != "" {
+			startOpts.AuthKey = opts.AuthKey
+			server.mu.Lock()
+			server.bootstrapLogin = true
+			server.mu.Unlock()
+		}
 		server.bs.GotCommand(context.TODO(), &ipn.Command{
 			Version: version.Long,
 			Start: &ipn.StartArgs{
-				Opts: ipn.Options{StateKey: opts.AutostartStateKey},
+				Opts: startOpts,
 			},
 		})
 	}
 
+	idleExited := make(chan struct{})
+	if opts.IdleExit > 0 {
+		go server.runIdleExit(ctx, opts.IdleExit, func() {
+			close(idleExited)
+			cancel()
+		})
+	}
+
 	systemd.Ready()
 	for i := 1; ctx.Err() == nil; i++ {
 		var c net.Conn
@@ -719,9 +867,35 @@ func Run(ctx context.Context, logf logger.Logf, logid string, getEngine func() (
 		}
 		go server.serveConn(ctx, c, logger.WithPrefix(logf, fmt.Sprintf("ipnserver: conn%d: ", i)))
 	}
+	select {
+	case <-idleExited:
+		return nil
+	default:
+	}
 	return ctx.Err()
 }
 
+// writeBootstrapPrefs writes the default prefs, with mp applied, to
+// store under key, if store has no prefs saved for key yet. It
+// reports whether it wrote them.
+func writeBootstrapPrefs(logf logger.Logf, store ipn.StateStore, key ipn.StateKey, mp *ipn.MaskedPrefs) (wrote bool, err error) {
+	_, err = store.ReadState(key)
+	if err == nil {
+		return false, nil
+	}
+	if !errors.Is(err, ipn.ErrStateNotExist) {
+		return false, fmt.Errorf("calling ReadState for %q: %w", key, err)
+	}
+	p := ipn.NewPrefs()
+	p.WantRunning = false
+	p.ApplyEdits(mp)
+	logf("ipnserver: writing bootstrap prefs for %q: %v", key, mp.Pretty())
+	if err := store.WriteState(key, p.ToBytes()); err != nil {
+		return false, fmt.Errorf("writing bootstrap prefs: %w", err)
+	}
+	return true, nil
+}
+
 // BabysitProc runs the current executable as a child process with the
 // provided args, capturing its output, writing it to files, and
 // restarting the process on any crashes.
@@ -945,6 +1119,63 @@ func serveHTMLStatus(w http.ResponseWriter, b *ipnlocal.LocalBackend) {
 	st.WriteHTML(w)
 }
 
+// debugRoutes returns the node's routes, for the /debug/routes
+// handler: its own addresses and advertised routes, and the IPs
+// routed to each peer.
+func debugRoutes(b *ipnlocal.LocalBackend) interface{} {
+	type peerRoutes struct {
+		Name          string
+		AllowedIPs    []netaddr.IPPrefix
+		PrimaryRoutes []netaddr.IPPrefix `json:",omitempty"`
+	}
+	var ret struct {
+		Addresses       []netaddr.IPPrefix
+		AdvertiseRoutes []netaddr.IPPrefix
+		ExitNodeID      tailcfg.StableNodeID `json:",omitempty"`
+		Peers           []peerRoutes
+	}
+	if p := b.Prefs(); p != nil {
+		ret.AdvertiseRoutes = p.AdvertiseRoutes
+		ret.ExitNodeID = p.ExitNodeID
+	}
+	if nm := b.NetMap(); nm != nil {
+		ret.Addresses = nm.Addresses
+		for _, p := range nm.Peers {
+			ret.Peers = append(ret.Peers, peerRoutes{
+				Name:          p.Name,
+				AllowedIPs:    p.AllowedIPs,
+				PrimaryRoutes: p.PrimaryRoutes,
+			})
+		}
+	}
+	return ret
+}
+
+// debugDNS returns the node's DNS configuration, for the /debug/dns
+// handler.
+func debugDNS(b *ipnlocal.LocalBackend) interface{} {
+	var ret struct {
+		CorpDNS bool               // whether the node accepts the DNS config
+		Config  *tailcfg.DNSConfig // from the control server, or nil
+	}
+	if p := b.Prefs(); p != nil {
+		ret.CorpDNS = p.CorpDNS
+	}
+	if nm := b.NetMap(); nm != nil {
+		ret.Config = &nm.DNS
+	}
+	return ret
+}
+
+// serveDebugJSON writes v to w as indented JSON, for the debug
+// handlers.
+func serveDebugJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(v)
+}
+
 func peerPid(entries []netstat.Entry, la, ra netaddr.IPPort) int {
 	for _, e := range entries {
 		if e.Local == ra && e.Remote == la {
@@ -7,9 +7,12 @@ package ipnserver_test
 import (
 	"context"
 	"fmt"
+	"net"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnserver"
@@ -69,3 +72,73 @@ func TestRunMultipleAccepts(t *testing.T) {
 	err = ipnserver.Run(ctx, logTriggerTestf, "dummy_logid", ipnserver.FixedEngine(eng), opts)
 	t.Logf("ipnserver.Run = %v", err)
 }
+
+func TestRunIdleExit(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "tailscale.sock")
+
+	var mu sync.Mutex
+	var exitLog string
+	logf := func(format string, args ...interface{}) {
+		msg := fmt.Sprintf(format, args...)
+		if strings.Contains(msg, "exiting") {
+			mu.Lock()
+			exitLog = msg
+			mu.Unlock()
+		}
+		t.Log(msg)
+	}
+
+	eng, err := wgengine.NewFakeUserspaceEngine(logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer eng.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	const idleExit = 2 * time.Second
+	opts := ipnserver.Options{
+		SocketPath: socketPath,
+		IdleExit:   idleExit,
+	}
+	start := time.Now()
+	errc := make(chan error, 1)
+	go func() { errc <- ipnserver.Run(ctx, logf, "dummy_logid", ipnserver.FixedEngine(eng), opts) }()
+
+	// A connected frontend keeps the server running.
+	var c net.Conn
+	for {
+		c, err = safesocket.Connect(socketPath, 0)
+		if err == nil {
+			break
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("connecting: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Say something, so the server doesn't wait to see whether
+	// it's an HTTP request before counting the connection.
+	bc := ipn.NewBackendClient(logf, func(b []byte) { ipn.WriteMsg(c, b) })
+	bc.RequestStatus()
+	select {
+	case err := <-errc:
+		t.Fatalf("Run returned with a frontend connected: %v", err)
+	case <-time.After(3 * idleExit):
+	}
+
+	connClosed := time.Now()
+	c.Close()
+	if err := <-errc; err != nil {
+		t.Fatalf("Run = %v; want nil after idle exit", err)
+	}
+	if d := time.Since(connClosed); d < idleExit {
+		t.Errorf("exited %v after the last frontend left; want at least %v", d, idleExit)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !strings.Contains(exitLog, "idle for") {
+		t.Errorf("exit log = %q; want reason", exitLog)
+	}
+}
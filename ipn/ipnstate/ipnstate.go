@@ -52,6 +52,16 @@ type Status struct {
 	// trailing periods, and without any "_acme-challenge." prefix.
 	CertDomains []string
 
+	// Health contains a human-readable line for each of the node's
+	// subsystems that's currently failing, such as applying the
+	// route configuration. It's empty if none are.
+	Health []string `json:",omitempty"`
+
+	// DefaultControlURL, if non-empty, is the control server URL
+	// the daemon was configured with (tailscaled's --login-server),
+	// for "tailscale up" to use when it isn't given --login-server.
+	DefaultControlURL string `json:",omitempty"`
+
 	Peer map[key.Public]*PeerStatus
 	User map[tailcfg.UserID]tailcfg.UserProfile
 }
@@ -454,6 +464,107 @@ type PingResult struct {
 	// TODO(bradfitz): details like whether port mapping was used on either side? (Once supported)
 }
 
+// PathEvent is an entry in a peer's path history: a change in how
+// packets reach the peer, or a round-trip time sample.
+type PathEvent struct {
+	Time time.Time
+
+	// Kind is one of "direct" (a direct UDP path was found),
+	// "endpoint-changed" (a different direct UDP path was chosen),
+	// "derp" (packets are only being relayed via DERP), or "rtt"
+	// (a latency sample).
+	Kind string
+
+	// Endpoint is the ip:port of the direct UDP path, if any.
+	Endpoint string `json:",omitempty"`
+
+	// LatencySeconds is the disco ping round-trip time, for "rtt"
+	// events.
+	LatencySeconds float64 `json:",omitempty"`
+}
+
+// PeerPathHistory is the recent path history of a peer, oldest first.
+type PeerPathHistory struct {
+	PublicKey tailcfg.NodeKey
+	Events    []PathEvent
+}
+
+// DNSQueryLog is the state of the in-daemon DNS resolver's query log.
+type DNSQueryLog struct {
+	// EnabledUntil is when query logging turns itself off, or the
+	// zero time if it's off.
+	EnabledUntil time.Time
+
+	// Entries are the most recently logged queries, oldest first.
+	Entries []DNSQueryLogEntry
+}
+
+// DNSQueryLogEntry is a DNS query handled by the in-daemon resolver,
+// as recorded while query logging is on.
+type DNSQueryLogEntry struct {
+	// Seq numbers the entries in the order they were logged, which
+	// is when their queries finished, starting at 1. Pollers can
+	// use it to skip the entries they've already seen; Time can't
+	// be, as a slow query is logged after later, faster ones.
+	Seq uint64
+
+	Time time.Time // when the query arrived
+	Name string    // the queried name, with a trailing dot
+	Type string    // the query type, such as "A" or "AAAA"
+
+	// Route is "local" for queries answered from the resolver's
+	// own records (MagicDNS), or else the suffix of the route the
+	// query was forwarded by, such as "." for the default route.
+	Route string
+
+	// Upstream is the ip:port, or DNS-over-HTTPS URL, of the
+	// nameserver that answered a forwarded query.
+	Upstream string `json:",omitempty"`
+
+	// Answer summarizes the response, such as
+	// "NOERROR A 100.101.102.103".
+	Answer string `json:",omitempty"`
+
+	// Error is why no response was sent, if so.
+	Error string `json:",omitempty"`
+
+	LatencySeconds float64
+}
+
+// NetstackConns is the table of connections that netstack is
+// forwarding on behalf of the tailnet, such as a userspace subnet
+// router's flows to its subnets.
+type NetstackConns struct {
+	// Active are the flows being forwarded now, oldest first.
+	Active []NetstackConn
+
+	// Closed, if requested, are the most recently finished flows,
+	// oldest first.
+	Closed []NetstackConn `json:",omitempty"`
+}
+
+// NetstackConn is a TCP or UDP flow forwarded by netstack.
+type NetstackConn struct {
+	Proto string         // "tcp" or "udp"
+	Src   netaddr.IPPort // the tailnet peer's address
+	Dst   netaddr.IPPort // the address it connected to
+
+	// State is "dialing" while a TCP flow's backend connection is
+	// being made, then "established", then "closed", or "failed"
+	// if the backend connection couldn't be made. UDP flows are
+	// "established" until they time out.
+	State string
+
+	Started time.Time
+	Ended   time.Time // zero while active
+
+	// AgeSeconds is how long the flow has been (or was) open.
+	AgeSeconds float64
+
+	TxBytes int64 // bytes from Src sent on to Dst
+	RxBytes int64 // bytes from Dst sent back to Src
+}
+
 func SortPeers(peers []*PeerStatus) {
 	sort.Slice(peers, func(i, j int) bool { return sortKey(peers[i]) < sortKey(peers[j]) })
 }
@@ -18,6 +18,7 @@ import (
 	"net/url"
 	"reflect"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -100,6 +101,8 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.serveLogout(w, r)
 	case "/localapi/v0/prefs":
 		h.servePrefs(w, r)
+	case "/localapi/v0/start":
+		h.serveStart(w, r)
 	case "/localapi/v0/check-ip-forwarding":
 		h.serveCheckIPForwarding(w, r)
 	case "/localapi/v0/bugreport":
@@ -110,6 +113,20 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.serveSetDNS(w, r)
 	case "/localapi/v0/derpmap":
 		h.serveDERPMap(w, r)
+	case "/localapi/v0/path-history":
+		h.servePathHistory(w, r)
+	case "/localapi/v0/debug-advance-clock":
+		h.serveDebugAdvanceClock(w, r)
+	case "/localapi/v0/debug-inject-link-change":
+		h.serveDebugInjectLinkChange(w, r)
+	case "/localapi/v0/dns-query-log":
+		h.serveDNSQueryLog(w, r)
+	case "/localapi/v0/netstack-conns":
+		h.serveNetstackConns(w, r)
+	case "/localapi/v0/netstack-forwards":
+		h.serveNetstackForwards(w, r)
+	case "/localapi/v0/wg-device-logging":
+		h.serveWireGuardDeviceLogging(w, r)
 	case "/":
 		io.WriteString(w, "tailscaled\n")
 	default:
@@ -128,6 +145,11 @@ func (h *Handler) serveBugReport(w http.ResponseWriter, r *http.Request) {
 	if note := r.FormValue("note"); len(note) > 0 {
 		h.logf("user bugreport note: %s", note)
 	}
+	if ph := h.b.PathHistory(); len(ph) > 0 {
+		if j, err := json.Marshal(ph); err == nil {
+			h.logf("user bugreport path history: %s", j)
+		}
+	}
 	w.Header().Set("Content-Type", "text/plain")
 	fmt.Fprintln(w, logMarker)
 }
@@ -238,6 +260,7 @@ func (h *Handler) servePrefs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var prefs *ipn.Prefs
+	var etag string
 	switch r.Method {
 	case "PATCH":
 		if !h.PermitWrite {
@@ -249,24 +272,63 @@ func (h *Handler) servePrefs(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), 400)
 			return
 		}
-		var err error
-		prefs, err = h.b.EditPrefs(mp)
+		// An If-Match header makes the edit conditional on the
+		// prefs not having changed since the client read them.
+		ifMatch := strings.Trim(r.Header.Get("If-Match"), `"`)
+		_, err := h.b.EditPrefsIfMatch(mp, ifMatch)
+		if err == ipnlocal.ErrPrefsChanged {
+			http.Error(w, err.Error(), http.StatusPreconditionFailed)
+			return
+		}
 		if err != nil {
 			http.Error(w, err.Error(), 400)
 			return
 		}
+		prefs, etag = h.b.PrefsWithETag()
 	case "GET", "HEAD":
-		prefs = h.b.Prefs()
+		prefs, etag = h.b.PrefsWithETag()
 	default:
 		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
 		return
 	}
+	w.Header().Set("ETag", `"`+etag+`"`)
 	w.Header().Set("Content-Type", "application/json")
 	e := json.NewEncoder(w)
 	e.SetIndent("", "\t")
 	e.Encode(prefs)
 }
 
+// serveStart starts the backend with the JSON-encoded ipn.Options in
+// the request body. Like a PATCH of prefs, an If-Match header makes
+// the start conditional on the prefs not having changed since the
+// client read them.
+func (h *Handler) serveStart(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "start access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "want POST", 400)
+		return
+	}
+	var opts ipn.Options
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	ifMatch := strings.Trim(r.Header.Get("If-Match"), `"`)
+	err := h.b.StartIfMatch(opts, ifMatch)
+	if err == ipnlocal.ErrPrefsChanged {
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (h *Handler) serveFiles(w http.ResponseWriter, r *http.Request) {
 	if !h.PermitWrite {
 		http.Error(w, "file access denied", http.StatusForbidden)
@@ -422,6 +484,269 @@ func (h *Handler) serveDERPMap(w http.ResponseWriter, r *http.Request) {
 	e.Encode(h.b.DERPMap())
 }
 
+func (h *Handler) servePathHistory(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "path history access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", 400)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(h.b.PathHistory())
+}
+
+// serveDebugAdvanceClock advances the fake clock of a tailscaled
+// started with TS_DEBUG_FAKE_CLOCK by the duration in the "d"
+// parameter, for integration tests.
+func (h *Handler) serveDebugAdvanceClock(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "want POST", 400)
+		return
+	}
+	d, err := time.ParseDuration(r.FormValue("d"))
+	if err != nil || d < 0 {
+		http.Error(w, "invalid duration", 400)
+		return
+	}
+	if err := h.b.DebugAdvanceClock(d); err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct{}{})
+}
+
+// serveDebugInjectLinkChange makes tailscaled act as if its link
+// monitor saw a network change, for tests. It requires tailscaled to
+// be started with TS_DEBUG_INJECT_LINK_CHANGE.
+func (h *Handler) serveDebugInjectLinkChange(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "want POST", 400)
+		return
+	}
+	if err := h.b.DebugInjectLinkChange(); err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct{}{})
+}
+
+// defaultDNSQueryLogDuration is how long DNS query logging stays on
+// if no duration is given.
+const defaultDNSQueryLogDuration = 10 * time.Minute
+
+// serveDNSQueryLog returns the DNS query log on GET. On POST, it
+// turns query logging on (with "enable=true" and an optional
+// "duration") or off (with "enable=false").
+func (h *Handler) serveDNSQueryLog(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		if !h.PermitRead {
+			http.Error(w, "DNS query log access denied", http.StatusForbidden)
+			return
+		}
+	case "POST":
+		if !h.PermitWrite {
+			http.Error(w, "DNS query log access denied", http.StatusForbidden)
+			return
+		}
+		enable, err := strconv.ParseBool(r.FormValue("enable"))
+		if err != nil {
+			http.Error(w, "invalid enable value", 400)
+			return
+		}
+		d := defaultDNSQueryLogDuration
+		if v := r.FormValue("duration"); v != "" {
+			d, err = time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				http.Error(w, "invalid duration", 400)
+				return
+			}
+		}
+		if !enable {
+			d = 0
+		}
+		h.b.SetDNSQueryLogging(d)
+	default:
+		http.Error(w, "want GET or POST", 400)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(h.b.DNSQueryLog())
+}
+
+// serveNetstackConns returns the connections netstack is forwarding.
+// With "history=true", the most recently closed ones are included.
+func (h *Handler) serveNetstackConns(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "netstack conns access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", 400)
+		return
+	}
+	conns, err := h.b.NetstackConns(defBool(r.FormValue("history"), false))
+	if err != nil {
+		writeErrorJSON(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(conns)
+}
+
+// serveNetstackForwards returns netstack's inbound TCP forward rules,
+// in the "tcp/PORT:IP:PORT[;proxy-proto=v2]" form of --netstack-forward,
+// as {"Rules": [...]}. On PUT, it first replaces them with the rules
+// in a JSON body of the same form. On POST, it first adds the rules
+// in the "add" parameters and removes those for the ports in the
+// "remove" parameters. Changes are atomic, take effect immediately,
+// and persist across restarts.
+func (h *Handler) serveNetstackForwards(w http.ResponseWriter, r *http.Request) {
+	type forwards struct {
+		Rules []string
+	}
+	var rules []string
+	var err error
+	switch r.Method {
+	case "GET":
+		if !h.PermitRead {
+			http.Error(w, "netstack forwards access denied", http.StatusForbidden)
+			return
+		}
+		rules, err = h.b.NetstackForwardRules()
+	case "PUT":
+		if !h.PermitWrite {
+			http.Error(w, "netstack forwards access denied", http.StatusForbidden)
+			return
+		}
+		var body forwards
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid JSON body", 400)
+			return
+		}
+		rules, err = h.b.EditNetstackForwardRules(func([]string) ([]string, error) {
+			return body.Rules, nil
+		})
+	case "POST":
+		if !h.PermitWrite {
+			http.Error(w, "netstack forwards access denied", http.StatusForbidden)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		add := r.Form["add"]
+		remove := make(map[uint16]bool)
+		for _, s := range r.Form["remove"] {
+			port, err := strconv.ParseUint(s, 10, 16)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid remove port %q", s), 400)
+				return
+			}
+			remove[uint16(port)] = true
+		}
+		rules, err = h.b.EditNetstackForwardRules(func(cur []string) ([]string, error) {
+			var ret []string
+			for _, rule := range cur {
+				if port, ok := forwardRulePort(rule); ok && remove[port] {
+					continue
+				}
+				ret = append(ret, rule)
+			}
+			return append(ret, add...), nil
+		})
+	default:
+		http.Error(w, "want GET, PUT or POST", 400)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	sort.Strings(rules)
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(forwards{Rules: makeNonNilStrings(rules)})
+}
+
+// forwardRulePort returns the port of a netstack forward rule of the
+// form "tcp/PORT:IP:PORT[;proxy-proto=v2]", and whether it has one.
+func forwardRulePort(rule string) (port uint16, ok bool) {
+	if !strings.HasPrefix(rule, "tcp/") {
+		return 0, false
+	}
+	rule = strings.TrimPrefix(rule, "tcp/")
+	i := strings.Index(rule, ":")
+	if i == -1 {
+		return 0, false
+	}
+	p, err := strconv.ParseUint(rule[:i], 10, 16)
+	if err != nil {
+		return 0, false
+	}
+	return uint16(p), true
+}
+
+// makeNonNilStrings returns s, or an empty slice if s is nil, so it
+// encodes as a JSON array.
+func makeNonNilStrings(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+// serveWireGuardDeviceLogging reports whether wireguard-go's verbose
+// device logging is on. On POST, it first turns it on or off, per
+// the "enable" parameter.
+func (h *Handler) serveWireGuardDeviceLogging(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		if !h.PermitRead {
+			http.Error(w, "device logging access denied", http.StatusForbidden)
+			return
+		}
+	case "POST":
+		if !h.PermitWrite {
+			http.Error(w, "device logging access denied", http.StatusForbidden)
+			return
+		}
+		enable, err := strconv.ParseBool(r.FormValue("enable"))
+		if err != nil {
+			http.Error(w, "invalid enable value", 400)
+			return
+		}
+		h.b.SetWireGuardDeviceLogging(enable)
+	default:
+		http.Error(w, "want GET or POST", 400)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Enabled bool
+	}{h.b.WireGuardDeviceLogging()})
+}
+
 var dialPeerTransportOnce struct {
 	sync.Once
 	v *http.Transport
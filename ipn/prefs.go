@@ -116,6 +116,17 @@ type Prefs struct {
 	// connections. This overrides tailcfg.Hostinfo's ShieldsUp.
 	ShieldsUp bool
 
+	// NoTailnetIPv4 and NoTailnetIPv6 specify whether to leave this
+	// node's Tailscale IPv4 or IPv6 address unconfigured. The address
+	// is still assigned by the control server and shown in status,
+	// but no interface address or routes are installed for it, and
+	// peers' addresses of that family are ignored. At most one of
+	// these should be true.
+	// These correspond to "tailscale up --tailnet-ipv4" and
+	// "--tailnet-ipv6", which default to true.
+	NoTailnetIPv4 bool
+	NoTailnetIPv6 bool
+
 	// AdvertiseTags specifies groups that this node wants to join, for
 	// purposes of ACL enforcement. These can be referenced from the ACL
 	// security policy. Note that advertising a tag doesn't guarantee that
@@ -202,6 +213,8 @@ type MaskedPrefs struct {
 	WantRunningSet            bool `json:",omitempty"`
 	LoggedOutSet              bool `json:",omitempty"`
 	ShieldsUpSet              bool `json:",omitempty"`
+	NoTailnetIPv4Set          bool `json:",omitempty"`
+	NoTailnetIPv6Set          bool `json:",omitempty"`
 	AdvertiseTagsSet          bool `json:",omitempty"`
 	HostnameSet               bool `json:",omitempty"`
 	OSVersionSet              bool `json:",omitempty"`
@@ -282,6 +295,12 @@ func (p *Prefs) pretty(goos string) string {
 	if p.ShieldsUp {
 		sb.WriteString("shields=true ")
 	}
+	if p.NoTailnetIPv4 {
+		sb.WriteString("tailnet-v4=false ")
+	}
+	if p.NoTailnetIPv6 {
+		sb.WriteString("tailnet-v6=false ")
+	}
 	if !p.ExitNodeIP.IsZero() {
 		fmt.Fprintf(&sb, "exit=%v lan=%t ", p.ExitNodeIP, p.ExitNodeAllowLANAccess)
 	} else if !p.ExitNodeID.IsZero() {
@@ -345,6 +364,8 @@ func (p *Prefs) Equals(p2 *Prefs) bool {
 		p.LoggedOut == p2.LoggedOut &&
 		p.NotepadURLs == p2.NotepadURLs &&
 		p.ShieldsUp == p2.ShieldsUp &&
+		p.NoTailnetIPv4 == p2.NoTailnetIPv4 &&
+		p.NoTailnetIPv6 == p2.NoTailnetIPv6 &&
 		p.NoSNAT == p2.NoSNAT &&
 		p.NetfilterMode == p2.NetfilterMode &&
 		p.OperatorUser == p2.OperatorUser &&
@@ -43,6 +43,8 @@ var _PrefsNeedsRegeneration = Prefs(struct {
 	WantRunning            bool
 	LoggedOut              bool
 	ShieldsUp              bool
+	NoTailnetIPv4          bool
+	NoTailnetIPv6          bool
 	AdvertiseTags          []string
 	Hostname               string
 	OSVersion              string
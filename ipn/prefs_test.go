@@ -44,6 +44,8 @@ func TestPrefsEqual(t *testing.T) {
 		"WantRunning",
 		"LoggedOut",
 		"ShieldsUp",
+		"NoTailnetIPv4",
+		"NoTailnetIPv6",
 		"AdvertiseTags",
 		"Hostname",
 		"OSVersion",
@@ -223,6 +225,22 @@ func TestPrefsEqual(t *testing.T) {
 			true,
 		},
 
+		{
+			&Prefs{NoTailnetIPv4: true},
+			&Prefs{NoTailnetIPv4: false},
+			false,
+		},
+		{
+			&Prefs{NoTailnetIPv6: true},
+			&Prefs{NoTailnetIPv6: false},
+			false,
+		},
+		{
+			&Prefs{NoTailnetIPv6: true},
+			&Prefs{NoTailnetIPv6: true},
+			true,
+		},
+
 		{
 			&Prefs{AdvertiseRoutes: nil},
 			&Prefs{AdvertiseRoutes: []netaddr.IPPrefix{}},
@@ -364,6 +382,11 @@ func TestPrefsPretty(t *testing.T) {
 			"windows",
 			"Prefs{ra=false mesh=false dns=false want=false shields=true Persist=nil}",
 		},
+		{
+			Prefs{NoTailnetIPv6: true},
+			"windows",
+			"Prefs{ra=false mesh=false dns=false want=false tailnet-v6=false Persist=nil}",
+		},
 		{
 			Prefs{AllowSingleHosts: true},
 			"windows",
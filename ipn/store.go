@@ -14,8 +14,11 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"syscall"
+	"time"
 
 	"tailscale.com/atomicfile"
+	"tailscale.com/health"
 )
 
 // ErrStateNotExist is returned by StateStore.ReadState when the
@@ -44,6 +47,11 @@ const (
 	// the server should start with the Prefs JSON loaded from
 	// StateKey "user-1234".
 	ServerModeStartKey = StateKey("server-mode-start-key")
+
+	// NetstackForwardsStateKey is the key under which the netstack
+	// inbound TCP forward rules set at runtime are stored, as a JSON
+	// array of rule strings, so they survive restarts.
+	NetstackForwardsStateKey = StateKey("_netstack-forwards")
 )
 
 // StateStore persists state, and produces it back on request.
@@ -85,12 +93,33 @@ func (s *MemoryStore) WriteState(id StateKey, bs []byte) error {
 	return nil
 }
 
+// Bounds on how often FileStore retries a failed write.
+var (
+	fileStoreMinRetry = time.Second
+	fileStoreMaxRetry = 30 * time.Second
+)
+
+// fileStoreWriteFile writes FileStore's file. It's a variable for
+// tests.
+var fileStoreWriteFile = atomicfile.WriteFile
+
 // FileStore is a StateStore that uses a JSON file for persistence.
+//
+// If the file can't be written, WriteState returns the error, but
+// keeps the new state in memory, so ReadState still returns it, and
+// reports the error to the health package. If the error may clear up
+// by itself, as when the filesystem has been remounted read-only, the
+// write is retried in the background with backoff until it succeeds.
+// Otherwise, as when the filesystem is full, the state is written out
+// by the next WriteState that succeeds.
 type FileStore struct {
 	path string
 
-	mu    sync.RWMutex
-	cache map[StateKey][]byte
+	mu         sync.RWMutex
+	cache      map[StateKey][]byte
+	writeErr   error         // last write error, if the file is stale
+	retryTimer *time.Timer   // non-nil if a retry is scheduled
+	retryDelay time.Duration // delay before the previous retry
 }
 
 func (s *FileStore) String() string { return fmt.Sprintf("FileStore(%q)", s.path) }
@@ -148,13 +177,90 @@ func (s *FileStore) ReadState(id StateKey) ([]byte, error) {
 func (s *FileStore) WriteState(id StateKey, bs []byte) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if bytes.Equal(s.cache[id], bs) {
+	if bytes.Equal(s.cache[id], bs) && s.writeErr == nil {
 		return nil
 	}
 	s.cache[id] = append([]byte(nil), bs...)
+	return s.flushLocked()
+}
+
+// flushLocked writes s.cache to s.path. If the write fails, the error
+// is noted and returned, and if it's retryable, a retry is scheduled.
+// Either way, the state stays readable from the cache.
+// s.mu must be held.
+func (s *FileStore) flushLocked() error {
 	bs, err := json.MarshalIndent(s.cache, "", "  ")
 	if err != nil {
 		return err
 	}
-	return atomicfile.WriteFile(s.path, bs, 0600)
+	if err := fileStoreWriteFile(s.path, bs, 0600); err != nil {
+		retry := isRetryableWriteError(err)
+		if s.writeErr == nil {
+			if retry {
+				log.Printf("%v: write failed, keeping state in memory and retrying: %v", s, err)
+			} else {
+				log.Printf("%v: write failed, keeping state in memory until a write succeeds: %v", s, err)
+			}
+		}
+		s.writeErr = err
+		health.SetStateStoreHealth(err)
+		if retry {
+			s.scheduleRetryLocked()
+		}
+		return fmt.Errorf("%v: %w", s, err)
+	}
+	if s.writeErr != nil {
+		log.Printf("%v: state written after earlier failure", s)
+		s.writeErr = nil
+		health.SetStateStoreHealth(nil)
+	}
+	if s.retryTimer != nil {
+		s.retryTimer.Stop()
+		s.retryTimer = nil
+	}
+	s.retryDelay = 0
+	return nil
+}
+
+// scheduleRetryLocked arranges for the cache to be written out again
+// after a delay that doubles with each consecutive failure, unless a
+// retry is already pending.
+// s.mu must be held.
+func (s *FileStore) scheduleRetryLocked() {
+	if s.retryTimer != nil {
+		return
+	}
+	d := s.retryDelay * 2
+	if d < fileStoreMinRetry {
+		d = fileStoreMinRetry
+	}
+	if d > fileStoreMaxRetry {
+		d = fileStoreMaxRetry
+	}
+	s.retryDelay = d
+	s.retryTimer = time.AfterFunc(d, s.retryWrite)
+}
+
+// isRetryableWriteError reports whether err, from writing the state
+// file, may go away without tailscaled doing anything, so that the
+// write is worth retrying in the background. That includes a
+// read-only filesystem or directory, as when an embedded device's
+// flash is remounted, which is fixed by remounting it writable.
+func isRetryableWriteError(err error) bool {
+	return errors.Is(err, syscall.EROFS) ||
+		errors.Is(err, syscall.EACCES) ||
+		errors.Is(err, syscall.EINTR) ||
+		errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, syscall.EBUSY) ||
+		os.IsTimeout(err)
+}
+
+func (s *FileStore) retryWrite() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retryTimer = nil
+	if s.writeErr == nil {
+		return
+	}
+	s.flushLocked()
 }
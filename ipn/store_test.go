@@ -5,10 +5,17 @@
 package ipn
 
 import (
+	"errors"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
+	"tailscale.com/atomicfile"
+	"tailscale.com/health"
 	"tailscale.com/tstest"
 )
 
@@ -125,3 +132,112 @@ func TestFileStore(t *testing.T) {
 		}
 	}
 }
+
+func TestFileStoreWriteRetry(t *testing.T) {
+	if os.Getuid() == 0 {
+		t.Skip("root can write to read-only directories")
+	}
+	defer func(min, max time.Duration) {
+		fileStoreMinRetry, fileStoreMaxRetry = min, max
+	}(fileStoreMinRetry, fileStoreMaxRetry)
+	fileStoreMinRetry, fileStoreMaxRetry = 10*time.Millisecond, 50*time.Millisecond
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state")
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WriteState("foo", []byte("bar")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chmod(dir, 0500); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(dir, 0700)
+	if err := store.WriteState("foo", []byte("baz")); err == nil {
+		t.Fatal("WriteState on read-only dir = nil; want error")
+	}
+	if bs, _ := store.ReadState("foo"); string(bs) != "baz" {
+		t.Errorf("ReadState = %q; want baz", bs)
+	}
+	if health.StateStoreHealth() == nil {
+		t.Error("no state store health error after failed write")
+	}
+	// Let a few retries fail.
+	time.Sleep(100 * time.Millisecond)
+
+	// Once the directory is writable again, the state is written
+	// without another WriteState.
+	if err := os.Chmod(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		disk, err := NewFileStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bs, _ := disk.ReadState("foo"); string(bs) == "baz" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("state not written after directory became writable")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := health.StateStoreHealth(); err != nil {
+		t.Errorf("state store health = %v after successful write", err)
+	}
+}
+
+func TestFileStoreWriteErrorNoRetry(t *testing.T) {
+	var mu sync.Mutex
+	full := true
+	defer func(f func(string, []byte, os.FileMode) error) { fileStoreWriteFile = f }(fileStoreWriteFile)
+	fileStoreWriteFile = func(path string, data []byte, perm os.FileMode) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if full {
+			return &os.PathError{Op: "write", Path: path, Err: syscall.ENOSPC}
+		}
+		return atomicfile.WriteFile(path, data, perm)
+	}
+
+	path := filepath.Join(t.TempDir(), "state")
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WriteState("foo", []byte("baz")); !errors.Is(err, syscall.ENOSPC) {
+		t.Fatalf("WriteState = %v; want ENOSPC", err)
+	}
+	if bs, _ := store.ReadState("foo"); string(bs) != "baz" {
+		t.Errorf("ReadState = %q; want baz", bs)
+	}
+	store.mu.Lock()
+	retrying := store.retryTimer != nil
+	store.mu.Unlock()
+	if retrying {
+		t.Error("retry scheduled for ENOSPC")
+	}
+
+	// Writing the same state again must still try to flush it.
+	mu.Lock()
+	full = false
+	mu.Unlock()
+	if err := store.WriteState("foo", []byte("baz")); err != nil {
+		t.Fatalf("WriteState after space was freed = %v", err)
+	}
+	disk, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bs, _ := disk.ReadState("foo"); string(bs) != "baz" {
+		t.Errorf("state on disk = %q; want baz", bs)
+	}
+	if err := health.StateStoreHealth(); err != nil {
+		t.Errorf("state store health = %v after successful write", err)
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logpolicy
+
+import "strings"
+
+// secretFlags are the names of command-line flags whose values are
+// secrets and mustn't be logged.
+var secretFlags = map[string]bool{
+	"authkey": true,
+}
+
+// redactArgs returns a copy of args, for logging, with the values
+// of secretFlags replaced. It understands both the "--flag=value"
+// and "--flag value" forms.
+func redactArgs(args []string) []string {
+	ret := make([]string, len(args))
+	copy(ret, args)
+	for i := 0; i < len(ret); i++ {
+		a := ret[i]
+		if !strings.HasPrefix(a, "-") {
+			continue
+		}
+		if a == "--" {
+			break
+		}
+		name := strings.TrimLeft(a, "-")
+		if j := strings.IndexByte(name, '='); j != -1 {
+			if secretFlags[name[:j]] {
+				ret[i] = a[:len(a)-len(name)] + name[:j] + "=REDACTED"
+			}
+			continue
+		}
+		if secretFlags[name] && i+1 < len(ret) {
+			ret[i+1] = "REDACTED"
+			i++
+		}
+	}
+	return ret
+}
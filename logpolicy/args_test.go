@@ -0,0 +1,48 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logpolicy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRedactArgs(t *testing.T) {
+	tests := []struct {
+		in   []string
+		want []string
+	}{
+		{
+			in:   []string{"tailscaled", "--state=/tmp/s"},
+			want: []string{"tailscaled", "--state=/tmp/s"},
+		},
+		{
+			in:   []string{"tailscaled", "--authkey=tskey-secret", "--verbose=1"},
+			want: []string{"tailscaled", "--authkey=REDACTED", "--verbose=1"},
+		},
+		{
+			in:   []string{"tailscaled", "-authkey", "tskey-secret", "--verbose=1"},
+			want: []string{"tailscaled", "-authkey", "REDACTED", "--verbose=1"},
+		},
+		{
+			in:   []string{"tailscaled", "--authkey-file=/run/tailscale/authkey"},
+			want: []string{"tailscaled", "--authkey-file=/run/tailscale/authkey"},
+		},
+		{
+			in:   []string{"tailscaled", "--authkey"},
+			want: []string{"tailscaled", "--authkey"},
+		},
+	}
+	for _, tt := range tests {
+		in := append([]string(nil), tt.in...)
+		got := redactArgs(tt.in)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("redactArgs(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+		if !reflect.DeepEqual(tt.in, in) {
+			t.Errorf("redactArgs modified its argument: %q", tt.in)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logpolicy
+
+import (
+	"fmt"
+	"strings"
+
+	"tailscale.com/types/flagtype"
+)
+
+// BufferSpec describes where logs are kept until they're uploaded.
+//
+// The zero value means to use the default on-disk buffer in the
+// logs directory.
+type BufferSpec struct {
+	// Memory, if true, buffers logs in memory only. Unsent logs
+	// are lost when the process exits.
+	Memory bool
+
+	// Path, if non-empty, is the file path prefix of an on-disk
+	// buffer to use instead of the default. Unsent logs in it are
+	// uploaded on the next run.
+	Path string
+
+	// MaxSize, if non-zero, is the maximum size in bytes of each
+	// of the on-disk buffer's files. Logs written while it's full
+	// are dropped.
+	MaxSize int64
+}
+
+// ParseBufferSpec parses a log buffer specification of the form
+// "memory" or "file:PATH[,maxsize=SIZE]", where SIZE is a byte count
+// with an optional KB, MB, or GB suffix. The empty string means the
+// default buffer.
+func ParseBufferSpec(s string) (BufferSpec, error) {
+	var bs BufferSpec
+	switch {
+	case s == "":
+		return bs, nil
+	case s == "memory":
+		bs.Memory = true
+		return bs, nil
+	case strings.HasPrefix(s, "file:"):
+	default:
+		return bs, fmt.Errorf("invalid log buffer %q; want \"memory\" or \"file:PATH[,maxsize=SIZE]\"", s)
+	}
+	f := strings.Split(strings.TrimPrefix(s, "file:"), ",")
+	bs.Path = f[0]
+	if bs.Path == "" {
+		return bs, fmt.Errorf("invalid log buffer %q: empty path", s)
+	}
+	for _, opt := range f[1:] {
+		kv := strings.SplitN(opt, "=", 2)
+		if len(kv) != 2 || kv[0] != "maxsize" {
+			return bs, fmt.Errorf("invalid log buffer %q: unknown option %q", s, opt)
+		}
+		if err := flagtype.ByteSizeValue(&bs.MaxSize, 0).Set(kv[1]); err != nil {
+			return bs, fmt.Errorf("invalid log buffer %q: %w", s, err)
+		}
+	}
+	return bs, nil
+}
@@ -0,0 +1,35 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logpolicy
+
+import "testing"
+
+func TestParseBufferSpec(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    BufferSpec
+		wantErr bool
+	}{
+		{in: "", want: BufferSpec{}},
+		{in: "memory", want: BufferSpec{Memory: true}},
+		{in: "file:/var/lib/tailscale/logbuf", want: BufferSpec{Path: "/var/lib/tailscale/logbuf"}},
+		{in: "file:/var/lib/tailscale/logbuf,maxsize=10MB", want: BufferSpec{Path: "/var/lib/tailscale/logbuf", MaxSize: 10 << 20}},
+		{in: "file:/tmp/x,maxsize=4096", want: BufferSpec{Path: "/tmp/x", MaxSize: 4096}},
+		{in: "file:", wantErr: true},
+		{in: "file:/tmp/x,maxsize=lots", wantErr: true},
+		{in: "file:/tmp/x,color=blue", wantErr: true},
+		{in: "disk", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseBufferSpec(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseBufferSpec(%q) error = %v; wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("ParseBufferSpec(%q) = %+v; want %+v", tt.in, got, tt.want)
+		}
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
@@ -340,9 +341,34 @@ func tryFixLogStateLocation(dir, cmdname string) {
 	}
 }
 
+// Options are optional settings for NewWithOptions.
+type Options struct {
+	// Buffer configures where logs are kept until they're
+	// uploaded. The zero value means the default on-disk buffer.
+	Buffer BufferSpec
+
+	// MaxUploadBandwidth, if non-zero, limits the average log
+	// upload rate, in bytes per second.
+	MaxUploadBandwidth int
+
+	// MaxBackoff, if non-zero, caps the delay between failed log
+	// upload attempts.
+	MaxBackoff time.Duration
+
+	// LogFile, if its Path is non-empty, is a local file that
+	// logs are also written to.
+	LogFile LogFile
+}
+
 // New returns a new log policy (a logger and its instance ID) for a
 // given collection name.
 func New(collection string) *Policy {
+	return NewWithOptions(collection, Options{})
+}
+
+// NewWithOptions is like New, but with optional settings for how
+// logs are buffered and uploaded.
+func NewWithOptions(collection string, opts Options) *Policy {
 	var lflags int
 	if term.IsTerminal(2) || runtime.GOOS == "windows" {
 		lflags = 0
@@ -429,7 +455,9 @@ func New(collection string) *Policy {
 			}
 			return w
 		},
-		HTTPC: &http.Client{Transport: newLogtailTransport(logtail.DefaultHost)},
+		HTTPC:              &http.Client{Transport: newLogtailTransport(logtail.DefaultHost)},
+		MaxUploadBandwidth: opts.MaxUploadBandwidth,
+		MaxBackoff:         opts.MaxBackoff,
 	}
 
 	if val := getLogTarget(); val != "" {
@@ -439,15 +467,41 @@ func New(collection string) *Policy {
 		c.HTTPC = &http.Client{Transport: newLogtailTransport(u.Host)}
 	}
 
-	filchBuf, filchErr := filch.New(filepath.Join(dir, cmdName), filch.Options{
-		ReplaceStderr: redirectStderrToLogPanics(),
-	})
+	var filchBuf *filch.Filch
+	var filchErr error
+	switch {
+	case opts.Buffer.Memory:
+		// Leave c.Buffer nil; logtail uses a memory buffer.
+	case opts.Buffer.Path != "":
+		filchBuf, filchErr = filch.New(opts.Buffer.Path, filch.Options{
+			ReplaceStderr: redirectStderrToLogPanics(),
+			MaxFileSize:   opts.Buffer.MaxSize,
+		})
+		if filchErr != nil {
+			filchErr = fmt.Errorf("log buffer %s unwritable, falling back to memory: %w", opts.Buffer.Path, filchErr)
+		}
+	default:
+		filchBuf, filchErr = filch.New(filepath.Join(dir, cmdName), filch.Options{
+			ReplaceStderr: redirectStderrToLogPanics(),
+			MaxFileSize:   opts.Buffer.MaxSize,
+		})
+	}
 	if filchBuf != nil {
 		c.Buffer = filchBuf
 		if filchBuf.OrigStderr != nil {
 			c.Stderr = filchBuf.OrigStderr
 		}
 	}
+	var logFileErr error
+	if opts.LogFile.Path != "" {
+		rf, err := newRotatingFile(opts.LogFile)
+		if err != nil {
+			logFileErr = fmt.Errorf("log file %s unwritable: %w", opts.LogFile.Path, err)
+		} else {
+			// The file first, as it never fails.
+			c.Stderr = io.MultiWriter(logWriter{log.New(rf, "", log.LstdFlags)}, c.Stderr)
+		}
+	}
 	lw := logtail.NewLogger(c, log.Printf)
 	log.SetFlags(0) // other logflags are set on console, not here
 	log.SetOutput(lw)
@@ -455,11 +509,14 @@ func New(collection string) *Policy {
 	log.Printf("Program starting: v%v, Go %v: %#v",
 		version.Long,
 		goVersion(),
-		os.Args)
+		redactArgs(os.Args))
 	log.Printf("LogID: %v", newc.PublicID)
 	if filchErr != nil {
 		log.Printf("filch failed: %v", filchErr)
 	}
+	if logFileErr != nil {
+		log.Printf("%v", logFileErr)
+	}
 	if earlyErrBuf.Len() != 0 {
 		log.Printf("%s", earlyErrBuf.Bytes())
 	}
@@ -0,0 +1,142 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logpolicy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Defaults for LogFile's rotation settings.
+const (
+	defaultLogFileMaxSize = 10 << 20
+	defaultLogFileKeep    = 3
+)
+
+// LogFile configures a local copy of the logs, kept in addition to
+// stderr and the log upload buffer.
+type LogFile struct {
+	// Path is the path of the current log file. Rotated files
+	// are named Path.1 (newest) through Path.Keep (oldest).
+	Path string
+
+	// MaxSize is the size in bytes at which the log file is
+	// rotated. Zero means 10MB.
+	MaxSize int64
+
+	// Keep is how many rotated files to keep. Zero means 3.
+	Keep int
+}
+
+// rotatingFile is an io.Writer that appends to a file, rotating it
+// when it grows too big.
+//
+// Write errors are reported once to stderr and otherwise ignored, so
+// a full or read-only disk doesn't stop the program that's logging.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	keep    int
+
+	mu      sync.Mutex
+	f       *os.File // or nil if not open
+	size    int64    // bytes in f
+	lastErr error    // last error reported to stderr
+}
+
+func newRotatingFile(lf LogFile) (*rotatingFile, error) {
+	rf := &rotatingFile{
+		path:    lf.Path,
+		maxSize: lf.MaxSize,
+		keep:    lf.Keep,
+	}
+	if rf.maxSize <= 0 {
+		rf.maxSize = defaultLogFileMaxSize
+	}
+	if rf.keep <= 0 {
+		rf.keep = defaultLogFileKeep
+	}
+	os.MkdirAll(filepath.Dir(rf.path), 0755) // best effort
+	if err := rf.openLocked(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) openLocked() error {
+	// O_SYNC so the last lines before a crash or power loss,
+	// often the interesting ones, make it to disk.
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND|os.O_SYNC, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f = f
+	rf.size = fi.Size()
+	return nil
+}
+
+// rotateLocked closes the current file and shifts it and the older
+// files down one name, dropping the oldest.
+func (rf *rotatingFile) rotateLocked() error {
+	if rf.f != nil {
+		rf.f.Close()
+		rf.f = nil
+	}
+	os.Remove(fmt.Sprintf("%s.%d", rf.path, rf.keep))
+	for i := rf.keep - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+	}
+	if err := os.Rename(rf.path, rf.path+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return rf.openLocked()
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	err := rf.writeLocked(p)
+	if err != nil && (rf.lastErr == nil || err.Error() != rf.lastErr.Error()) {
+		fmt.Fprintf(os.Stderr, "logpolicy: writing log file %s: %v\n", rf.path, err)
+	}
+	rf.lastErr = err
+	return len(p), nil
+}
+
+func (rf *rotatingFile) writeLocked(p []byte) error {
+	if rf.f != nil && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotateLocked(); err != nil {
+			return err
+		}
+	}
+	if rf.f == nil {
+		// A previous open or rotation failed; try again.
+		if err := rf.openLocked(); err != nil {
+			return err
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return err
+}
+
+// Close closes the current log file.
+func (rf *rotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.f == nil {
+		return nil
+	}
+	err := rf.f.Close()
+	rf.f = nil
+	return err
+}
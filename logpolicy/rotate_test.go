@@ -0,0 +1,73 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logpolicy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tailscaled.log")
+	rf, err := newRotatingFile(LogFile{Path: path, MaxSize: 1000, Keep: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+
+	line := strings.Repeat("x", 99) + "\n" // 100 bytes
+	for i := 0; i < 35; i++ {
+		if n, err := rf.Write([]byte(line)); n != len(line) || err != nil {
+			t.Fatalf("Write = %v, %v", n, err)
+		}
+	}
+
+	sizes := map[string]int64{}
+	for _, name := range []string{"tailscaled.log", "tailscaled.log.1", "tailscaled.log.2"} {
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes[name] = fi.Size()
+	}
+	want := map[string]int64{
+		"tailscaled.log":   500,
+		"tailscaled.log.1": 1000,
+		"tailscaled.log.2": 1000,
+	}
+	if fmt.Sprint(sizes) != fmt.Sprint(want) {
+		t.Errorf("file sizes = %v; want %v", sizes, want)
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("kept more than 2 rotated files; stat %s.3: %v", path, err)
+	}
+}
+
+func TestRotatingFileWriteError(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sub", "tailscaled.log")
+	rf, err := newRotatingFile(LogFile{Path: path, MaxSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+
+	// Make rotation fail by replacing the log directory.
+	if err := os.RemoveAll(filepath.Join(dir, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sub"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if n, err := rf.Write([]byte(strings.Repeat("y", 60))); n != 60 || err != nil {
+			t.Fatalf("Write = %v, %v; want errors to be swallowed", n, err)
+		}
+	}
+}
@@ -9,6 +9,7 @@ package filch
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -19,8 +20,17 @@ var stderrFD = 2 // a variable for testing
 
 type Options struct {
 	ReplaceStderr bool // dup over fd 2 so everything written to stderr comes here
+
+	// MaxFileSize, if non-zero, is the maximum size in bytes of
+	// each of the two buffer files. Writes that would grow the
+	// current file beyond it are dropped and return ErrFull.
+	MaxFileSize int64
 }
 
+// ErrFull is returned by Write when the Filch's MaxFileSize would
+// be exceeded.
+var ErrFull = errors.New("filch: buffer full")
+
 // A Filch uses two alternating files as a simplistic ring buffer.
 type Filch struct {
 	OrigStderr *os.File
@@ -30,6 +40,9 @@ type Filch struct {
 	alt       *os.File
 	altscan   *bufio.Scanner
 	recovered int64
+
+	maxFileSize int64 // or 0 for unlimited
+
 	// buf is an initial buffer for altscan.
 	// As of August 2021, 99.96% of all log lines
 	// are below 4096 bytes in length.
@@ -38,7 +51,7 @@ type Filch struct {
 	// so that the whole struct takes 4096 bytes
 	// (less on 32 bit platforms).
 	// This reduces allocation waste.
-	buf [4096 - 48]byte
+	buf [4096 - 56]byte
 }
 
 // TryReadline implements the logtail.Buffer interface.
@@ -96,7 +109,16 @@ func (f *Filch) Write(b []byte) (int, error) {
 		bnl := make([]byte, len(b)+1)
 		copy(bnl, b)
 		bnl[len(bnl)-1] = '\n'
-		return f.cur.Write(bnl)
+		b = bnl
+	}
+	if f.maxFileSize > 0 {
+		fi, err := f.cur.Stat()
+		if err != nil {
+			return 0, err
+		}
+		if fi.Size()+int64(len(b)) > f.maxFileSize {
+			return 0, ErrFull
+		}
 	}
 	return f.cur.Write(b)
 }
@@ -160,7 +182,8 @@ func New(filePrefix string, opts Options) (f *Filch, err error) {
 	}
 
 	f = &Filch{
-		OrigStderr: os.Stderr, // temporary, for past logs recovery
+		OrigStderr:  os.Stderr, // temporary, for past logs recovery
+		maxFileSize: opts.MaxFileSize,
 	}
 
 	// Neither, either, or both files may exist and contain logs from
@@ -78,6 +78,19 @@ func TestQueue(t *testing.T) {
 	f.close(t)
 }
 
+func TestMaxFileSize(t *testing.T) {
+	filePrefix := t.TempDir()
+	f := newFilchTest(t, filePrefix, Options{MaxFileSize: 12})
+
+	f.write(t, "hello") // 6 bytes with newline
+	if _, err := f.Write([]byte("world!")); err != ErrFull {
+		t.Fatalf("Write past MaxFileSize: err=%v, want ErrFull", err)
+	}
+	f.read(t, "hello")
+	f.readEOF(t)
+	f.close(t)
+}
+
 func TestRecover(t *testing.T) {
 	t.Run("empty", func(t *testing.T) {
 		filePrefix := t.TempDir()
@@ -46,6 +46,14 @@ type Config struct {
 	Buffer         Buffer           // temp storage, if nil a MemoryBuffer
 	NewZstdEncoder func() Encoder   // if set, used to compress logs for transmission
 
+	// MaxUploadBandwidth, if non-zero, is the maximum average rate,
+	// in bytes per second, at which logs are uploaded.
+	MaxUploadBandwidth int
+
+	// MaxBackoff, if non-zero, is the maximum time to wait between
+	// failed upload attempts. The default is 30 seconds.
+	MaxBackoff time.Duration
+
 	// DrainLogs, if non-nil, disables automatic uploading of new logs,
 	// so that logs are only uploaded when a token is sent to DrainLogs.
 	DrainLogs <-chan struct{}
@@ -64,6 +72,9 @@ func NewLogger(cfg Config, logf tslogger.Logf) *Logger {
 	if cfg.Stderr == nil {
 		cfg.Stderr = os.Stderr
 	}
+	if cfg.MaxBackoff == 0 {
+		cfg.MaxBackoff = 30 * time.Second
+	}
 	if cfg.Buffer == nil {
 		pendingSize := 256
 		if cfg.LowMemory {
@@ -83,7 +94,8 @@ func NewLogger(cfg Config, logf tslogger.Logf) *Logger {
 		sentinel:       make(chan int32, 16),
 		drainLogs:      cfg.DrainLogs,
 		timeNow:        cfg.TimeNow,
-		bo:             backoff.NewBackoff("logtail", logf, 30*time.Second),
+		bo:             backoff.NewBackoff("logtail", logf, cfg.MaxBackoff),
+		maxUploadBW:    cfg.MaxUploadBandwidth,
 
 		shutdownStart: make(chan struct{}),
 		shutdownDone:  make(chan struct{}),
@@ -116,6 +128,7 @@ type Logger struct {
 	sentinel       chan int32
 	timeNow        func() time.Time
 	bo             *backoff.Backoff
+	maxUploadBW    int // bytes/sec; 0 means unlimited
 	zstdEncoder    Encoder
 	uploadCancel   func()
 	explainedRaw   bool
@@ -295,6 +308,7 @@ func (l *Logger) uploading(ctx context.Context) {
 			}
 			l.bo.BackOff(ctx, err)
 			if uploaded {
+				l.throttle(ctx, len(body))
 				break
 			}
 		}
@@ -307,6 +321,32 @@ func (l *Logger) uploading(ctx context.Context) {
 	}
 }
 
+// throttle sleeps long enough after an upload of n bytes to keep the
+// average upload rate under the configured MaxUploadBandwidth.
+func (l *Logger) throttle(ctx context.Context, n int) {
+	d := uploadDelay(n, l.maxUploadBW)
+	if d <= 0 {
+		return
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-l.shutdownStart:
+	case <-t.C:
+	}
+}
+
+// uploadDelay returns how long to wait after uploading n bytes to
+// stay at or below bytesPerSec. A bytesPerSec of zero or less means
+// unlimited.
+func uploadDelay(n, bytesPerSec int) time.Duration {
+	if bytesPerSec <= 0 || n <= 0 {
+		return 0
+	}
+	return time.Duration(n) * time.Second / time.Duration(bytesPerSec)
+}
+
 func (l *Logger) internetUp() bool {
 	if l.linkMonitor == nil {
 		// No way to tell, so assume it is.
@@ -322,3 +322,22 @@ func unmarshalOne(t *testing.T, body []byte) map[string]interface{} {
 	}
 	return entries[0]
 }
+
+func TestUploadDelay(t *testing.T) {
+	tests := []struct {
+		n, bytesPerSec int
+		want           time.Duration
+	}{
+		{1000, 0, 0},
+		{1000, -1, 0},
+		{0, 1000, 0},
+		{1000, 1000, time.Second},
+		{500, 1000, 500 * time.Millisecond},
+		{10 << 10, 1 << 10, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := uploadDelay(tt.n, tt.bytesPerSec); got != tt.want {
+			t.Errorf("uploadDelay(%d, %d) = %v; want %v", tt.n, tt.bytesPerSec, got, tt.want)
+		}
+	}
+}
@@ -28,6 +28,18 @@ type Config struct {
 	// A Routes entry with no resolvers means the route should be
 	// authoritatively answered using the contents of Hosts.
 	Routes map[dnsname.FQDN][]netaddr.IPPort
+	// DoHRoutes maps a DNS suffix to the URLs of DNS-over-HTTPS
+	// servers to use for queries that fall within that suffix, with
+	// "." covering the queries DefaultResolvers would get. Any
+	// resolvers for the same suffix in Routes or DefaultResolvers
+	// are only used if the DoH servers fail. Suffixes in DoHRoutes
+	// are always resolved by 100.100.100.100, as OSes can't forward
+	// to DoH servers themselves.
+	DoHRoutes map[dnsname.FQDN][]string
+	// DoHBootstrap maps the URLs in DoHRoutes to the IPs of their
+	// hostnames, so that connecting to the DoH servers doesn't
+	// depend on looking them up with DNS.
+	DoHBootstrap map[string][]netaddr.IP
 	// SearchDomains are DNS suffixes to try when expanding
 	// single-label queries.
 	SearchDomains []dnsname.FQDN
@@ -49,6 +61,12 @@ func (c *Config) WriteToBufioWriter(w *bufio.Writer) {
 
 	w.WriteString(" Routes:")
 	resolver.WriteRoutes(w, c.Routes)
+	if len(c.DoHRoutes) > 0 {
+		fmt.Fprintf(w, " DoHRoutes:%v", c.DoHRoutes)
+	}
+	if len(c.DoHBootstrap) > 0 {
+		fmt.Fprintf(w, " DoHBootstrap:%v", c.DoHBootstrap)
+	}
 
 	fmt.Fprintf(w, " SearchDomains:%v", c.SearchDomains)
 	fmt.Fprintf(w, " Hosts:%v", len(c.Hosts))
@@ -62,23 +80,28 @@ func (c Config) needsOSResolver() bool {
 }
 
 func (c Config) hasRoutes() bool {
-	return len(c.Routes) > 0
+	return len(c.Routes) > 0 || len(c.DoHRoutes) > 0
 }
 
 // hasDefaultResolversOnly reports whether the only resolvers in c are
 // DefaultResolvers.
 func (c Config) hasDefaultResolversOnly() bool {
-	return c.hasDefaultResolvers() && !c.hasRoutes()
+	return len(c.DefaultResolvers) > 0 && !c.hasRoutes()
 }
 
+// hasDefaultResolvers reports whether c has resolvers for queries
+// outside Routes, either in DefaultResolvers or as a DoH route for ".".
 func (c Config) hasDefaultResolvers() bool {
-	return len(c.DefaultResolvers) > 0
+	return len(c.DefaultResolvers) > 0 || len(c.DoHRoutes["."]) > 0
 }
 
 // singleResolverSet returns the resolvers used by c.Routes if all
 // routes use the same resolvers, or nil if multiple sets of resolvers
-// are specified.
+// are specified or any route uses DoH.
 func (c Config) singleResolverSet() []netaddr.IPPort {
+	if len(c.DoHRoutes) > 0 {
+		return nil
+	}
 	var (
 		prev            []netaddr.IPPort
 		prevInitialized bool
@@ -98,10 +121,15 @@ func (c Config) singleResolverSet() []netaddr.IPPort {
 
 // matchDomains returns the list of match suffixes needed by Routes.
 func (c Config) matchDomains() []dnsname.FQDN {
-	ret := make([]dnsname.FQDN, 0, len(c.Routes))
+	ret := make([]dnsname.FQDN, 0, len(c.Routes)+len(c.DoHRoutes))
 	for suffix := range c.Routes {
 		ret = append(ret, suffix)
 	}
+	for suffix := range c.DoHRoutes {
+		if _, ok := c.Routes[suffix]; !ok {
+			ret = append(ret, suffix)
+		}
+	}
 	sort.Slice(ret, func(i, j int) bool {
 		return ret[i].WithTrailingDot() < ret[j].WithTrailingDot()
 	})
@@ -6,10 +6,12 @@ package dns
 
 import (
 	"bufio"
+	"context"
 	"runtime"
 	"time"
 
 	"inet.af/netaddr"
+	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/net/dns/resolver"
 	"tailscale.com/net/tsaddr"
 	"tailscale.com/types/logger"
@@ -82,6 +84,8 @@ func (m *Manager) compileConfig(cfg Config) (rcfg resolver.Config, ocfg OSConfig
 	// authoritative suffixes, even if we don't propagate MagicDNS to
 	// the OS.
 	rcfg.Hosts = cfg.Hosts
+	rcfg.DoHRoutes = cfg.DoHRoutes
+	rcfg.DoHBootstrap = cfg.DoHBootstrap
 	routes := map[dnsname.FQDN][]netaddr.IPPort{} // assigned conditionally to rcfg.Routes below.
 	for suffix, resolvers := range cfg.Routes {
 		if len(resolvers) == 0 {
@@ -109,7 +113,13 @@ func (m *Manager) compileConfig(cfg Config) (rcfg resolver.Config, ocfg OSConfig
 		// Default resolvers plus other stuff always ends up proxying
 		// through quad-100.
 		rcfg.Routes = routes
-		rcfg.Routes["."] = cfg.DefaultResolvers
+		if len(cfg.DefaultResolvers) > 0 {
+			rcfg.Routes["."] = cfg.DefaultResolvers
+		} else if bcfg, err := m.os.GetBaseConfig(); err == nil {
+			// Only DoH default resolvers. Fall back to the OS's
+			// resolvers if they fail, where we know them.
+			rcfg.Routes["."] = toIPPorts(bcfg.Nameservers)
+		}
 		ocfg.Nameservers = []netaddr.IP{tsaddr.TailscaleServiceIP()}
 		return rcfg, ocfg, nil
 	}
@@ -195,6 +205,23 @@ func (m *Manager) NextResponse() ([]byte, netaddr.IPPort, error) {
 	return m.resolver.NextResponse()
 }
 
+// Query answers the DNS query bs with the internal resolver, as if it
+// were sent to 100.100.100.100, and returns the response.
+func (m *Manager) Query(ctx context.Context, bs []byte) ([]byte, error) {
+	return m.resolver.Query(ctx, bs)
+}
+
+// SetQueryLogging turns logging of the queries handled by the
+// internal resolver on for d, or off if d is zero or negative.
+func (m *Manager) SetQueryLogging(d time.Duration) {
+	m.resolver.SetQueryLogging(d)
+}
+
+// QueryLog returns the internal resolver's query log.
+func (m *Manager) QueryLog() ipnstate.DNSQueryLog {
+	return m.resolver.QueryLog()
+}
+
 func (m *Manager) Down() error {
 	if err := m.os.Close(); err != nil {
 		return err
@@ -368,6 +368,55 @@ func TestManager(t *testing.T) {
 				LocalDomains: fqdns("ts.com."),
 			},
 		},
+		{
+			name: "doh-split",
+			in: Config{
+				Routes:    upstreams("corp.com", "2.2.2.2:53"),
+				DoHRoutes: map[dnsname.FQDN][]string{"corp.com.": {"https://dns.corp.com/dns-query"}},
+			},
+			split: true,
+			os: OSConfig{
+				Nameservers:  mustIPs("100.100.100.100"),
+				MatchDomains: fqdns("corp.com"),
+			},
+			rs: resolver.Config{
+				Routes:    upstreams("corp.com.", "2.2.2.2:53"),
+				DoHRoutes: map[dnsname.FQDN][]string{"corp.com.": {"https://dns.corp.com/dns-query"}},
+			},
+		},
+		{
+			name: "doh-only-route",
+			in: Config{
+				DoHRoutes: map[dnsname.FQDN][]string{"corp.com.": {"https://dns.corp.com/dns-query"}},
+			},
+			bs: OSConfig{
+				Nameservers: mustIPs("8.8.8.8"),
+			},
+			os: OSConfig{
+				Nameservers: mustIPs("100.100.100.100"),
+			},
+			rs: resolver.Config{
+				Routes:    upstreams(".", "8.8.8.8:53"),
+				DoHRoutes: map[dnsname.FQDN][]string{"corp.com.": {"https://dns.corp.com/dns-query"}},
+			},
+		},
+		{
+			name: "doh-default",
+			in: Config{
+				DoHRoutes: map[dnsname.FQDN][]string{".": {"https://dns.corp.com/dns-query"}},
+			},
+			split: true,
+			bs: OSConfig{
+				Nameservers: mustIPs("8.8.8.8"),
+			},
+			os: OSConfig{
+				Nameservers: mustIPs("100.100.100.100"),
+			},
+			rs: resolver.Config{
+				Routes:    upstreams(".", "8.8.8.8:53"),
+				DoHRoutes: map[dnsname.FQDN][]string{".": {"https://dns.corp.com/dns-query"}},
+			},
+		},
 	}
 
 	for _, test := range tests {
@@ -5,12 +5,22 @@
 package resolver
 
 import (
+	"bytes"
 	"context"
 	"flag"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"golang.org/x/net/dns/dnsmessage"
+	"inet.af/netaddr"
+	"tailscale.com/health"
+	"tailscale.com/util/dnsname"
 )
 
 var testDoH = flag.Bool("test-doh", false, "do real DoH tests against the network")
@@ -96,3 +106,278 @@ func TestDoHV6Fallback(t *testing.T) {
 		}
 	}
 }
+
+// testDNSResponse returns a response to query with n A records for
+// ip. It's called from server goroutines, so it panics on error.
+func testDNSResponse(query []byte, ip netaddr.IP, n int) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		panic(err)
+	}
+	q, err := p.Question()
+	if err != nil {
+		panic(err)
+	}
+	h.Response = true
+	b := dnsmessage.NewBuilder(nil, h)
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAnswers()
+	for i := 0; i < n; i++ {
+		b.AResource(dnsmessage.ResourceHeader{
+			Name:  q.Name,
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+			TTL:   60,
+		}, dnsmessage.AResource{A: ip.As4()})
+	}
+	res, err := b.Finish()
+	if err != nil {
+		panic(err)
+	}
+	return res
+}
+
+// newTestDoHServer returns a DNS-over-HTTPS server (over plain HTTP)
+// that answers queries with the response from answer, or fails them
+// with a 500 if answer returns nil.
+func newTestDoHServer(t *testing.T, answer func(query []byte) []byte) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.Header.Get("Content-Type") != dohType {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		q, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+		res := answer(q)
+		if res == nil {
+			http.Error(w, "failing", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", dohType)
+		w.Write(res)
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestSendDoHLargeResponse(t *testing.T) {
+	// Much larger than fits in a UDP DNS response.
+	want := testDNSResponse(someDNSQuestion(t), netaddr.IPv4(1, 2, 3, 4), 300)
+	if len(want) <= maxResponseBytes {
+		t.Fatalf("test response is only %d bytes", len(want))
+	}
+	ts := newTestDoHServer(t, func(q []byte) []byte { return want })
+	f := newForwarder(t.Logf, nil, nil, nil)
+	defer f.Close()
+	f.mu.Lock()
+	up := f.dohUpstreamLocked(ts.URL)
+	f.mu.Unlock()
+
+	got, err := f.sendDoH(context.Background(), up.url, up.c, someDNSQuestion(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %d byte response; want the %d bytes sent", len(got), len(want))
+	}
+}
+
+func TestSendDoHTimeout(t *testing.T) {
+	unblock := make(chan struct{})
+	defer close(unblock)
+	ts := newTestDoHServer(t, func(q []byte) []byte {
+		<-unblock
+		return nil
+	})
+	f := newForwarder(t.Logf, nil, nil, nil)
+	defer f.Close()
+	f.mu.Lock()
+	up := f.dohUpstreamLocked(ts.URL)
+	f.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := f.sendDoH(ctx, up.url, up.c, someDNSQuestion(t)); err == nil {
+		t.Fatal("sendDoH succeeded; want timeout")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("sendDoH took %v to time out", d)
+	}
+}
+
+func TestForwardDoHFallback(t *testing.T) {
+	dohIP := netaddr.IPv4(1, 1, 1, 1)
+	plainIP := netaddr.IPv4(2, 2, 2, 2)
+
+	var dohHealthy, dohQueries int32
+	ts := newTestDoHServer(t, func(q []byte) []byte {
+		atomic.AddInt32(&dohQueries, 1)
+		if atomic.LoadInt32(&dohHealthy) == 0 {
+			return nil
+		}
+		return testDNSResponse(q, dohIP, 1)
+	})
+
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(testDNSResponse(buf[:n], plainIP, 1), addr)
+		}
+	}()
+
+	responses := make(chan packet, 1)
+	f := newForwarder(t.Logf, responses, nil, nil)
+	defer f.Close()
+	plain := netaddr.MustParseIPPort(pc.LocalAddr().String())
+	f.setRoutes(
+		map[dnsname.FQDN][]netaddr.IPPort{".": {plain}},
+		map[dnsname.FQDN][]string{".": {ts.URL}},
+		nil,
+	)
+	defer f.setRoutes(nil, nil, nil) // clear health
+
+	// query forwards a query and returns the IP it was answered with.
+	query := func() netaddr.IP {
+		t.Helper()
+		if err := f.forward(packet{someDNSQuestion(t), netaddr.IPPort{}}, nil); err != nil {
+			t.Fatal(err)
+		}
+		res := <-responses
+		var p dnsmessage.Parser
+		if _, err := p.Start(res.bs); err != nil {
+			t.Fatal(err)
+		}
+		p.SkipAllQuestions()
+		if _, err := p.AnswerHeader(); err != nil {
+			t.Fatal(err)
+		}
+		a, err := p.AResource()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return netaddr.IPv4(a.A[0], a.A[1], a.A[2], a.A[3])
+	}
+
+	for i := 0; i < dohMaxFailures+2; i++ {
+		if got := query(); got != plainIP {
+			t.Fatalf("query %d answered with %v; want plaintext fallback %v", i, got, plainIP)
+		}
+	}
+	if got := atomic.LoadInt32(&dohQueries); got != dohMaxFailures {
+		t.Errorf("DoH server got %d queries; want %d before falling back", got, dohMaxFailures)
+	}
+	if health.DNSForwarderHealth() == nil {
+		t.Error("failing DoH server not reported to health")
+	}
+
+	// Once the retry interval passes and the server recovers, it's
+	// used again.
+	atomic.StoreInt32(&dohHealthy, 1)
+	f.mu.Lock()
+	f.dohUpstreams[ts.URL].downUntil = time.Now().Add(-time.Second)
+	f.mu.Unlock()
+	if got := query(); got != dohIP {
+		t.Errorf("answered with %v after recovery; want DoH %v", got, dohIP)
+	}
+	if err := health.DNSForwarderHealth(); err != nil {
+		t.Errorf("health still reports %v after recovery", err)
+	}
+}
+
+func TestDoHDialsBootstrap(t *testing.T) {
+	dohIP := netaddr.IPv4(1, 1, 1, 1)
+	ts := newTestDoHServer(t, func(q []byte) []byte {
+		return testDNSResponse(q, dohIP, 1)
+	})
+	// A hostname nothing but the bootstrap IPs and the route's
+	// plaintext resolvers knows, so the test fails if it's looked
+	// up with the system resolver.
+	u := strings.Replace(ts.URL, "127.0.0.1", "doh.test.invalid", 1)
+
+	// A plaintext resolver that says the DoH server's at localhost.
+	var plainQueries int32
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&plainQueries, 1)
+			pc.WriteTo(testDNSResponse(buf[:n], netaddr.IPv4(127, 0, 0, 1), 1), addr)
+		}
+	}()
+	plain := netaddr.MustParseIPPort(pc.LocalAddr().String())
+
+	tests := []struct {
+		name        string
+		routes      map[dnsname.FQDN][]netaddr.IPPort
+		bootstrap   map[string][]netaddr.IP
+		wantErr     bool
+		wantQueries int32 // of the plaintext resolver
+	}{
+		{
+			name:      "bootstrap",
+			bootstrap: map[string][]netaddr.IP{u: {netaddr.IPv4(127, 0, 0, 1)}},
+		},
+		{
+			name:        "plaintext_resolvers",
+			routes:      map[dnsname.FQDN][]netaddr.IPPort{".": {plain}},
+			wantQueries: 2, // A and AAAA
+		},
+		{
+			name:    "neither",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&plainQueries, 0)
+			f := newForwarder(t.Logf, nil, nil, nil)
+			defer f.Close()
+			f.setRoutes(tt.routes, map[dnsname.FQDN][]string{".": {u}}, tt.bootstrap)
+			defer f.setRoutes(nil, nil, nil) // clear health
+			f.mu.Lock()
+			up := f.dohUpstreams[u]
+			f.mu.Unlock()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			res, err := f.sendDoH(ctx, up.url, up.c, someDNSQuestion(t))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("sendDoH succeeded; want an error without bootstrap IPs or resolvers")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := answerIPs(res); len(got) != 1 || got[0] != dohIP {
+				t.Errorf("answered with %v; want %v", got, dohIP)
+			}
+			if got := atomic.LoadInt32(&plainQueries); got != tt.wantQueries {
+				t.Errorf("plaintext resolver got %d queries; want %d", got, tt.wantQueries)
+			}
+		})
+	}
+}
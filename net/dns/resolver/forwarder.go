@@ -23,6 +23,7 @@ import (
 
 	dns "golang.org/x/net/dns/dnsmessage"
 	"inet.af/netaddr"
+	"tailscale.com/health"
 	"tailscale.com/net/netns"
 	"tailscale.com/types/logger"
 	"tailscale.com/util/dnsname"
@@ -45,6 +46,25 @@ const (
 	// DNS queries to the "fallback" DNS server IP for a known provider
 	// (e.g. how long to wait to query Google's 8.8.4.4 after 8.8.8.8).
 	wellKnownHostBackupDelay = 200 * time.Millisecond
+
+	// dohFallbackTimeout is how long to wait for a route's
+	// DNS-over-HTTPS servers before falling back to its plaintext
+	// resolvers, leaving them the rest of responseTimeout.
+	dohFallbackTimeout = 2 * time.Second
+
+	// dohMaxFailures is how many queries in a row a DNS-over-HTTPS
+	// server can fail before we stop sending it queries for
+	// dohRetryInterval and use the route's plaintext resolvers
+	// instead.
+	dohMaxFailures = 3
+
+	// dohRetryInterval is how long to wait before trying a failing
+	// DNS-over-HTTPS server again.
+	dohRetryInterval = 30 * time.Second
+
+	// maxDoHResponseBytes is the largest DNS-over-HTTPS response
+	// body we accept, which is the largest possible DNS message.
+	maxDoHResponseBytes = 65535
 )
 
 var errNoUpstreams = errors.New("upstream nameservers not set")
@@ -128,6 +148,23 @@ func clampEDNSSize(packet []byte, maxSize uint16) {
 type route struct {
 	Suffix    dnsname.FQDN
 	Resolvers []resolverAndDelay
+	// DoH are the URLs of DNS-over-HTTPS servers to query before
+	// Resolvers, which are only used if none of them answer.
+	DoH []string
+}
+
+// dohUpstream is a DNS-over-HTTPS server configured by URL, rather
+// than upgraded from a well-known resolver IP.
+type dohUpstream struct {
+	url string
+	c   *http.Client // reused for all queries, to reuse connections
+
+	// The following are guarded by forwarder.mu.
+	fails     int              // queries failed in a row
+	downUntil time.Time        // if non-zero, only fall back to plaintext until then
+	bootstrap []netaddr.IP     // IPs to dial for the URL's hostname, from the control plane
+	resolvers []netaddr.IPPort // plaintext resolvers of its routes, to look up the hostname with otherwise
+	isDefault bool             // whether it's a server for the "." route
 }
 
 // resolverAndDelay is an upstream DNS resolver and a delay for how
@@ -160,6 +197,10 @@ type forwarder struct {
 
 	dohClient map[netaddr.IP]*http.Client
 
+	// dohUpstreams are the DNS-over-HTTPS servers in routes, keyed
+	// by URL.
+	dohUpstreams map[string]*dohUpstream
+
 	// routes are per-suffix resolvers to use, with
 	// the most specific routes first.
 	routes []route
@@ -189,6 +230,11 @@ func newForwarder(logf logger.Logf, responses chan packet, linkMon *monitor.Mon,
 
 func (f *forwarder) Close() error {
 	f.ctxCancel()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, up := range f.dohUpstreams {
+		up.c.CloseIdleConnections()
+	}
 	return nil
 }
 
@@ -254,17 +300,26 @@ func resolversWithDelays(ipps []netaddr.IPPort) []resolverAndDelay {
 }
 
 // setRoutes sets the routes to use for DNS forwarding. It's called by
-// Resolver.SetConfig on reconfig.
+// Resolver.SetConfig on reconfig. dohBySuffix are the
+// DNS-over-HTTPS server URLs to try first for each suffix, if any,
+// and dohBootstrap the IPs to dial for their hostnames, by URL.
 //
-// The memory referenced by routesBySuffix should not be modified.
-func (f *forwarder) setRoutes(routesBySuffix map[dnsname.FQDN][]netaddr.IPPort) {
+// The memory referenced by routesBySuffix, dohBySuffix and
+// dohBootstrap should not be modified.
+func (f *forwarder) setRoutes(routesBySuffix map[dnsname.FQDN][]netaddr.IPPort, dohBySuffix map[dnsname.FQDN][]string, dohBootstrap map[string][]netaddr.IP) {
 	routes := make([]route, 0, len(routesBySuffix))
 	for suffix, ipps := range routesBySuffix {
 		routes = append(routes, route{
 			Suffix:    suffix,
 			Resolvers: resolversWithDelays(ipps),
+			DoH:       dohBySuffix[suffix],
 		})
 	}
+	for suffix, urls := range dohBySuffix {
+		if _, ok := routesBySuffix[suffix]; !ok {
+			routes = append(routes, route{Suffix: suffix, DoH: urls})
+		}
+	}
 	// Sort from longest prefix to shortest.
 	sort.Slice(routes, func(i, j int) bool {
 		return routes[i].Suffix.NumLabels() > routes[j].Suffix.NumLabels()
@@ -273,6 +328,32 @@ func (f *forwarder) setRoutes(routesBySuffix map[dnsname.FQDN][]netaddr.IPPort)
 	f.mu.Lock()
 	defer f.mu.Unlock()
 	f.routes = routes
+
+	// Forget DNS-over-HTTPS servers that are no longer used, closing
+	// their idle connections, and update how to dial the others.
+	inUse := map[string]bool{}
+	for suffix, urls := range dohBySuffix {
+		for _, u := range urls {
+			up := f.dohUpstreamLocked(u)
+			if !inUse[u] {
+				inUse[u] = true
+				up.bootstrap = dohBootstrap[u]
+				up.resolvers = nil
+				up.isDefault = false
+			}
+			up.resolvers = append(up.resolvers, routesBySuffix[suffix]...)
+			if suffix == "." {
+				up.isDefault = true
+			}
+		}
+	}
+	for u, up := range f.dohUpstreams {
+		if !inUse[u] {
+			up.c.CloseIdleConnections()
+			delete(f.dohUpstreams, u)
+		}
+	}
+	f.updateDoHHealthLocked()
 }
 
 var stdNetPacketListener packetListener = new(net.ListenConfig)
@@ -334,6 +415,262 @@ func (f *forwarder) getDoHClient(ip netaddr.IP) (urlBase string, c *http.Client,
 	return urlBase, c, true
 }
 
+// dohUpstreamLocked returns the state of the DNS-over-HTTPS server at
+// url, creating it if needed. f.mu must be held.
+func (f *forwarder) dohUpstreamLocked(url string) *dohUpstream {
+	if up, ok := f.dohUpstreams[url]; ok {
+		return up
+	}
+	if f.dohUpstreams == nil {
+		f.dohUpstreams = map[string]*dohUpstream{}
+	}
+	nsDialer := netns.NewDialer()
+	up := &dohUpstream{url: url}
+	up.c = &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, netw, addr string) (net.Conn, error) {
+				return f.dialDoH(ctx, nsDialer, up, netw, addr)
+			},
+			ForceAttemptHTTP2: true,
+			IdleConnTimeout:   dohTransportTimeout,
+		},
+	}
+	f.dohUpstreams[url] = up
+	return up
+}
+
+// dialDoH dials addr, the host and port of up's URL, for up's HTTP
+// client.
+//
+// A hostname isn't looked up with the system resolver, which may be
+// this one: with a "." DoH route, the lookup would come back to this
+// forwarder and wait on the DoH server it's for. Instead it's dialed
+// at its bootstrap IPs, if the control plane sent any, or else at the
+// addresses the plaintext resolvers of up's routes return for it.
+func (f *forwarder) dialDoH(ctx context.Context, d netns.Dialer, up *dohUpstream, netw, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := netaddr.ParseIP(host); err == nil {
+		return d.DialContext(ctx, netw, addr)
+	}
+	f.mu.Lock()
+	ips, resolvers, isDefault := up.bootstrap, up.resolvers, up.isDefault
+	f.mu.Unlock()
+	if len(ips) == 0 && len(resolvers) > 0 {
+		ips, err = f.lookupDoHHost(ctx, host, resolvers)
+		if err != nil {
+			return nil, fmt.Errorf("looking up DoH server %s: %w", host, err)
+		}
+	}
+	if len(ips) == 0 {
+		if isDefault {
+			return nil, fmt.Errorf("no bootstrap IPs or resolvers to look up DoH server %s with", host)
+		}
+		// Only a split DNS route's DoH server, so the system
+		// resolver won't ask it about its own name.
+		return d.DialContext(ctx, netw, addr)
+	}
+	for _, ip := range ips {
+		var c net.Conn
+		c, err = d.DialContext(ctx, netw, net.JoinHostPort(ip.String(), port))
+		if err == nil || ctx.Err() != nil {
+			return c, err
+		}
+	}
+	return nil, err
+}
+
+// lookupDoHHost returns the IPv4 and IPv6 addresses of the DoH server
+// host, as answered by the first of resolvers that answers.
+func (f *forwarder) lookupDoHHost(ctx context.Context, host string, resolvers []netaddr.IPPort) ([]netaddr.IP, error) {
+	fqdn, err := dnsname.ToFQDN(host)
+	if err != nil {
+		return nil, err
+	}
+	name, err := dns.NewName(fqdn.WithTrailingDot())
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, responseTimeout)
+	defer cancel()
+	pool := new(closePool)
+	defer pool.Close()
+	go func() {
+		<-ctx.Done()
+		pool.Close()
+	}()
+
+	var lastErr error
+	for _, rr := range resolvers {
+		var ips []netaddr.IP
+		for _, typ := range []dns.Type{dns.TypeA, dns.TypeAAAA} {
+			id := uint16(rand.Intn(1 << 16))
+			b := dns.NewBuilder(nil, dns.Header{ID: id, RecursionDesired: true})
+			b.StartQuestions()
+			b.Question(dns.Question{Name: name, Type: typ, Class: dns.ClassINET})
+			q, err := b.Finish()
+			if err != nil {
+				return nil, err
+			}
+			res, err := f.send(ctx, &forwardQuery{txid: txid(id), packet: q, closeOnCtxDone: pool}, rr)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			ips = append(ips, answerIPs(res)...)
+		}
+		if len(ips) > 0 {
+			return ips, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no addresses")
+	}
+	return nil, lastErr
+}
+
+// answerIPs returns the IPs in the A and AAAA records of the DNS
+// response res.
+func answerIPs(res []byte) []netaddr.IP {
+	var p dns.Parser
+	if _, err := p.Start(res); err != nil {
+		return nil
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil
+	}
+	var ips []netaddr.IP
+	for {
+		h, err := p.AnswerHeader()
+		if err != nil {
+			return ips
+		}
+		switch h.Type {
+		case dns.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return ips
+			}
+			ips = append(ips, netaddr.IPv4(r.A[0], r.A[1], r.A[2], r.A[3]))
+		case dns.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return ips
+			}
+			ips = append(ips, netaddr.IPFrom16(r.AAAA))
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return ips
+			}
+		}
+	}
+}
+
+// usableDoH returns the DNS-over-HTTPS servers among urls to query,
+// skipping those that have been failing unless all is true.
+func (f *forwarder) usableDoH(urls []string, all bool) []*dohUpstream {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	var ret []*dohUpstream
+	for _, u := range urls {
+		up := f.dohUpstreamLocked(u)
+		if all || up.downUntil.IsZero() || !now.Before(up.downUntil) {
+			ret = append(ret, up)
+		}
+	}
+	return ret
+}
+
+// noteDoHResult records the result of a query to up, which failed
+// if err is non-nil.
+func (f *forwarder) noteDoHResult(up *dohUpstream, err error) {
+	if errors.Is(err, context.Canceled) {
+		// Another server answered first, or we're shutting down.
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err == nil {
+		if !up.downUntil.IsZero() {
+			f.logf("DoH server %s is answering again", up.url)
+			up.downUntil = time.Time{}
+			f.updateDoHHealthLocked()
+		}
+		up.fails = 0
+		return
+	}
+	up.fails++
+	if up.fails < dohMaxFailures {
+		f.logf("DoH error from %s: %v", up.url, err)
+		return
+	}
+	if up.downUntil.IsZero() {
+		f.logf("DoH server %s failed %d queries in a row, using plaintext resolvers for %v: %v", up.url, up.fails, dohRetryInterval, err)
+	}
+	up.downUntil = time.Now().Add(dohRetryInterval)
+	f.updateDoHHealthLocked()
+}
+
+// updateDoHHealthLocked reports which DNS-over-HTTPS servers are
+// failing to the health package. f.mu must be held.
+func (f *forwarder) updateDoHHealthLocked() {
+	var down []string
+	for u, up := range f.dohUpstreams {
+		if !up.downUntil.IsZero() {
+			down = append(down, u)
+		}
+	}
+	if len(down) == 0 {
+		if health.DNSForwarderHealth() != nil {
+			health.SetDNSForwarderHealth(nil)
+		}
+		return
+	}
+	sort.Strings(down)
+	health.SetDNSForwarderHealth(fmt.Errorf("DNS-over-HTTPS servers failing, using plaintext DNS instead: %s", strings.Join(down, ", ")))
+}
+
+// forwardDoH sends fq to the DNS-over-HTTPS servers ups at once,
+// returning the first response and the URL of the server that sent
+// it.
+func (f *forwarder) forwardDoH(ctx context.Context, fq *forwardQuery, ups []*dohUpstream) (res []byte, from string, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		bs  []byte
+		up  *dohUpstream
+		err error
+	}
+	resc := make(chan result, len(ups))
+	for _, up := range ups {
+		go func(up *dohUpstream) {
+			bs, err := f.sendDoH(ctx, up.url, up.c, fq.packet)
+			if err == nil && getTxID(bs) != fq.txid {
+				err = errors.New("txid doesn't match")
+			}
+			f.noteDoHResult(up, err)
+			resc <- result{bs, up, err}
+		}(up)
+	}
+	for range ups {
+		r := <-resc
+		if r.err == nil {
+			return r.bs, r.up.url, nil
+		}
+		if err == nil {
+			err = r.err
+		}
+	}
+	return nil, "", err
+}
+
 const dohType = "application/dns-message"
 
 func (f *forwarder) releaseDoHSem() { <-f.dohSem }
@@ -374,7 +711,14 @@ func (f *forwarder) sendDoH(ctx context.Context, urlBase string, c *http.Client,
 	if ct := hres.Header.Get("Content-Type"); ct != dohType {
 		return nil, fmt.Errorf("unexpected response Content-Type %q", ct)
 	}
-	return ioutil.ReadAll(hres.Body)
+	res, err := ioutil.ReadAll(io.LimitReader(hres.Body, maxDoHResponseBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(res) > maxDoHResponseBytes {
+		return nil, errors.New("DoH response too large")
+	}
+	return res, nil
 }
 
 // send sends packet to dst. It is best effort.
@@ -458,17 +802,18 @@ func (f *forwarder) send(ctx context.Context, fq *forwardQuery, dst netaddr.IPPo
 	return out, nil
 }
 
-// resolvers returns the resolvers to use for domain.
-func (f *forwarder) resolvers(domain dnsname.FQDN) []resolverAndDelay {
+// resolvers returns the resolvers and DNS-over-HTTPS server URLs to
+// use for domain, and the suffix of the route they're from.
+func (f *forwarder) resolvers(domain dnsname.FQDN) (suffix dnsname.FQDN, rr []resolverAndDelay, doh []string) {
 	f.mu.Lock()
 	routes := f.routes
 	f.mu.Unlock()
 	for _, route := range routes {
 		if route.Suffix == "." || route.Suffix.Contains(domain) {
-			return route.Resolvers
+			return route.Suffix, route.Resolvers, route.DoH
 		}
 	}
-	return nil
+	return "", nil, nil
 }
 
 // forwardQuery is information and state about a forwarded DNS query that's
@@ -496,7 +841,15 @@ type forwardQuery struct {
 }
 
 // forward forwards the query to all upstream nameservers and returns the first response.
-func (f *forwarder) forward(query packet) error {
+// If the query's route has DNS-over-HTTPS servers, they're tried first,
+// and the other nameservers are only used if they fail.
+// If qe is non-nil, the route and the answering upstream are recorded in it.
+func (f *forwarder) forward(query packet, qe *queryLogEntry) error {
+	return f.forwardTo(query, f.responses, qe)
+}
+
+// forwardTo is like forward, but sends the response to responses.
+func (f *forwarder) forwardTo(query packet, responses chan<- packet, qe *queryLogEntry) error {
 	domain, err := nameFromQuery(query.bs)
 	if err != nil {
 		return err
@@ -504,8 +857,8 @@ func (f *forwarder) forward(query packet) error {
 
 	clampEDNSSize(query.bs, maxResponseBytes)
 
-	resolvers := f.resolvers(domain)
-	if len(resolvers) == 0 {
+	suffix, resolvers, doh := f.resolvers(domain)
+	if len(resolvers) == 0 && len(doh) == 0 {
 		return errNoUpstreams
 	}
 
@@ -519,7 +872,39 @@ func (f *forwarder) forward(query packet) error {
 	ctx, cancel := context.WithTimeout(f.ctx, responseTimeout)
 	defer cancel()
 
-	resc := make(chan []byte, 1)
+	respond := func(from string, bs []byte) error {
+		qe.setForwarded(suffix, from, bs)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case responses <- packet{bs, query.addr}:
+			return nil
+		}
+	}
+
+	// With no plaintext resolvers to fall back to, keep querying
+	// DoH servers even if they've been failing.
+	if ups := f.usableDoH(doh, len(resolvers) == 0); len(ups) > 0 {
+		dohCtx := ctx
+		if len(resolvers) > 0 {
+			var dohCancel context.CancelFunc
+			dohCtx, dohCancel = context.WithTimeout(ctx, dohFallbackTimeout)
+			defer dohCancel()
+		}
+		res, from, err := f.forwardDoH(dohCtx, fq, ups)
+		if err == nil {
+			return respond(from, res)
+		}
+		if len(resolvers) == 0 || ctx.Err() != nil {
+			return err
+		}
+	}
+
+	type result struct {
+		bs   []byte
+		from netaddr.IPPort
+	}
+	resc := make(chan result, 1)
 	var (
 		mu       sync.Mutex
 		firstErr error
@@ -546,7 +931,7 @@ func (f *forwarder) forward(query packet) error {
 				return
 			}
 			select {
-			case resc <- resb:
+			case resc <- result{resb, rr.ipp}:
 			default:
 			}
 		}(rr)
@@ -554,12 +939,7 @@ func (f *forwarder) forward(query packet) error {
 
 	select {
 	case v := <-resc:
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case f.responses <- packet{v, query.addr}:
-			return nil
-		}
+		return respond(v.from.String(), v.bs)
 	case <-ctx.Done():
 		mu.Lock()
 		defer mu.Unlock()
@@ -0,0 +1,220 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resolver
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"inet.af/netaddr"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/util/dnsname"
+)
+
+// maxQueryLogEntries is how many queries the query log keeps.
+const maxQueryLogEntries = 500
+
+// queryLog is a ring buffer of recently handled DNS queries, for
+// debugging. It only records queries while enabled, and it turns
+// itself off after a while so verbose logging isn't left on by
+// accident.
+//
+// The zero value is ready for use, and off.
+type queryLog struct {
+	now func() time.Time // or nil for time.Now
+
+	mu      sync.Mutex
+	until   time.Time // logging is on until then
+	entries [maxQueryLogEntries]ipnstate.DNSQueryLogEntry
+	next    int    // index in entries to write next
+	n       int    // number of valid entries
+	seq     uint64 // Seq of the last entry added
+}
+
+func (l *queryLog) timeNow() time.Time {
+	if l.now != nil {
+		return l.now()
+	}
+	return time.Now()
+}
+
+// setEnabled turns logging on for d, or off if d is zero or negative.
+// Turning logging on again while it's on extends it, and keeps the
+// entries logged so far.
+func (l *queryLog) setEnabled(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if d <= 0 {
+		l.until = time.Time{}
+		return
+	}
+	l.until = l.timeNow().Add(d)
+}
+
+// enabled reports whether queries should currently be logged.
+func (l *queryLog) enabled() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return !l.until.IsZero() && l.timeNow().Before(l.until)
+}
+
+// add records e, if logging is still on, numbering it after the
+// entries before it.
+func (l *queryLog) add(e ipnstate.DNSQueryLogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.until.IsZero() || !l.timeNow().Before(l.until) {
+		return
+	}
+	l.seq++
+	e.Seq = l.seq
+	l.entries[l.next] = e
+	l.next = (l.next + 1) % len(l.entries)
+	if l.n < len(l.entries) {
+		l.n++
+	}
+}
+
+// snapshot returns the logging state and a copy of the entries,
+// oldest first.
+func (l *queryLog) snapshot() ipnstate.DNSQueryLog {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var ret ipnstate.DNSQueryLog
+	if l.timeNow().Before(l.until) {
+		ret.EnabledUntil = l.until
+	}
+	ret.Entries = make([]ipnstate.DNSQueryLogEntry, 0, l.n)
+	start := l.next - l.n
+	if start < 0 {
+		start += len(l.entries)
+	}
+	for i := 0; i < l.n; i++ {
+		ret.Entries = append(ret.Entries, l.entries[(start+i)%len(l.entries)])
+	}
+	return ret
+}
+
+// queryLogEntry is the query log entry being built for a query,
+// filled in as the query is handled. A nil *queryLogEntry means
+// the query isn't being logged; its methods are no-ops then.
+type queryLogEntry struct {
+	start time.Time
+	e     ipnstate.DNSQueryLogEntry
+}
+
+// setQuestion records the name and type of query.
+func (qe *queryLogEntry) setQuestion(query []byte) {
+	if qe == nil {
+		return
+	}
+	var parser dns.Parser
+	if _, err := parser.Start(query); err != nil {
+		return
+	}
+	q, err := parser.Question()
+	if err != nil {
+		return
+	}
+	qe.e.Name = q.Name.String()
+	qe.e.Type = typeString(q.Type)
+}
+
+// setForwarded records that the query was forwarded by the route
+// for suffix to upstream, which answered with resp.
+func (qe *queryLogEntry) setForwarded(suffix dnsname.FQDN, upstream string, resp []byte) {
+	if qe == nil {
+		return
+	}
+	qe.e.Route = string(suffix)
+	qe.e.Upstream = upstream
+	qe.e.Answer = summarizeResponse(resp)
+}
+
+// typeString returns t without its "Type" prefix, such as "AAAA".
+func typeString(t dns.Type) string {
+	return strings.TrimPrefix(t.String(), "Type")
+}
+
+// rcodeString returns the conventional name of rc, such as "NXDOMAIN".
+func rcodeString(rc dns.RCode) string {
+	switch rc {
+	case dns.RCodeSuccess:
+		return "NOERROR"
+	case dns.RCodeFormatError:
+		return "FORMERR"
+	case dns.RCodeServerFailure:
+		return "SERVFAIL"
+	case dns.RCodeNameError:
+		return "NXDOMAIN"
+	case dns.RCodeNotImplemented:
+		return "NOTIMP"
+	case dns.RCodeRefused:
+		return "REFUSED"
+	}
+	return fmt.Sprintf("RCODE%d", rc)
+}
+
+// summarizeResponse returns a one-line summary of the DNS response
+// resp: its rcode followed by its answers, such as
+// "NOERROR A 1.2.3.4, CNAME foo.example.com.".
+func summarizeResponse(resp []byte) string {
+	var parser dns.Parser
+	h, err := parser.Start(resp)
+	if err != nil {
+		return fmt.Sprintf("unparseable response: %v", err)
+	}
+	var sb strings.Builder
+	sb.WriteString(rcodeString(h.RCode))
+	if err := parser.SkipAllQuestions(); err != nil {
+		return sb.String()
+	}
+	for i := 0; ; i++ {
+		ah, err := parser.AnswerHeader()
+		if err != nil {
+			break
+		}
+		if i == 0 {
+			sb.WriteByte(' ')
+		} else {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(typeString(ah.Type))
+		switch ah.Type {
+		case dns.TypeA:
+			r, err := parser.AResource()
+			if err != nil {
+				return sb.String()
+			}
+			fmt.Fprintf(&sb, " %v", netaddr.IPv4(r.A[0], r.A[1], r.A[2], r.A[3]))
+		case dns.TypeAAAA:
+			r, err := parser.AAAAResource()
+			if err != nil {
+				return sb.String()
+			}
+			fmt.Fprintf(&sb, " %v", netaddr.IPFrom16(r.AAAA))
+		case dns.TypeCNAME:
+			r, err := parser.CNAMEResource()
+			if err != nil {
+				return sb.String()
+			}
+			fmt.Fprintf(&sb, " %v", r.CNAME)
+		case dns.TypePTR:
+			r, err := parser.PTRResource()
+			if err != nil {
+				return sb.String()
+			}
+			fmt.Fprintf(&sb, " %v", r.PTR)
+		default:
+			if err := parser.SkipAnswer(); err != nil {
+				return sb.String()
+			}
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package resolver
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	dns "golang.org/x/net/dns/dnsmessage"
+	"inet.af/netaddr"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/util/dnsname"
+)
+
+func TestQueryLogExpiry(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := &queryLog{now: func() time.Time { return now }}
+
+	l.add(ipnstate.DNSQueryLogEntry{Name: "off."})
+	if l.enabled() {
+		t.Fatal("enabled by default")
+	}
+
+	l.setEnabled(10 * time.Minute)
+	if !l.enabled() {
+		t.Fatal("not enabled after setEnabled")
+	}
+	l.add(ipnstate.DNSQueryLogEntry{Name: "on."})
+
+	now = now.Add(10 * time.Minute)
+	if l.enabled() {
+		t.Fatal("still enabled after expiry")
+	}
+	l.add(ipnstate.DNSQueryLogEntry{Name: "expired."})
+
+	ql := l.snapshot()
+	if !ql.EnabledUntil.IsZero() {
+		t.Errorf("EnabledUntil = %v; want zero", ql.EnabledUntil)
+	}
+	if len(ql.Entries) != 1 || ql.Entries[0].Name != "on." {
+		t.Errorf("entries = %+v; want just on.", ql.Entries)
+	}
+
+	l.setEnabled(time.Minute)
+	l.setEnabled(0)
+	if l.enabled() {
+		t.Fatal("enabled after setEnabled(0)")
+	}
+}
+
+func TestQueryLogWraps(t *testing.T) {
+	l := new(queryLog)
+	l.setEnabled(time.Hour)
+	const n = maxQueryLogEntries + 10
+	for i := 0; i < n; i++ {
+		l.add(ipnstate.DNSQueryLogEntry{Name: fmt.Sprint(i)})
+	}
+	ql := l.snapshot()
+	if len(ql.Entries) != maxQueryLogEntries {
+		t.Fatalf("got %d entries; want %d", len(ql.Entries), maxQueryLogEntries)
+	}
+	if got, want := ql.Entries[0].Name, fmt.Sprint(n-maxQueryLogEntries); got != want {
+		t.Errorf("oldest entry = %q; want %q", got, want)
+	}
+	if got, want := ql.Entries[len(ql.Entries)-1].Name, fmt.Sprint(n-1); got != want {
+		t.Errorf("newest entry = %q; want %q", got, want)
+	}
+	for i, e := range ql.Entries {
+		if want := uint64(n - maxQueryLogEntries + i + 1); e.Seq != want {
+			t.Fatalf("entry %d has Seq %d; want %d", i, e.Seq, want)
+		}
+	}
+}
+
+func TestSummarizeResponse(t *testing.T) {
+	tests := []struct {
+		name string
+		resp []byte
+		want string
+	}{
+		{"a", ipv4Response, "NOERROR A 1.2.3.4"},
+		{"aaaa", ipv6Response, "NOERROR AAAA 1:203:405:607:809:a0b:c0d:e0f"},
+		{"ptr", ptrResponse, "NOERROR PTR test1.ipn.dev."},
+		{"nxdomain", nxdomainResponse, "NXDOMAIN"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := summarizeResponse(tt.resp); got != tt.want {
+				t.Errorf("got %q; want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolverQueryLog(t *testing.T) {
+	server := serveDNS(t, "127.0.0.1:0",
+		"test.site.", resolveToIP(testipv4, testipv6, "dns.test.site."))
+	defer server.Shutdown()
+	upstream := netaddr.MustParseIPPort(server.PacketConn.LocalAddr().String())
+
+	r := newResolver(t)
+	defer r.Close()
+	cfg := dnsCfg
+	cfg.Routes = map[dnsname.FQDN][]netaddr.IPPort{
+		".": {upstream},
+	}
+	r.SetConfig(cfg)
+
+	// Not logged; logging is off by default.
+	if _, err := syncRespond(r, dnspacket("test1.ipn.dev.", dns.TypeA, noEdns)); err != nil {
+		t.Fatal(err)
+	}
+
+	r.SetQueryLogging(time.Minute)
+	for _, q := range []dnsname.FQDN{"test1.ipn.dev.", "test.site."} {
+		if _, err := syncRespond(r, dnspacket(q, dns.TypeA, noEdns)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Queries are added to the log just after their response is
+	// sent, so wait for them.
+	var ql ipnstate.DNSQueryLog
+	for i := 0; i < 100; i++ {
+		ql = r.QueryLog()
+		if len(ql.Entries) >= 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ql.EnabledUntil.IsZero() {
+		t.Error("EnabledUntil is zero; want logging on")
+	}
+	if len(ql.Entries) != 2 {
+		t.Fatalf("got %d entries; want 2: %+v", len(ql.Entries), ql.Entries)
+	}
+
+	local, fwd := ql.Entries[0], ql.Entries[1]
+	if local.Name != "test1.ipn.dev." || local.Type != "A" || local.Route != "local" || local.Answer != "NOERROR A 1.2.3.4" {
+		t.Errorf("local query logged as %+v", local)
+	}
+	if fwd.Name != "test.site." || fwd.Type != "A" || fwd.Route != "." || fwd.Upstream != upstream.String() || fwd.Answer != "NOERROR A 1.2.3.4" {
+		t.Errorf("forwarded query logged as %+v", fwd)
+	}
+	for _, e := range ql.Entries {
+		if e.Time.IsZero() || e.LatencySeconds <= 0 {
+			t.Errorf("missing time or latency in %+v", e)
+		}
+	}
+
+	r.SetQueryLogging(0)
+	if !r.QueryLog().EnabledUntil.IsZero() {
+		t.Error("logging still on after SetQueryLogging(0)")
+	}
+}
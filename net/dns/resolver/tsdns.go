@@ -8,6 +8,7 @@ package resolver
 
 import (
 	"bufio"
+	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
@@ -20,6 +21,7 @@ import (
 
 	dns "golang.org/x/net/dns/dnsmessage"
 	"inet.af/netaddr"
+	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/types/logger"
 	"tailscale.com/util/dnsname"
 	"tailscale.com/wgengine/monitor"
@@ -74,6 +76,14 @@ type Config struct {
 	// Queries only match the most specific suffix.
 	// To register a "default route", add an entry for ".".
 	Routes map[dnsname.FQDN][]netaddr.IPPort
+	// DoHRoutes is a map of DNS name suffix to the URLs of
+	// DNS-over-HTTPS (RFC 8484) servers to use for queries within
+	// that suffix. They're tried before any resolvers in Routes for
+	// the same suffix, which are used as a fallback if they fail.
+	DoHRoutes map[dnsname.FQDN][]string
+	// DoHBootstrap maps the URLs in DoHRoutes to IPs to connect to
+	// for their hostnames, instead of looking them up.
+	DoHBootstrap map[string][]netaddr.IP
 	// LocalHosts is a map of FQDNs to corresponding IPs.
 	Hosts map[dnsname.FQDN][]netaddr.IP
 	// LocalDomains is a list of DNS name suffixes that should not be
@@ -86,6 +96,12 @@ type Config struct {
 func (c *Config) WriteToBufioWriter(w *bufio.Writer) {
 	w.WriteString("{Routes:")
 	WriteRoutes(w, c.Routes)
+	if len(c.DoHRoutes) > 0 {
+		fmt.Fprintf(w, " DoHRoutes:%v", c.DoHRoutes)
+	}
+	if len(c.DoHBootstrap) > 0 {
+		fmt.Fprintf(w, " DoHBootstrap:%v", c.DoHBootstrap)
+	}
 	fmt.Fprintf(w, " Hosts:%v LocalDomains:[", len(c.Hosts))
 	space := false
 	arpa := 0
@@ -162,6 +178,8 @@ type Resolver struct {
 
 	activeQueriesAtomic int32 // number of DNS queries in flight
 
+	qlog queryLog // has its own mutex
+
 	// responses is an unbuffered channel to which responses are returned.
 	responses chan packet
 	// errors is an unbuffered channel to which errors are returned.
@@ -216,7 +234,7 @@ func (r *Resolver) SetConfig(cfg Config) error {
 		}
 	}
 
-	r.forwarder.setRoutes(cfg.Routes)
+	r.forwarder.setRoutes(cfg.Routes, cfg.DoHRoutes, cfg.DoHBootstrap)
 
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -257,6 +275,36 @@ func (r *Resolver) EnqueueRequest(bs []byte, from netaddr.IPPort) error {
 	return nil
 }
 
+// Query answers the DNS query bs as it would be answered if sent to
+// 100.100.100.100, and returns the response. It's for in-process
+// clients that have no way to send it packets, such as netstack's
+// dialers in userspace-networking mode.
+func (r *Resolver) Query(ctx context.Context, bs []byte) ([]byte, error) {
+	select {
+	case <-r.closed:
+		return nil, ErrClosed
+	default:
+	}
+	if n := atomic.AddInt32(&r.activeQueriesAtomic, 1); n > maxActiveQueries() {
+		atomic.AddInt32(&r.activeQueriesAtomic, -1)
+		return nil, errFullQueue
+	}
+	// Buffered, so handleQueryTo can finish after ctx is done.
+	responses := make(chan packet, 1)
+	errs := make(chan error, 1)
+	go r.handleQueryTo(packet{bs, netaddr.IPPort{}}, responses, errs)
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-r.closed:
+		return nil, ErrClosed
+	case resp := <-responses:
+		return resp.bs, nil
+	case err := <-errs:
+		return nil, err
+	}
+}
+
 // NextResponse returns a DNS response to a previously enqueued request.
 // It blocks until a response is available and gives up ownership of the response payload.
 func (r *Resolver) NextResponse() (packet []byte, to netaddr.IPPort, err error) {
@@ -357,26 +405,62 @@ func (r *Resolver) resolveLocalReverse(ip netaddr.IP) (dnsname.FQDN, dns.RCode)
 	return name, dns.RCodeSuccess
 }
 
+// SetQueryLogging turns on logging of the queries the resolver
+// handles for d, or turns it off if d is zero or negative. Queries
+// are only logged to memory, to be read with QueryLog.
+func (r *Resolver) SetQueryLogging(d time.Duration) {
+	r.qlog.setEnabled(d)
+}
+
+// QueryLog returns whether query logging is on and the most recently
+// logged queries.
+func (r *Resolver) QueryLog() ipnstate.DNSQueryLog {
+	return r.qlog.snapshot()
+}
+
 func (r *Resolver) handleQuery(pkt packet) {
+	r.handleQueryTo(pkt, r.responses, r.errors)
+}
+
+// handleQueryTo answers pkt, sending the response to responses, or
+// why there's none to errs.
+func (r *Resolver) handleQueryTo(pkt packet, responses chan<- packet, errs chan<- error) {
 	defer atomic.AddInt32(&r.activeQueriesAtomic, -1)
 
+	var qe *queryLogEntry // nil unless query logging is on
+	if r.qlog.enabled() {
+		qe = &queryLogEntry{start: time.Now()}
+		qe.setQuestion(pkt.bs)
+		defer func() {
+			qe.e.Time = qe.start
+			qe.e.LatencySeconds = time.Since(qe.start).Seconds()
+			r.qlog.add(qe.e)
+		}()
+	}
+
 	out, err := r.respond(pkt.bs)
 	if err == errNotOurName {
-		err = r.forwarder.forward(pkt)
+		err = r.forwarder.forwardTo(pkt, responses, qe)
 		if err == nil {
-			// forward will send response into r.responses, nothing to do.
+			// forwardTo will send response into responses, nothing to do.
 			return
 		}
+	} else if err == nil && qe != nil {
+		qe.e.Route = "local"
+		qe.e.Answer = summarizeResponse(out)
 	}
 	if err != nil {
+		if qe != nil {
+			qe.e.Error = err.Error()
+		}
 		select {
 		case <-r.closed:
-		case r.errors <- err:
+		case errs <- err:
 		}
 	} else {
 		select {
 		case <-r.closed:
-		case r.responses <- packet{out, pkt.addr}:
+		case responses <- packet{out, pkt.addr}:
 		}
 	}
 }
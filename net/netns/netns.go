@@ -17,15 +17,105 @@ package netns
 import (
 	"context"
 	"net"
+	"sync"
 
 	"inet.af/netaddr"
 )
 
-// Listener returns a new net.Listener with its Control hook func
+// PacketListener is the interface for listening for packets.
+// It's implemented by net.ListenConfig.
+type PacketListener interface {
+	ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error)
+}
+
+// Listener returns a new PacketListener with its Control hook func
 // initialized as necessary to run in logical network namespace that
-// doesn't route back into Tailscale.
-func Listener() *net.ListenConfig {
-	return &net.ListenConfig{Control: control}
+// doesn't route back into Tailscale. If SetSocketNetNS was used, its
+// sockets are created in that network namespace.
+func Listener() PacketListener {
+	lc := &net.ListenConfig{Control: control}
+	if path := socketNetNS(); path != "" {
+		return nsListener{lc, path}
+	}
+	return lc
+}
+
+// socketNS is the OS network namespace set by SetSocketNetNS.
+var socketNS struct {
+	sync.Mutex
+	path string
+}
+
+// SetSocketNetNS makes the sockets from this package's listeners and
+// dialers (and thus WireGuard's UDP, STUN, DERP and control
+// connections) be created in the Linux network namespace at path,
+// such as /proc/1/ns/net, while the rest of the process, including
+// its TUN device, stays in its own. An empty path means to use the
+// process's network namespace, which is the default.
+//
+// Host name lookups by dialers still happen in the process's network
+// namespace.
+//
+// It returns an error on other operating systems, or if path can't
+// be entered.
+func SetSocketNetNS(path string) error {
+	if path != "" {
+		if err := checkNetNS(path); err != nil {
+			return err
+		}
+	}
+	socketNS.Lock()
+	defer socketNS.Unlock()
+	socketNS.path = path
+	return nil
+}
+
+// socketNetNS returns the path set by SetSocketNetNS.
+func socketNetNS() string {
+	socketNS.Lock()
+	defer socketNS.Unlock()
+	return socketNS.path
+}
+
+// nsListener is a PacketListener that creates its sockets in the
+// network namespace at path.
+type nsListener struct {
+	lc   *net.ListenConfig
+	path string
+}
+
+func (l nsListener) ListenPacket(ctx context.Context, network, address string) (pc net.PacketConn, err error) {
+	if nsErr := runInNetNS(l.path, func() {
+		pc, err = l.lc.ListenPacket(ctx, network, address)
+	}); nsErr != nil {
+		return nil, nsErr
+	}
+	return pc, err
+}
+
+// nsDialer is a Dialer that creates its sockets in the network
+// namespace at path.
+type nsDialer struct {
+	d    *net.Dialer
+	path string
+}
+
+func (d nsDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d nsDialer) DialContext(ctx context.Context, network, address string) (c net.Conn, err error) {
+	// Without a dual-stack fallback, the net package dials
+	// addresses one at a time from the calling goroutine, which
+	// is the one runInNetNS put in the namespace.
+	nd := *d.d
+	nd.FallbackDelay = -1
+	if nsErr := runInNetNS(d.path, func() {
+		c, err = nd.DialContext(ctx, network, address)
+	}); nsErr != nil {
+		return nil, nsErr
+	}
+	return c, err
 }
 
 // NewDialer returns a new Dialer using a net.Dialer with its Control
@@ -42,10 +132,14 @@ func NewDialer() Dialer {
 // ALL_PROXY.
 func FromDialer(d *net.Dialer) Dialer {
 	d.Control = control
+	var nd Dialer = d
+	if path := socketNetNS(); path != "" {
+		nd = nsDialer{d, path}
+	}
 	if wrapDialer != nil {
-		return wrapDialer(d)
+		return wrapDialer(nd)
 	}
-	return d
+	return nd
 }
 
 // IsSOCKSDialer reports whether d is SOCKS-proxying dialer as returned by
@@ -54,8 +148,11 @@ func IsSOCKSDialer(d Dialer) bool {
 	if d == nil {
 		return false
 	}
-	_, ok := d.(*net.Dialer)
-	return !ok
+	switch d.(type) {
+	case *net.Dialer, nsDialer:
+		return false
+	}
+	return true
 }
 
 // wrapDialer, if non-nil, specifies a function to wrap a dialer in a
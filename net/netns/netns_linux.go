@@ -91,6 +91,12 @@ func control(network, address string, c syscall.RawConn) error {
 		// Don't bind to an interface for localhost connections.
 		return nil
 	}
+	if socketNetNS() != "" {
+		// The socket is in another network namespace, which
+		// doesn't have our routes, and whose interfaces we don't
+		// know.
+		return nil
+	}
 
 	var sockErr error
 	err := c.Control(func(fd uintptr) {
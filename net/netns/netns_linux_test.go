@@ -5,10 +5,12 @@
 package netns
 
 import (
+	"context"
 	"fmt"
 	"go/ast"
 	"go/parser"
 	"go/token"
+	"os"
 	"testing"
 )
 
@@ -55,3 +57,37 @@ func TestSocketMarkWorks(t *testing.T) {
 	// we cannot actually assert whether the test runner has SO_MARK available
 	// or not, as we don't know. We're just checking that it doesn't panic.
 }
+
+func TestSocketNetNS(t *testing.T) {
+	if err := SetSocketNetNS("/no/such/netns"); err == nil {
+		t.Error("SetSocketNetNS with bad path succeeded")
+	}
+	if got := socketNetNS(); got != "" {
+		t.Fatalf("after failed SetSocketNetNS, socketNetNS = %q", got)
+	}
+
+	if os.Getuid() != 0 {
+		t.Skip("entering a network namespace requires root")
+	}
+	// Our own namespace is the only one the test can count on.
+	if err := SetSocketNetNS("/proc/self/ns/net"); err != nil {
+		t.Fatal(err)
+	}
+	defer SetSocketNetNS("")
+
+	pc, err := Listener().ListenPacket(context.Background(), "udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	d := NewDialer()
+	if IsSOCKSDialer(d) && os.Getenv("ALL_PROXY") == "" {
+		t.Error("namespace dialer reported as SOCKS dialer")
+	}
+	c, err := d.DialContext(context.Background(), "udp4", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux && !android
+// +build linux,!android
+
+package netns
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// checkNetNS reports whether sockets can be created in the network
+// namespace at path.
+func checkNetNS(path string) error {
+	return runInNetNS(path, func() {})
+}
+
+// runInNetNS runs fn on a new goroutine whose OS thread is in the
+// network namespace at path, so sockets created by fn (but not by any
+// goroutines it starts) are in that namespace.
+func runInNetNS(path string, fn func()) error {
+	ns, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("opening network namespace: %w", err)
+	}
+	defer ns.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		// The thread is only unlocked once it's back in its
+		// original namespace. Otherwise the runtime discards it
+		// when this goroutine exits.
+		runtime.LockOSThread()
+
+		orig, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+		if err != nil {
+			runtime.UnlockOSThread()
+			errc <- fmt.Errorf("opening current network namespace: %w", err)
+			return
+		}
+		defer orig.Close()
+
+		if err := unix.Setns(int(ns.Fd()), unix.CLONE_NEWNET); err != nil {
+			runtime.UnlockOSThread()
+			errc <- fmt.Errorf("entering network namespace %s: %w", path, err)
+			return
+		}
+		fn()
+		if err := unix.Setns(int(orig.Fd()), unix.CLONE_NEWNET); err == nil {
+			runtime.UnlockOSThread()
+		}
+		errc <- nil
+	}()
+	return <-errc
+}
@@ -0,0 +1,19 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux || android
+// +build !linux android
+
+package netns
+
+import (
+	"errors"
+	"runtime"
+)
+
+var errNoNetNS = errors.New("socket network namespaces are not supported on " + runtime.GOOS)
+
+func checkNetNS(path string) error { return errNoNetNS }
+
+func runInNetNS(path string, fn func()) error { return errNoNetNS }
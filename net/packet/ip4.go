@@ -95,9 +95,10 @@ func ip4Checksum(b []byte) uint16 {
 const ip4PseudoHeaderOffset = 8
 
 // marshalPseudo serializes h into buf in the "pseudo-header" form
-// required when calculating UDP checksums. The pseudo-header starts
-// at buf[ip4PseudoHeaderOffset] so as to abut the following UDP
-// header, while leaving enough space in buf for a full IPv4 header.
+// required when calculating UDP and TCP checksums. The pseudo-header
+// starts at buf[ip4PseudoHeaderOffset] so as to abut the following
+// UDP or TCP header, while leaving enough space in buf for a full
+// IPv4 header.
 func (h IP4Header) marshalPseudo(buf []byte) error {
 	if len(buf) < h.Len() {
 		return errSmallBuffer
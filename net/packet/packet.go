@@ -360,6 +360,34 @@ func (q *Parsed) UDP4Header() UDP4Header {
 	}
 }
 
+func (q *Parsed) TCP4Header() TCP4Header {
+	if q.IPVersion != 4 {
+		panic("TCP4Header called on non-IPv4 Parsed")
+	}
+	return TCP4Header{
+		IP4Header: q.IP4Header(),
+		SrcPort:   q.Src.Port(),
+		DstPort:   q.Dst.Port(),
+		Seq:       binary.BigEndian.Uint32(q.b[q.subofs+4:]),
+		Ack:       binary.BigEndian.Uint32(q.b[q.subofs+8:]),
+		Flags:     q.TCPFlags,
+	}
+}
+
+func (q *Parsed) TCP6Header() TCP6Header {
+	if q.IPVersion != 6 {
+		panic("TCP6Header called on non-IPv6 Parsed")
+	}
+	return TCP6Header{
+		IP6Header: q.IP6Header(),
+		SrcPort:   q.Src.Port(),
+		DstPort:   q.Dst.Port(),
+		Seq:       binary.BigEndian.Uint32(q.b[q.subofs+4:]),
+		Ack:       binary.BigEndian.Uint32(q.b[q.subofs+8:]),
+		Flags:     q.TCPFlags,
+	}
+}
+
 // Buffer returns the entire packet buffer.
 // This is a read-only view; that is, q retains the ownership of the buffer.
 func (q *Parsed) Buffer() []byte {
@@ -531,6 +531,86 @@ func TestMarshalResponse(t *testing.T) {
 	}
 }
 
+func TestMarshalTCP(t *testing.T) {
+	tests := []struct {
+		name   string
+		header Header
+		want   Parsed // only the fields checked below
+	}{
+		{
+			name: "tcp4",
+			header: TCP4Header{
+				IP4Header: IP4Header{Src: netaddr.MustParseIP("1.2.3.4"), Dst: netaddr.MustParseIP("5.6.7.8")},
+				SrcPort:   123,
+				DstPort:   456,
+				Seq:       0x01020304,
+				Ack:       0x05060708,
+				Flags:     TCPRst | TCPAck,
+			},
+			want: Parsed{
+				IPVersion: 4,
+				IPProto:   TCP,
+				Src:       mustIPPort("1.2.3.4:123"),
+				Dst:       mustIPPort("5.6.7.8:456"),
+				TCPFlags:  TCPRst | TCPAck,
+			},
+		},
+		{
+			name: "tcp6",
+			header: TCP6Header{
+				IP6Header: IP6Header{Src: netaddr.MustParseIP("2001:db8::1"), Dst: netaddr.MustParseIP("2001:db8::2")},
+				SrcPort:   123,
+				DstPort:   456,
+				Seq:       0x01020304,
+				Ack:       0x05060708,
+				Flags:     TCPRst | TCPAck,
+			},
+			want: Parsed{
+				IPVersion: 6,
+				IPProto:   TCP,
+				Src:       mustIPPort("[2001:db8::1]:123"),
+				Dst:       mustIPPort("[2001:db8::2]:456"),
+				TCPFlags:  TCPRst | TCPAck,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := Generate(tt.header, nil)
+			var p Parsed
+			p.Decode(buf)
+			if p.IPVersion != tt.want.IPVersion || p.IPProto != tt.want.IPProto || p.Src != tt.want.Src || p.Dst != tt.want.Dst || p.TCPFlags != tt.want.TCPFlags {
+				t.Fatalf("decoded %v flags %v; want %v flags %v", &p, p.TCPFlags, &tt.want, tt.want.TCPFlags)
+			}
+
+			var seq, ack uint32
+			var pseudo []byte
+			switch p.IPVersion {
+			case 4:
+				h := p.TCP4Header()
+				seq, ack = h.Seq, h.Ack
+				src, dst := h.Src.As4(), h.Dst.As4()
+				pseudo = append(append(pseudo, src[:]...), dst[:]...)
+				pseudo = append(pseudo, 0, uint8(TCP), 0, tcpHeaderLength)
+			case 6:
+				h := p.TCP6Header()
+				seq, ack = h.Seq, h.Ack
+				src, dst := h.Src.As16(), h.Dst.As16()
+				pseudo = append(append(pseudo, src[:]...), dst[:]...)
+				pseudo = append(pseudo, 0, 0, 0, tcpHeaderLength, 0, 0, 0, uint8(TCP))
+			}
+			if seq != 0x01020304 || ack != 0x05060708 {
+				t.Errorf("seq, ack = %#x, %#x; want 0x01020304, 0x05060708", seq, ack)
+			}
+			// A correct checksum makes the checksum of the whole
+			// pseudo-header and segment zero.
+			if sum := ip4Checksum(append(pseudo, buf[p.subofs:]...)); sum != 0 {
+				t.Errorf("bad TCP checksum in %x", buf)
+			}
+		})
+	}
+}
+
 var sinkString string
 
 func BenchmarkString(b *testing.B) {
@@ -0,0 +1,113 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package packet
+
+import (
+	"encoding/binary"
+
+	"tailscale.com/types/ipproto"
+)
+
+// TCP4Header is an IPv4+TCP header, without TCP options.
+type TCP4Header struct {
+	IP4Header
+	SrcPort uint16
+	DstPort uint16
+	Seq     uint32
+	Ack     uint32
+	Flags   TCPFlag
+}
+
+// Len implements Header.
+func (h TCP4Header) Len() int {
+	return h.IP4Header.Len() + tcpHeaderLength
+}
+
+// Marshal implements Header.
+func (h TCP4Header) Marshal(buf []byte) error {
+	if len(buf) < h.Len() {
+		return errSmallBuffer
+	}
+	if len(buf) > maxPacketLength {
+		return errLargePacket
+	}
+	// The caller does not need to set this.
+	h.IPProto = ipproto.TCP
+
+	marshalTCP(buf[h.IP4Header.Len():], h.SrcPort, h.DstPort, h.Seq, h.Ack, h.Flags)
+
+	// TCP checksum with IP pseudo header.
+	h.IP4Header.marshalPseudo(buf)
+	binary.BigEndian.PutUint16(buf[36:38], ip4Checksum(buf[ip4PseudoHeaderOffset:]))
+
+	h.IP4Header.Marshal(buf)
+
+	return nil
+}
+
+// ToResponse implements Header. It swaps the addresses and ports,
+// but leaves Seq, Ack and Flags for the caller to set.
+func (h *TCP4Header) ToResponse() {
+	h.SrcPort, h.DstPort = h.DstPort, h.SrcPort
+	h.IP4Header.ToResponse()
+}
+
+// TCP6Header is an IPv6+TCP header, without TCP options.
+type TCP6Header struct {
+	IP6Header
+	SrcPort uint16
+	DstPort uint16
+	Seq     uint32
+	Ack     uint32
+	Flags   TCPFlag
+}
+
+// Len implements Header.
+func (h TCP6Header) Len() int {
+	return h.IP6Header.Len() + tcpHeaderLength
+}
+
+// Marshal implements Header.
+func (h TCP6Header) Marshal(buf []byte) error {
+	if len(buf) < h.Len() {
+		return errSmallBuffer
+	}
+	if len(buf) > maxPacketLength {
+		return errLargePacket
+	}
+	// The caller does not need to set this.
+	h.IPProto = ipproto.TCP
+
+	marshalTCP(buf[h.IP6Header.Len():], h.SrcPort, h.DstPort, h.Seq, h.Ack, h.Flags)
+
+	// TCP checksum with IP pseudo header.
+	h.IP6Header.marshalPseudo(buf)
+	binary.BigEndian.PutUint16(buf[56:58], ip4Checksum(buf[:]))
+
+	h.IP6Header.Marshal(buf)
+
+	return nil
+}
+
+// ToResponse implements Header. It swaps the addresses and ports,
+// but leaves Seq, Ack and Flags for the caller to set.
+func (h *TCP6Header) ToResponse() {
+	h.SrcPort, h.DstPort = h.DstPort, h.SrcPort
+	h.IP6Header.ToResponse()
+}
+
+// marshalTCP serializes an option-less TCP header into b, with a zero
+// window and a blank checksum.
+func marshalTCP(b []byte, srcPort, dstPort uint16, seq, ack uint32, flags TCPFlag) {
+	binary.BigEndian.PutUint16(b[0:2], srcPort)
+	binary.BigEndian.PutUint16(b[2:4], dstPort)
+	binary.BigEndian.PutUint32(b[4:8], seq)
+	binary.BigEndian.PutUint32(b[8:12], ack)
+	b[12] = (tcpHeaderLength / 4) << 4 // data offset, in 32-bit words
+	b[13] = uint8(flags)
+	binary.BigEndian.PutUint16(b[14:16], 0) // window
+	binary.BigEndian.PutUint16(b[16:18], 0) // blank checksum
+	binary.BigEndian.PutUint16(b[18:20], 0) // urgent pointer
+}
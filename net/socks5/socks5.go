@@ -21,6 +21,8 @@ import (
 	"log"
 	"net"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"tailscale.com/types/logger"
@@ -84,6 +86,16 @@ type Server struct {
 	// Dialer optionally specifies the dialer to use for outgoing connections.
 	// If nil, the net package's standard dialer is used.
 	Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// IdleTimeout optionally specifies how long a proxied
+	// connection may go without any bytes in either direction
+	// before both its legs are closed. If zero, there's no limit.
+	IdleTimeout time.Duration
+
+	// MaxLifetime optionally specifies how long a proxied
+	// connection may stay open in total, active or not, before both
+	// its legs are closed. If zero, there's no limit.
+	MaxLifetime time.Duration
 }
 
 func (s *Server) dial(ctx context.Context, network, addr string) (net.Conn, error) {
@@ -203,22 +215,72 @@ func (c *Conn) handleRequest() error {
 	}
 	c.clientConn.Write(buf)
 
+	var (
+		closeOnce     sync.Once
+		closedByLimit int32 // atomic; 1 once a limit closed the connection
+	)
+	closeForLimit := func(why string) {
+		closeOnce.Do(func() {
+			atomic.StoreInt32(&closedByLimit, 1)
+			c.srv.logf("[v1] closing connection from %v to %v: %s", c.clientConn.RemoteAddr(), srv.RemoteAddr(), why)
+			c.clientConn.Close()
+			srv.Close()
+		})
+	}
+	var backendReader, clientReader io.Reader = srv, c.clientConn
+	if d := c.srv.IdleTimeout; d > 0 {
+		idle := time.AfterFunc(d, func() {
+			closeForLimit(fmt.Sprintf("idle for %v", d))
+		})
+		defer idle.Stop()
+		resetIdle := func() { idle.Reset(d) }
+		backendReader = activityReader{srv, resetIdle}
+		clientReader = activityReader{c.clientConn, resetIdle}
+	}
+	if d := c.srv.MaxLifetime; d > 0 {
+		life := time.AfterFunc(d, func() {
+			closeForLimit(fmt.Sprintf("reached max lifetime of %v", d))
+		})
+		defer life.Stop()
+	}
+
 	errc := make(chan error, 2)
 	go func() {
-		_, err := io.Copy(c.clientConn, srv)
+		_, err := io.Copy(c.clientConn, backendReader)
 		if err != nil {
 			err = fmt.Errorf("from backend to client: %w", err)
 		}
 		errc <- err
 	}()
 	go func() {
-		_, err := io.Copy(srv, c.clientConn)
+		_, err := io.Copy(srv, clientReader)
 		if err != nil {
 			err = fmt.Errorf("from client to backend: %w", err)
 		}
 		errc <- err
 	}()
-	return <-errc
+	err = <-errc
+	if atomic.LoadInt32(&closedByLimit) != 0 {
+		// The copy failed because we closed the connection
+		// ourselves, which was already logged.
+		return nil
+	}
+	return err
+}
+
+// activityReader is an io.Reader that calls onRead whenever a read
+// returns data.
+type activityReader struct {
+	r      io.Reader
+	onRead func()
+}
+
+func (r activityReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.onRead()
+	}
+	return n, err
 }
 
 // parseClientGreeting parses a request initiation packet
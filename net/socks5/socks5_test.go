@@ -0,0 +1,173 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package socks5
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// pipeConn is one end of a net.Pipe with a TCP local address, as
+// handleRequest needs to report one to the client.
+type pipeConn struct {
+	net.Conn
+}
+
+func (pipeConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+}
+
+// startConn runs a connection through s over in-memory pipes, and
+// returns the client's end, after the SOCKS5 handshake, and the
+// backend's end. Run's result is sent on the returned channel.
+func startConn(t *testing.T, s *Server) (client, backend net.Conn, runErr <-chan error) {
+	t.Helper()
+	clientConn, proxyClientConn := net.Pipe()
+	proxyBackendConn, backendConn := net.Pipe()
+	t.Cleanup(func() {
+		clientConn.Close()
+		backendConn.Close()
+	})
+	s.Dialer = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return pipeConn{proxyBackendConn}, nil
+	}
+	errc := make(chan error, 1)
+	go func() {
+		c := &Conn{clientConn: proxyClientConn, srv: s}
+		errc <- c.Run()
+	}()
+
+	if _, err := clientConn.Write([]byte{socks5Version, 1, noAuthRequired}); err != nil {
+		t.Fatal(err)
+	}
+	var greeting [2]byte
+	if _, err := io.ReadFull(clientConn, greeting[:]); err != nil {
+		t.Fatal(err)
+	}
+	req := []byte{socks5Version, byte(connect), 0, byte(ipv4), 100, 64, 0, 1, 0, 80}
+	if _, err := clientConn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	var res [10]byte // IPv4 bind address
+	if _, err := io.ReadFull(clientConn, res[:]); err != nil {
+		t.Fatal(err)
+	}
+	if res[1] != byte(success) {
+		t.Fatalf("reply = %v; want success", res[1])
+	}
+	return clientConn, backendConn, errc
+}
+
+// echo sends b from one end of a proxied connection and reads it at
+// the other.
+func echo(t *testing.T, from, to net.Conn, b string) {
+	t.Helper()
+	go from.Write([]byte(b))
+	got := make([]byte, len(b))
+	to.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(to, got); err != nil {
+		t.Fatalf("reading %q: %v", b, err)
+	}
+	if string(got) != b {
+		t.Fatalf("got %q; want %q", got, b)
+	}
+}
+
+// awaitClosed waits for Run to return and checks that both legs of
+// the connection were closed.
+func awaitClosed(t *testing.T, client, backend net.Conn, runErr <-chan error) {
+	t.Helper()
+	select {
+	case err := <-runErr:
+		if err != nil {
+			t.Errorf("Run = %v; want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed")
+	}
+	for _, c := range []net.Conn{client, backend} {
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("read after close = %v; want EOF", err)
+		}
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	s := &Server{Logf: t.Logf, IdleTimeout: timeout}
+	client, backend, runErr := startConn(t, s)
+
+	// Traffic in either direction keeps the connection open for
+	// well past the idle timeout.
+	start := time.Now()
+	for i := 0; time.Since(start) < 3*timeout; i++ {
+		if i%2 == 0 {
+			echo(t, client, backend, "ping")
+		} else {
+			echo(t, backend, client, "pong")
+		}
+		time.Sleep(timeout / 4)
+	}
+	select {
+	case err := <-runErr:
+		t.Fatalf("connection closed while active: %v", err)
+	default:
+	}
+
+	awaitClosed(t, client, backend, runErr)
+}
+
+func TestMaxLifetime(t *testing.T) {
+	const lifetime = 200 * time.Millisecond
+	s := &Server{Logf: t.Logf, MaxLifetime: lifetime}
+	client, backend, runErr := startConn(t, s)
+	start := time.Now()
+
+	// An active connection is closed all the same.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if _, err := client.Write([]byte("x")); err != nil {
+				return
+			}
+			time.Sleep(lifetime / 10)
+		}
+	}()
+	go io.Copy(io.Discard, backend)
+
+	select {
+	case err := <-runErr:
+		if err != nil {
+			t.Errorf("Run = %v; want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed")
+	}
+	if d := time.Since(start); d < lifetime {
+		t.Errorf("closed after %v; want at least %v", d, lifetime)
+	}
+	<-done
+}
+
+func TestNoLimits(t *testing.T) {
+	s := &Server{Logf: t.Logf}
+	client, backend, runErr := startConn(t, s)
+
+	time.Sleep(100 * time.Millisecond)
+	echo(t, client, backend, "still here")
+	echo(t, backend, client, "indeed")
+
+	client.Close()
+	select {
+	case <-runErr:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run didn't return after client closed")
+	}
+}
@@ -50,6 +50,11 @@ func (d *dialer) onNewNetmap(nm *netmap.NetworkMap) {
 }
 
 func (d *dialer) resolve(ctx context.Context, addr string) (netaddr.IPPort, error) {
+	if d.ns != nil {
+		// Resolve names like 100.100.100.100 would, as it's
+		// what local apps' DNS queries would go to with a TUN.
+		return d.ns.Resolve(ctx, addr)
+	}
 	d.mu.Lock()
 	dns := d.dns
 	d.mu.Unlock()
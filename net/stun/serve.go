@@ -0,0 +1,69 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package stun
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"tailscale.com/types/logger"
+)
+
+// Dispositions of packets read by Serve, as passed to its note func.
+const (
+	ReadError  = "read_error"
+	NotSTUN    = "not_stun"
+	WriteError = "write_error"
+	Success    = "success"
+)
+
+// Serve answers the STUN binding requests read from pc until pc is
+// closed, and then returns net.ErrClosed. Other read errors are
+// logged to logf, at most once a minute, and retried after a second.
+//
+// If note is non-nil, it's called with the disposition of each packet
+// read (or read error) and, unless the read failed, the address it
+// came from.
+func Serve(pc net.PacketConn, logf logger.Logf, note func(disposition string, from *net.UDPAddr)) error {
+	if note == nil {
+		note = func(string, *net.UDPAddr) {}
+	}
+	logf = logger.RateLimitedFn(logf, time.Minute, 1, 1)
+	var buf [64 << 10]byte
+	for {
+		n, addr, err := pc.ReadFrom(buf[:])
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			logf("STUN ReadFrom: %v", err)
+			note(ReadError, nil)
+			time.Sleep(time.Second)
+			continue
+		}
+		ua, ok := addr.(*net.UDPAddr)
+		if !ok {
+			note(ReadError, nil)
+			continue
+		}
+		pkt := buf[:n]
+		if !Is(pkt) {
+			note(NotSTUN, ua)
+			continue
+		}
+		txid, err := ParseBindingRequest(pkt)
+		if err != nil {
+			note(NotSTUN, ua)
+			continue
+		}
+		res := Response(txid, ua.IP, uint16(ua.Port))
+		if _, err := pc.WriteTo(res, addr); err != nil {
+			note(WriteError, ua)
+		} else {
+			note(Success, ua)
+		}
+	}
+}
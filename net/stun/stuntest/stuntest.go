@@ -20,22 +20,37 @@ import (
 	"tailscale.com/types/nettype"
 )
 
-type stunStats struct {
+// Stats counts the STUN binding requests read by a test server.
+type Stats struct {
 	mu       sync.Mutex
 	readIPv4 int
 	readIPv6 int
 }
 
+// Reads returns the number of binding requests read so far from IPv4
+// and IPv6 clients.
+func (s *Stats) Reads() (ipv4, ipv6 int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readIPv4, s.readIPv6
+}
+
 func Serve(t testing.TB) (addr *net.UDPAddr, cleanupFn func()) {
 	return ServeWithPacketListener(t, nettype.Std{})
 }
 
 func ServeWithPacketListener(t testing.TB, ln nettype.PacketListener) (addr *net.UDPAddr, cleanupFn func()) {
 	t.Helper()
+	addr, _, cleanupFn = ServeWithStats(t, ln)
+	return addr, cleanupFn
+}
 
-	// TODO(crawshaw): use stats to test re-STUN logic
-	var stats stunStats
+// ServeWithStats is like ServeWithPacketListener, but also returns
+// the server's request counts, for testing re-STUN logic.
+func ServeWithStats(t testing.TB, ln nettype.PacketListener) (addr *net.UDPAddr, stats *Stats, cleanupFn func()) {
+	t.Helper()
 
+	stats = new(Stats)
 	pc, err := ln.ListenPacket(context.Background(), "udp4", ":0")
 	if err != nil {
 		t.Fatalf("failed to open STUN listener: %v", err)
@@ -45,14 +60,14 @@ func ServeWithPacketListener(t testing.TB, ln nettype.PacketListener) (addr *net
 		addr.IP = net.ParseIP("127.0.0.1")
 	}
 	doneCh := make(chan struct{})
-	go runSTUN(t, pc, &stats, doneCh)
-	return addr, func() {
+	go runSTUN(t, pc, stats, doneCh)
+	return addr, stats, func() {
 		pc.Close()
 		<-doneCh
 	}
 }
 
-func runSTUN(t testing.TB, pc net.PacketConn, stats *stunStats, done chan<- struct{}) {
+func runSTUN(t testing.TB, pc net.PacketConn, stats *Stats, done chan<- struct{}) {
 	defer close(done)
 
 	var buf [64 << 10]byte
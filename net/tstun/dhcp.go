@@ -0,0 +1,286 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"inet.af/netaddr"
+	"tailscale.com/atomicfile"
+	"tailscale.com/types/logger"
+)
+
+const (
+	// dhcpLeaseTime is how long a DHCP lease lasts.
+	dhcpLeaseTime = time.Hour
+
+	// dhcpOfferTime is how long an offered address is held for a
+	// client that hasn't requested it yet.
+	dhcpOfferTime = time.Minute
+)
+
+// dhcpLease is a DHCP lease, as stored in the lease file.
+type dhcpLease struct {
+	MAC     string // client hardware address, as from net.HardwareAddr.String
+	IP      netaddr.IP
+	Expires time.Time
+}
+
+// dhcpServer is TAP mode's DHCPv4 server. It hands out addresses from
+// a fixed range, and keeps them sticky per client MAC: a client keeps
+// getting its old address back, even after its lease has expired,
+// unless the range ran out and the address was given to another
+// client.
+type dhcpServer struct {
+	logf logger.Logf
+	conf DHCPConfig
+	path string           // lease file, or empty to keep leases in memory
+	now  func() time.Time // or nil for time.Now
+
+	mu     sync.Mutex
+	leases map[string]*dhcpLease // by MAC
+}
+
+// newDHCPServer returns a DHCP server for conf. If path is non-empty,
+// leases are loaded from and saved to it.
+func newDHCPServer(logf logger.Logf, conf DHCPConfig, path string) *dhcpServer {
+	s := &dhcpServer{
+		logf:   logf,
+		conf:   conf,
+		path:   path,
+		leases: map[string]*dhcpLease{},
+	}
+	if path == "" {
+		return s
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logf("reading leases: %v", err)
+		}
+		return s
+	}
+	var leases []*dhcpLease
+	if err := json.Unmarshal(b, &leases); err != nil {
+		logf("reading leases from %s: %v", path, err)
+		return s
+	}
+	for _, l := range leases {
+		// The range may have changed since the leases were saved.
+		if s.inRange(l.IP) {
+			s.leases[l.MAC] = l
+		}
+	}
+	return s
+}
+
+func (s *dhcpServer) timeNow() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+func (s *dhcpServer) inRange(ip netaddr.IP) bool {
+	return !ip.Less(s.conf.Start) && !s.conf.End.Less(ip)
+}
+
+// saveLocked writes the leases to the lease file, if any.
+// s.mu must be held.
+func (s *dhcpServer) saveLocked() {
+	if s.path == "" {
+		return
+	}
+	leases := make([]*dhcpLease, 0, len(s.leases))
+	for _, l := range s.leases {
+		leases = append(leases, l)
+	}
+	b, err := json.MarshalIndent(leases, "", "\t")
+	if err != nil {
+		s.logf("encoding leases: %v", err)
+		return
+	}
+	if err := atomicfile.WriteFile(s.path, b, 0600); err != nil {
+		s.logf("saving leases: %v", err)
+	}
+}
+
+// allocateLocked returns the address for mac: its existing one if it
+// has one, else want if that's free, else any free address. If every
+// address is taken, the one whose lease expired longest ago is
+// reclaimed. It reports false if there are no addresses left.
+// s.mu must be held.
+func (s *dhcpServer) allocateLocked(mac string, want netaddr.IP) (netaddr.IP, bool) {
+	if l, ok := s.leases[mac]; ok {
+		return l.IP, true
+	}
+	inUse := map[netaddr.IP]bool{}
+	for _, l := range s.leases {
+		inUse[l.IP] = true
+	}
+	if !want.IsZero() && s.inRange(want) && !inUse[want] {
+		return want, true
+	}
+	for ip := s.conf.Start; ip.IsValid() && s.inRange(ip); ip = ip.Next() {
+		if !inUse[ip] {
+			return ip, true
+		}
+	}
+	now := s.timeNow()
+	var oldest *dhcpLease
+	for _, l := range s.leases {
+		if l.Expires.Before(now) && (oldest == nil || l.Expires.Before(oldest.Expires)) {
+			oldest = l
+		}
+	}
+	if oldest == nil {
+		return netaddr.IP{}, false
+	}
+	delete(s.leases, oldest.MAC)
+	return oldest.IP, true
+}
+
+// offer picks an address for mac, preferring want, and holds it for
+// the client for a while. It reports false if there are no addresses
+// left.
+func (s *dhcpServer) offer(mac string, want netaddr.IP) (netaddr.IP, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ip, ok := s.allocateLocked(mac, want)
+	if !ok {
+		return netaddr.IP{}, false
+	}
+	exp := s.timeNow().Add(dhcpOfferTime)
+	if l, ok := s.leases[mac]; ok {
+		if l.Expires.After(exp) {
+			// Already has a longer lease.
+			return ip, true
+		}
+		l.Expires = exp
+	} else {
+		s.leases[mac] = &dhcpLease{MAC: mac, IP: ip, Expires: exp}
+	}
+	s.saveLocked()
+	return ip, true
+}
+
+// lease leases ip to mac, or reports false if ip isn't available
+// to mac.
+func (s *dhcpServer) lease(mac string, ip netaddr.IP) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	got, ok := s.allocateLocked(mac, ip)
+	if !ok || got != ip {
+		return false
+	}
+	s.leases[mac] = &dhcpLease{MAC: mac, IP: ip, Expires: s.timeNow().Add(dhcpLeaseTime)}
+	s.saveLocked()
+	return true
+}
+
+// release ends mac's lease on ip, if it has one.
+func (s *dhcpServer) release(mac string, ip netaddr.IP) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if l, ok := s.leases[mac]; ok && l.IP == ip {
+		delete(s.leases, mac)
+		s.saveLocked()
+	}
+}
+
+// leasedTo returns the MAC that ip is leased to, or the empty string
+// if it isn't leased.
+func (s *dhcpServer) leasedTo(ip netaddr.IP) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, l := range s.leases {
+		if l.IP == ip {
+			return l.MAC
+		}
+	}
+	return ""
+}
+
+// handle handles the DHCP message req and returns the reply to send,
+// or nil to send nothing.
+func (s *dhcpServer) handle(req *dhcpv4.DHCPv4) *dhcpv4.DHCPv4 {
+	mac := req.ClientHWAddr.String()
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeDiscover:
+		want, _ := netaddr.FromStdIP(req.RequestedIPAddress())
+		ip, ok := s.offer(mac, want)
+		if !ok {
+			s.logf("no free addresses for %v", mac)
+			return nil
+		}
+		return s.reply(req, dhcpv4.MessageTypeOffer, ip)
+	case dhcpv4.MessageTypeRequest:
+		if sid := req.ServerIdentifier(); sid != nil && !sid.Equal(stdIPv4(s.conf.Gateway)) {
+			// The client chose another server's offer.
+			return nil
+		}
+		want, _ := netaddr.FromStdIP(req.RequestedIPAddress())
+		if want.IsZero() {
+			// Renewing; the address is in ciaddr instead.
+			want, _ = netaddr.FromStdIP(req.ClientIPAddr)
+		}
+		if want.IsZero() || want == netaddr.IPv4(0, 0, 0, 0) {
+			return nil
+		}
+		if !s.lease(mac, want) {
+			return s.reply(req, dhcpv4.MessageTypeNak, netaddr.IP{})
+		}
+		return s.reply(req, dhcpv4.MessageTypeAck, want)
+	case dhcpv4.MessageTypeRelease:
+		ip, _ := netaddr.FromStdIP(req.ClientIPAddr)
+		s.release(mac, ip)
+	}
+	return nil
+}
+
+// reply returns a reply of type typ to req, leasing ip for an offer
+// or ack. It returns nil if the reply can't be built.
+func (s *dhcpServer) reply(req *dhcpv4.DHCPv4, typ dhcpv4.MessageType, ip netaddr.IP) *dhcpv4.DHCPv4 {
+	gw := stdIPv4(s.conf.Gateway)
+	mods := []dhcpv4.Modifier{
+		dhcpv4.WithReply(req),
+		dhcpv4.WithMessageType(typ),
+		dhcpv4.WithServerIP(gw),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(gw)),
+	}
+	if typ != dhcpv4.MessageTypeNak {
+		mods = append(mods,
+			dhcpv4.WithYourIP(stdIPv4(ip)),
+			dhcpv4.WithRouter(gw),
+			dhcpv4.WithNetmask(s.conf.Netmask),
+			dhcpv4.WithLeaseTime(uint32(dhcpLeaseTime/time.Second)),
+		)
+		if len(s.conf.DNS) > 0 {
+			dns := make([]net.IP, len(s.conf.DNS))
+			for i, ip := range s.conf.DNS {
+				dns[i] = stdIPv4(ip)
+			}
+			mods = append(mods, dhcpv4.WithDNS(dns...))
+		}
+	}
+	resp, err := dhcpv4.New(mods...)
+	if err != nil {
+		s.logf("building DHCP %v: %v", typ, err)
+		return nil
+	}
+	return resp
+}
+
+// stdIPv4 returns the IPv4 address ip as a 4 byte net.IP.
+func stdIPv4(ip netaddr.IP) net.IP {
+	b := ip.As4()
+	return net.IP(b[:])
+}
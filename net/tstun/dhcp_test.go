@@ -0,0 +1,188 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"inet.af/netaddr"
+)
+
+func testDHCPConfig() DHCPConfig {
+	return DHCPConfig{
+		Start:   netaddr.MustParseIP("192.168.100.10"),
+		End:     netaddr.MustParseIP("192.168.100.12"),
+		Gateway: netaddr.MustParseIP("192.168.100.1"),
+		Netmask: net.CIDRMask(24, 32),
+		DNS:     []netaddr.IP{netaddr.MustParseIP("100.100.100.100")},
+	}
+}
+
+func TestDHCPLeaseAllocation(t *testing.T) {
+	ip := netaddr.MustParseIP
+	now := time.Unix(1000, 0)
+	s := newDHCPServer(t.Logf, testDHCPConfig(), "")
+	s.now = func() time.Time { return now }
+
+	if got, ok := s.offer("mac1", netaddr.IP{}); !ok || got != ip("192.168.100.10") {
+		t.Fatalf("offer mac1 = %v, %v; want first address", got, ok)
+	}
+	// A client asking for a free address gets it.
+	if got, ok := s.offer("mac2", ip("192.168.100.12")); !ok || got != ip("192.168.100.12") {
+		t.Fatalf("offer mac2 = %v, %v; want requested address", got, ok)
+	}
+	// But not one that's taken.
+	now = now.Add(time.Second)
+	if got, ok := s.offer("mac3", ip("192.168.100.10")); !ok || got != ip("192.168.100.11") {
+		t.Fatalf("offer mac3 = %v, %v; want the free address", got, ok)
+	}
+	if s.lease("mac1", ip("192.168.100.11")) {
+		t.Error("leased mac3's address to mac1")
+	}
+	if s.lease("mac1", ip("192.168.100.200")) {
+		t.Error("leased an address outside the range")
+	}
+	if !s.lease("mac1", ip("192.168.100.10")) {
+		t.Fatal("couldn't lease mac1 its offered address")
+	}
+	if got := s.leasedTo(ip("192.168.100.10")); got != "mac1" {
+		t.Errorf("leasedTo = %q; want mac1", got)
+	}
+
+	// The range is full, and no leases have expired.
+	if got, ok := s.offer("mac4", netaddr.IP{}); ok {
+		t.Fatalf("offer mac4 = %v; want none", got)
+	}
+
+	// Once the unaccepted offers expire, the oldest is reclaimed.
+	now = now.Add(dhcpOfferTime + time.Second)
+	if got, ok := s.offer("mac4", netaddr.IP{}); !ok || got != ip("192.168.100.12") {
+		t.Fatalf("offer mac4 after expiry = %v, %v; want mac2's old address", got, ok)
+	}
+	// mac1's lease is still good, and sticky.
+	if got, ok := s.offer("mac1", netaddr.IP{}); !ok || got != ip("192.168.100.10") {
+		t.Fatalf("offer mac1 again = %v, %v; want its leased address", got, ok)
+	}
+
+	s.release("mac1", ip("192.168.100.11")) // wrong address; ignored
+	if got := s.leasedTo(ip("192.168.100.10")); got != "mac1" {
+		t.Errorf("after bogus release, leasedTo = %q; want mac1", got)
+	}
+	s.release("mac1", ip("192.168.100.10"))
+	if got := s.leasedTo(ip("192.168.100.10")); got != "" {
+		t.Errorf("after release, leasedTo = %q; want none", got)
+	}
+}
+
+func TestDHCPLeasePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leases.json")
+	s := newDHCPServer(t.Logf, testDHCPConfig(), path)
+	want := netaddr.MustParseIP("192.168.100.11")
+	if !s.lease("mac1", want) {
+		t.Fatal("lease failed")
+	}
+
+	s = newDHCPServer(t.Logf, testDHCPConfig(), path)
+	if got := s.leasedTo(want); got != "mac1" {
+		t.Errorf("after reload, leasedTo = %q; want mac1", got)
+	}
+
+	// Leases outside a changed range are dropped.
+	conf := testDHCPConfig()
+	conf.Start = netaddr.MustParseIP("192.168.100.20")
+	conf.End = netaddr.MustParseIP("192.168.100.30")
+	s = newDHCPServer(t.Logf, conf, path)
+	if got := s.leasedTo(want); got != "" {
+		t.Errorf("after range change, leasedTo = %q; want none", got)
+	}
+}
+
+// roundTrip encodes and decodes m, as sending it over the wire would.
+func roundTrip(t *testing.T, m *dhcpv4.DHCPv4) *dhcpv4.DHCPv4 {
+	t.Helper()
+	m2, err := dhcpv4.FromBytes(m.ToBytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m2
+}
+
+func TestDHCPHandle(t *testing.T) {
+	conf := testDHCPConfig()
+	s := newDHCPServer(t.Logf, conf, "")
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+
+	disc, err := dhcpv4.NewDiscovery(mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offer := s.handle(roundTrip(t, disc))
+	if offer == nil {
+		t.Fatal("no offer")
+	}
+	offer = roundTrip(t, offer)
+	if offer.MessageType() != dhcpv4.MessageTypeOffer {
+		t.Fatalf("got %v; want offer", offer.MessageType())
+	}
+	if offer.TransactionID != disc.TransactionID {
+		t.Errorf("offer xid = %v; want %v", offer.TransactionID, disc.TransactionID)
+	}
+	if !offer.YourIPAddr.Equal(net.ParseIP("192.168.100.10")) {
+		t.Errorf("offered %v; want 192.168.100.10", offer.YourIPAddr)
+	}
+	if got := offer.ServerIdentifier(); !got.Equal(net.ParseIP("192.168.100.1")) {
+		t.Errorf("server identifier = %v; want the gateway", got)
+	}
+	if got := offer.Router(); len(got) != 1 || !got[0].Equal(net.ParseIP("192.168.100.1")) {
+		t.Errorf("router = %v; want the gateway", got)
+	}
+	if got := offer.DNS(); len(got) != 1 || !got[0].Equal(net.ParseIP("100.100.100.100")) {
+		t.Errorf("DNS = %v; want MagicDNS", got)
+	}
+	if got := offer.SubnetMask(); got.String() != net.CIDRMask(24, 32).String() {
+		t.Errorf("netmask = %v; want /24", got)
+	}
+	if got := offer.IPAddressLeaseTime(0); got != dhcpLeaseTime {
+		t.Errorf("lease time = %v; want %v", got, dhcpLeaseTime)
+	}
+
+	req, err := dhcpv4.NewRequestFromOffer(offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack := s.handle(roundTrip(t, req))
+	if ack == nil {
+		t.Fatal("no ack")
+	}
+	ack = roundTrip(t, ack)
+	if ack.MessageType() != dhcpv4.MessageTypeAck || !ack.YourIPAddr.Equal(offer.YourIPAddr) {
+		t.Fatalf("got %v for %v; want ack for %v", ack.MessageType(), ack.YourIPAddr, offer.YourIPAddr)
+	}
+
+	// A request to another server is none of our business.
+	other, err := dhcpv4.NewRequestFromOffer(offer,
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(net.ParseIP("192.168.100.2"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := s.handle(roundTrip(t, other)); resp != nil {
+		t.Errorf("answered request to another server with %v", resp.MessageType())
+	}
+
+	// Another client asking for the leased address is refused.
+	mac2 := net.HardwareAddr{0x02, 0, 0, 0, 0, 2}
+	req2, err := dhcpv4.NewRequestFromOffer(offer, dhcpv4.WithHwAddr(mac2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nak := s.handle(roundTrip(t, req2))
+	if nak == nil || roundTrip(t, nak).MessageType() != dhcpv4.MessageTypeNak {
+		t.Errorf("got %v; want nak", nak)
+	}
+}
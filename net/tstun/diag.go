@@ -0,0 +1,109 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"net"
+	"strings"
+
+	"tailscale.com/types/logger"
+)
+
+// The OS-specific TUN failure diagnostics below are written in terms
+// of small system query funcs, rather than calling the OS directly,
+// so they can be tested on any platform.
+
+// windowsDiagSys are the system queries used by diagnoseWindows.
+type windowsDiagSys struct {
+	// interfaceNames returns the names of the system's network
+	// adapters.
+	interfaceNames func() ([]string, error)
+	// driverInstalled reports whether the wintun driver is
+	// installed.
+	driverInstalled func() (bool, error)
+}
+
+// diagnoseWindows explains common Wintun adapter creation failures:
+// a stale adapter left behind by a crashed previous run, or a driver
+// that failed to install.
+func diagnoseWindows(tunName string, logf logger.Logf, sys windowsDiagSys) {
+	names, err := sys.interfaceNames()
+	if err != nil {
+		logf("failed to list network adapters: %v", err)
+	} else {
+		for _, name := range names {
+			if strings.EqualFold(name, tunName) {
+				logf("a network adapter named %q already exists, probably left behind by a previous tailscaled that didn't exit cleanly; remove it in Device Manager (View > Show hidden devices, Network adapters) or reboot, then try again", name)
+				break
+			}
+		}
+	}
+
+	ok, err := sys.driverInstalled()
+	switch {
+	case err != nil:
+		logf("failed to check for the wintun driver: %v", err)
+	case !ok:
+		logf("the wintun driver isn't installed; it's normally installed on first use, which requires running as Administrator. Reinstalling Tailscale may also fix this")
+	}
+}
+
+// utunLimit is roughly the number of utun devices macOS allows
+// before device creation starts failing.
+const utunLimit = 255
+
+// darwinDiagSys are the system queries used by diagnoseDarwin.
+type darwinDiagSys struct {
+	// isRoot reports whether the process is running as root.
+	isRoot func() bool
+	// interfaceNames returns the names of the system's network
+	// interfaces.
+	interfaceNames func() ([]string, error)
+	// sandboxed reports whether the process is running inside
+	// the macOS App Sandbox.
+	sandboxed func() bool
+}
+
+// diagnoseDarwin explains common utun creation failures: not being
+// root, running sandboxed without the entitlements to create utun
+// devices, and running out of utun devices.
+func diagnoseDarwin(tunName string, logf logger.Logf, sys darwinDiagSys) {
+	if !sys.isRoot() {
+		logf("failed to create TUN device as non-root user; use 'sudo tailscaled', or run under launchd with 'sudo tailscaled install-system-daemon'")
+	}
+	if sys.sandboxed() {
+		logf("tailscaled is running in the App Sandbox, which doesn't permit creating utun devices; run it outside of the sandbox, or use --tun=userspace-networking")
+	}
+	if tunName != "utun" {
+		logf("failed to create TUN device %q; try using tun device \"utun\" instead for automatic selection", tunName)
+	}
+	names, err := sys.interfaceNames()
+	if err != nil {
+		logf("failed to list network interfaces: %v", err)
+		return
+	}
+	n := 0
+	for _, name := range names {
+		if strings.HasPrefix(name, "utun") {
+			n++
+		}
+	}
+	if n >= utunLimit {
+		logf("%d utun devices exist, which is at the macOS limit; quit other VPN software or reboot to free some", n)
+	}
+}
+
+// interfaceNames returns the names of the system's network interfaces.
+func interfaceNames() ([]string, error) {
+	ifs, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(ifs))
+	for _, iface := range ifs {
+		names = append(names, iface.Name)
+	}
+	return names, nil
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// logCollector returns a logf that collects formatted log lines
+// into *lines.
+func logCollector(lines *[]string) func(string, ...interface{}) {
+	return func(format string, args ...interface{}) {
+		*lines = append(*lines, fmt.Sprintf(format, args...))
+	}
+}
+
+func hasLine(lines []string, substr string) bool {
+	for _, l := range lines {
+		if strings.Contains(l, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDiagnoseWindows(t *testing.T) {
+	names := func(n ...string) func() ([]string, error) {
+		return func() ([]string, error) { return n, nil }
+	}
+	driver := func(ok bool, err error) func() (bool, error) {
+		return func() (bool, error) { return ok, err }
+	}
+	tests := []struct {
+		name  string
+		sys   windowsDiagSys
+		want  []string
+		nolog bool
+	}{
+		{
+			name:  "healthy",
+			sys:   windowsDiagSys{interfaceNames: names("Ethernet", "Wi-Fi"), driverInstalled: driver(true, nil)},
+			nolog: true,
+		},
+		{
+			name: "stale_adapter",
+			sys:  windowsDiagSys{interfaceNames: names("Ethernet", "tailscale"), driverInstalled: driver(true, nil)},
+			want: []string{"already exists", "Device Manager"},
+		},
+		{
+			name: "no_driver",
+			sys:  windowsDiagSys{interfaceNames: names("Ethernet"), driverInstalled: driver(false, nil)},
+			want: []string{"wintun driver isn't installed", "Administrator"},
+		},
+		{
+			name: "query_errors",
+			sys: windowsDiagSys{
+				interfaceNames:  func() ([]string, error) { return nil, errors.New("boom") },
+				driverInstalled: driver(false, errors.New("bang")),
+			},
+			want: []string{"failed to list network adapters: boom", "failed to check for the wintun driver: bang"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var lines []string
+			diagnoseWindows("Tailscale", logCollector(&lines), tt.sys)
+			if tt.nolog && len(lines) > 0 {
+				t.Errorf("unexpected logs: %q", lines)
+			}
+			for _, w := range tt.want {
+				if !hasLine(lines, w) {
+					t.Errorf("missing log containing %q; got %q", w, lines)
+				}
+			}
+		})
+	}
+}
+
+func TestDiagnoseDarwin(t *testing.T) {
+	utuns := func(n int) func() ([]string, error) {
+		return func() ([]string, error) {
+			ret := []string{"lo0", "en0"}
+			for i := 0; i < n; i++ {
+				ret = append(ret, fmt.Sprintf("utun%d", i))
+			}
+			return ret, nil
+		}
+	}
+	yes := func() bool { return true }
+	no := func() bool { return false }
+	tests := []struct {
+		name    string
+		tunName string
+		sys     darwinDiagSys
+		want    []string
+		nolog   bool
+	}{
+		{
+			name:    "healthy",
+			tunName: "utun",
+			sys:     darwinDiagSys{isRoot: yes, interfaceNames: utuns(3), sandboxed: no},
+			nolog:   true,
+		},
+		{
+			name:    "non_root",
+			tunName: "utun",
+			sys:     darwinDiagSys{isRoot: no, interfaceNames: utuns(0), sandboxed: no},
+			want:    []string{"non-root user"},
+		},
+		{
+			name:    "sandboxed",
+			tunName: "utun",
+			sys:     darwinDiagSys{isRoot: yes, interfaceNames: utuns(0), sandboxed: yes},
+			want:    []string{"App Sandbox"},
+		},
+		{
+			name:    "named_device",
+			tunName: "utun7",
+			sys:     darwinDiagSys{isRoot: yes, interfaceNames: utuns(0), sandboxed: no},
+			want:    []string{`try using tun device "utun"`},
+		},
+		{
+			name:    "utun_limit",
+			tunName: "utun",
+			sys:     darwinDiagSys{isRoot: yes, interfaceNames: utuns(utunLimit), sandboxed: no},
+			want:    []string{"at the macOS limit"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var lines []string
+			diagnoseDarwin(tt.tunName, logCollector(&lines), tt.sys)
+			if tt.nolog && len(lines) > 0 {
+				t.Errorf("unexpected logs: %q", lines)
+			}
+			for _, w := range tt.want {
+				if !hasLine(lines, w) {
+					t.Errorf("missing log containing %q; got %q", w, lines)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"os"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/tun"
+	"inet.af/netaddr"
+)
+
+// multiTUN is a tun.Device that joins a primary and a secondary TUN
+// device. Packets read from either device are returned from Read.
+// Packets written are sent to the secondary device if their
+// destination is in one of the secondary prefixes, and to the
+// primary device otherwise. Events from either device are merged
+// into one channel.
+type multiTUN struct {
+	primary   tun.Device
+	secondary tun.Device
+	prefixes  []netaddr.IPPrefix
+
+	reads     chan multiRead
+	events    chan tun.Event
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// multiRead is the result of one Read from a joined device. If err is
+// nil, the packet is in (*buf)[PacketStartOffset:][:n], and buf must be
+// returned to multiBufferPool once the packet has been copied out.
+type multiRead struct {
+	buf *[maxBufferSize]byte
+	n   int
+	err error
+}
+
+// multiBufferPool holds packet buffers for multiTUN's read path, so
+// that reading a packet doesn't allocate.
+var multiBufferPool = sync.Pool{New: func() interface{} { return new([maxBufferSize]byte) }}
+
+// NewMulti returns a tun.Device that sends packets destined to
+// prefixes to secondary, and all other packets to primary. Packets
+// read from either device are returned from its Read method, and
+// events from either device from its Events method. The returned
+// device's name and MTU are those of primary.
+func NewMulti(primary, secondary tun.Device, prefixes []netaddr.IPPrefix) tun.Device {
+	t := &multiTUN{
+		primary:   primary,
+		secondary: secondary,
+		prefixes:  append([]netaddr.IPPrefix(nil), prefixes...),
+		reads:     make(chan multiRead),
+		events:    make(chan tun.Event),
+		closed:    make(chan struct{}),
+	}
+	go t.readFrom(primary)
+	go t.readFrom(secondary)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go t.pumpEvents(&wg, primary)
+	go t.pumpEvents(&wg, secondary)
+	go func() {
+		wg.Wait()
+		close(t.events)
+	}()
+	return t
+}
+
+func (t *multiTUN) readFrom(dev tun.Device) {
+	for {
+		buf := multiBufferPool.Get().(*[maxBufferSize]byte)
+		n, err := dev.Read(buf[:], PacketStartOffset)
+		r := multiRead{buf: buf, n: n, err: err}
+		if err != nil {
+			multiBufferPool.Put(buf)
+			r.buf = nil
+		}
+		select {
+		case t.reads <- r:
+		case <-t.closed:
+			if r.buf != nil {
+				multiBufferPool.Put(r.buf)
+			}
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// pumpEvents copies events from dev to t.events.
+// pumpEvents exits when dev's events channel or t.closed is closed,
+// and calls wg.Done when it does.
+func (t *multiTUN) pumpEvents(wg *sync.WaitGroup, dev tun.Device) {
+	defer wg.Done()
+	src := dev.Events()
+	for {
+		var event tun.Event
+		var ok bool
+		select {
+		case <-t.closed:
+			return
+		case event, ok = <-src:
+			if !ok {
+				return
+			}
+		}
+		select {
+		case <-t.closed:
+			return
+		case t.events <- event:
+		}
+	}
+}
+
+func (t *multiTUN) Read(buf []byte, offset int) (int, error) {
+	select {
+	case r := <-t.reads:
+		if r.err != nil {
+			return 0, r.err
+		}
+		n := copy(buf[offset:], r.buf[PacketStartOffset:PacketStartOffset+r.n])
+		multiBufferPool.Put(r.buf)
+		return n, nil
+	case <-t.closed:
+		return 0, ErrClosed
+	}
+}
+
+func (t *multiTUN) Write(buf []byte, offset int) (int, error) {
+	if dst, ok := packetDst(buf[offset:]); ok && t.isSecondary(dst) {
+		return t.secondary.Write(buf, offset)
+	}
+	return t.primary.Write(buf, offset)
+}
+
+func (t *multiTUN) isSecondary(ip netaddr.IP) bool {
+	for _, p := range t.prefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// packetDst returns the destination address of the IPv4 or IPv6
+// packet b.
+func packetDst(b []byte) (ip netaddr.IP, ok bool) {
+	if len(b) == 0 {
+		return ip, false
+	}
+	switch b[0] >> 4 {
+	case 4:
+		if len(b) < 20 {
+			return ip, false
+		}
+		return netaddr.IPv4(b[16], b[17], b[18], b[19]), true
+	case 6:
+		if len(b) < 40 {
+			return ip, false
+		}
+		var a [16]byte
+		copy(a[:], b[24:40])
+		return netaddr.IPFrom16(a), true
+	}
+	return ip, false
+}
+
+func (t *multiTUN) Close() error {
+	var err error
+	t.closeOnce.Do(func() {
+		close(t.closed)
+		err = t.primary.Close()
+		if err2 := t.secondary.Close(); err == nil {
+			err = err2
+		}
+	})
+	return err
+}
+
+func (t *multiTUN) Flush() error {
+	if err := t.primary.Flush(); err != nil {
+		return err
+	}
+	return t.secondary.Flush()
+}
+
+func (t *multiTUN) File() *os.File         { return t.primary.File() }
+func (t *multiTUN) MTU() (int, error)      { return t.primary.MTU() }
+func (t *multiTUN) Name() (string, error)  { return t.primary.Name() }
+func (t *multiTUN) Events() chan tun.Event { return t.events }
@@ -0,0 +1,209 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/tun"
+	"inet.af/netaddr"
+	"tailscale.com/net/packet"
+)
+
+// chanTUN is a tun.Device whose packets are read from in and
+// written to out, and whose events are read from events.
+type chanTUN struct {
+	name   string
+	in     chan []byte
+	out    chan []byte
+	events chan tun.Event
+}
+
+func newChanTUN(name string) *chanTUN {
+	return &chanTUN{
+		name:   name,
+		in:     make(chan []byte),
+		out:    make(chan []byte, 10),
+		events: make(chan tun.Event),
+	}
+}
+
+func (t *chanTUN) Read(b []byte, offset int) (int, error) {
+	p, ok := <-t.in
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(b[offset:], p), nil
+}
+
+func (t *chanTUN) Write(b []byte, offset int) (int, error) {
+	t.out <- append([]byte(nil), b[offset:]...)
+	return len(b) - offset, nil
+}
+
+func (t *chanTUN) Close() error {
+	close(t.in)
+	return nil
+}
+
+func (t *chanTUN) File() *os.File         { return nil }
+func (t *chanTUN) Flush() error           { return nil }
+func (t *chanTUN) MTU() (int, error)      { return 1280, nil }
+func (t *chanTUN) Name() (string, error)  { return t.name, nil }
+func (t *chanTUN) Events() chan tun.Event { return t.events }
+
+func udp6(src, dst string, sport, dport uint16) []byte {
+	header := &packet.UDP6Header{
+		IP6Header: packet.IP6Header{
+			Src: netaddr.MustParseIP(src),
+			Dst: netaddr.MustParseIP(dst),
+		},
+		SrcPort: sport,
+		DstPort: dport,
+	}
+	return packet.Generate(header, []byte("udp_payload"))
+}
+
+func TestMultiTUN(t *testing.T) {
+	primary := newChanTUN("tailscale0")
+	secondary := newChanTUN("tailscale1")
+	dev := NewMulti(primary, secondary, []netaddr.IPPrefix{
+		netaddr.MustParseIPPrefix("10.1.0.0/16"),
+		netaddr.MustParseIPPrefix("fd00:1::/64"),
+	})
+	defer dev.Close()
+
+	if name, _ := dev.Name(); name != "tailscale0" {
+		t.Errorf("Name = %q; want tailscale0", name)
+	}
+
+	tests := []struct {
+		pkt  []byte
+		want *chanTUN
+	}{
+		{udp4("1.2.3.4", "10.1.2.3", 1, 2), secondary},
+		{udp4("1.2.3.4", "10.2.2.3", 1, 2), primary},
+		{udp4("1.2.3.4", "100.64.0.1", 1, 2), primary},
+		{udp6("fd7a:115c:a1e0::1", "fd00:1::5", 1, 2), secondary},
+		{udp6("fd7a:115c:a1e0::1", "fd00:2::5", 1, 2), primary},
+		{[]byte{}, primary},
+	}
+	for i, tt := range tests {
+		buf := make([]byte, PacketStartOffset+len(tt.pkt))
+		copy(buf[PacketStartOffset:], tt.pkt)
+		if _, err := dev.Write(buf, PacketStartOffset); err != nil {
+			t.Fatalf("%d: Write: %v", i, err)
+		}
+		other := primary
+		if tt.want == primary {
+			other = secondary
+		}
+		select {
+		case got := <-tt.want.out:
+			if !bytes.Equal(got, tt.pkt) {
+				t.Errorf("%d: wrote %x; want %x", i, got, tt.pkt)
+			}
+		default:
+			t.Errorf("%d: packet not written to %s", i, tt.want.name)
+		}
+		select {
+		case <-other.out:
+			t.Errorf("%d: packet also written to %s", i, other.name)
+		default:
+		}
+	}
+
+	// Packets read from either device come out of the joined device.
+	for _, src := range []*chanTUN{primary, secondary} {
+		pkt := udp4("10.1.2.3", "100.64.0.1", 3, 4)
+		src.in <- pkt
+		buf := make([]byte, maxBufferSize)
+		n, err := dev.Read(buf, PacketStartOffset)
+		if err != nil {
+			t.Fatalf("Read from %s: %v", src.name, err)
+		}
+		if got := buf[PacketStartOffset : PacketStartOffset+n]; !bytes.Equal(got, pkt) {
+			t.Errorf("Read from %s = %x; want %x", src.name, got, pkt)
+		}
+	}
+}
+
+func TestMultiTUNEvents(t *testing.T) {
+	primary := newChanTUN("tailscale0")
+	secondary := newChanTUN("tailscale1")
+	dev := NewMulti(primary, secondary, nil)
+	defer dev.Close() // in case of t.Fatal; Close is idempotent
+
+	// Events from both devices come out of the joined device, and
+	// neither device's sender is left blocked.
+	for _, tt := range []struct {
+		src *chanTUN
+		ev  tun.Event
+	}{
+		{primary, tun.EventUp},
+		{secondary, tun.EventMTUUpdate},
+		{secondary, tun.EventDown},
+		{primary, tun.EventMTUUpdate},
+	} {
+		select {
+		case tt.src.events <- tt.ev:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("sending %v on %s blocked", tt.ev, tt.src.name)
+		}
+		select {
+		case got := <-dev.Events():
+			if got != tt.ev {
+				t.Errorf("event from %s = %v; want %v", tt.src.name, got, tt.ev)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("event %v from %s not delivered", tt.ev, tt.src.name)
+		}
+	}
+
+	// Closing the joined device closes both devices and its events
+	// channel.
+	dev.Close()
+	for _, d := range []*chanTUN{primary, secondary} {
+		select {
+		case _, ok := <-d.in:
+			if ok {
+				t.Errorf("%s: got packet after Close", d.name)
+			}
+		default:
+			t.Errorf("%s not closed by joined device's Close", d.name)
+		}
+	}
+	select {
+	case _, ok := <-dev.Events():
+		if ok {
+			t.Error("got event after Close; want closed channel")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Events not closed after Close")
+	}
+}
+
+func TestMultiTUNReadAllocs(t *testing.T) {
+	primary := newChanTUN("tailscale0")
+	secondary := newChanTUN("tailscale1")
+	dev := NewMulti(primary, secondary, nil)
+	defer dev.Close()
+
+	pkt := udp4("10.1.2.3", "100.64.0.1", 3, 4)
+	buf := make([]byte, maxBufferSize)
+	allocs := testing.AllocsPerRun(100, func() {
+		primary.in <- pkt
+		if _, err := dev.Read(buf, PacketStartOffset); err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+	})
+	if allocs > 0 {
+		t.Errorf("read allocs = %v; want 0", allocs)
+	}
+}
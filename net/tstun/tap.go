@@ -0,0 +1,206 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"golang.zx2c4.com/wireguard/tun"
+	"inet.af/netaddr"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/types/logger"
+)
+
+// TAPConfig is a parsed TAP device spec. See ParseTAPConfig.
+type TAPConfig struct {
+	Name   string // TAP device name
+	Bridge string // bridge to add the device to, or empty
+
+	// DHCP, if non-nil, configures a DHCPv4 server for clients on
+	// the TAP device's network. If nil, DHCP traffic is ignored,
+	// leaving it to any other DHCP server on the bridge.
+	DHCP *DHCPConfig
+}
+
+// DHCPConfig configures TAP mode's DHCPv4 server.
+type DHCPConfig struct {
+	// Start and End are the first and last addresses to lease,
+	// inclusive.
+	Start, End netaddr.IP
+
+	// Gateway is the default router handed out to clients. It's
+	// also the address the server answers from.
+	Gateway netaddr.IP
+
+	// Netmask is the subnet mask handed out to clients.
+	Netmask net.IPMask
+
+	// DNS are the nameservers handed out to clients, if any.
+	DNS []netaddr.IP
+}
+
+// ParseTAPConfig parses a TAP device spec of the form
+// "tap:TAPNAME[:BRIDGENAME][;OPTIONS]".
+//
+// OPTIONS, if present, configure the DHCP server as comma-separated
+// key=value pairs:
+//
+//	dhcp=START-END   the range of addresses to lease (required)
+//	gw=IP            the default router (required)
+//	netmask=MASK     the subnet mask; default 255.255.255.0
+//	dns=IP           a nameserver, or "magicdns" for Tailscale's
+//	                 MagicDNS resolver; may be repeated
+//
+// For example, "tap:tap0:br0;dhcp=192.168.100.10-192.168.100.100,gw=192.168.100.1".
+func ParseTAPConfig(spec string) (TAPConfig, error) {
+	var c TAPConfig
+	if !strings.HasPrefix(spec, "tap:") {
+		return c, fmt.Errorf("TAP spec %q doesn't start with \"tap:\"", spec)
+	}
+	devSpec, opts := strings.TrimPrefix(spec, "tap:"), ""
+	if i := strings.IndexByte(devSpec, ';'); i != -1 {
+		devSpec, opts = devSpec[:i], devSpec[i+1:]
+	}
+	f := strings.Split(devSpec, ":")
+	switch len(f) {
+	case 1:
+		c.Name = f[0]
+	case 2:
+		c.Name, c.Bridge = f[0], f[1]
+	default:
+		return c, errors.New("bogus tap argument")
+	}
+	if c.Name == "" {
+		return c, errors.New("bogus tap argument: empty TAP name")
+	}
+	if opts == "" {
+		return c, nil
+	}
+	dc, err := parseDHCPConfig(opts)
+	if err != nil {
+		return c, fmt.Errorf("tap %s: %w", c.Name, err)
+	}
+	c.DHCP = dc
+	return c, nil
+}
+
+func parseDHCPConfig(opts string) (*DHCPConfig, error) {
+	c := &DHCPConfig{
+		Netmask: net.CIDRMask(24, 32),
+	}
+	parseIPv4 := func(k, v string) (netaddr.IP, error) {
+		ip, err := netaddr.ParseIP(v)
+		if err != nil || !ip.Is4() {
+			return netaddr.IP{}, fmt.Errorf("invalid IPv4 address %q for %s", v, k)
+		}
+		return ip, nil
+	}
+	for _, kv := range strings.Split(opts, ",") {
+		i := strings.IndexByte(kv, '=')
+		if i == -1 {
+			return nil, fmt.Errorf("option %q isn't of the form key=value", kv)
+		}
+		k, v := kv[:i], kv[i+1:]
+		var err error
+		switch k {
+		case "dhcp":
+			i := strings.IndexByte(v, '-')
+			if i == -1 {
+				return nil, fmt.Errorf("dhcp range %q isn't of the form START-END", v)
+			}
+			if c.Start, err = parseIPv4("dhcp", v[:i]); err != nil {
+				return nil, err
+			}
+			if c.End, err = parseIPv4("dhcp", v[i+1:]); err != nil {
+				return nil, err
+			}
+		case "gw":
+			if c.Gateway, err = parseIPv4(k, v); err != nil {
+				return nil, err
+			}
+		case "netmask":
+			ip, err := parseIPv4(k, v)
+			if err != nil {
+				return nil, err
+			}
+			b := ip.As4()
+			mask := net.IPMask(b[:])
+			if ones, bits := mask.Size(); ones == 0 && bits == 0 {
+				return nil, fmt.Errorf("invalid netmask %q", v)
+			}
+			c.Netmask = mask
+		case "dns":
+			ip := tsaddr.TailscaleServiceIP()
+			if v != "magicdns" {
+				if ip, err = parseIPv4(k, v); err != nil {
+					return nil, err
+				}
+			}
+			c.DNS = append(c.DNS, ip)
+		default:
+			return nil, fmt.Errorf("unknown option %q", k)
+		}
+	}
+	if c.Start.IsZero() {
+		return nil, errors.New("missing dhcp=START-END option")
+	}
+	if c.Gateway.IsZero() {
+		return nil, errors.New("missing gw option")
+	}
+	if c.End.Less(c.Start) {
+		return nil, fmt.Errorf("dhcp range %v-%v is backwards", c.Start, c.End)
+	}
+	ones, _ := c.Netmask.Size()
+	subnet := netaddr.IPPrefixFrom(c.Gateway, uint8(ones)).Masked()
+	if !subnet.Contains(c.Start) || !subnet.Contains(c.End) {
+		return nil, fmt.Errorf("dhcp range %v-%v isn't in gateway %v's subnet %v", c.Start, c.End, c.Gateway, subnet)
+	}
+	if !c.Gateway.Less(c.Start) && !c.End.Less(c.Gateway) {
+		return nil, fmt.Errorf("gateway %v is inside dhcp range %v-%v", c.Gateway, c.Start, c.End)
+	}
+	return c, nil
+}
+
+// tapDevice is a TAP tun.Device along with the DHCP server, if any,
+// for its network. WrapTAP picks the server up from it.
+type tapDevice struct {
+	tun.Device
+	dhcp *dhcpServer // or nil
+}
+
+// NewTAP returns a TAP device for spec (see ParseTAPConfig), along
+// with its name. If spec configures a DHCP server, the server's
+// leases are kept in stateDir, or only in memory if stateDir is empty.
+func NewTAP(logf logger.Logf, spec, stateDir string) (tun.Device, string, error) {
+	if runtime.GOOS != "linux" {
+		return nil, "", errors.New("tap only works on Linux")
+	}
+	c, err := ParseTAPConfig(spec)
+	if err != nil {
+		return nil, "", err
+	}
+	dev, err := createTAP(c.Name, c.Bridge)
+	if err != nil {
+		return nil, "", err
+	}
+	name, err := waitUpAndName(logf, dev)
+	if err != nil {
+		return nil, "", err
+	}
+	if c.DHCP == nil {
+		return dev, name, nil
+	}
+	var leasePath string
+	if stateDir != "" {
+		leasePath = filepath.Join(stateDir, "dhcp-leases-"+c.Name+".json")
+	}
+	srv := newDHCPServer(logger.WithPrefix(logf, "tap: dhcp: "), *c.DHCP, leasePath)
+	return &tapDevice{Device: dev, dhcp: srv}, name, nil
+}
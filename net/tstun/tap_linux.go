@@ -154,9 +154,9 @@ func (t *Wrapper) handleTAPFrame(ethBuf []byte) bool {
 			res.SetIPv4OverEthernet()
 			res.SetOp(header.ARPReply)
 
-			// If the client's asking about their own IP, tell them it's
-			// their own MAC. TODO(bradfitz): remove String allocs.
-			if net.IP(req.ProtocolAddressTarget()).String() == theClientIP {
+			// If the client's asking about the IP we leased them, tell
+			// them it's their own MAC.
+			if t.isLeasedTo(req.ProtocolAddressTarget(), ethSrcMAC) {
 				copy(res.HardwareAddressSender(), ethSrcMAC)
 			} else {
 				copy(res.HardwareAddressSender(), ourMAC[:])
@@ -176,13 +176,23 @@ func (t *Wrapper) handleTAPFrame(ethBuf []byte) bool {
 	}
 }
 
-// TODO(bradfitz): remove these hard-coded values and move from a /24 to a /10 CGNAT as the range.
-const theClientIP = "100.70.145.3" // TODO: make dynamic from netmap
-const routerIP = "100.70.145.1"    // must be in same netmask (currently hack at /24) as theClientIP
+// isLeasedTo reports whether the IPv4 address ip is leased to mac by
+// the DHCP server.
+func (t *Wrapper) isLeasedTo(ip []byte, mac net.HardwareAddr) bool {
+	if t.dhcp == nil {
+		return false
+	}
+	nip, ok := netaddr.FromStdIP(net.IP(ip))
+	return ok && t.dhcp.leasedTo(nip) == mac.String()
+}
 
 // handleDHCPRequest handles receiving a raw TAP ethernet frame and reports whether
 // it's been handled as a DHCP request. That is, it reports whether the frame should
 // be ignored by the caller and not passed on.
+//
+// DHCP requests are only answered if a DHCP server is configured.
+// Otherwise they're dropped without reply, leaving them to any other
+// DHCP server on the bridge.
 func (t *Wrapper) handleDHCPRequest(ethBuf []byte) bool {
 	const udpHeader = 8
 	if len(ethBuf) < ethernetFrameSize+ipv4HeaderLen+udpHeader {
@@ -212,6 +222,12 @@ func (t *Wrapper) handleDHCPRequest(ethBuf []byte) bool {
 		}
 		return passOnPacket
 	}
+	if t.dhcp == nil {
+		if tapDebug {
+			t.logf("tap: ignoring DHCP request; no DHCP server configured")
+		}
+		return consumePacket
+	}
 
 	dp, err := dhcpv4.FromBytes(ethBuf[ethernetFrameSize+ipv4HeaderLen+udpHeader:])
 	if err != nil {
@@ -224,67 +240,20 @@ func (t *Wrapper) handleDHCPRequest(ethBuf []byte) bool {
 	if tapDebug {
 		t.logf("tap: DHCP request: %+v", dp)
 	}
-	switch dp.MessageType() {
-	case dhcpv4.MessageTypeDiscover:
-		offer, err := dhcpv4.New(
-			dhcpv4.WithReply(dp),
-			dhcpv4.WithMessageType(dhcpv4.MessageTypeOffer),
-			dhcpv4.WithRouter(net.ParseIP(routerIP)), // the default route
-			dhcpv4.WithDNS(net.ParseIP("100.100.100.100")),
-			dhcpv4.WithServerIP(net.ParseIP("100.100.100.100")), // TODO: what is this?
-			dhcpv4.WithOption(dhcpv4.OptServerIdentifier(net.ParseIP("100.100.100.100"))),
-			dhcpv4.WithYourIP(net.ParseIP(theClientIP)),
-			dhcpv4.WithLeaseTime(3600), // hour works
-			//dhcpv4.WithHwAddr(ethSrcMAC),
-			dhcpv4.WithNetmask(net.IPMask(net.ParseIP("255.255.255.0").To4())), // TODO: wrong
-			//dhcpv4.WithTransactionID(dp.TransactionID),
-		)
-		if err != nil {
-			t.logf("error building DHCP offer: %v", err)
-			return consumePacket
-		}
-		// Make a layer 2 packet to write out:
-		pkt := packLayer2UDP(
-			offer.ToBytes(),
-			ourMAC, ethSrcMAC,
-			netaddr.IPPortFrom(netaddr.IPv4(100, 100, 100, 100), 67), // src
-			netaddr.IPPortFrom(netaddr.IPv4(255, 255, 255, 255), 68), // dst
-		)
-		n, err := t.tdev.Write(pkt, 0)
-		if tapDebug {
-			t.logf("tap: wrote DHCP OFFER %v, %v", n, err)
-		}
-	case dhcpv4.MessageTypeRequest:
-		ack, err := dhcpv4.New(
-			dhcpv4.WithReply(dp),
-			dhcpv4.WithMessageType(dhcpv4.MessageTypeAck),
-			dhcpv4.WithDNS(net.ParseIP("100.100.100.100")),
-			dhcpv4.WithRouter(net.ParseIP(routerIP)),            // the default route
-			dhcpv4.WithServerIP(net.ParseIP("100.100.100.100")), // TODO: what is this?
-			dhcpv4.WithOption(dhcpv4.OptServerIdentifier(net.ParseIP("100.100.100.100"))),
-			dhcpv4.WithYourIP(net.ParseIP(theClientIP)), // Hello world
-			dhcpv4.WithLeaseTime(3600),                  // hour works
-			dhcpv4.WithNetmask(net.IPMask(net.ParseIP("255.255.255.0").To4())),
-		)
-		if err != nil {
-			t.logf("error building DHCP ack: %v", err)
-			return consumePacket
-		}
-		// Make a layer 2 packet to write out:
-		pkt := packLayer2UDP(
-			ack.ToBytes(),
-			ourMAC, ethSrcMAC,
-			netaddr.IPPortFrom(netaddr.IPv4(100, 100, 100, 100), 67), // src
-			netaddr.IPPortFrom(netaddr.IPv4(255, 255, 255, 255), 68), // dst
-		)
-		n, err := t.tdev.Write(pkt, 0)
-		if tapDebug {
-			t.logf("tap: wrote DHCP ACK %v, %v", n, err)
-		}
-	default:
-		if tapDebug {
-			t.logf("tap: unknown DHCP type")
-		}
+	resp := t.dhcp.handle(dp)
+	if resp == nil {
+		return consumePacket
+	}
+	// Make a layer 2 packet to write out:
+	pkt := packLayer2UDP(
+		resp.ToBytes(),
+		ourMAC, ethSrcMAC,
+		netaddr.IPPortFrom(t.dhcp.conf.Gateway, 67),              // src
+		netaddr.IPPortFrom(netaddr.IPv4(255, 255, 255, 255), 68), // dst
+	)
+	n, err := t.tdev.Write(pkt, 0)
+	if tapDebug {
+		t.logf("tap: wrote DHCP %v %v, %v", resp.MessageType(), n, err)
 	}
 	return consumePacket
 }
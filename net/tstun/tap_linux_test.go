@@ -0,0 +1,106 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"inet.af/netaddr"
+	"tailscale.com/net/packet"
+	"tailscale.com/types/ipproto"
+)
+
+// recordingTUN is a fake TUN device that records the frames written
+// to it.
+type recordingTUN struct {
+	fakeTUN
+	written [][]byte
+}
+
+func (t *recordingTUN) Write(b []byte, offset int) (int, error) {
+	t.written = append(t.written, append([]byte(nil), b[offset:]...))
+	return len(b) - offset, nil
+}
+
+var broadcastMAC = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+func TestPackLayer2UDP(t *testing.T) {
+	payload := []byte("hello")
+	srcMAC := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	src := netaddr.MustParseIPPort("192.168.100.1:67")
+	dst := netaddr.MustParseIPPort("255.255.255.255:68")
+	frame := packLayer2UDP(payload, srcMAC, broadcastMAC, src, dst)
+
+	if got := net.HardwareAddr(frame[:6]); got.String() != broadcastMAC.String() {
+		t.Errorf("dst MAC = %v", got)
+	}
+	if got := net.HardwareAddr(frame[6:12]); got.String() != srcMAC.String() {
+		t.Errorf("src MAC = %v", got)
+	}
+	if et := (etherType{frame[12], frame[13]}); et != etherTypeIPv4 {
+		t.Errorf("etherType = %v", et)
+	}
+	var p packet.Parsed
+	p.Decode(frame[ethernetFrameSize:])
+	if p.IPProto != ipproto.UDP || p.Src != src || p.Dst != dst {
+		t.Errorf("decoded %v %v -> %v; want UDP %v -> %v", p.IPProto, p.Src, p.Dst, src, dst)
+	}
+	if !bytes.Equal(p.Payload(), payload) {
+		t.Errorf("payload = %q; want %q", p.Payload(), payload)
+	}
+}
+
+func TestHandleDHCPRequest(t *testing.T) {
+	clientMAC := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	disc, err := dhcpv4.NewDiscovery(clientMAC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := packLayer2UDP(disc.ToBytes(), clientMAC, broadcastMAC,
+		netaddr.MustParseIPPort("0.0.0.0:68"),
+		netaddr.MustParseIPPort("255.255.255.255:67"))
+
+	// Without a DHCP server, requests are swallowed unanswered.
+	dev := new(recordingTUN)
+	w := &Wrapper{logf: t.Logf, tdev: dev, isTAP: true}
+	if !w.handleDHCPRequest(frame) {
+		t.Error("DHCP request passed on without a DHCP server")
+	}
+	if len(dev.written) != 0 {
+		t.Errorf("answered DHCP request without a DHCP server")
+	}
+
+	w.dhcp = newDHCPServer(t.Logf, testDHCPConfig(), "")
+	if !w.handleDHCPRequest(frame) {
+		t.Error("DHCP request passed on")
+	}
+	if len(dev.written) != 1 {
+		t.Fatalf("wrote %d frames; want 1", len(dev.written))
+	}
+	resp := dev.written[0]
+	if got := net.HardwareAddr(resp[:6]); got.String() != clientMAC.String() {
+		t.Errorf("reply sent to MAC %v; want %v", got, clientMAC)
+	}
+	var p packet.Parsed
+	p.Decode(resp[ethernetFrameSize:])
+	if want := netaddr.MustParseIPPort("192.168.100.1:67"); p.Src != want {
+		t.Errorf("reply from %v; want %v", p.Src, want)
+	}
+	offer, err := dhcpv4.FromBytes(p.Payload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offer.MessageType() != dhcpv4.MessageTypeOffer || !offer.YourIPAddr.Equal(net.ParseIP("192.168.100.10")) {
+		t.Errorf("got %v of %v; want offer of 192.168.100.10", offer.MessageType(), offer.YourIPAddr)
+	}
+
+	// The leased address is now ARPed as the client's own.
+	if !w.isLeasedTo(net.ParseIP("192.168.100.10").To4(), clientMAC) {
+		t.Error("offered address not leased to the client")
+	}
+}
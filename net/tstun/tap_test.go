@@ -0,0 +1,78 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstun
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestParseTAPConfig(t *testing.T) {
+	ip := netaddr.MustParseIP
+	tests := []struct {
+		spec    string
+		want    TAPConfig
+		wantErr bool
+	}{
+		{spec: "tap:tap0", want: TAPConfig{Name: "tap0"}},
+		{spec: "tap:tap0:br0", want: TAPConfig{Name: "tap0", Bridge: "br0"}},
+		{
+			spec: "tap:tap0:br0;dhcp=192.168.100.10-192.168.100.100,gw=192.168.100.1",
+			want: TAPConfig{
+				Name:   "tap0",
+				Bridge: "br0",
+				DHCP: &DHCPConfig{
+					Start:   ip("192.168.100.10"),
+					End:     ip("192.168.100.100"),
+					Gateway: ip("192.168.100.1"),
+					Netmask: net.CIDRMask(24, 32),
+				},
+			},
+		},
+		{
+			spec: "tap:tap0;dhcp=10.1.0.10-10.1.2.0,gw=10.1.0.1,netmask=255.255.0.0,dns=magicdns,dns=8.8.8.8",
+			want: TAPConfig{
+				Name: "tap0",
+				DHCP: &DHCPConfig{
+					Start:   ip("10.1.0.10"),
+					End:     ip("10.1.2.0"),
+					Gateway: ip("10.1.0.1"),
+					Netmask: net.CIDRMask(16, 32),
+					DNS:     []netaddr.IP{ip("100.100.100.100"), ip("8.8.8.8")},
+				},
+			},
+		},
+		{spec: "tailscale0", wantErr: true},
+		{spec: "tap:", wantErr: true},
+		{spec: "tap:a:b:c", wantErr: true},
+		{spec: "tap:tap0;gw=192.168.100.1", wantErr: true},                                           // no range
+		{spec: "tap:tap0;dhcp=192.168.100.10-192.168.100.100", wantErr: true},                        // no gateway
+		{spec: "tap:tap0;dhcp=192.168.100.100-192.168.100.10,gw=192.168.100.1", wantErr: true},       // backwards
+		{spec: "tap:tap0;dhcp=192.168.100.10-192.168.101.10,gw=192.168.100.1", wantErr: true},        // outside subnet
+		{spec: "tap:tap0;dhcp=192.168.100.1-192.168.100.100,gw=192.168.100.50", wantErr: true},       // gateway in range
+		{spec: "tap:tap0;dhcp=192.168.100.10-192.168.100.100,gw=192.168.100.1,foo=1", wantErr: true}, // unknown option
+		{spec: "tap:tap0;dhcp=192.168.100.10-192.168.100.100,gw=192.168.100.1,dns", wantErr: true},   // not key=value
+		{spec: "tap:tap0;dhcp=fd00::10-fd00::20,gw=fd00::1", wantErr: true},                          // not IPv4
+	}
+	for _, tt := range tests {
+		got, err := ParseTAPConfig(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseTAPConfig(%q) error = %v; want error %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseTAPConfig(%q) = %+v; want %+v", tt.spec, got, tt.want)
+			if got.DHCP != nil && tt.want.DHCP != nil {
+				t.Errorf("DHCP = %+v; want %+v", *got.DHCP, *tt.want.DHCP)
+			}
+		}
+	}
+}
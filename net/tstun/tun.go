@@ -7,7 +7,6 @@
 package tstun
 
 import (
-	"errors"
 	"os"
 	"runtime"
 	"strconv"
@@ -39,40 +38,45 @@ var createTAP func(tapName, bridgeName string) (tun.Device, error)
 
 // New returns a tun.Device for the requested device name, along with
 // the OS-dependent name that was allocated to the device.
+//
+// Some names ask the OS to pick a free unit number: "tun" on OpenBSD
+// and "utun" on macOS. A name with a number, like "tun3", asks for
+// that specific device. The allocated name is logged when it differs
+// from tunName.
+//
+// A tunName of the form "tap:TAPNAME[:BRIDGENAME][;OPTIONS]" creates
+// a TAP device, as NewTAP does with no state directory.
 func New(logf logger.Logf, tunName string) (tun.Device, string, error) {
-	var dev tun.Device
-	var err error
 	if strings.HasPrefix(tunName, "tap:") {
-		if runtime.GOOS != "linux" {
-			return nil, "", errors.New("tap only works on Linux")
-		}
-		f := strings.Split(tunName, ":")
-		var tapName, bridgeName string
-		switch len(f) {
-		case 2:
-			tapName = f[1]
-		case 3:
-			tapName, bridgeName = f[1], f[2]
-		default:
-			return nil, "", errors.New("bogus tap argument")
-		}
-		dev, err = createTAP(tapName, bridgeName)
-	} else {
-		dev, err = tun.CreateTUN(tunName, tunMTU)
+		return NewTAP(logf, tunName, "")
 	}
+	dev, err := tun.CreateTUN(tunName, tunMTU)
 	if err != nil {
 		return nil, "", err
 	}
+	name, err := waitUpAndName(logf, dev)
+	if err != nil {
+		return nil, "", err
+	}
+	if name != tunName {
+		logf("tstun: requested %q, got %q", tunName, name)
+	}
+	return dev, name, nil
+}
+
+// waitUpAndName waits for the newly created dev to come up and
+// returns its OS-dependent name. It closes dev on failure.
+func waitUpAndName(logf logger.Logf, dev tun.Device) (string, error) {
 	if err := waitInterfaceUp(dev, 90*time.Second, logf); err != nil {
 		dev.Close()
-		return nil, "", err
+		return "", err
 	}
 	name, err := interfaceName(dev)
 	if err != nil {
 		dev.Close()
-		return nil, "", err
+		return "", err
 	}
-	return dev, name, nil
+	return name, nil
 }
 
 // tunDiagnoseFailure, if non-nil, does OS-specific diagnostics of why
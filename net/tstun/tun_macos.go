@@ -18,10 +18,9 @@ func init() {
 }
 
 func diagnoseDarwinTUNFailure(tunName string, logf logger.Logf) {
-	if os.Getuid() != 0 {
-		logf("failed to create TUN device as non-root user; use 'sudo tailscaled', or run under launchd with 'sudo tailscaled install-system-daemon'")
-	}
-	if tunName != "utun" {
-		logf("failed to create TUN device %q; try using tun device \"utun\" instead for automatic selection", tunName)
-	}
+	diagnoseDarwin(tunName, logf, darwinDiagSys{
+		isRoot:         func() bool { return os.Getuid() == 0 },
+		interfaceNames: interfaceNames,
+		sandboxed:      func() bool { return os.Getenv("APP_SANDBOX_CONTAINER_ID") != "" },
+	})
 }
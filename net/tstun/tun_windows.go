@@ -5,10 +5,14 @@
 package tstun
 
 import (
+	"os"
+	"path/filepath"
+
 	"golang.org/x/sys/windows"
 	"golang.zx2c4.com/wireguard/tun"
 	"golang.zx2c4.com/wireguard/tun/wintun"
 	"golang.zx2c4.com/wireguard/windows/tunnel/winipcfg"
+	"tailscale.com/types/logger"
 )
 
 func init() {
@@ -22,6 +26,28 @@ func init() {
 		panic(err)
 	}
 	tun.WintunStaticRequestedGUID = &guid
+	tunDiagnoseFailure = diagnoseWindowsTUNFailure
+}
+
+func diagnoseWindowsTUNFailure(tunName string, logf logger.Logf) {
+	diagnoseWindows(tunName, logf, windowsDiagSys{
+		interfaceNames:  interfaceNames,
+		driverInstalled: wintunDriverInstalled,
+	})
+}
+
+// wintunDriverInstalled reports whether the wintun driver file is
+// present in the system drivers directory.
+func wintunDriverInstalled() (bool, error) {
+	dir, err := windows.GetSystemDirectory()
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(filepath.Join(dir, "drivers", "wintun.sys"))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
 }
 
 func interfaceName(dev tun.Device) (string, error) {
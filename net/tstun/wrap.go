@@ -20,6 +20,7 @@ import (
 	"golang.zx2c4.com/wireguard/tun"
 	"inet.af/netaddr"
 	"tailscale.com/net/packet"
+	"tailscale.com/syncs"
 	"tailscale.com/tstime/mono"
 	"tailscale.com/types/ipproto"
 	"tailscale.com/types/logger"
@@ -67,7 +68,8 @@ type Wrapper struct {
 	logf logger.Logf
 	// tdev is the underlying Wrapper device.
 	tdev  tun.Device
-	isTAP bool // whether tdev is a TAP device
+	isTAP bool        // whether tdev is a TAP device
+	dhcp  *dhcpServer // TAP mode's DHCP server, or nil if not configured
 
 	closeOnce sync.Once
 
@@ -139,10 +141,14 @@ type Wrapper struct {
 	// running for the given IP address.
 	PeerAPIPort func(netaddr.IP) (port uint16, ok bool)
 
+	// logPackets is whether to log every packet; see SetPacketLogging.
+	logPackets syncs.AtomicBool
+
 	// disableFilter disables all filtering when set. This should only be used in tests.
 	disableFilter bool
 
-	// disableTSMPRejected disables TSMP rejected responses. For tests.
+	// disableTSMPRejected disables TSMP rejected responses and TCP
+	// resets. For tests.
 	disableTSMPRejected bool
 }
 
@@ -154,6 +160,7 @@ type tunReadResult struct {
 	err  error
 }
 
+// WrapTAP wraps a TAP device, such as one returned by NewTAP.
 func WrapTAP(logf logger.Logf, tdev tun.Device) *Wrapper {
 	return wrap(logf, tdev, true)
 }
@@ -178,6 +185,9 @@ func wrap(logf logger.Logf, tdev tun.Device, isTAP bool) *Wrapper {
 		// TODO(dmytro): (highly rate-limited) hexdumps should happen on unknown packets.
 		filterFlags: filter.LogAccepts | filter.LogDrops,
 	}
+	if td, ok := tdev.(*tapDevice); ok {
+		tun.dhcp = td.dhcp
+	}
 
 	go tun.poll()
 	go tun.pumpEvents()
@@ -446,6 +456,9 @@ func (t *Wrapper) Read(buf []byte, offset int) (int, error) {
 	p := parsedPacketPool.Get().(*packet.Parsed)
 	defer parsedPacketPool.Put(p)
 	p.Decode(buf[offset : offset+n])
+	if t.logPackets.Get() {
+		t.logPacket(p)
+	}
 
 	if m, ok := t.destIPActivity.Load().(map[netaddr.IP]func()); ok {
 		if fn := m[p.Dst.IP()]; fn != nil {
@@ -528,8 +541,16 @@ func (t *Wrapper) filterIn(buf []byte) filter.Response {
 			}
 			pkt := packet.Generate(rj, nil)
 			t.InjectOutbound(pkt)
+		}
 
-			// TODO(bradfitz): also send a TCP RST, after the TSMP message.
+		// And reset the connection, so the sender fails fast
+		// rather than retransmitting SYNs until it times out.
+		// This covers connections to this node, to subnets it
+		// routes, and to netstack, all of which are filtered here.
+		// With shields up, stay silent instead: a RST would tell
+		// scanners that something's listening.
+		if p.IPProto == ipproto.TCP && p.IsTCPSyn() && !t.disableTSMPRejected && !filt.ShieldsUp() {
+			t.injectOutboundReset(p)
 		}
 
 		return filter.Drop
@@ -547,6 +568,12 @@ func (t *Wrapper) filterIn(buf []byte) filter.Response {
 // Write accepts an incoming packet. The packet begins at buf[offset:],
 // like wireguard-go/tun.Device.Write.
 func (t *Wrapper) Write(buf []byte, offset int) (int, error) {
+	if t.logPackets.Get() {
+		p := parsedPacketPool.Get().(*packet.Parsed)
+		p.Decode(buf[offset:])
+		t.logPacket(p)
+		parsedPacketPool.Put(p)
+	}
 	if !t.disableFilter {
 		if t.filterIn(buf[offset:]) != filter.Accept {
 			// If we're not accepting the packet, lie to wireguard-go and pretend
@@ -577,6 +604,17 @@ func (t *Wrapper) tdevWrite(buf []byte, offset int) (int, error) {
 	return t.tdev.Write(buf, offset)
 }
 
+// SetPacketLogging sets whether t logs a line for every packet it
+// reads or writes, including those to and from netstack, with the
+// packet's addresses, protocol and length. It's very verbose.
+func (t *Wrapper) SetPacketLogging(v bool) {
+	t.logPackets.Set(v)
+}
+
+func (t *Wrapper) logPacket(p *packet.Parsed) {
+	t.logf("packet: %v -> %v proto=%v len=%d", p.Src, p.Dst, p.IPProto, len(p.Buffer()))
+}
+
 func (t *Wrapper) GetFilter() *filter.Filter {
 	filt, _ := t.filter.Load().(*filter.Filter)
 	return filt
@@ -652,6 +690,30 @@ func (t *Wrapper) injectOutboundPong(pp *packet.Parsed, req packet.TSMPPingReque
 	t.InjectOutbound(packet.Generate(pong, nil))
 }
 
+// injectOutboundReset sends a TCP RST in reply to the TCP SYN pp.
+func (t *Wrapper) injectOutboundReset(pp *packet.Parsed) {
+	// Per RFC 793, a RST answering a segment without an ACK has
+	// sequence number zero and acknowledges the segment. A SYN
+	// occupies one sequence number.
+	var h packet.Header
+	switch pp.IPVersion {
+	case 4:
+		h4 := pp.TCP4Header()
+		h4.ToResponse()
+		h4.Seq, h4.Ack, h4.Flags = 0, h4.Seq+1, packet.TCPRst|packet.TCPAck
+		h = h4
+	case 6:
+		h6 := pp.TCP6Header()
+		h6.ToResponse()
+		h6.Seq, h6.Ack, h6.Flags = 0, h6.Seq+1, packet.TCPRst|packet.TCPAck
+		h = h6
+	default:
+		return
+	}
+
+	t.InjectOutbound(packet.Generate(h, nil))
+}
+
 // InjectOutbound makes the Wrapper device behave as if a packet
 // with the given contents was sent to the network.
 // It does not block, but takes ownership of the packet.
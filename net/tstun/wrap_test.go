@@ -10,7 +10,9 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 	"unsafe"
 
 	"golang.zx2c4.com/wireguard/tun/tuntest"
@@ -396,6 +398,47 @@ func TestClose(t *testing.T) {
 	}
 }
 
+func TestPacketLogging(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		logs []string
+	)
+	logf := func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	_, tun := newFakeTUN(logf, false)
+	defer tun.Close()
+
+	data := udp4("1.2.3.4", "5.6.7.8", 98, 99)
+	hasPacketLog := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, line := range logs {
+			if strings.Contains(line, "packet: 1.2.3.4:98 -> 5.6.7.8:99 proto=UDP") {
+				return true
+			}
+		}
+		return false
+	}
+
+	if _, err := tun.Write(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	if hasPacketLog() {
+		t.Errorf("packet logged with packet logging off")
+	}
+
+	tun.SetPacketLogging(true)
+	if _, err := tun.Write(data, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !hasPacketLog() {
+		t.Errorf("packet not logged with packet logging on")
+	}
+}
+
 func BenchmarkWrite(b *testing.B) {
 	ftun, tun := newFakeTUN(b.Logf, true)
 	defer tun.Close()
@@ -485,3 +528,185 @@ func TestPeerAPIBypass(t *testing.T) {
 		})
 	}
 }
+
+func TestFilterInResetsDeniedSYN(t *testing.T) {
+	// The node routes 10.0.0.0/24 and 2001:db8::/64, but its ACLs
+	// only allow port 80 there. SYNs to other ports must be answered
+	// with a RST rather than silently dropped, unless shields are up,
+	// in which case the node shouldn't reveal anything is there.
+	var sb netaddr.IPSetBuilder
+	sb.AddPrefix(netaddr.MustParseIPPrefix("10.0.0.0/24"))
+	sb.AddPrefix(netaddr.MustParseIPPrefix("2001:db8::/64"))
+	localNets, _ := sb.IPSet()
+	matches := []filter.Match{{
+		IPProto: []ipproto.Proto{ipproto.TCP},
+		Srcs:    nets("100.64.0.0/10", "fd7a:115c:a1e0::/48"),
+		Dsts:    netports("10.0.0.0/24:80", "2001:db8::/64:80"),
+	}}
+	syn4 := packet.TCP4Header{
+		IP4Header: packet.IP4Header{Src: netaddr.MustParseIP("100.64.0.2"), Dst: netaddr.MustParseIP("10.0.0.5")},
+		SrcPort:   1234,
+		DstPort:   22,
+		Seq:       1000,
+		Flags:     packet.TCPSyn,
+	}
+	syn6 := packet.TCP6Header{
+		IP6Header: packet.IP6Header{Src: netaddr.MustParseIP("fd7a:115c:a1e0::2"), Dst: netaddr.MustParseIP("2001:db8::5")},
+		SrcPort:   1234,
+		DstPort:   22,
+		Seq:       1000,
+		Flags:     packet.TCPSyn,
+	}
+
+	tests := []struct {
+		name      string
+		syn       packet.Header
+		shieldsUp bool
+		wantTSMP  bool
+		wantRST   bool
+	}{
+		{name: "ipv4", syn: syn4, wantTSMP: true, wantRST: true},
+		{name: "ipv6", syn: syn6, wantRST: true},
+		{name: "ipv4_shields_up", syn: syn4, shieldsUp: true, wantTSMP: true},
+		{name: "ipv6_shields_up", syn: syn6, shieldsUp: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chtun, tun := newChannelTUN(t.Logf, false)
+			defer tun.Close()
+			tun.disableFilter = false
+			if tt.shieldsUp {
+				tun.SetFilter(filter.NewShieldsUpFilter(localNets, localNets, nil, t.Logf))
+			} else {
+				tun.SetFilter(filter.New(matches, localNets, localNets, nil, t.Logf))
+			}
+
+			syn := packet.Generate(tt.syn, nil)
+			var in packet.Parsed
+			in.Decode(syn)
+
+			written := make(chan struct{})
+			go func() {
+				tun.Write(syn, 0)
+				close(written)
+			}()
+
+			// readOutbound returns the next packet tun sends to
+			// the network.
+			readOutbound := func() ([]byte, *packet.Parsed) {
+				t.Helper()
+				type result struct {
+					b   []byte
+					err error
+				}
+				c := make(chan result, 1)
+				go func() {
+					buf := make([]byte, MaxPacketSize)
+					n, err := tun.Read(buf, 0)
+					c <- result{buf[:n], err}
+				}()
+				select {
+				case r := <-c:
+					if r.err != nil {
+						t.Fatal(r.err)
+					}
+					p := new(packet.Parsed)
+					p.Decode(r.b)
+					return r.b, p
+				case <-time.After(5 * time.Second):
+					t.Fatal("timeout waiting for reply to denied SYN")
+					return nil, nil
+				}
+			}
+
+			if tt.wantTSMP {
+				if _, p := readOutbound(); p.IPProto != ipproto.TSMP {
+					t.Fatalf("first reply = %v; want TSMP rejection", p)
+				}
+			}
+			if tt.wantRST {
+				b, p := readOutbound()
+				if p.IPProto != ipproto.TCP || p.Src != in.Dst || p.Dst != in.Src {
+					t.Fatalf("reply = %v; want TCP from %v to %v", p, in.Dst, in.Src)
+				}
+				if want := packet.TCPRst | packet.TCPAck; p.TCPFlags != want {
+					t.Errorf("reply flags = %v; want %v", p.TCPFlags, want)
+				}
+				var ack uint32
+				if p.IPVersion == 4 {
+					ack = p.TCP4Header().Ack
+				} else {
+					ack = p.TCP6Header().Ack
+				}
+				if ack != 1001 {
+					t.Errorf("reply acks %d; want 1001", ack)
+				}
+				checkRSTChecksums(t, b)
+			}
+
+			// Once Write returns, anything filterIn injected is
+			// queued, so an empty queue means nothing else was sent.
+			select {
+			case <-written:
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout waiting for Write; unexpected reply queued?")
+			}
+			if len(tun.outbound) != 0 {
+				r := <-tun.outbound
+				var p packet.Parsed
+				p.Decode(r.data)
+				t.Errorf("unexpected reply to denied SYN: %v", &p)
+			}
+
+			select {
+			case pkt := <-chtun.Inbound:
+				t.Errorf("denied SYN delivered to TUN: %x", pkt)
+			default:
+			}
+		})
+	}
+}
+
+// checkRSTChecksums reports an error if the IP or TCP checksums of
+// the generated, option-less TCP packet b are wrong.
+func checkRSTChecksums(t *testing.T, b []byte) {
+	t.Helper()
+	var pseudo, seg []byte
+	switch b[0] >> 4 {
+	case 4:
+		if sum := onesComplementSum(b[:20]); sum != 0xffff {
+			t.Errorf("bad IPv4 header checksum in %x", b)
+		}
+		pseudo = append(pseudo, b[12:20]...) // src, dst
+		seg = b[20:]
+		pseudo = append(pseudo, 0, b[9], byte(len(seg)>>8), byte(len(seg)))
+	case 6:
+		// IPv6 has no header checksum.
+		pseudo = append(pseudo, b[8:40]...) // src, dst
+		seg = b[40:]
+		pseudo = append(pseudo, 0, 0, byte(len(seg)>>8), byte(len(seg)), 0, 0, 0, b[6])
+	default:
+		t.Fatalf("not an IP packet: %x", b)
+	}
+	// A correct checksum makes the sum over the pseudo-header and
+	// segment all ones.
+	if sum := onesComplementSum(append(pseudo, seg...)); sum != 0xffff {
+		t.Errorf("bad TCP checksum in %x", b)
+	}
+}
+
+// onesComplementSum returns the 16-bit one's complement sum of b,
+// as used by IP and TCP checksums.
+func onesComplementSum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return uint16(sum)
+}
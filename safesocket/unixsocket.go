@@ -60,6 +60,15 @@ func listen(path string, port uint16) (ln net.Listener, _ uint16, err error) {
 		}
 		return nil, 0, fmt.Errorf("%v: address already in use", path)
 	}
+	if isAbstract(path) {
+		// No file to remove, create a directory for, or chmod;
+		// the socket goes away when its last fd is closed.
+		pipe, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, 0, err
+		}
+		return pipe, 0, nil
+	}
 	_ = os.Remove(path)
 
 	perm := socketPermissionsForOS()
@@ -90,6 +99,13 @@ func listen(path string, port uint16) (ln net.Listener, _ uint16, err error) {
 	return pipe, 0, err
 }
 
+// isAbstract reports whether path names a Linux abstract unix
+// socket, which has no file in the filesystem. Such names begin with
+// a NUL byte, or "@", which the net package treats the same way.
+func isAbstract(path string) bool {
+	return runtime.GOOS == "linux" && (strings.HasPrefix(path, "\x00") || strings.HasPrefix(path, "@"))
+}
+
 func tailscaledRunningUnderLaunchd() bool {
 	if runtime.GOOS != "darwin" {
 		return false
@@ -0,0 +1,46 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package safesocket
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestAbstractSocket(t *testing.T) {
+	name := fmt.Sprintf("tailscale-test-%d", os.Getpid())
+	for _, path := range []string{"@" + name, "\x00" + name} {
+		l, _, err := Listen(path, 0)
+		if err != nil {
+			t.Fatalf("Listen(%q): %v", path, err)
+		}
+		if _, err := os.Lstat(path); err == nil {
+			t.Errorf("Listen(%q) created a file", path)
+		}
+		if _, _, err := Listen(path, 0); err == nil {
+			t.Errorf("second Listen(%q) succeeded; want address in use", path)
+		}
+
+		go func() {
+			if c, err := l.Accept(); err == nil {
+				c.Close()
+			}
+		}()
+		c, err := Connect(path, 0)
+		if err != nil {
+			t.Fatalf("Connect(%q): %v", path, err)
+		}
+		c.Close()
+		l.Close()
+
+		// Nothing is left behind to prevent listening again.
+		l, _, err = Listen(path, 0)
+		if err != nil {
+			t.Fatalf("Listen(%q) after Close: %v", path, err)
+		}
+		l.Close()
+	}
+}
@@ -152,6 +152,7 @@ func (s *Server) start() error {
 		return fmt.Errorf("netstack.Create: %w", err)
 	}
 	ns.ForwardTCPIn = s.forwardTCP
+	ns.AcceptTCPIn = s.acceptTCP
 	if err := ns.Start(); err != nil {
 		return fmt.Errorf("failed to start netstack: %w", err)
 	}
@@ -188,10 +189,23 @@ func (s *Server) start() error {
 	return nil
 }
 
-func (s *Server) forwardTCP(c net.Conn, port uint16) {
+// acceptTCP reports whether there's a listener for inbound TCP
+// connections to dst. Connections to other ports are reset.
+func (s *Server) acceptTCP(src, dst netaddr.IPPort) bool {
+	_, ok := s.tcpListener(dst.Port())
+	return ok
+}
+
+func (s *Server) tcpListener(port uint16) (*listener, bool) {
 	s.mu.Lock()
+	defer s.mu.Unlock()
 	ln, ok := s.listeners[listenKey{"tcp", "", fmt.Sprint(port)}]
-	s.mu.Unlock()
+	return ln, ok
+}
+
+func (s *Server) forwardTCP(c net.Conn, port uint16) {
+	// The listener may have been closed since acceptTCP.
+	ln, ok := s.tcpListener(port)
 	if !ok {
 		c.Close()
 		return
@@ -11,7 +11,9 @@ package integration
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -25,6 +27,7 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"testing"
@@ -48,17 +51,117 @@ type Binaries struct {
 	Dir    string // temp dir for tailscale & tailscaled
 	Daemon string // tailscaled
 	CLI    string // tailscale
+	ASAN   bool   // whether built with AddressSanitizer
 }
 
 // BuildTestBinaries builds tailscale and tailscaled, failing the test
 // if they fail to compile.
+//
+// The binaries are cached across test runs under the user's cache
+// directory, keyed by a hash of their source, unless the
+// TS_TEST_NO_CACHE environment variable is set to 1.
 func BuildTestBinaries(t testing.TB) *Binaries {
+	return BuildTestBinariesWithOptions(t, BuildOptions{})
+}
+
+// BuildTestBinariesWithASAN is like BuildTestBinaries but builds with
+// AddressSanitizer ("go build -asan"), to catch memory errors in cgo
+// code. It needs Go 1.18 or later with cgo enabled, and libasan.so
+// installed on the host. AddressSanitizer reports go to the daemon's
+// stderr, so callers should log that.
+func BuildTestBinariesWithASAN(t testing.TB) *Binaries {
+	return BuildTestBinariesWithOptions(t, BuildOptions{ASAN: true})
+}
+
+// BuildOptions are options for BuildTestBinariesWithOptions. The zero
+// value builds the binaries the way BuildTestBinaries does.
+type BuildOptions struct {
+	// Tags are extra build tags.
+	Tags []string
+
+	// LDFlags, if non-empty, is passed to the linker with -ldflags,
+	// e.g. "-X tailscale.com/version.Long=1.2.3" to test upgrades.
+	LDFlags string
+
+	// GOOS and GOARCH, if non-empty, cross-compile the binaries,
+	// e.g. for VM guests of another architecture.
+	GOOS, GOARCH string
+
+	// Suffix is appended to the binaries' names (before any
+	// ".exe"), so that variants can sit side by side.
+	Suffix string
+
+	// ASAN is whether to build with AddressSanitizer. See
+	// BuildTestBinariesWithASAN.
+	ASAN bool
+}
+
+func (o BuildOptions) goos() string {
+	if o.GOOS != "" {
+		return o.GOOS
+	}
+	return runtime.GOOS
+}
+
+func (o BuildOptions) goarch() string {
+	if o.GOARCH != "" {
+		return o.GOARCH
+	}
+	return runtime.GOARCH
+}
+
+// flags returns the go build flags for o. The binaries are built with
+// -race if the test itself was, unless they're cross-compiled or built
+// with -asan, which the go command won't combine with -race.
+func (o BuildOptions) flags() []string {
+	var flags []string
+	if len(o.Tags) > 0 {
+		flags = append(flags, "-tags="+strings.Join(o.Tags, ","))
+	}
+	if o.LDFlags != "" {
+		flags = append(flags, "-ldflags="+o.LDFlags)
+	}
+	if o.ASAN {
+		flags = append(flags, "-asan")
+	}
+	if version.IsRace() && !o.ASAN && o.goos() == runtime.GOOS && o.goarch() == runtime.GOARCH {
+		flags = append(flags, "-race")
+	}
+	return flags
+}
+
+// env returns the environment for go commands building for o.
+func (o BuildOptions) env() []string {
+	return append(os.Environ(), "GOOS="+o.goos(), "GOARCH="+o.goarch())
+}
+
+// binName returns the file name of target's binary.
+func (o BuildOptions) binName(target string) string {
+	name := path.Base(target) + o.Suffix
+	if o.goos() == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// BuildTestBinariesWithOptions is like BuildTestBinaries but builds
+// according to opts. Each call returns its own Binaries, so tests can
+// use several variants at once.
+func BuildTestBinariesWithOptions(t testing.TB, opts BuildOptions) *Binaries {
+	if opts.ASAN {
+		goBin := findGo(t)
+		if out, _ := exec.Command(goBin, "help", "build").Output(); !bytes.Contains(out, []byte("-asan")) {
+			t.Fatalf("%s doesn't support -asan; need Go 1.18 or later", goBin)
+		}
+	}
+	const daemon, cli = "tailscale.com/cmd/tailscaled", "tailscale.com/cmd/tailscale"
 	td := t.TempDir()
-	build(t, td, "tailscale.com/cmd/tailscaled", "tailscale.com/cmd/tailscale")
+	cachedBuild(t, td, opts, daemon, cli)
 	return &Binaries{
 		Dir:    td,
-		Daemon: filepath.Join(td, "tailscaled"+exe()),
-		CLI:    filepath.Join(td, "tailscale"+exe()),
+		Daemon: filepath.Join(td, opts.binName(daemon)),
+		CLI:    filepath.Join(td, opts.binName(cli)),
+		ASAN:   opts.ASAN,
 	}
 }
 
@@ -66,7 +169,7 @@ func BuildTestBinaries(t testing.TB) *Binaries {
 // fight Go's built-in caching trying to do the same build concurrently.
 var buildMu sync.Mutex
 
-func build(t testing.TB, outDir string, targets ...string) {
+func build(t testing.TB, outDir string, opts BuildOptions, targets ...string) {
 	buildMu.Lock()
 	defer buildMu.Unlock()
 
@@ -74,29 +177,168 @@ func build(t testing.TB, outDir string, targets ...string) {
 	defer func() { t.Logf("built %s in %v", targets, time.Since(t0).Round(time.Millisecond)) }()
 
 	goBin := findGo(t)
-	cmd := exec.Command(goBin, "install")
-	if version.IsRace() {
-		cmd.Args = append(cmd.Args, "-race")
-	}
-	cmd.Args = append(cmd.Args, targets...)
-	cmd.Env = append(os.Environ(), "GOARCH="+runtime.GOARCH, "GOBIN="+outDir)
-	errOut, err := cmd.CombinedOutput()
-	if err == nil {
+	for _, target := range targets {
+		cmd := exec.Command(goBin, "build", "-o", filepath.Join(outDir, opts.binName(target)))
+		cmd.Args = append(cmd.Args, opts.flags()...)
+		cmd.Args = append(cmd.Args, target)
+		cmd.Env = opts.env()
+		if errOut, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("failed to build %v with %v: %v, %s", target, goBin, err, errOut)
+		}
+	}
+}
+
+// cacheMu serializes cachedBuild, so concurrent tests in one process
+// don't both fill the same cache entry.
+var cacheMu sync.Mutex
+
+// buildCacheMaxAge is how long a cached build can go unused before
+// cachedBuild deletes it.
+const buildCacheMaxAge = 7 * 24 * time.Hour
+
+// cachedBuild puts the binaries for targets in outDir, like build,
+// reusing an earlier build of the same source and options if there
+// is one.
+func cachedBuild(t testing.TB, outDir string, opts BuildOptions, targets ...string) {
+	if noCache, _ := strconv.ParseBool(os.Getenv("TS_TEST_NO_CACHE")); noCache {
+		build(t, outDir, opts, targets...)
+		return
+	}
+	userCache, err := os.UserCacheDir()
+	if err != nil {
+		t.Logf("not caching test binaries: %v", err)
+		build(t, outDir, opts, targets...)
 		return
 	}
-	if strings.Contains(string(errOut), "when GOBIN is set") {
-		// Fallback slow path for cross-compiled binaries.
-		for _, target := range targets {
-			outFile := filepath.Join(outDir, path.Base(target)+exe())
-			cmd := exec.Command(goBin, "build", "-o", outFile, target)
-			cmd.Env = append(os.Environ(), "GOARCH="+runtime.GOARCH)
-			if errOut, err := cmd.CombinedOutput(); err != nil {
-				t.Fatalf("failed to build %v with %v: %v, %s", target, goBin, err, errOut)
+	key, err := buildCacheKey(findGo(t), opts, targets...)
+	if err != nil {
+		t.Logf("not caching test binaries: %v", err)
+		build(t, outDir, opts, targets...)
+		return
+	}
+	cacheRoot := filepath.Join(userCache, "tailscale-test-bins")
+	cacheDir := filepath.Join(cacheRoot, key)
+
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	if _, err := os.Stat(cacheDir); err == nil {
+		t.Logf("using cached %s from %s", targets, cacheDir)
+		now := time.Now()
+		os.Chtimes(cacheDir, now, now) // keep it from being pruned
+	} else {
+		if err := os.MkdirAll(cacheRoot, 0755); err != nil {
+			t.Fatal(err)
+		}
+		pruneBuildCache(t, cacheRoot)
+		// Build somewhere else and rename it into place, so other
+		// processes never see a partial entry.
+		tmp, err := ioutil.TempDir(cacheRoot, key+".tmp-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tmp)
+		build(t, tmp, opts, targets...)
+		if err := os.Rename(tmp, cacheDir); err != nil {
+			// Another process may have filled the entry first.
+			if _, statErr := os.Stat(cacheDir); statErr != nil {
+				t.Fatalf("caching test binaries: %v", err)
 			}
 		}
+	}
+
+	// Link rather than use the cache directory directly, as tests
+	// may add files next to the binaries.
+	for _, target := range targets {
+		name := opts.binName(target)
+		if err := linkOrCopy(filepath.Join(cacheDir, name), filepath.Join(outDir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// buildCacheKey returns the cache key for building targets with goBin
+// and opts: a hash of the Go version, build settings, and the source
+// files of all the non-standard-library packages they depend on.
+func buildCacheKey(goBin string, opts BuildOptions, targets ...string) (string, error) {
+	flags := opts.flags()
+	args := append([]string{"list", "-deps", "-json"}, flags...)
+	cmd := exec.Command(goBin, append(args, targets...)...)
+	cmd.Env = opts.env()
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("go list: %w", err)
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s/%s flags=%q suffix=%q\n", runtime.Version(), opts.goos(), opts.goarch(), flags, opts.Suffix)
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for {
+		var pkg struct {
+			ImportPath string
+			Dir        string
+			Standard   bool
+			GoFiles    []string
+			CgoFiles   []string
+			SFiles     []string
+			EmbedFiles []string
+		}
+		if err := dec.Decode(&pkg); err == io.EOF {
+			break
+		} else if err != nil {
+			return "", fmt.Errorf("decoding go list output: %w", err)
+		}
+		if pkg.Standard {
+			continue // covered by the Go version
+		}
+		fmt.Fprintf(h, "package %s\n", pkg.ImportPath)
+		for _, files := range [][]string{pkg.GoFiles, pkg.CgoFiles, pkg.SFiles, pkg.EmbedFiles} {
+			for _, name := range files {
+				b, err := ioutil.ReadFile(filepath.Join(pkg.Dir, name))
+				if err != nil {
+					return "", err
+				}
+				fmt.Fprintf(h, "file %s %d\n", name, len(b))
+				h.Write(b)
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16]), nil
+}
+
+// pruneBuildCache removes cached builds in cacheRoot, and leftovers
+// of failed ones, that haven't been used for buildCacheMaxAge.
+func pruneBuildCache(t testing.TB, cacheRoot string) {
+	fis, err := ioutil.ReadDir(cacheRoot)
+	if err != nil {
+		t.Logf("pruning test binary cache: %v", err)
 		return
 	}
-	t.Fatalf("failed to build %v with %v: %v, %s", targets, goBin, err, errOut)
+	for _, fi := range fis {
+		if fi.IsDir() && time.Since(fi.ModTime()) > buildCacheMaxAge {
+			os.RemoveAll(filepath.Join(cacheRoot, fi.Name()))
+		}
+	}
+}
+
+// linkOrCopy hard links src to dst, or copies it if it can't.
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
 }
 
 func findGo(t testing.TB) string {
@@ -124,6 +366,14 @@ func exe() string {
 // returned cleanup function.
 func RunDERPAndSTUN(t testing.TB, logf logger.Logf, ipAddress string) (derpMap *tailcfg.DERPMap) {
 	t.Helper()
+	derpMap, _ = RunDERPAndSTUNWithStats(t, logf, ipAddress)
+	return derpMap
+}
+
+// RunDERPAndSTUNWithStats is like RunDERPAndSTUN, but also returns the
+// STUN server's request counts.
+func RunDERPAndSTUNWithStats(t testing.TB, logf logger.Logf, ipAddress string) (derpMap *tailcfg.DERPMap, stunStats *stuntest.Stats) {
+	t.Helper()
 
 	var serverPrivateKey key.Private
 	if _, err := rand.Read(serverPrivateKey[:]); err != nil {
@@ -136,7 +386,7 @@ func RunDERPAndSTUN(t testing.TB, logf logger.Logf, ipAddress string) (derpMap *
 	httpsrv.Config.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
 	httpsrv.StartTLS()
 
-	stunAddr, stunCleanup := stuntest.ServeWithPacketListener(t, nettype.Std{})
+	stunAddr, stunStats, stunCleanup := stuntest.ServeWithStats(t, nettype.Std{})
 
 	m := &tailcfg.DERPMap{
 		Regions: map[int]*tailcfg.DERPRegion{
@@ -167,7 +417,7 @@ func RunDERPAndSTUN(t testing.TB, logf logger.Logf, ipAddress string) (derpMap *
 		stunCleanup()
 	})
 
-	return m
+	return m, stunStats
 }
 
 // LogCatcher is a minimal logcatcher for the logtail upload client.
@@ -16,6 +16,7 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -26,23 +27,31 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"go4.org/mem"
+	"golang.org/x/net/proxy"
 	"inet.af/netaddr"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/stun/stuntest"
 	"tailscale.com/safesocket"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tstest"
 	"tailscale.com/tstest/integration/testcontrol"
+	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
+	"tailscale.com/types/wgkey"
+	"tailscale.com/util/crashpoint"
 )
 
 var (
 	verboseTailscaled = flag.Bool("verbose-tailscaled", false, "verbose tailscaled logging")
 	verboseTailscale  = flag.Bool("verbose-tailscale", false, "verbose tailscale CLI logging")
+	realTUN           = flag.Bool("real-tun", false, "run test nodes' tailscaled on real TUN devices instead of netstack, when running as root on Linux")
+	hostCleanup       = flag.Bool("host-cleanup", false, "when running as root, run tests of tailscaled --cleanup, which removes this host's real Tailscale firewall rules and DNS config")
 )
 
 var mainError atomic.Value // of error
@@ -84,6 +93,138 @@ func TestOneNodeUp_NoAuth(t *testing.T) {
 	t.Logf("number of HTTP logcatcher requests: %v", env.LogCatcher.numRequests())
 }
 
+// TestIPNPort tests that with a non-default --ipn-port, the CLI
+// reaches tailscaled when it's given the same --ipn-port, and not at
+// another port.
+func TestIPNPort(t *testing.T) {
+	if runtime.GOOS != "windows" {
+		t.Skip("the IPN server only listens on a TCP port on Windows")
+	}
+	t.Parallel()
+	bins := BuildTestBinaries(t)
+
+	env := newTestEnv(t, bins)
+	defer env.Close()
+
+	n1 := newTestNode(t, env)
+	n1.ipnPort = freeTCPPort(t)
+
+	d1 := n1.StartDaemon(t)
+	defer d1.Kill()
+	n1.AwaitResponding(t)
+	n1.MustUp()
+	n1.AwaitRunning(t)
+
+	cmd := exec.Command(bins.CLI, fmt.Sprintf("--ipn-port=%d", freeTCPPort(t)), "status")
+	if out, err := cmd.CombinedOutput(); err == nil {
+		t.Errorf("status with the wrong --ipn-port succeeded: %s", out)
+	}
+
+	d1.MustCleanShutdown(t)
+}
+
+// freeTCPPort returns a localhost TCP port that was free when it was
+// checked.
+func freeTCPPort(t testing.TB) uint16 {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return uint16(ln.Addr().(*net.TCPAddr).Port)
+}
+
+func TestOneNodeUp_RealTUN(t *testing.T) {
+	if !canUseTUN() {
+		t.Skip("needs root on Linux")
+	}
+	t.Parallel()
+	bins := BuildTestBinaries(t)
+
+	env := newTestEnv(t, bins)
+	defer env.Close()
+
+	n1 := newTestNode(t, env)
+	n1.UseTUN()
+
+	d1 := n1.StartDaemon(t)
+	defer d1.Kill()
+	n1.AwaitResponding(t)
+	n1.MustUp()
+
+	ip := n1.AwaitIP(t)
+	n1.AwaitRunning(t)
+
+	if err := tstest.WaitFor(10*time.Second, func() error {
+		ifc, err := net.InterfaceByName(n1.tun)
+		if err != nil {
+			return err
+		}
+		addrs, err := ifc.Addrs()
+		if err != nil {
+			return err
+		}
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(ip.IPAddr().IP) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s has addresses %v; want %v", n1.tun, addrs, ip)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	d1.MustCleanShutdown(t)
+
+	if _, err := net.InterfaceByName(n1.tun); err == nil {
+		t.Errorf("TUN device %s still exists after shutdown", n1.tun)
+	}
+}
+
+func TestDaemonOutputOnStartFailure(t *testing.T) {
+	t.Parallel()
+	bins := BuildTestBinaries(t)
+
+	env := newTestEnv(t, bins)
+	defer env.Close()
+
+	n1 := newTestNode(t, env)
+	n1.daemonArgs = []string{"--no-such-flag"}
+	d1 := n1.StartDaemon(t)
+	defer d1.Kill()
+
+	err := n1.awaitListening(5 * time.Second)
+	if err == nil {
+		t.Fatal("tailscaled with a bogus flag is listening")
+	}
+	const want = "flag provided but not defined: -no-such-flag"
+	if !strings.Contains(err.Error(), want) {
+		t.Errorf("error doesn't include tailscaled's output %q: %v", want, err)
+	}
+}
+
+// A version-stamped build with a name suffix should be usable next to
+// the default build.
+func TestBuildTestBinariesWithOptions(t *testing.T) {
+	t.Parallel()
+	const stamp = "1.2.3-testbuild"
+	bins := BuildTestBinariesWithOptions(t, BuildOptions{
+		LDFlags: "-X tailscale.com/version.Long=" + stamp,
+		Suffix:  "-stamped",
+	})
+	if got, want := filepath.Base(bins.CLI), "tailscale-stamped"+exe(); got != want {
+		t.Errorf("CLI name = %q; want %q", got, want)
+	}
+	out, err := exec.Command(bins.CLI, "version").CombinedOutput()
+	if err != nil {
+		t.Fatalf("tailscale version: %v, %s", err, out)
+	}
+	if !strings.HasPrefix(string(out), stamp+"\n") {
+		t.Errorf("tailscale version = %q; want it to start with %q", out, stamp)
+	}
+}
+
 func TestCollectPanic(t *testing.T) {
 	t.Parallel()
 	bins := BuildTestBinaries(t)
@@ -160,6 +301,225 @@ func TestStateSavedOnStart(t *testing.T) {
 	d1.MustCleanShutdown(t)
 }
 
+// TestStateDirReadOnly tests that tailscaled keeps running when its
+// state directory goes read-only, as when an embedded device's flash
+// is remounted, and writes out the state it couldn't save by itself
+// once the directory is writable again.
+func TestStateDirReadOnly(t *testing.T) {
+	if os.Getuid() == 0 {
+		t.Skip("root can write to read-only directories")
+	}
+	t.Parallel()
+	bins := BuildTestBinaries(t)
+
+	env := newTestEnv(t, bins)
+	defer env.Close()
+
+	n1 := newTestNode(t, env)
+	stateDir := filepath.Join(n1.dir, "state")
+	if err := os.Mkdir(stateDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	n1.stateFile = filepath.Join(stateDir, "tailscale.state")
+
+	d1 := n1.StartDaemon(t)
+	defer d1.Kill()
+	n1.AwaitResponding(t)
+	n1.MustUp()
+	n1.AwaitRunning(t)
+
+	if err := os.Chmod(stateDir, 0500); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(stateDir, 0700)
+
+	// Change the prefs, which can now only be saved in memory.
+	n1.MustUp("--hostname=readonly")
+	if p := n1.diskPrefs(t); p.Hostname == "readonly" {
+		t.Fatal("prefs written to read-only state directory")
+	}
+	if err := tstest.WaitFor(5*time.Second, func() error {
+		if !strings.Contains(n1.DaemonOutput(), "keeping state in memory") {
+			return errors.New("no state write failure logged")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	n1.AwaitRunning(t)
+
+	if err := os.Chmod(stateDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := tstest.WaitFor(time.Minute, func() error {
+		if p := n1.diskPrefs(t); p.Hostname != "readonly" {
+			return fmt.Errorf("hostname on disk = %q; want readonly", p.Hostname)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	n1.AwaitRunning(t)
+
+	d1.MustCleanShutdown(t)
+}
+
+// TestCorruptStateRecovery tests that tailscaled starts with fresh
+// state if its state file was left corrupt, as when it's OOM-killed
+// partway through writing it.
+func TestCorruptStateRecovery(t *testing.T) {
+	t.Parallel()
+	bins := BuildTestBinaries(t)
+
+	env := newTestEnv(t, bins)
+	defer env.Close()
+
+	n1 := newTestNode(t, env)
+	const corrupt = `{"_daemon": "eyJDb250cm9sVVJM`
+	if err := os.WriteFile(n1.stateFile, []byte(corrupt), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	d1 := n1.StartDaemon(t)
+	defer d1.Kill()
+	n1.AwaitResponding(t)
+	n1.MustUp()
+	n1.AwaitRunning(t)
+
+	if p := n1.diskPrefs(t); !p.WantRunning {
+		t.Errorf("fresh state not saved; prefs = %v", p.Pretty())
+	}
+	if got, err := os.ReadFile(n1.stateFile + ".corrupt"); err != nil {
+		t.Errorf("corrupt state not kept: %v", err)
+	} else if string(got) != corrupt {
+		t.Errorf("kept corrupt state = %q; want %q", got, corrupt)
+	}
+
+	d1.MustCleanShutdown(t)
+}
+
+// TestCleanupThenStart tests that "tailscaled --cleanup", as run
+// after an unclean exit, leaves the system in a state where
+// tailscaled then starts normally. As root on Linux, it also checks
+// that leftover iptables chains from the previous run are removed.
+func TestCleanupThenStart(t *testing.T) {
+	t.Parallel()
+	if os.Getuid() == 0 && !*hostCleanup {
+		t.Skip("as root, tailscaled --cleanup would remove this host's real Tailscale firewall rules and DNS config; use -host-cleanup to run it anyway")
+	}
+	bins := BuildTestBinaries(t)
+
+	env := newTestEnv(t, bins)
+	defer env.Close()
+
+	n1 := newTestNode(t, env)
+
+	checkIPTables := runtime.GOOS == "linux" && os.Getuid() == 0
+	if checkIPTables {
+		// Simulate a chain left behind by a killed tailscaled.
+		if out, err := exec.Command("iptables", "-N", "ts-input").CombinedOutput(); err != nil {
+			t.Logf("can't create leftover iptables chain, not checking it: %v, %s", err, out)
+			checkIPTables = false
+		}
+	}
+
+	cmd := exec.Command(bins.Daemon, "--cleanup")
+	cmd.Env = append(os.Environ(), "TS_LOG_TARGET="+env.LogCatcherServer.URL)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("cleanup failed: %v: %q", err, out)
+	}
+	if checkIPTables {
+		if err := exec.Command("iptables", "-S", "ts-input").Run(); err == nil {
+			exec.Command("iptables", "-X", "ts-input").Run()
+			t.Errorf("leftover iptables chain ts-input still exists after --cleanup")
+		}
+	}
+
+	d1 := n1.StartDaemon(t)
+	defer d1.Kill()
+	n1.AwaitResponding(t)
+	n1.MustUp()
+	n1.AwaitRunning(t)
+	d1.MustCleanShutdown(t)
+}
+
+// TestStateCompat tests that tailscaled picks up where previous
+// releases left off: given a state file they wrote, it starts with
+// the same prefs and logs in as the same node, with the same node
+// and machine keys, rather than registering as a new one. It then
+// checks that the state tailscaled writes back can still be read
+// the way previous releases read it, so downgrading works too.
+//
+// The fixtures in testdata/state are meant to be written by the
+// tailscaled releases they're named after, as run by
+// gen_state_fixtures.go. testdata/state/SOURCES records where the
+// current ones came from.
+func TestStateCompat(t *testing.T) {
+	t.Parallel()
+	bins := BuildTestBinaries(t)
+
+	fixtures, err := filepath.Glob(filepath.Join("testdata", "state", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fixtures) == 0 {
+		t.Fatal("no state fixtures found; run go run gen_state_fixtures.go (see its doc)")
+	}
+	for _, fixture := range fixtures {
+		fixture := fixture
+		t.Run(strings.TrimSuffix(filepath.Base(fixture), ".json"), func(t *testing.T) {
+			t.Parallel()
+			env := newTestEnv(t, bins)
+			defer env.Close()
+
+			n1 := newTestNode(t, env)
+			n1.writeFixtureState(t, fixture)
+			old, machineKey := readLegacyState(t, n1.stateFile)
+			nodeKey := old.Config.PrivateNodeKey
+
+			// The fixtures all have WantRunning set, so
+			// tailscaled logs in again on its own, without
+			// a "tailscale up".
+			d1 := n1.StartDaemon(t)
+			defer d1.Kill()
+			n1.AwaitResponding(t)
+			n1.AwaitRunning(t)
+
+			nodes := env.Control.AllNodes()
+			if len(nodes) != 1 {
+				t.Fatalf("control has %d nodes; want 1", len(nodes))
+			}
+			if got, want := nodes[0].Key, tailcfg.NodeKey(nodeKey.Public()); got != want {
+				t.Errorf("registered with node key %v; want the fixture's %v", got.ShortString(), want.ShortString())
+			}
+			if got, want := nodes[0].Machine, tailcfg.MachineKey(machineKey.Public()); got != want {
+				t.Errorf("registered with machine key %v; want the fixture's %v", got, want)
+			}
+
+			p := n1.diskPrefs(t)
+			if p.Hostname != old.Hostname {
+				t.Errorf("Prefs.Hostname = %q; want %q", p.Hostname, old.Hostname)
+			}
+			if p.RouteAll != old.RouteAll || p.CorpDNS != old.CorpDNS || int(p.NetfilterMode) != old.NetfilterMode {
+				t.Errorf("prefs not carried over from fixture; got %v", p.Pretty())
+			}
+
+			d1.MustCleanShutdown(t)
+
+			got, gotMachineKey := readLegacyState(t, n1.stateFile)
+			if !gotMachineKey.Equal(machineKey) {
+				t.Errorf("machine key written back doesn't match the fixture's")
+			}
+			if !got.Config.PrivateNodeKey.Equal(nodeKey) {
+				t.Errorf("node key written back doesn't match the fixture's")
+			}
+			if got.ControlURL != old.ControlURL || got.Hostname != old.Hostname || !got.WantRunning {
+				t.Errorf("prefs written back = %+v; want those of %+v", got, old)
+			}
+		})
+	}
+}
+
 func TestOneNodeUp_Auth(t *testing.T) {
 	t.Parallel()
 	bins := BuildTestBinaries(t)
@@ -207,6 +567,84 @@ func TestOneNodeUp_Auth(t *testing.T) {
 	d1.MustCleanShutdown(t)
 }
 
+func TestOneNodeUp_AuthKey(t *testing.T) {
+	t.Parallel()
+	bins := BuildTestBinaries(t)
+
+	env := newTestEnv(t, bins, configureControl(func(control *testcontrol.Server) {
+		control.RequireAuth = true
+		control.AuthKeys = []string{"tskey-good"}
+	}))
+	defer env.Close()
+
+	n1 := newTestNode(t, env)
+	n1.authKey = "tskey-good"
+	d1 := n1.StartDaemon(t)
+	defer d1.Kill()
+
+	n1.AwaitListening(t)
+	n1.MustUp()
+	t.Logf("Got IP: %v", n1.AwaitIP(t))
+	n1.AwaitRunning(t)
+
+	d1.MustCleanShutdown(t)
+}
+
+func TestOneNodeUp_InvalidAuthKey(t *testing.T) {
+	t.Parallel()
+	bins := BuildTestBinaries(t)
+
+	env := newTestEnv(t, bins, configureControl(func(control *testcontrol.Server) {
+		control.RequireAuth = true
+		control.AuthKeys = []string{"tskey-good"}
+	}))
+	defer env.Close()
+
+	n1 := newTestNode(t, env)
+	n1.authKey = "tskey-bad"
+	rejected := make(chan bool, 1)
+	n1.addLogLineHook(func(line []byte) {
+		if mem.Contains(mem.B(line), mem.S("invalid auth key")) {
+			select {
+			case rejected <- true:
+			default:
+			}
+		}
+	})
+	d1 := n1.StartDaemon(t)
+	defer d1.Kill()
+
+	n1.AwaitListening(t)
+
+	// "up" keeps waiting for a login that isn't going to happen,
+	// so run it in the background until the rejection is logged.
+	cmd := n1.upCmd()
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	timer := time.NewTimer(20 * time.Second)
+	defer timer.Stop()
+	select {
+	case <-rejected:
+	case <-timer.C:
+		t.Fatal("timeout waiting for tailscaled to log the auth key rejection")
+	}
+
+	if st := n1.MustStatus(t); st.BackendState == "Running" {
+		t.Errorf("BackendState = %q after invalid auth key", st.BackendState)
+	}
+	if n := env.Control.NumNodes(); n != 0 {
+		t.Errorf("control has %d nodes; want 0", n)
+	}
+
+	d1.MustCleanShutdown(t)
+}
+
 func TestTwoNodes(t *testing.T) {
 	t.Parallel()
 	bins := BuildTestBinaries(t)
@@ -226,7 +664,7 @@ func TestTwoNodes(t *testing.T) {
 	defer d2.Kill()
 
 	n1Socks := n1.AwaitSocksAddr(t, n1SocksAddrCh)
-	n2Socks := n1.AwaitSocksAddr(t, n2SocksAddrCh)
+	n2Socks := n2.AwaitSocksAddr(t, n2SocksAddrCh)
 	t.Logf("node1 SOCKS5 addr: %v", n1Socks)
 	t.Logf("node2 SOCKS5 addr: %v", n2Socks)
 
@@ -258,24 +696,183 @@ func TestTwoNodes(t *testing.T) {
 	d2.MustCleanShutdown(t)
 }
 
-func TestNodeAddressIPFields(t *testing.T) {
+func TestTwoNodesConnect(t *testing.T) {
 	t.Parallel()
 	bins := BuildTestBinaries(t)
 
 	env := newTestEnv(t, bins)
 	defer env.Close()
 
+	// Both nodes run in netstack mode on this machine, so
+	// connections to either one's Tailscale IP land here.
+	port := listenLocal(t)
+
 	n1 := newTestNode(t, env)
+	n1SocksAddrCh := n1.socks5AddrChan()
 	d1 := n1.StartDaemon(t)
 	defer d1.Kill()
 
+	n2 := newTestNode(t, env)
+	n2SocksAddrCh := n2.socks5AddrChan()
+	d2 := n2.StartDaemon(t)
+	defer d2.Kill()
+
+	n1.AwaitSocksAddr(t, n1SocksAddrCh)
+	n2.AwaitSocksAddr(t, n2SocksAddrCh)
 	n1.AwaitListening(t)
+	n2.AwaitListening(t)
 	n1.MustUp()
+	n2.MustUp()
 	n1.AwaitRunning(t)
+	n2.AwaitRunning(t)
 
-	testNodes := env.Control.AllNodes()
+	MeasureConnectivity(t, n1, n2, port)
+	AssertCanConnect(t, n2, n1, port)
 
-	if len(testNodes) != 1 {
+	d1.MustCleanShutdown(t)
+	d2.MustCleanShutdown(t)
+}
+
+func TestTwoNodeNetPing(t *testing.T) {
+	t.Parallel()
+	for _, tt := range []struct {
+		name string
+		opts []TwoNodeOpt
+	}{
+		{name: "netstack"},
+		{name: "tun", opts: []TwoNodeOpt{WithTUN()}},
+	} {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			tn := NewTwoNodeNet(t, tt.opts...)
+			for _, pair := range [][2]*testNode{{tn.N1, tn.N2}, {tn.N2, tn.N1}} {
+				from, to := pair[0], pair[1]
+				ip := to.AwaitIP(t)
+				out, err := from.Tailscale("ping", "--tsmp", "--c=5", ip.String()).CombinedOutput()
+				if err != nil {
+					t.Fatalf("ping %v: %v, %s", ip, err, out)
+				}
+				if !strings.Contains(string(out), "pong from") {
+					t.Errorf("ping %v output = %q; want a pong", ip, out)
+				}
+			}
+		})
+	}
+}
+
+// Two nodes on the same machine should find a direct path to each
+// other instead of relaying through DERP.
+func TestPeerStatusDirect(t *testing.T) {
+	t.Parallel()
+	tn := NewTwoNodeNet(t)
+	ip := tn.N2.AwaitIP(t)
+	if err := tstest.WaitFor(20*time.Second, func() error {
+		// Disco pings are what find the direct path.
+		tn.N1.Tailscale("ping", "--c=1", "--timeout=1s", ip.String()).Run()
+		ps, err := tn.N1.PeerStatus(ip)
+		if err != nil {
+			return err
+		}
+		if ps.CurAddr == "" {
+			return fmt.Errorf("peer %v not direct; relay=%q", ip, ps.Relay)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestTailnetAddrFamilyDisabled tests that a node with --tailnet-ipv4=false
+// or --tailnet-ipv6=false in netstack mode doesn't accept connections
+// to its address of that family, while still reporting it, and that
+// the setting can be flipped at runtime.
+func TestTailnetAddrFamilyDisabled(t *testing.T) {
+	t.Parallel()
+	bins := BuildTestBinaries(t)
+
+	env := newTestEnv(t, bins)
+	defer env.Close()
+
+	port := listenLocal(t)
+
+	n1 := newTestNode(t, env)
+	n1SocksAddrCh := n1.socks5AddrChan()
+	d1 := n1.StartDaemon(t)
+	defer d1.Kill()
+
+	n2 := newTestNode(t, env)
+	d2 := n2.StartDaemon(t)
+	defer d2.Kill()
+
+	n1.AwaitSocksAddr(t, n1SocksAddrCh)
+	n1.AwaitListening(t)
+	n2.AwaitListening(t)
+	n1.MustUp()
+	n2.MustUp("--tailnet-ipv4=false")
+	n1.AwaitRunning(t)
+	n2.AwaitRunning(t)
+
+	var ip4, ip6 netaddr.IP
+	for _, ip := range n2.AwaitIPs(t) {
+		if ip.Is4() {
+			ip4 = ip
+		} else {
+			ip6 = ip
+		}
+	}
+	if ip4.IsZero() || ip6.IsZero() {
+		t.Fatalf("n2 should still report both of its addresses; got v4=%v v6=%v", ip4, ip6)
+	}
+
+	mustConnect := func(ip netaddr.IP) {
+		t.Helper()
+		err := tstest.WaitFor(10*time.Second, func() error {
+			return n1.dialVia(t, ip, port, 2*time.Second)
+		})
+		if err != nil {
+			t.Fatalf("can't connect to %v: %v", ip, err)
+		}
+	}
+	mustNotConnect := func(ip netaddr.IP) {
+		t.Helper()
+		if err := n1.dialVia(t, ip, port, 3*time.Second); err == nil {
+			t.Fatalf("unexpectedly connected to %v", ip)
+		}
+	}
+
+	mustConnect(ip6)
+	mustNotConnect(ip4)
+
+	n2.MustUp("--tailnet-ipv4=true", "--tailnet-ipv6=false")
+	mustConnect(ip4)
+	mustNotConnect(ip6)
+
+	n2.MustUp("--tailnet-ipv6=true")
+	mustConnect(ip6)
+
+	d1.MustCleanShutdown(t)
+	d2.MustCleanShutdown(t)
+}
+
+func TestNodeAddressIPFields(t *testing.T) {
+	t.Parallel()
+	bins := BuildTestBinaries(t)
+
+	env := newTestEnv(t, bins)
+	defer env.Close()
+
+	n1 := newTestNode(t, env)
+	d1 := n1.StartDaemon(t)
+	defer d1.Kill()
+
+	n1.AwaitListening(t)
+	n1.MustUp()
+	n1.AwaitRunning(t)
+
+	testNodes := env.Control.AllNodes()
+
+	if len(testNodes) != 1 {
 		t.Errorf("Expected %d nodes, got %d", 1, len(testNodes))
 	}
 	node := testNodes[0]
@@ -289,6 +886,78 @@ func TestNodeAddressIPFields(t *testing.T) {
 	d1.MustCleanShutdown(t)
 }
 
+func TestDebugPrefsAndStatus(t *testing.T) {
+	t.Parallel()
+	bins := BuildTestBinaries(t)
+
+	env := newTestEnv(t, bins)
+	defer env.Close()
+
+	// Find a free port for tailscaled's debug server, which doesn't
+	// report the port it picked.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	debugAddr := ln.Addr().String()
+	ln.Close()
+
+	n1 := newTestNode(t, env)
+	n1.daemonArgs = []string{"--debug=" + debugAddr}
+	d1 := n1.StartDaemon(t)
+	defer d1.Kill()
+	n1.AwaitListening(t)
+	n1.MustUp()
+	n1.AwaitRunning(t)
+
+	getJSON := func(path string, v interface{}) {
+		t.Helper()
+		res, err := http.Get("http://" + debugAddr + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Fatalf("GET %s: %v", path, res.Status)
+		}
+		if ct := res.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("GET %s: Content-Type = %q; want application/json", path, ct)
+		}
+		if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+	}
+
+	var prefs ipn.Prefs
+	getJSON("/debug/prefs", &prefs)
+	if !prefs.WantRunning {
+		t.Error("prefs: WantRunning = false; want true")
+	}
+	if prefs.ControlURL != env.ControlServer.URL {
+		t.Errorf("prefs: ControlURL = %q; want %q", prefs.ControlURL, env.ControlServer.URL)
+	}
+	if prefs.Persist == nil {
+		t.Fatal("prefs: nil Persist")
+	}
+	if !prefs.Persist.PrivateNodeKey.IsZero() || !prefs.Persist.OldPrivateNodeKey.IsZero() || !prefs.Persist.LegacyFrontendPrivateMachineKey.IsZero() {
+		t.Error("prefs: private keys not redacted")
+	}
+
+	var st ipnstate.Status
+	getJSON("/debug/status", &st)
+	if st.BackendState != "Running" {
+		t.Errorf("status: BackendState = %q; want Running", st.BackendState)
+	}
+	if st.Self == nil {
+		t.Error("status: nil Self")
+	}
+	if len(st.TailscaleIPs) == 0 {
+		t.Error("status: no TailscaleIPs")
+	}
+
+	d1.MustCleanShutdown(t)
+}
+
 func TestAddPingRequest(t *testing.T) {
 	t.Parallel()
 	bins := BuildTestBinaries(t)
@@ -370,27 +1039,662 @@ func TestNoControlConnWhenDown(t *testing.T) {
 	n1.MustDown()
 	d1.MustCleanShutdown(t)
 
-	env.LogCatcher.Reset()
-	d2 := n1.StartDaemon(t)
-	defer d2.Kill()
+	env.LogCatcher.Reset()
+	d2 := n1.StartDaemon(t)
+	defer d2.Kill()
+	n1.AwaitResponding(t)
+
+	st := n1.MustStatus(t)
+	if got, want := st.BackendState, "Stopped"; got != want {
+		t.Fatalf("after restart, state = %q; want %q", got, want)
+	}
+
+	ip2 := n1.AwaitIP(t)
+	if ip1 != ip2 {
+		t.Errorf("IPs different: %q vs %q", ip1, ip2)
+	}
+
+	// The real test: verify our daemon doesn't have an HTTP request open.:
+	if n := env.Control.InServeMap(); n != 0 {
+		t.Errorf("in serve map = %d; want 0", n)
+	}
+
+	d2.MustCleanShutdown(t)
+}
+
+// On SIGTERM, tailscaled should tell control it's going away (by
+// clearing its endpoints) unless started with --skip-going-away.
+func TestGoingAwayOnSIGTERM(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no SIGTERM on Windows")
+	}
+	t.Parallel()
+	bins := BuildTestBinaries(t)
+
+	for _, skip := range []bool{false, true} {
+		t.Run(fmt.Sprintf("skip=%v", skip), func(t *testing.T) {
+			env := newTestEnv(t, bins)
+			defer env.Close()
+
+			n1 := newTestNode(t, env)
+			if skip {
+				n1.daemonArgs = []string{"--skip-going-away"}
+			}
+			d1 := n1.StartDaemon(t)
+			defer d1.Kill()
+			n1.AwaitResponding(t)
+			n1.MustUp()
+			n1.AwaitRunning(t)
+
+			nodeKey := tailcfg.NodeKey(n1.MustStatus(t).Self.PublicKey)
+			if err := tstest.WaitFor(20*time.Second, func() error {
+				if n := env.Control.Node(nodeKey); n == nil || len(n.Endpoints) == 0 {
+					return errors.New("no endpoints in control yet")
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			d1.Process.Signal(syscall.SIGTERM)
+			ps, err := d1.Process.Wait()
+			if err != nil {
+				t.Fatalf("tailscaled Wait: %v", err)
+			}
+			if ps.ExitCode() != 0 {
+				t.Errorf("tailscaled ExitCode = %d; want 0", ps.ExitCode())
+			}
+
+			eps := env.Control.Node(nodeKey).Endpoints
+			if skip && len(eps) == 0 {
+				t.Errorf("endpoints cleared despite --skip-going-away")
+			}
+			if !skip && len(eps) != 0 {
+				t.Errorf("endpoints after SIGTERM = %q; want none", eps)
+			}
+		})
+	}
+}
+
+// Repeated "tailscale down"/"up" cycles should stop and restore
+// connectivity each time, without leaking goroutines or memory.
+func TestUpDownCycles(t *testing.T) {
+	t.Parallel()
+	const (
+		cycles       = 20
+		warmup       = 3                // cycles before leak samples count
+		upDeadline   = 10 * time.Second // to reach the peer after up
+		goroutineTol = 20               // goroutine growth tolerated
+		heapTol      = 4 << 20          // heap growth tolerated, in bytes
+	)
+	bins := BuildTestBinaries(t)
+
+	env := newTestEnv(t, bins)
+	defer env.Close()
+
+	// Both nodes run in netstack mode on this machine, so
+	// connections to either one's Tailscale IP land here.
+	port := listenLocal(t)
+
+	// Find a free port for n1's debug server, for /debug/runtime.
+	dln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	debugAddr := dln.Addr().String()
+	dln.Close()
+
+	n1 := newTestNode(t, env)
+	n1.daemonArgs = []string{"--debug=" + debugAddr}
+	n1SocksAddrCh := n1.socks5AddrChan()
+	d1 := n1.StartDaemon(t)
+	defer d1.Kill()
+
+	n2 := newTestNode(t, env)
+	d2 := n2.StartDaemon(t)
+	defer d2.Kill()
+
+	n1.AwaitSocksAddr(t, n1SocksAddrCh)
+	n1.AwaitListening(t)
+	n2.AwaitListening(t)
+	n1.MustUp()
+	n2.MustUp()
+	n1.AwaitRunning(t)
+	n2.AwaitRunning(t)
+	ip2 := n2.AwaitIP(t)
+
+	type runtimeStats struct {
+		Goroutines int
+		HeapAlloc  uint64
+	}
+	getStats := func() runtimeStats {
+		t.Helper()
+		res, err := http.Get("http://" + debugAddr + "/debug/runtime?gc=1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var st runtimeStats
+		if err := json.NewDecoder(res.Body).Decode(&st); err != nil {
+			t.Fatalf("decoding /debug/runtime: %v", err)
+		}
+		return st
+	}
+
+	var goroutines, heap []uint64
+	for i := 0; i < cycles; i++ {
+		n1.MustDown()
+		if err := tstest.WaitFor(20*time.Second, func() error {
+			st, err := n1.Status()
+			if err != nil {
+				return err
+			}
+			if st.BackendState != "Stopped" {
+				return fmt.Errorf("in state %q", st.BackendState)
+			}
+			return nil
+		}); err != nil {
+			t.Fatalf("cycle %d: after down: %v", i, err)
+		}
+		if err := n1.dialVia(t, ip2, port, time.Second); err == nil {
+			t.Fatalf("cycle %d: reached peer %v while down", i, ip2)
+		}
+
+		n1.MustUp()
+		n1.AwaitRunning(t)
+		if err := tstest.WaitFor(upDeadline, func() error {
+			return n1.dialVia(t, ip2, port, 2*time.Second)
+		}); err != nil {
+			t.Fatalf("cycle %d: can't reach peer %v after up: %v", i, ip2, err)
+		}
+
+		if i >= warmup {
+			st := getStats()
+			goroutines = append(goroutines, uint64(st.Goroutines))
+			heap = append(heap, st.HeapAlloc)
+		}
+	}
+	checkNoLeak(t, "goroutines", goroutines, goroutineTol)
+	checkNoLeak(t, "heap bytes", heap, heapTol)
+
+	d1.MustCleanShutdown(t)
+	d2.MustCleanShutdown(t)
+}
+
+// checkNoLeak fails t if samples, one per cycle of some repeated
+// operation, grew steadily: that is, if each sample is at least the
+// one before it and the last is more than tolerance above the first.
+func checkNoLeak(t testing.TB, what string, samples []uint64, tolerance uint64) {
+	t.Helper()
+	if len(samples) < 2 {
+		return
+	}
+	for i := 1; i < len(samples); i++ {
+		if samples[i] < samples[i-1] {
+			return // not monotonic
+		}
+	}
+	if first, last := samples[0], samples[len(samples)-1]; last > first+tolerance {
+		t.Errorf("%s grew every cycle, from %d to %d: %v", what, first, last, samples)
+	}
+}
+
+// Logs written while the log server is unreachable should be kept in
+// the --logtail-buffer file and uploaded by a later run of tailscaled.
+func TestLogsBufferedAcrossRestart(t *testing.T) {
+	t.Parallel()
+	bins := BuildTestBinaries(t)
+
+	env := newTestEnv(t, bins)
+	defer env.Close()
+
+	n1 := newTestNode(t, env)
+	logBuf := "--logtail-buffer=file:" + filepath.Join(n1.dir, "logbuf") + ",maxsize=10MB"
+
+	// The first run's "Program starting" line includes its
+	// arguments, so mark it with an otherwise unused --verbose
+	// value to tell it apart from the second run.
+	const marker = `"--verbose=1"`
+	env.restartLogCatcher(func() {
+		n1.daemonArgs = []string{logBuf, "--verbose=1"}
+		d1 := n1.StartDaemon(t)
+		n1.AwaitListening(t)
+		d1.Kill() // no clean shutdown; logs were never uploaded
+		d1.Process.Wait()
+	})
+	if env.LogCatcher.logsContains(mem.S(marker)) {
+		t.Fatalf("log catcher saw %#q while it was down", marker)
+	}
+
+	n1.daemonArgs = []string{logBuf}
+	d2 := n1.StartDaemon(t)
+	defer d2.Kill()
+	n1.AwaitListening(t)
+
+	if err := tstest.WaitFor(20*time.Second, func() error {
+		if !env.LogCatcher.logsContains(mem.S(marker)) {
+			return fmt.Errorf("log catcher didn't see %#q; got %s", marker, env.LogCatcher.logsString())
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	d2.MustCleanShutdown(t)
+}
+
+// tailscaled --accept-dns=false should start without taking over DNS
+// on first start, and a later "up" should be able to turn it back on.
+func TestBootstrapAcceptDNSFalse(t *testing.T) {
+	t.Parallel()
+	bins := BuildTestBinaries(t)
+
+	env := newTestEnv(t, bins)
+	defer env.Close()
+
+	n1 := newTestNode(t, env)
+	n1.daemonArgs = []string{"--accept-dns=false"}
+	d1 := n1.StartDaemon(t)
+	defer d1.Kill()
+	n1.AwaitResponding(t)
+
+	if p := n1.diskPrefs(t); p.CorpDNS {
+		t.Errorf("on first start, CorpDNS = true; want false")
+	}
+
+	n1.MustUp("--accept-dns=false")
+	n1.AwaitRunning(t)
+	if p := n1.diskPrefs(t); p.CorpDNS {
+		t.Errorf("after up, CorpDNS = true; want false")
+	}
+
+	n1.MustUp("--accept-dns=true")
+	if p := n1.diskPrefs(t); !p.CorpDNS {
+		t.Errorf("after up --accept-dns=true, CorpDNS = false; want true")
+	}
+
+	d1.MustCleanShutdown(t)
+}
+
+// tailscaled --shields-up should block incoming connections from
+// the first start, including after an "up" that doesn't mention
+// --shields-up, and a later "up" should be able to lower them.
+func TestBootstrapShieldsUp(t *testing.T) {
+	t.Parallel()
+	bins := BuildTestBinaries(t)
+
+	env := newTestEnv(t, bins)
+	defer env.Close()
+
+	// Both nodes run in netstack mode on this machine, so
+	// connections to either one's Tailscale IP land here.
+	port := listenLocal(t)
+
+	n1 := newTestNode(t, env)
+	n1.daemonArgs = []string{"--shields-up"}
+	n1SocksAddrCh := n1.socks5AddrChan()
+	d1 := n1.StartDaemon(t)
+	defer d1.Kill()
+
+	n2 := newTestNode(t, env)
+	n2SocksAddrCh := n2.socks5AddrChan()
+	d2 := n2.StartDaemon(t)
+	defer d2.Kill()
+
+	n1.AwaitSocksAddr(t, n1SocksAddrCh)
+	n2.AwaitSocksAddr(t, n2SocksAddrCh)
+	n1.AwaitListening(t)
+	n2.AwaitListening(t)
+
+	if p := n1.diskPrefs(t); !p.ShieldsUp {
+		t.Errorf("on first start, ShieldsUp = false; want true")
+	}
+
+	n1.MustUp()
+	n2.MustUp()
+	n1.AwaitRunning(t)
+	n2.AwaitRunning(t)
+	if p := n1.diskPrefs(t); !p.ShieldsUp {
+		t.Errorf("after up, ShieldsUp = false; want true")
+	}
+
+	// Outbound connections still work...
+	AssertCanConnect(t, n1, n2, port)
+	// ... but inbound ones don't.
+	if err := n2.dialVia(t, n1.AwaitIP(t), port, 3*time.Second); err == nil {
+		t.Errorf("connected to shields-up node")
+	}
+
+	n1.MustUp("--shields-up=false")
+	if p := n1.diskPrefs(t); p.ShieldsUp {
+		t.Errorf("after up --shields-up=false, ShieldsUp = true; want false")
+	}
+	AssertCanConnect(t, n2, n1, port)
+
+	d1.MustCleanShutdown(t)
+	d2.MustCleanShutdown(t)
+}
+
+// tailscaled --login-server should seed the control URL so that "up"
+// needn't specify it.
+func TestBootstrapLoginServer(t *testing.T) {
+	t.Parallel()
+	bins := BuildTestBinaries(t)
+
+	env := newTestEnv(t, bins)
+	defer env.Close()
+
+	n1 := newTestNode(t, env)
+	n1.daemonArgs = []string{"--login-server=" + env.ControlServer.URL}
+	d1 := n1.StartDaemon(t)
+	defer d1.Kill()
+	n1.AwaitResponding(t)
+
+	if err := n1.Tailscale("up").Run(); err != nil {
+		t.Fatalf("up: %v", err)
+	}
+	t.Logf("Got IP: %v", n1.AwaitIP(t))
+	n1.AwaitRunning(t)
+
+	if p := n1.diskPrefs(t); p.ControlURL != env.ControlServer.URL {
+		t.Errorf("ControlURL = %q; want %q", p.ControlURL, env.ControlServer.URL)
+	}
+
+	d1.MustCleanShutdown(t)
+}
+
+// Two concurrent "tailscale up" commands with different flags must
+// leave the prefs matching exactly one of them, and the other must
+// fail rather than silently merging or dropping settings.
+func TestConcurrentUp(t *testing.T) {
+	t.Parallel()
+	bins := BuildTestBinaries(t)
+
+	env := newTestEnv(t, bins)
+	defer env.Close()
+
+	n1 := newTestNode(t, env)
+	d1 := n1.StartDaemon(t)
+	defer d1.Kill()
+
+	n1.AwaitListening(t)
+	n1.MustUp()
+	n1.AwaitRunning(t)
+
+	const route = "10.0.0.0/24"
+	const hostname = "concurrent-up"
+	type result struct {
+		out []byte
+		err error
+	}
+	run := func(arg string) <-chan result {
+		ch := make(chan result, 1)
+		go func() {
+			cmd := n1.upCmd(arg)
+			cmd.Stdout, cmd.Stderr = nil, nil
+			out, err := cmd.CombinedOutput()
+			ch <- result{out, err}
+		}()
+		return ch
+	}
+	routesc := run("--advertise-routes=" + route)
+	hostc := run("--hostname=" + hostname)
+	routesRes, hostRes := <-routesc, <-hostc
+
+	if (routesRes.err == nil) == (hostRes.err == nil) {
+		t.Fatalf("want exactly one up to succeed; routes: %v, %s; hostname: %v, %s",
+			routesRes.err, routesRes.out, hostRes.err, hostRes.out)
+	}
+	for _, r := range []result{routesRes, hostRes} {
+		if r.err != nil && len(bytes.TrimSpace(r.out)) == 0 {
+			t.Errorf("failed up printed no error")
+		}
+	}
+
+	p := n1.diskPrefs(t)
+	gotRoutes := len(p.AdvertiseRoutes) == 1 && p.AdvertiseRoutes[0].String() == route
+	gotHostname := p.Hostname == hostname
+	if routesRes.err == nil && (!gotRoutes || gotHostname) {
+		t.Errorf("routes up won, but prefs have AdvertiseRoutes=%v Hostname=%q", p.AdvertiseRoutes, p.Hostname)
+	}
+	if hostRes.err == nil && (gotRoutes || !gotHostname) {
+		t.Errorf("hostname up won, but prefs have AdvertiseRoutes=%v Hostname=%q", p.AdvertiseRoutes, p.Hostname)
+	}
+
+	d1.MustCleanShutdown(t)
+}
+
+// A "tailscale up" that computed its prefs before another client
+// changed them must fail with 412 Precondition Failed, rather than
+// silently overwriting the other change. This is the race that
+// TestConcurrentUp runs into, driven through LocalAPI so that the
+// interleaving is deterministic. Both the prefs edit used on a running
+// node and the start used on a fresh or re-auth run are checked.
+func TestUpStalePrefsETag(t *testing.T) {
+	t.Parallel()
+	bins := BuildTestBinaries(t)
+
+	env := newTestEnv(t, bins)
+	defer env.Close()
+
+	n1 := newTestNode(t, env)
+	d1 := n1.StartDaemon(t)
+	defer d1.Kill()
+
+	n1.AwaitListening(t)
+	n1.MustUp()
+	n1.AwaitRunning(t)
+
+	// The first "up" reads the prefs, and computes new ones from them.
+	res, body := n1.localAPIRequest(t, "GET", "/localapi/v0/prefs", nil, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("GET prefs: %v, %s", res.Status, body)
+	}
+	staleETag := res.Header.Get("ETag")
+	if staleETag == "" {
+		t.Fatal("GET prefs returned no ETag")
+	}
+	var stalePrefs ipn.Prefs
+	if err := json.Unmarshal(body, &stalePrefs); err != nil {
+		t.Fatal(err)
+	}
+	stalePrefs.AdvertiseRoutes = []netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.0.0.0/24")}
+
+	// Meanwhile, a second "up" changes them.
+	const hostname = "concurrent-up"
+	n1.MustUp("--hostname=" + hostname)
+
+	// So the first one's writes must be refused.
+	ifMatch := http.Header{"If-Match": {staleETag}}
+	opts, err := json.Marshal(ipn.Options{
+		StateKey:    ipn.GlobalDaemonStateKey,
+		UpdatePrefs: &stalePrefs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, body := n1.localAPIRequest(t, "POST", "/localapi/v0/start", ifMatch, opts); res.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("start with stale ETag: %v, %s; want 412", res.Status, body)
+	}
+	edit, err := json.Marshal(ipn.MaskedPrefs{
+		Prefs:              ipn.Prefs{AdvertiseRoutes: stalePrefs.AdvertiseRoutes},
+		AdvertiseRoutesSet: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, body := n1.localAPIRequest(t, "PATCH", "/localapi/v0/prefs", ifMatch, edit); res.StatusCode != http.StatusPreconditionFailed {
+		t.Errorf("PATCH prefs with stale ETag: %v, %s; want 412", res.Status, body)
+	}
+
+	p := n1.diskPrefs(t)
+	if p.Hostname != hostname || len(p.AdvertiseRoutes) != 0 {
+		t.Errorf("prefs have Hostname=%q AdvertiseRoutes=%v; want only the second up's hostname", p.Hostname, p.AdvertiseRoutes)
+	}
+
+	// With the current ETag, the same edit goes through.
+	res, body = n1.localAPIRequest(t, "GET", "/localapi/v0/prefs", nil, nil)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("GET prefs: %v, %s", res.Status, body)
+	}
+	ifMatch = http.Header{"If-Match": {res.Header.Get("ETag")}}
+	if res, body := n1.localAPIRequest(t, "PATCH", "/localapi/v0/prefs", ifMatch, edit); res.StatusCode != http.StatusOK {
+		t.Errorf("PATCH prefs with current ETag: %v, %s; want 200", res.Status, body)
+	}
+
+	d1.MustCleanShutdown(t)
+}
+
+// A node whose key expires should go to NeedsLogin at the expiry time,
+// without waiting for anything else to happen. Advancing the node's
+// fake clock lets that be tested without waiting for real.
+func TestKeyExpiryFakeClock(t *testing.T) {
+	t.Parallel()
+	bins := BuildTestBinaries(t)
+
+	env := newTestEnv(t, bins, configureControl(func(control *testcontrol.Server) {
+		control.NodeKeyExpiry = time.Hour
+	}))
+	defer env.Close()
+
+	n1 := newTestNode(t, env)
+	n1.fakeClock = true
+	d1 := n1.StartDaemon(t)
+	defer d1.Kill()
+
+	n1.AwaitListening(t)
+	n1.MustUp()
+	n1.AwaitRunning(t)
+
+	n1.AdvanceClock(t, 30*time.Minute)
+	if st := n1.MustStatus(t); st.BackendState != "Running" {
+		t.Fatalf("before expiry, state = %q; want Running", st.BackendState)
+	}
+
+	n1.AdvanceClock(t, time.Hour)
+	if err := tstest.WaitFor(20*time.Second, func() error {
+		st, err := n1.Status()
+		if err != nil {
+			return err
+		}
+		if st.BackendState != "NeedsLogin" {
+			return fmt.Errorf("in state %q", st.BackendState)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("after expiry: %v", err)
+	}
+
+	d1.MustCleanShutdown(t)
+}
+
+// TestCrashBetweenRegisterAndStateWrite tests that tailscaled recovers
+// when it's killed after control accepted its new node key but before
+// it saved the key.
+func TestCrashBetweenRegisterAndStateWrite(t *testing.T) {
+	t.Parallel()
+	bins := BuildTestBinaries(t)
+
+	env := newTestEnv(t, bins)
+	defer env.Close()
+
+	n1 := newTestNode(t, env)
+	d1, reached := n1.StartDaemonCrashingAt(t, crashpoint.PersistNodeKey)
+	defer d1.Kill()
+	n1.AwaitResponding(t)
+
+	upErr := make(chan error, 1)
+	go func() { upErr <- n1.upCmd().Run() }()
+	d1.KillAtCrashPoint(t, reached)
+	select {
+	case err := <-upErr:
+		t.Logf("up during crash: %v", err)
+	case <-time.After(20 * time.Second):
+		t.Fatal("timeout waiting for up to fail after tailscaled was killed")
+	}
+
+	if got := len(env.Control.AllNodes()); got != 1 {
+		t.Fatalf("control has %d nodes before restart; want 1", got)
+	}
+	machineKey := n1.checkStateConsistent(t)
+
+	d2 := n1.StartDaemon(t)
+	defer d2.Kill()
+	n1.AwaitResponding(t)
+	n1.MustUp()
+	n1.AwaitRunning(t)
+
+	if got := n1.checkStateConsistent(t); got != machineKey {
+		t.Errorf("machine key changed across crash: got %v; want %v", got, machineKey)
+	}
+	p := n1.diskPrefs(t)
+	if p.Persist == nil || p.Persist.PrivateNodeKey.IsZero() {
+		t.Fatalf("no node key saved after recovery; prefs: %v", p.Pretty())
+	}
+	for _, node := range env.Control.AllNodes() {
+		if node.Machine != machineKey {
+			t.Errorf("control has node %v with machine key %v; want only %v", node.Key.ShortString(), node.Machine, machineKey)
+		}
+	}
+
+	d2.MustCleanShutdown(t)
+}
+
+// TestInjectedLinkChangeReSTUNs tests that a link change injected into
+// tailscaled's link monitor makes the engine redo endpoint discovery,
+// which sends new STUN requests.
+func TestInjectedLinkChangeReSTUNs(t *testing.T) {
+	t.Parallel()
+	bins := BuildTestBinaries(t)
+
+	env := newTestEnv(t, bins)
+	defer env.Close()
+
+	n1 := newTestNode(t, env)
+	n1.linkChange = true
+	d1 := n1.StartDaemon(t)
+	defer d1.Kill()
+
 	n1.AwaitResponding(t)
+	n1.MustUp()
+	n1.AwaitRunning(t)
 
-	st := n1.MustStatus(t)
-	if got, want := st.BackendState, "Stopped"; got != want {
-		t.Fatalf("after restart, state = %q; want %q", got, want)
+	// Wait for the initial endpoint discovery to STUN.
+	if err := tstest.WaitFor(20*time.Second, func() error {
+		if v4, _ := env.STUNStats.Reads(); v4 == 0 {
+			return errors.New("no STUN requests yet")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
 	}
-
-	ip2 := n1.AwaitIP(t)
-	if ip1 != ip2 {
-		t.Errorf("IPs different: %q vs %q", ip1, ip2)
+	// And for its burst of requests to finish.
+	before, _ := env.STUNStats.Reads()
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		time.Sleep(time.Second)
+		v4, _ := env.STUNStats.Reads()
+		if v4 == before {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("STUN requests didn't settle")
+		}
+		before = v4
 	}
 
-	// The real test: verify our daemon doesn't have an HTTP request open.:
-	if n := env.Control.InServeMap(); n != 0 {
-		t.Errorf("in serve map = %d; want 0", n)
+	n1.InjectLinkChange(t)
+	// Periodic re-STUNs are 20s or more apart, so a new request
+	// this soon is from the link change.
+	if err := tstest.WaitFor(10*time.Second, func() error {
+		if v4, _ := env.STUNStats.Reads(); v4 <= before {
+			return fmt.Errorf("STUN requests = %d; want more than %d", v4, before)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("after link change: %v", err)
 	}
 
-	d2.MustCleanShutdown(t)
+	d1.MustCleanShutdown(t)
 }
 
 // Issue 2137: make sure Windows tailscaled works with the CLI alone,
@@ -430,6 +1734,8 @@ type testEnv struct {
 
 	TrafficTrap       *trafficTrap
 	TrafficTrapServer *httptest.Server
+
+	STUNStats *stuntest.Stats // requests read by the DERP map's STUN server
 }
 
 type testEnvOpt interface {
@@ -450,7 +1756,7 @@ func newTestEnv(t testing.TB, bins *Binaries, opts ...testEnvOpt) *testEnv {
 	if runtime.GOOS == "windows" {
 		t.Skip("not tested/working on Windows yet")
 	}
-	derpMap := RunDERPAndSTUN(t, logger.Discard, "127.0.0.1")
+	derpMap, stunStats := RunDERPAndSTUNWithStats(t, logger.Discard, "127.0.0.1")
 	logc := new(LogCatcher)
 	control := &testcontrol.Server{
 		DERPMap: derpMap,
@@ -466,6 +1772,7 @@ func newTestEnv(t testing.TB, bins *Binaries, opts ...testEnvOpt) *testEnv {
 		ControlServer:     control.HTTPTestServer,
 		TrafficTrap:       trafficTrap,
 		TrafficTrapServer: httptest.NewServer(trafficTrap),
+		STUNStats:         stunStats,
 	}
 	for _, o := range opts {
 		o.modifyTestEnv(e)
@@ -474,6 +1781,27 @@ func newTestEnv(t testing.TB, bins *Binaries, opts ...testEnvOpt) *testEnv {
 	return e
 }
 
+// restartLogCatcher stops the log catcher's HTTP server, calls fn
+// while it's down, and then starts a new one on the same address.
+func (e *testEnv) restartLogCatcher(fn func()) {
+	t := e.t
+	addr := e.LogCatcherServer.Listener.Addr().String()
+	e.LogCatcherServer.CloseClientConnections()
+	e.LogCatcherServer.Close()
+
+	fn()
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("relistening log catcher on %v: %v", addr, err)
+	}
+	srv := httptest.NewUnstartedServer(e.LogCatcher)
+	srv.Listener.Close()
+	srv.Listener = ln
+	srv.Start()
+	e.LogCatcherServer = srv
+}
+
 func (e *testEnv) Close() error {
 	if err := e.TrafficTrap.Err(); err != nil {
 		e.t.Errorf("traffic trap: %v", err)
@@ -486,6 +1814,112 @@ func (e *testEnv) Close() error {
 	return nil
 }
 
+// TwoNodeNet is a test tailnet of two running nodes, as returned by
+// NewTwoNodeNet.
+type TwoNodeNet struct {
+	Env     *testEnv
+	Control *testcontrol.Server
+	DERPMap *tailcfg.DERPMap
+	N1, N2  *testNode
+}
+
+// TwoNodeOpt is an option for NewTwoNodeNet.
+type TwoNodeOpt func(*twoNodeConfig)
+
+type twoNodeConfig struct {
+	tun        bool
+	daemonArgs []string
+	upArgs     []string
+}
+
+// WithTUN runs the nodes with TUN devices rather than in netstack
+// mode. That needs root on Linux; tests using it are skipped
+// otherwise.
+func WithTUN() TwoNodeOpt {
+	return func(c *twoNodeConfig) { c.tun = true }
+}
+
+// WithDaemonArgs passes extra flags to both nodes' tailscaled.
+func WithDaemonArgs(args ...string) TwoNodeOpt {
+	return func(c *twoNodeConfig) { c.daemonArgs = append(c.daemonArgs, args...) }
+}
+
+// WithUpArgs passes extra flags to both nodes' "tailscale up".
+func WithUpArgs(args ...string) TwoNodeOpt {
+	return func(c *twoNodeConfig) { c.upArgs = append(c.upArgs, args...) }
+}
+
+// tunCounter makes TUN device names unique within a test binary.
+var tunCounter int32
+
+// sockCounter makes abstract socket names unique within a test binary.
+var sockCounter int32
+
+// canUseTUN reports whether tests can create real TUN devices.
+func canUseTUN() bool {
+	return runtime.GOOS == "linux" && os.Getuid() == 0
+}
+
+// newTUNName returns a TUN device name that's unique among
+// concurrently running test binaries.
+func newTUNName() string {
+	return fmt.Sprintf("tst%d-%d", os.Getpid()%100000, atomic.AddInt32(&tunCounter, 1))
+}
+
+// NewTwoNodeNet starts a test control server, DERP and STUN server,
+// and two nodes, brings both nodes up, and waits for them to be
+// running. The nodes' SOCKS5 addresses are known, for use with
+// AssertCanConnect. Everything is shut down when t ends; the nodes
+// must shut down cleanly unless t has already failed.
+func NewTwoNodeNet(t *testing.T, opts ...TwoNodeOpt) *TwoNodeNet {
+	t.Helper()
+	var conf twoNodeConfig
+	for _, o := range opts {
+		o(&conf)
+	}
+	if conf.tun && !canUseTUN() {
+		t.Skip("TUN mode needs root on Linux")
+	}
+	bins := BuildTestBinaries(t)
+
+	env := newTestEnv(t, bins)
+	t.Cleanup(func() { env.Close() })
+
+	var nodes [2]*testNode
+	for i := range nodes {
+		n := newTestNode(t, env)
+		if conf.tun {
+			n.UseTUN()
+		}
+		n.daemonArgs = append(n.daemonArgs, conf.daemonArgs...)
+		socksAddrCh := n.socks5AddrChan()
+		d := n.StartDaemon(t)
+		t.Cleanup(func() {
+			if t.Failed() {
+				d.Kill()
+				return
+			}
+			d.MustCleanShutdown(t)
+		})
+		n.AwaitSocksAddr(t, socksAddrCh)
+		n.AwaitListening(t)
+		nodes[i] = n
+	}
+	for _, n := range nodes {
+		n.MustUp(conf.upArgs...)
+	}
+	for _, n := range nodes {
+		n.AwaitRunning(t)
+	}
+	return &TwoNodeNet{
+		Env:     env,
+		Control: env.Control,
+		DERPMap: env.Control.DERPMap,
+		N1:      nodes[0],
+		N2:      nodes[1],
+	}
+}
+
 // testNode is a machine with a tailscale & tailscaled.
 // Currently, the test is simplistic and user==node==machine.
 // That may grow complexity later to test more.
@@ -495,10 +1929,19 @@ type testNode struct {
 	dir        string // temp dir for sock & state
 	sockFile   string
 	stateFile  string
-	upFlagGOOS string // if non-empty, sets TS_DEBUG_UP_FLAG_GOOS for cmd/tailscale CLI
+	upFlagGOOS string   // if non-empty, sets TS_DEBUG_UP_FLAG_GOOS for cmd/tailscale CLI
+	daemonArgs []string // extra flags to pass to tailscaled
+	tun        string   // if non-empty, the --tun device to use instead of netstack
+	authKey    string   // if non-empty, passed to "up" as --authkey
+	fakeClock  bool     // run tailscaled with TS_DEBUG_FAKE_CLOCK; see AdvanceClock
+	crashAfter string   // if non-empty, TS_DEBUG_CRASH_AFTER for tailscaled; see StartDaemonCrashingAt
+	linkChange bool     // run tailscaled with TS_DEBUG_INJECT_LINK_CHANGE; see InjectLinkChange
+	ipnPort    uint16   // if non-zero, the --ipn-port for tailscaled and the CLI
 
 	mu        sync.Mutex
 	onLogLine []func([]byte)
+	socksAddr string       // once known, from AwaitSocksAddr
+	daemonOut bytes.Buffer // stdout and stderr of all tailscaled runs
 }
 
 // newTestNode allocates a temp directory for a new test node.
@@ -506,15 +1949,38 @@ type testNode struct {
 func newTestNode(t *testing.T, env *testEnv) *testNode {
 	dir := t.TempDir()
 	sockFile := filepath.Join(dir, "tailscale.sock")
+	if runtime.GOOS == "linux" {
+		// An abstract socket, so there's no socket file whose
+		// cleanup can race with the next daemon start.
+		sockFile = fmt.Sprintf("@tailscale-test-%d-%d", os.Getpid(), atomic.AddInt32(&sockCounter, 1))
+	}
 	if len(sockFile) >= 104 {
 		t.Fatalf("sockFile path %q (len %v) is too long, must be < 104", sockFile, len(sockFile))
 	}
-	return &testNode{
+	n := &testNode{
 		env:       env,
 		dir:       dir,
 		sockFile:  sockFile,
 		stateFile: filepath.Join(dir, "tailscale.state"),
 	}
+	if *realTUN {
+		n.UseTUN()
+	}
+	return n
+}
+
+// UseTUN makes n's tailscaled use a real TUN device with a unique
+// name, if the test is running as root on Linux, and reports whether
+// it does. Otherwise n keeps using netstack. It must be called before
+// the daemon is started.
+func (n *testNode) UseTUN() bool {
+	if !canUseTUN() {
+		return false
+	}
+	if n.tun == "" {
+		n.tun = newTUNName()
+	}
+	return true
 }
 
 func (n *testNode) diskPrefs(t testing.TB) *ipn.Prefs {
@@ -537,6 +2003,95 @@ func (n *testNode) diskPrefs(t testing.TB) *ipn.Prefs {
 	return p
 }
 
+// writeFixtureState writes the state file fixture (see
+// gen_state_fixtures.go) as n's state, pointing its prefs at n's
+// control server.
+func (n *testNode) writeFixtureState(t testing.TB, fixture string) {
+	t.Helper()
+	b, err := ioutil.ReadFile(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state map[ipn.StateKey][]byte
+	if err := json.Unmarshal(b, &state); err != nil {
+		t.Fatalf("parsing %s: %v", fixture, err)
+	}
+	// Edit the prefs generically, so fields the current
+	// ipn.Prefs doesn't know about are kept as they were.
+	var prefs map[string]interface{}
+	if err := json.Unmarshal(state[ipn.GlobalDaemonStateKey], &prefs); err != nil {
+		t.Fatalf("parsing %s prefs: %v", fixture, err)
+	}
+	prefs["ControlURL"] = n.env.ControlServer.URL
+	if state[ipn.GlobalDaemonStateKey], err = json.MarshalIndent(prefs, "", "\t"); err != nil {
+		t.Fatal(err)
+	}
+	if b, err = json.MarshalIndent(state, "", "  "); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(n.stateFile, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// legacyPrefs is ipn.Prefs as previous releases read it from the
+// "_daemon" state key: only the fields they knew, with the types
+// they decoded them as.
+type legacyPrefs struct {
+	ControlURL       string
+	RouteAll         bool
+	AllowSingleHosts bool
+	CorpDNS          bool
+	WantRunning      bool
+	ShieldsUp        bool
+	AdvertiseTags    []string
+	Hostname         string
+	NotepadURLs      bool
+	AdvertiseRoutes  []netaddr.IPPrefix
+	NoSNAT           bool
+	NetfilterMode    int
+	Config           *struct {
+		PrivateMachineKey wgkey.Private
+		PrivateNodeKey    wgkey.Private
+		OldPrivateNodeKey wgkey.Private
+		Provider          string
+		LoginName         string
+	}
+}
+
+// readLegacyState reads the state file at path the way previous
+// releases did, returning its prefs and machine key. The machine key
+// is read from the "_machinekey" state key if present, else from the
+// prefs, where the oldest releases kept it.
+func readLegacyState(t testing.TB, path string) (*legacyPrefs, wgkey.Private) {
+	t.Helper()
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state map[string][]byte
+	if err := json.Unmarshal(b, &state); err != nil {
+		t.Fatalf("parsing %s: %v", path, err)
+	}
+	p := new(legacyPrefs)
+	if err := json.Unmarshal(state[string(ipn.GlobalDaemonStateKey)], p); err != nil {
+		t.Fatalf("parsing %s prefs: %v", path, err)
+	}
+	if p.Config == nil || p.Config.PrivateNodeKey.IsZero() {
+		t.Fatalf("%s has no node key", path)
+	}
+	machineKey := p.Config.PrivateMachineKey
+	if text, ok := state[string(ipn.MachineKeyStateKey)]; ok {
+		if err := machineKey.UnmarshalText(text); err != nil {
+			t.Fatalf("parsing %s machine key: %v", path, err)
+		}
+	}
+	if machineKey.IsZero() {
+		t.Fatalf("%s has no machine key", path)
+	}
+	return p, machineKey
+}
+
 // AwaitResponding waits for n's tailscaled to be up enough to be
 // responding, but doesn't wait for any particular state.
 func (n *testNode) AwaitResponding(t testing.TB) {
@@ -590,6 +2145,9 @@ func (n *testNode) AwaitSocksAddr(t testing.TB, ch <-chan string) string {
 	defer timer.Stop()
 	select {
 	case v := <-ch:
+		n.mu.Lock()
+		n.socksAddr = v
+		n.mu.Unlock()
 		return v
 	case <-timer.C:
 		t.Fatal("timeout waiting for node to log its SOCK5 listening address")
@@ -597,6 +2155,26 @@ func (n *testNode) AwaitSocksAddr(t testing.TB, ch <-chan string) string {
 	}
 }
 
+// daemonOutputWriter is an io.Writer that appends to a testNode's
+// daemonOut.
+type daemonOutputWriter struct {
+	n *testNode
+}
+
+func (w daemonOutputWriter) Write(p []byte) (int, error) {
+	w.n.mu.Lock()
+	defer w.n.mu.Unlock()
+	return w.n.daemonOut.Write(p)
+}
+
+// DaemonOutput returns what n's tailscaled has written to stdout and
+// stderr so far, across all of its runs.
+func (n *testNode) DaemonOutput() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.daemonOut.String()
+}
+
 // nodeOutputParser parses stderr of tailscaled processes, calling the
 // per-line callbacks previously registered via
 // testNode.addLogLineHook.
@@ -662,12 +2240,20 @@ func (n *testNode) StartDaemon(t testing.TB) *Daemon {
 }
 
 func (n *testNode) StartDaemonAsIPNGOOS(t testing.TB, ipnGOOS string) *Daemon {
+	tun := n.tun
+	if tun == "" {
+		tun = "userspace-networking"
+	}
 	cmd := exec.Command(n.env.Binaries.Daemon,
-		"--tun=userspace-networking",
+		"--tun="+tun,
 		"--state="+n.stateFile,
 		"--socket="+n.sockFile,
 		"--socks5-server=localhost:0",
 	)
+	if n.ipnPort != 0 {
+		cmd.Args = append(cmd.Args, fmt.Sprintf("--ipn-port=%d", n.ipnPort))
+	}
+	cmd.Args = append(cmd.Args, n.daemonArgs...)
 	cmd.Env = append(os.Environ(),
 		"TS_LOG_TARGET="+n.env.LogCatcherServer.URL,
 		"HTTP_PROXY="+n.env.TrafficTrapServer.URL,
@@ -675,32 +2261,202 @@ func (n *testNode) StartDaemonAsIPNGOOS(t testing.TB, ipnGOOS string) *Daemon {
 		"TS_DEBUG_TAILSCALED_IPN_GOOS="+ipnGOOS,
 		"TS_LOGS_DIR="+t.TempDir(),
 	)
-	cmd.Stderr = &nodeOutputParser{n: n}
+	if n.fakeClock {
+		cmd.Env = append(cmd.Env, "TS_DEBUG_FAKE_CLOCK=1")
+	}
+	if n.crashAfter != "" {
+		cmd.Env = append(cmd.Env, "TS_DEBUG_CRASH_AFTER="+n.crashAfter)
+	}
+	if n.linkChange {
+		cmd.Env = append(cmd.Env, "TS_DEBUG_INJECT_LINK_CHANGE=1")
+	}
+	out := daemonOutputWriter{n}
+	cmd.Stdout = out
+	cmd.Stderr = io.MultiWriter(&nodeOutputParser{n: n}, out)
 	if *verboseTailscaled {
-		cmd.Stdout = os.Stdout
+		cmd.Stdout = io.MultiWriter(cmd.Stdout, os.Stdout)
 		cmd.Stderr = io.MultiWriter(cmd.Stderr, os.Stderr)
 	}
 	if err := cmd.Start(); err != nil {
 		t.Fatalf("starting tailscaled: %v", err)
 	}
+	t.Cleanup(func() {
+		if t.Failed() && !*verboseTailscaled {
+			t.Logf("tailscaled output:\n%s", n.DaemonOutput())
+		}
+	})
 	return &Daemon{
 		Process: cmd.Process,
 	}
 }
 
-func (n *testNode) MustUp(extraArgs ...string) {
-	t := n.env.t
+// StartDaemonCrashingAt starts n's tailscaled like StartDaemon, but
+// with TS_DEBUG_CRASH_AFTER set to point, one of the crashpoint
+// package's crash points. The returned channel is closed once
+// tailscaled reports reaching point, where it then stops until it's
+// killed with KillAtCrashPoint. Later StartDaemon calls run tailscaled
+// normally.
+func (n *testNode) StartDaemonCrashingAt(t testing.TB, point string) (*Daemon, <-chan struct{}) {
+	reached := make(chan struct{})
+	var once sync.Once
+	want := crashpoint.ReachedPrefix + point
+	n.addLogLineHook(func(line []byte) {
+		if mem.Contains(mem.B(line), mem.S(want)) {
+			once.Do(func() { close(reached) })
+		}
+	})
+	n.crashAfter = point
+	defer func() { n.crashAfter = "" }()
+	return n.StartDaemon(t), reached
+}
+
+// KillAtCrashPoint waits for reached, from StartDaemonCrashingAt, and
+// then kills d with SIGKILL, so it gets no chance to clean up, and
+// waits for it to exit.
+func (d *Daemon) KillAtCrashPoint(t testing.TB, reached <-chan struct{}) {
+	t.Helper()
+	timer := time.NewTimer(20 * time.Second)
+	defer timer.Stop()
+	select {
+	case <-reached:
+	case <-timer.C:
+		d.Kill()
+		t.Fatal("timeout waiting for tailscaled to reach its crash point")
+	}
+	if err := d.Process.Kill(); err != nil {
+		t.Fatalf("killing tailscaled: %v", err)
+	}
+	d.Process.Wait()
+}
+
+// checkStateConsistent checks that n's state file, however tailscaled
+// last exited, is readable and has a machine key, and that any node
+// key in it is one control registered for that machine key. It
+// returns the machine key.
+func (n *testNode) checkStateConsistent(t testing.TB) tailcfg.MachineKey {
+	t.Helper()
+	if _, err := os.Stat(n.stateFile); err != nil {
+		t.Fatalf("state file: %v", err)
+	}
+	fs, err := ipn.NewFileStore(n.stateFile)
+	if err != nil {
+		t.Fatalf("state file unreadable: %v", err)
+	}
+	text, err := fs.ReadState(ipn.MachineKeyStateKey)
+	if err != nil {
+		t.Fatalf("reading machine key: %v", err)
+	}
+	var machinePriv wgkey.Private
+	if err := machinePriv.UnmarshalText(text); err != nil {
+		t.Fatalf("parsing machine key: %v", err)
+	}
+	machineKey := tailcfg.MachineKey(machinePriv.Public())
+
+	prefBytes, err := fs.ReadState(ipn.GlobalDaemonStateKey)
+	if err == ipn.ErrStateNotExist {
+		return machineKey
+	}
+	if err != nil {
+		t.Fatalf("reading prefs: %v", err)
+	}
+	p, err := ipn.PrefsFromBytes(prefBytes, false)
+	if err != nil {
+		t.Fatalf("parsing prefs: %v", err)
+	}
+	if p.Persist == nil || p.Persist.PrivateNodeKey.IsZero() {
+		return machineKey
+	}
+	nodeKey := tailcfg.NodeKey(p.Persist.PrivateNodeKey.Public())
+	node := n.env.Control.Node(nodeKey)
+	if node == nil {
+		t.Fatalf("saved node key %v unknown to control", nodeKey.ShortString())
+	}
+	if node.Machine != machineKey {
+		t.Fatalf("saved node key %v registered with machine key %v; want saved %v", nodeKey.ShortString(), node.Machine, machineKey)
+	}
+	return machineKey
+}
+
+// localAPIRequest does an HTTP request with the given method, path,
+// extra header and body to n's tailscaled LocalAPI, and returns the
+// response and its body.
+func (n *testNode) localAPIRequest(t testing.TB, method, path string, header http.Header, body []byte) (*http.Response, []byte) {
+	t.Helper()
+	c := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				port := uint16(41112)
+				if n.ipnPort != 0 {
+					port = n.ipnPort
+				}
+				return safesocket.Connect(n.sockFile, port)
+			},
+		},
+	}
+	req, err := http.NewRequest(method, "http://local-tailscaled.sock"+path, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, vv := range header {
+		req.Header[k] = vv
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer res.Body.Close()
+	slurp, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("%s %s: reading body: %v", method, path, err)
+	}
+	return res, slurp
+}
+
+// upCmd returns the command to run "tailscale up" against the test
+// control server, with the node's auth key, if any.
+func (n *testNode) upCmd(extraArgs ...string) *exec.Cmd {
 	args := []string{
 		"up",
 		"--login-server=" + n.env.ControlServer.URL,
 	}
+	if n.authKey != "" {
+		args = append(args, "--authkey="+n.authKey)
+	}
 	args = append(args, extraArgs...)
-	t.Logf("Running %v ...", args)
-	if err := n.Tailscale(args...).Run(); err != nil {
+	n.env.t.Logf("Running %v ...", args)
+	return n.Tailscale(args...)
+}
+
+func (n *testNode) MustUp(extraArgs ...string) {
+	t := n.env.t
+	if err := n.upCmd(extraArgs...).Run(); err != nil {
 		t.Fatalf("up: %v", err)
 	}
 }
 
+// AdvanceClock advances the fake clock of n's tailscaled, which must
+// have been started with n.fakeClock set, by d.
+func (n *testNode) AdvanceClock(t testing.TB, d time.Duration) {
+	t.Helper()
+	cmd := n.Tailscale("debug", "--advance-clock="+d.String())
+	cmd.Stdout, cmd.Stderr = nil, nil
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("advancing clock: %v, %s", err, out)
+	}
+}
+
+// InjectLinkChange makes n's tailscaled, which must have been started
+// with n.linkChange set, act as if its link monitor saw a network
+// change.
+func (n *testNode) InjectLinkChange(t testing.TB) {
+	t.Helper()
+	cmd := n.Tailscale("debug", "--inject-link-change")
+	cmd.Stdout, cmd.Stderr = nil, nil
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("injecting link change: %v, %s", err, out)
+	}
+}
+
 func (n *testNode) MustDown() {
 	t := n.env.t
 	t.Logf("Running down ...")
@@ -712,7 +2468,17 @@ func (n *testNode) MustDown() {
 // AwaitListening waits for the tailscaled to be serving local clients
 // over its localhost IPC mechanism. (Unix socket, etc)
 func (n *testNode) AwaitListening(t testing.TB) {
-	if err := tstest.WaitFor(20*time.Second, func() (err error) {
+	t.Helper()
+	if err := n.awaitListening(20 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// awaitListening is like AwaitListening but returns an error,
+// including tailscaled's output so far, if tailscaled isn't
+// listening within timeout.
+func (n *testNode) awaitListening(timeout time.Duration) error {
+	if err := tstest.WaitFor(timeout, func() (err error) {
 		c, err := safesocket.Connect(n.sockFile, 41112)
 		if err != nil {
 			return err
@@ -720,8 +2486,9 @@ func (n *testNode) AwaitListening(t testing.TB) {
 		c.Close()
 		return nil
 	}); err != nil {
-		t.Fatal(err)
+		return fmt.Errorf("tailscaled not listening on %s: %v\ntailscaled output:\n%s", n.sockFile, err, n.DaemonOutput())
 	}
+	return nil
 }
 
 func (n *testNode) AwaitIPs(t testing.TB) []netaddr.IP {
@@ -784,6 +2551,9 @@ func (n *testNode) AwaitRunning(t testing.TB) {
 // It does not start the process.
 func (n *testNode) Tailscale(arg ...string) *exec.Cmd {
 	cmd := exec.Command(n.env.Binaries.CLI, "--socket="+n.sockFile)
+	if n.ipnPort != 0 {
+		cmd.Args = append(cmd.Args, fmt.Sprintf("--ipn-port=%d", n.ipnPort))
+	}
 	cmd.Args = append(cmd.Args, arg...)
 	cmd.Dir = n.dir
 	cmd.Env = append(os.Environ(),
@@ -812,6 +2582,23 @@ func (n *testNode) Status() (*ipnstate.Status, error) {
 	return st, nil
 }
 
+// PeerStatus returns n's status, from "tailscale status --json", for
+// the peer with Tailscale IP peerIP.
+func (n *testNode) PeerStatus(peerIP netaddr.IP) (ipnstate.PeerStatus, error) {
+	st, err := n.Status()
+	if err != nil {
+		return ipnstate.PeerStatus{}, err
+	}
+	for _, ps := range st.Peer {
+		for _, ip := range ps.TailscaleIPs {
+			if ip == peerIP {
+				return *ps, nil
+			}
+		}
+	}
+	return ipnstate.PeerStatus{}, fmt.Errorf("no peer with IP %v", peerIP)
+}
+
 func (n *testNode) MustStatus(tb testing.TB) *ipnstate.Status {
 	tb.Helper()
 	st, err := n.Status()
@@ -821,6 +2608,134 @@ func (n *testNode) MustStatus(tb testing.TB) *ipnstate.Status {
 	return st
 }
 
+// AssertCanConnect fails t unless a TCP connection can be made from
+// node from, via its SOCKS5 proxy, to port on node to's Tailscale IP
+// within a few seconds. from's SOCKS5 address must already be known
+// via AwaitSocksAddr.
+func AssertCanConnect(t testing.TB, from, to *testNode, port int) {
+	t.Helper()
+	ip := to.AwaitIP(t)
+	err := tstest.WaitFor(10*time.Second, func() error {
+		return from.dialVia(t, ip, port, 2*time.Second)
+	})
+	if err != nil {
+		t.Fatalf("can't connect to %v: %v\nsource: %s\ndestination: %s", ip, err, from.stateSummary(), to.stateSummary())
+	}
+}
+
+// listenLocal starts a TCP listener on localhost that accepts and
+// immediately closes connections, for AssertCanConnect and friends to
+// dial, and returns its port. Nodes in netstack mode forward
+// connections to their Tailscale IPs to localhost, so any node on
+// this machine reaches it. The listener is closed when t ends.
+func listenLocal(t testing.TB) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// Thresholds for MeasureConnectivity, by the path the connection took.
+const (
+	directConnectivityThreshold = 10 * time.Second
+	derpConnectivityThreshold   = 20 * time.Second
+)
+
+// MeasureConnectivity measures the time from when both from and to
+// have joined the control server to when a TCP connection from node
+// from, via its SOCKS5 proxy, to port on node to's Tailscale IP
+// succeeds. It logs the measurement as a line like
+// "connectivity_latency: 1.234s path=direct" for CI dashboards, and
+// fails t if the connection took longer than the threshold for its
+// path (direct or DERP). from's SOCKS5 address must already be known
+// via AwaitSocksAddr.
+func MeasureConnectivity(t testing.TB, from, to *testNode, port int) time.Duration {
+	t.Helper()
+	ip := to.AwaitIP(t)
+	fromKey := from.MustStatus(t).Self.PublicKey
+	toKey := to.MustStatus(t).Self.PublicKey
+
+	var joined time.Time
+	if err := tstest.WaitFor(20*time.Second, func() error {
+		for _, k := range []key.Public{fromKey, toKey} {
+			jt := from.env.Control.JoinTime(tailcfg.NodeKey(k))
+			if jt.IsZero() {
+				return fmt.Errorf("node %v hasn't joined control", k.ShortString())
+			}
+			if jt.After(joined) {
+				joined = jt
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := tstest.WaitFor(derpConnectivityThreshold, func() error {
+		return from.dialVia(t, ip, port, 2*time.Second)
+	})
+	d := time.Since(joined)
+	if err != nil {
+		t.Fatalf("can't connect to %v after %v: %v\nsource: %s\ndestination: %s", ip, d, err, from.stateSummary(), to.stateSummary())
+	}
+
+	path, threshold := "derp", derpConnectivityThreshold
+	if ps := from.MustStatus(t).Peer[toKey]; ps != nil && ps.CurAddr != "" {
+		path, threshold = "direct", directConnectivityThreshold
+	}
+	t.Logf("connectivity_latency: %v path=%s", d.Round(time.Millisecond), path)
+	if d > threshold {
+		t.Errorf("connecting to %v via %s took %v; want under %v", ip, path, d, threshold)
+	}
+	return d
+}
+
+// dialVia makes a TCP connection from n, via its SOCKS5 proxy, to
+// ip:port and closes it. n's SOCKS5 address must already be known
+// via AwaitSocksAddr.
+func (n *testNode) dialVia(t testing.TB, ip netaddr.IP, port int, timeout time.Duration) error {
+	t.Helper()
+	n.mu.Lock()
+	socksAddr := n.socksAddr
+	n.mu.Unlock()
+	if socksAddr == "" {
+		t.Fatal("dialVia: node's SOCKS5 address not yet known; call AwaitSocksAddr first")
+	}
+	d, err := proxy.SOCKS5("tcp", socksAddr, nil, &net.Dialer{})
+	if err != nil {
+		t.Fatalf("dialVia: SOCKS5 dialer: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	c, err := d.(proxy.ContextDialer).DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), fmt.Sprint(port)))
+	if err != nil {
+		return err
+	}
+	return c.Close()
+}
+
+// stateSummary returns a one-line description of n's status, for
+// test failure messages.
+func (n *testNode) stateSummary() string {
+	st, err := n.Status()
+	if err != nil {
+		return fmt.Sprintf("<status error: %v>", err)
+	}
+	return fmt.Sprintf("state=%s ips=%v peers=%d", st.BackendState, st.TailscaleIPs, len(st.Peer))
+}
+
 // trafficTrap is an HTTP proxy handler to note whether any
 // HTTP traffic tries to leave localhost from tailscaled. We don't
 // expect any, so any request triggers a failure.
@@ -44,6 +44,16 @@ type Server struct {
 	RequireAuth bool
 	Verbose     bool
 
+	// AuthKeys, if non-empty, are auth keys that nodes can use to
+	// register without interactive auth, even if RequireAuth is
+	// set. Registrations with any other non-empty auth key are then
+	// rejected.
+	AuthKeys []string
+
+	// NodeKeyExpiry, if non-zero, is how long after registering
+	// nodes' keys expire.
+	NodeKeyExpiry time.Duration
+
 	// ExplicitBaseURL or HTTPTestServer must be set.
 	ExplicitBaseURL string           // e.g. "http://127.0.0.1:1234" with no trailing URL
 	HTTPTestServer  *httptest.Server // if non-nil, used to get BaseURL
@@ -63,6 +73,7 @@ type Server struct {
 	authPath      map[string]*AuthPath
 	nodeKeyAuthed map[tailcfg.NodeKey]bool // key => true once authenticated
 	pingReqsToAdd map[tailcfg.NodeKey]*tailcfg.PingRequest
+	joined        map[tailcfg.NodeKey]time.Time // when each node first polled for its netmap
 }
 
 // BaseURL returns the server's base URL, without trailing slash.
@@ -90,6 +101,14 @@ func (s *Server) NumNodes() int {
 	return len(s.nodes)
 }
 
+// JoinTime returns when the node with key k first polled for its
+// network map, or the zero time if it hasn't yet.
+func (s *Server) JoinTime(k tailcfg.NodeKey) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.joined[k]
+}
+
 // condLocked lazily initializes and returns s.cond.
 // s.mu must be held.
 func (s *Server) condLocked() *sync.Cond {
@@ -428,8 +447,29 @@ func (s *Server) serveRegister(w http.ResponseWriter, r *http.Request, mkey tail
 		// some follow-ups? For now all are successes.
 	}
 
+	authKeyOK := false
+	if k := req.Auth.AuthKey; k != "" && len(s.AuthKeys) > 0 {
+		for _, valid := range s.AuthKeys {
+			if k == valid {
+				authKeyOK = true
+				break
+			}
+		}
+		if !authKeyOK {
+			s.logf("rejecting register of %v with invalid auth key", req.NodeKey.ShortString())
+			http.Error(w, "invalid auth key", http.StatusUnauthorized)
+			return
+		}
+	}
+
 	user, login := s.getUser(req.NodeKey)
 	s.mu.Lock()
+	if authKeyOK {
+		if s.nodeKeyAuthed == nil {
+			s.nodeKeyAuthed = map[tailcfg.NodeKey]bool{}
+		}
+		s.nodeKeyAuthed[req.NodeKey] = true
+	}
 	if s.nodes == nil {
 		s.nodes = map[tailcfg.NodeKey]*tailcfg.Node{}
 	}
@@ -444,7 +484,7 @@ func (s *Server) serveRegister(w http.ResponseWriter, r *http.Request, mkey tail
 		v6Prefix,
 	}
 
-	s.nodes[req.NodeKey] = &tailcfg.Node{
+	node := &tailcfg.Node{
 		ID:                tailcfg.NodeID(user.ID),
 		StableID:          tailcfg.StableNodeID(fmt.Sprintf("TESTCTRL%08x", int(user.ID))),
 		User:              user.ID,
@@ -454,6 +494,10 @@ func (s *Server) serveRegister(w http.ResponseWriter, r *http.Request, mkey tail
 		Addresses:         allowedIPs,
 		AllowedIPs:        allowedIPs,
 	}
+	if s.NodeKeyExpiry != 0 {
+		node.KeyExpiry = time.Now().Add(s.NodeKeyExpiry)
+	}
+	s.nodes[req.NodeKey] = node
 	requireAuth := s.RequireAuth
 	if requireAuth && s.nodeKeyAuthed[req.NodeKey] {
 		requireAuth = false
@@ -585,6 +629,12 @@ func (s *Server) serveMap(w http.ResponseWriter, r *http.Request, mkey tailcfg.M
 	nodeID := node.ID
 
 	s.mu.Lock()
+	if _, ok := s.joined[req.NodeKey]; !ok {
+		if s.joined == nil {
+			s.joined = map[tailcfg.NodeKey]time.Time{}
+		}
+		s.joined[req.NodeKey] = time.Now()
+	}
 	updatesCh := make(chan updateType, 1)
 	oldUpdatesCh := s.updates[nodeID]
 	if breakSameNodeMapResponseStreams(req) {
@@ -19,6 +19,7 @@ import (
 	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -28,6 +29,7 @@ import (
 	"inet.af/netaddr"
 	"tailscale.com/tstest/integration"
 	"tailscale.com/tstest/integration/testcontrol"
+	"tailscale.com/types/logger"
 )
 
 type Harness struct {
@@ -43,7 +45,30 @@ type Harness struct {
 	ipMap          map[string]ipMapping
 }
 
-func newHarness(t *testing.T) *Harness {
+// HarnessOption configures the tester node made by newHarness.
+type HarnessOption func(*harnessOpts)
+
+type harnessOpts struct {
+	upArgs []string // extra flags for the tester's "tailscale up"
+}
+
+// HarnessWithRoutes makes the tester node advertise the given subnet
+// routes.
+func HarnessWithRoutes(cidrs ...string) HarnessOption {
+	return func(o *harnessOpts) {
+		o.upArgs = append(o.upArgs, "--advertise-routes="+strings.Join(cidrs, ","))
+	}
+}
+
+// HarnessWithExitNode makes the tester node advertise itself as an
+// exit node.
+func HarnessWithExitNode() HarnessOption {
+	return func(o *harnessOpts) {
+		o.upArgs = append(o.upArgs, "--advertise-exit-node")
+	}
+}
+
+func newHarness(t *testing.T, options ...HarnessOption) *Harness {
 	dir := t.TempDir()
 	bindHost := deriveBindhost(t)
 	ln, err := net.Listen("tcp", net.JoinHostPort(bindHost, "0"))
@@ -116,6 +141,13 @@ func newHarness(t *testing.T) *Harness {
 	t.Logf("loginServer: %s", loginServer)
 
 	bins := integration.BuildTestBinaries(t)
+	// The tester's tailscaled runs on the host, so with TS_TEST_ASAN
+	// it's built with AddressSanitizer. The binaries copied into the
+	// VMs are left alone, as guests don't have libasan.
+	testerBins := bins
+	if asan, _ := strconv.ParseBool(os.Getenv("TS_TEST_ASAN")); asan {
+		testerBins = integration.BuildTestBinariesWithASAN(t)
+	}
 
 	h := &Harness{
 		pubKey:         string(pubkey),
@@ -127,7 +159,7 @@ func newHarness(t *testing.T) *Harness {
 		ipMap:          ipMap,
 	}
 
-	h.makeTestNode(t, bins, loginServer)
+	h.makeTestNode(t, testerBins, loginServer, options...)
 
 	return h
 }
@@ -150,7 +182,12 @@ func (h *Harness) Tailscale(t *testing.T, args ...string) []byte {
 // enables us to make connections to and from the tailscale network being
 // tested. This mutates the Harness to allow tests to dial into the tailscale
 // network as well as control the tester's tailscaled.
-func (h *Harness) makeTestNode(t *testing.T, bins *integration.Binaries, controlURL string) {
+func (h *Harness) makeTestNode(t *testing.T, bins *integration.Binaries, controlURL string, options ...HarnessOption) {
+	var opts harnessOpts
+	for _, o := range options {
+		o(&opts)
+	}
+
 	dir := t.TempDir()
 	h.testerDir = dir
 
@@ -172,6 +209,10 @@ func (h *Harness) makeTestNode(t *testing.T, bins *integration.Binaries, control
 		"NOTIFY_SOCKET="+filepath.Join(dir, "notify_socket"),
 		"TS_LOG_TARGET="+h.loginServerURL,
 	)
+	if bins.ASAN {
+		// AddressSanitizer reports go to stderr.
+		cmd.Stderr = logger.FuncWriter(t.Logf)
+	}
 
 	err = cmd.Start()
 	if err != nil {
@@ -180,6 +221,9 @@ func (h *Harness) makeTestNode(t *testing.T, bins *integration.Binaries, control
 
 	t.Cleanup(func() {
 		cmd.Process.Kill()
+		// Wait for the stderr copy to finish, so it doesn't
+		// call t.Logf after the test has ended.
+		cmd.Wait()
 	})
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -203,12 +247,14 @@ outer:
 		}
 	}
 
-	run(t, dir, bins.CLI,
-		"--socket="+filepath.Join(dir, "sock"),
+	upArgs := []string{
+		"--socket=" + filepath.Join(dir, "sock"),
 		"up",
-		"--login-server="+controlURL,
+		"--login-server=" + controlURL,
 		"--hostname=tester",
-	)
+	}
+	upArgs = append(upArgs, opts.upArgs...)
+	run(t, dir, bins.CLI, upArgs...)
 
 	dialer, err := proxy.SOCKS5("tcp", net.JoinHostPort("127.0.0.1", fmt.Sprint(port)), nil, &net.Dialer{})
 	if err != nil {
@@ -0,0 +1,103 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstime
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a source of the current time and of timers, so tests can
+// substitute a FakeClock for the real one.
+type Clock interface {
+	Now() time.Time
+
+	// AfterFunc calls f in its own goroutine once d has elapsed,
+	// like time.AfterFunc.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer returned by Clock.AfterFunc.
+type Timer interface {
+	// Stop prevents the timer from firing. It reports whether it
+	// stopped the timer, rather than it having already fired or
+	// been stopped.
+	Stop() bool
+}
+
+// StdClock is the real Clock, using package time.
+type StdClock struct{}
+
+func (StdClock) Now() time.Time { return time.Now() }
+
+func (StdClock) AfterFunc(d time.Duration, f func()) Timer { return time.AfterFunc(d, f) }
+
+// FakeClock is a Clock whose time only moves when Advance is called.
+// It must be created with NewFakeClock.
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers map[*fakeTimer]bool // pending timers
+}
+
+// NewFakeClock returns a new FakeClock whose time is start.
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{
+		now:    start,
+		timers: map[*fakeTimer]bool{},
+	}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{c: c, when: c.now.Add(d), f: f}
+	if d <= 0 {
+		go f()
+		return t
+	}
+	c.timers[t] = true
+	return t
+}
+
+// Advance moves the clock's time forward by d, firing the timers
+// that are then due.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var due []*fakeTimer
+	for t := range c.timers {
+		if !t.when.After(c.now) {
+			due = append(due, t)
+			delete(c.timers, t)
+		}
+	}
+	c.mu.Unlock()
+	for _, t := range due {
+		go t.f()
+	}
+}
+
+type fakeTimer struct {
+	c    *FakeClock
+	when time.Time
+	f    func()
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	if !t.c.timers[t] {
+		return false
+	}
+	delete(t.c.timers, t)
+	return true
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tstime
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	c := NewFakeClock(start)
+
+	fired := make(chan string, 3)
+	c.AfterFunc(time.Minute, func() { fired <- "minute" })
+	c.AfterFunc(time.Hour, func() { fired <- "hour" })
+	stopped := c.AfterFunc(2*time.Minute, func() { fired <- "stopped" })
+	if !stopped.Stop() {
+		t.Error("Stop of pending timer = false")
+	}
+	if stopped.Stop() {
+		t.Error("second Stop = true")
+	}
+
+	expectFired := func(want string) {
+		t.Helper()
+		select {
+		case got := <-fired:
+			if got != want {
+				t.Fatalf("fired %q; want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %q", want)
+		}
+	}
+	expectNone := func() {
+		t.Helper()
+		select {
+		case got := <-fired:
+			t.Fatalf("unexpectedly fired %q", got)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	expectNone()
+	c.Advance(59 * time.Second)
+	expectNone()
+	c.Advance(time.Second)
+	expectFired("minute")
+	c.Advance(2 * time.Minute)
+	expectNone()
+	c.Advance(time.Hour)
+	expectFired("hour")
+
+	if got, want := c.Now(), start.Add(time.Hour+3*time.Minute); !got.Equal(want) {
+		t.Errorf("Now = %v; want %v", got, want)
+	}
+}
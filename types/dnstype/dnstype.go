@@ -14,7 +14,7 @@ type Resolver struct {
 	// Addr is the address of the DNS resolver, one of:
 	//  - A plain IP address for a "classic" UDP+TCP DNS resolver
 	//  - [TODO] "tls://resolver.com" for DNS over TCP+TLS
-	//  - [TODO] "https://resolver.com/query-tmpl" for DNS over HTTPS
+	//  - "https://resolver.com/query-tmpl" for DNS over HTTPS (RFC 8484)
 	Addr string `json:",omitempty"`
 
 	// BootstrapResolution is an optional suggested resolution for the
@@ -44,3 +44,52 @@ func (p portValue) Set(v string) error {
 	*p.n = uint16(n)
 	return nil
 }
+
+type byteSizeValue struct{ n *int64 }
+
+// ByteSizeValue returns a flag.Value that parses a size in bytes
+// into dst, such as "1024", "64KB", or "10MB". Units are powers of
+// 1024.
+func ByteSizeValue(dst *int64, defaultSize int64) flag.Value {
+	*dst = defaultSize
+	return byteSizeValue{dst}
+}
+
+func (b byteSizeValue) String() string {
+	if b.n == nil {
+		return ""
+	}
+	return fmt.Sprint(*b.n)
+}
+
+func (b byteSizeValue) Set(v string) error {
+	s := strings.ToUpper(strings.TrimSpace(v))
+	mult := int64(1)
+	for _, u := range []struct {
+		suffix string
+		mult   int64
+	}{
+		{"KB", 1 << 10},
+		{"MB", 1 << 20},
+		{"GB", 1 << 30},
+		{"K", 1 << 10},
+		{"M", 1 << 20},
+		{"G", 1 << 30},
+		{"B", 1},
+	} {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSuffix(s, u.suffix)
+			mult = u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", v)
+	}
+	if n > math.MaxInt64/mult {
+		return fmt.Errorf("size %q out of range", v)
+	}
+	*b.n = n * mult
+	return nil
+}
@@ -68,6 +68,7 @@ var disableRateLimit = os.Getenv("TS_DEBUG_LOG_RATE") == "all"
 var rateFree = []string{
 	"magicsock: disco: ",
 	"magicsock: ParseEndpoint:",
+	"wgdev: ", // wireguard-go verbose logs, rate-limited by wglog
 	// grinder stats lines
 	"SetPrefs: %v",
 	"peer keys: %s",
@@ -0,0 +1,56 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package crashpoint lets integration tests kill tailscaled at chosen
+// moments, to check that it recovers from crashes there.
+//
+// Code calls Reached at each interesting moment. If the
+// TS_DEBUG_CRASH_AFTER environment variable names that crash point,
+// the process announces it on stderr and stops there until the test
+// kills it. Otherwise Reached does nothing.
+package crashpoint
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Crash points.
+const (
+	// PersistNodeKey is after control has accepted a new node key
+	// and before it's written to the state store.
+	PersistNodeKey = "persist-node-key"
+
+	// MapResponse is after a map response is received from
+	// control and before it's handled.
+	MapResponse = "map-response"
+)
+
+// ReachedPrefix starts the line written to stderr when the crash
+// point named by TS_DEBUG_CRASH_AFTER is reached. The point's name
+// follows it.
+const ReachedPrefix = "crashpoint: reached "
+
+// maxWait is how long Reached waits to be killed before killing the
+// process itself, so a forgotten TS_DEBUG_CRASH_AFTER can't leave a
+// daemon hung forever.
+const maxWait = time.Minute
+
+var crashAfter = os.Getenv("TS_DEBUG_CRASH_AFTER")
+
+// Reached notes that the process has reached the named crash point.
+// If that's the one named by TS_DEBUG_CRASH_AFTER, it never returns.
+func Reached(name string) {
+	if crashAfter == "" || name != crashAfter {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s%s\n", ReachedPrefix, name)
+	time.Sleep(maxWait)
+	fmt.Fprintf(os.Stderr, "crashpoint: not killed after %v; killing self\n", maxWait)
+	if p, err := os.FindProcess(os.Getpid()); err == nil {
+		p.Kill()
+	}
+	os.Exit(1)
+}
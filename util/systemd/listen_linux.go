@@ -0,0 +1,65 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd
+// socket activation. See sd_listen_fds(3).
+const listenFDsStart = 3
+
+// Listeners returns the listening sockets passed to this process by
+// systemd socket activation, in the order they were configured. It
+// returns nil and no error if the process wasn't socket activated.
+//
+// The LISTEN_* environment variables are unset, so child processes
+// don't also think they were socket activated. Listeners should
+// therefore be called at most once.
+func Listeners() ([]net.Listener, error) {
+	return listenersFromEnv(os.Getpid())
+}
+
+func listenersFromEnv(pid int) ([]net.Listener, error) {
+	pidStr, fdsStr := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if pidStr == "" {
+		return nil, nil
+	}
+	if p, err := strconv.Atoi(pidStr); err != nil || p != pid {
+		// Meant for some other process, such as a parent that
+		// didn't unset it.
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fdsStr)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("systemd: invalid LISTEN_FDS %q", fdsStr)
+	}
+	var lns []net.Listener
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), "systemd-listen-fd-"+strconv.Itoa(fd))
+		ln, err := net.FileListener(f)
+		f.Close() // FileListener dups the fd
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, fmt.Errorf("systemd: socket activation fd %d: %w", fd, err)
+		}
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package systemd
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestListenersNotActivated(t *testing.T) {
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	lns, err := Listeners()
+	if err != nil || lns != nil {
+		t.Fatalf("Listeners = %v, %v; want nil, nil", lns, err)
+	}
+}
+
+func TestListenersOtherPID(t *testing.T) {
+	os.Setenv("LISTEN_PID", fmt.Sprint(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+	lns, err := Listeners()
+	if err != nil || lns != nil {
+		t.Fatalf("Listeners = %v, %v; want nil, nil", lns, err)
+	}
+	if v, ok := os.LookupEnv("LISTEN_FDS"); ok {
+		t.Errorf("LISTEN_FDS still set to %q", v)
+	}
+}
+
+// TestListenersActivated plays the part of systemd: it passes a unix
+// listener to a child process (this test binary) using the socket
+// activation protocol, with a connection already queued on it.
+func TestListenersActivated(t *testing.T) {
+	if os.Getenv("TS_TEST_SOCKET_ACTIVATION_CHILD") == "1" {
+		socketActivationChild()
+		return
+	}
+
+	sock := filepath.Join(t.TempDir(), "activated.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	lf, err := ln.(*net.UnixListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lf.Close()
+
+	// Connect before the child starts, like a CLI that triggered
+	// the activation.
+	c, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := fmt.Fprintf(c, "ping\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	// LISTEN_PID must be the child's pid, which isn't known until
+	// it starts, so set it from a shell that then execs the child.
+	cmd := exec.Command("/bin/sh", "-c", `LISTEN_PID=$$ exec "$0" -test.run=^TestListenersActivated$`, os.Args[0])
+	cmd.Env = append(os.Environ(), "TS_TEST_SOCKET_ACTIVATION_CHILD=1", "LISTEN_FDS=1")
+	cmd.ExtraFiles = []*os.File{lf} // fd 3
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("child: %v; output: %s", err, out)
+	}
+	if !strings.Contains(string(out), "child ok") {
+		t.Errorf("child output = %q", out)
+	}
+
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "pong\n" {
+		t.Errorf("got %q; want pong", line)
+	}
+}
+
+func socketActivationChild() {
+	fail := func(format string, args ...interface{}) {
+		fmt.Fprintf(os.Stderr, "child: "+format+"\n", args...)
+		os.Exit(1)
+	}
+	lns, err := Listeners()
+	if err != nil {
+		fail("Listeners: %v", err)
+	}
+	if len(lns) != 1 {
+		fail("got %d listeners; want 1", len(lns))
+	}
+	if _, ok := os.LookupEnv("LISTEN_PID"); ok {
+		fail("LISTEN_PID not unset")
+	}
+	c, err := lns[0].Accept()
+	if err != nil {
+		fail("Accept: %v", err)
+	}
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil || line != "ping\n" {
+		fail("read %q, %v", line, err)
+	}
+	fmt.Fprintf(c, "pong\n")
+	c.Close()
+	fmt.Println("child ok")
+}
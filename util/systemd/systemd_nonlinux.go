@@ -7,5 +7,8 @@
 
 package systemd
 
-func Ready()                        {}
-func Status(string, ...interface{}) {}
+import "net"
+
+func Ready()                             {}
+func Status(string, ...interface{})      {}
+func Listeners() ([]net.Listener, error) { return nil, nil }
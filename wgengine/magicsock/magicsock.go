@@ -37,7 +37,6 @@ import (
 	"tailscale.com/disco"
 	"tailscale.com/health"
 	"tailscale.com/ipn/ipnstate"
-	"tailscale.com/logtail/backoff"
 	"tailscale.com/net/dnscache"
 	"tailscale.com/net/interfaces"
 	"tailscale.com/net/netcheck"
@@ -96,6 +95,8 @@ type Conn struct {
 	connCtxCancel func()          // closes connCtx
 	donec         <-chan struct{} // connCtx.Done()'s to avoid context.cancelCtx.Done()'s mutex per call
 
+	pathHist pathHistory // per-peer path changes and latency samples; has its own mutex
+
 	// pconn4 and pconn6 are the underlying UDP sockets used to
 	// send/receive packets for wireguard and other magicsock
 	// protocols.
@@ -1395,7 +1396,7 @@ func (c *Conn) runDerpReader(ctx context.Context, derpFakeAddr netaddr.IPPort, d
 	// peerPresent is the set of senders we know are present on this
 	// connection, based on messages we've received from the server.
 	peerPresent := map[key.Public]bool{}
-	bo := backoff.NewBackoff(fmt.Sprintf("derp-%d", regionID), c.logf, 5*time.Second)
+	var bo derpReconnectBackoff
 	var lastPacketTime time.Time
 
 	for {
@@ -1426,18 +1427,23 @@ func (c *Conn) runDerpReader(ctx context.Context, derpFakeAddr netaddr.IPPort, d
 			// conditions changed. Start that check.
 			c.ReSTUN("derp-recv-error")
 
-			// Back off a bit before reconnecting.
-			bo.BackOff(ctx, err)
+			// Back off before reconnecting, so that clients
+			// don't all reconnect at once when a region's
+			// server restarts.
+			d := bo.next(time.Now())
+			c.logf("[v1] magicsock: derp-%d: reconnecting in %v", regionID, d.Round(time.Millisecond))
+			t := time.NewTimer(d)
 			select {
 			case <-ctx.Done():
+				t.Stop()
 				return
-			default:
+			case <-t.C:
 			}
 			continue
 		}
-		bo.BackOff(ctx, nil) // reset
 
 		now := time.Now()
+		bo.noteUp(now)
 		if lastPacketTime.IsZero() || now.Sub(lastPacketTime) > 5*time.Second {
 			health.NoteDERPRegionReceivedFrame(regionID)
 			lastPacketTime = now
@@ -1490,6 +1496,49 @@ func (c *Conn) runDerpReader(ctx context.Context, derpFakeAddr netaddr.IPPort, d
 	}
 }
 
+const (
+	// derpBackoffMin and derpBackoffMax bound the delay before
+	// reconnecting to a DERP region after its connection fails.
+	derpBackoffMin = 1 * time.Second
+	derpBackoffMax = 60 * time.Second
+
+	// derpBackoffResetAfter is how long a DERP connection must
+	// have worked for its reconnect backoff to start over.
+	derpBackoffResetAfter = 60 * time.Second
+)
+
+// derpReconnectBackoff is the exponential reconnect backoff for a
+// DERP region's connection.
+type derpReconnectBackoff struct {
+	n       int       // failures since the backoff was reset
+	upSince time.Time // when the connection last started working; zero if it's not
+}
+
+// noteUp notes that the connection worked at now.
+func (b *derpReconnectBackoff) noteUp(now time.Time) {
+	if b.upSince.IsZero() {
+		b.upSince = now
+	}
+}
+
+// next notes a connection failure at now and returns how long to wait
+// before reconnecting: derpBackoffMin, doubling on each consecutive
+// failure up to derpBackoffMax, with ±25% jitter.
+func (b *derpReconnectBackoff) next(now time.Time) time.Duration {
+	if !b.upSince.IsZero() && now.Sub(b.upSince) > derpBackoffResetAfter {
+		b.n = 0
+	}
+	b.upSince = time.Time{}
+
+	d := derpBackoffMax
+	if b.n < 30 && derpBackoffMin<<b.n < derpBackoffMax {
+		d = derpBackoffMin << b.n
+	}
+	b.n++
+	jitter := int64(d / 4)
+	return d + time.Duration(rand.Int63n(2*jitter+1)-jitter)
+}
+
 type derpWriteRequest struct {
 	addr   netaddr.IPPort
 	pubKey key.Public
@@ -2076,6 +2125,17 @@ func (c *Conn) SetNetworkUp(up bool) {
 	}
 }
 
+// NoteLinkChange tells the active DERP clients that the network
+// changed in a major way, so they redial their DERP servers, trusting
+// their static IPs again or resolving their hostnames again.
+func (c *Conn) NoteLinkChange() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, ad := range c.activeDerp {
+		ad.c.NoteNetworkChange()
+	}
+}
+
 // SetPreferredPort sets the connection's preferred local port.
 func (c *Conn) SetPreferredPort(port uint16) {
 	if uint16(c.port.Get()) == port {
@@ -2165,6 +2225,14 @@ func (c *Conn) UpdatePeers(newPeers map[key.Public]struct{}) {
 	}
 }
 
+// DERPMap returns the DERP map set by SetDERPMap, or nil if DERP is
+// disabled. It must not be modified.
+func (c *Conn) DERPMap() *tailcfg.DERPMap {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.derpMap
+}
+
 // SetDERPMap controls which (if any) DERP servers are used.
 // A nil value means to disable DERP; it's disabled by default.
 func (c *Conn) SetDERPMap(dm *tailcfg.DERPMap) {
@@ -2309,6 +2377,19 @@ func (c *Conn) logEndpointChange(endpoints []tailcfg.Endpoint) {
 	}))
 }
 
+// DERPLatencies returns the measured round-trip latency to each DERP
+// region with an active connection, keyed by region ID. Regions
+// without a completed measurement have a zero latency.
+func (c *Conn) DERPLatencies() map[int]time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ret := make(map[int]time.Duration, len(c.activeDerp))
+	for regionID, ad := range c.activeDerp {
+		ret[regionID] = ad.c.Latency()
+	}
+	return ret
+}
+
 // c.mu must be held.
 func (c *Conn) foreachActiveDerpSortedLocked(fn func(regionID int, ad activeDerp)) {
 	if len(c.activeDerp) < 2 {
@@ -3153,6 +3234,9 @@ type discoEndpoint struct {
 	isCallMeMaybeEP    map[netaddr.IPPort]bool
 
 	pendingCLIPings []pendingCLIPing // any outstanding "tailscale ping" commands running
+
+	onlyDERP      bool      // last recorded path was DERP only; see Conn.pathHist
+	lastRTTSample mono.Time // last time a latency sample was recorded in Conn.pathHist
 }
 
 type pendingCLIPing struct {
@@ -3324,6 +3408,10 @@ func (de *discoEndpoint) addrForSendLocked(now mono.Time) (udpAddr, derpAddr net
 		// and DERP.
 		derpAddr = de.derpAddr
 	}
+	if udpAddr.IsZero() && !derpAddr.IsZero() && !de.onlyDERP {
+		de.onlyDERP = true
+		de.c.pathHist.add(de.publicKey, ipnstate.PathEvent{Kind: pathEventDERP})
+	}
 	return
 }
 
@@ -3700,12 +3788,27 @@ func (de *discoEndpoint) handlePongConnLocked(m *disco.Pong, src netaddr.IPPort)
 	}
 	de.pendingCLIPings = nil
 
+	if de.lastRTTSample.IsZero() || now.Sub(de.lastRTTSample) >= rttSampleInterval {
+		de.lastRTTSample = now
+		ev := ipnstate.PathEvent{Kind: pathEventRTT, LatencySeconds: latency.Seconds()}
+		if !isDerp {
+			ev.Endpoint = sp.to.String()
+		}
+		de.c.pathHist.add(de.publicKey, ev)
+	}
+
 	// Promote this pong response to our current best address if it's lower latency.
 	// TODO(bradfitz): decide how latency vs. preference order affects decision
 	if !isDerp {
 		thisPong := addrLatency{sp.to, latency}
 		if betterAddr(thisPong, de.bestAddr) {
 			de.c.logf("magicsock: disco: node %v %v now using %v", de.publicKey.ShortString(), de.discoShort, sp.to)
+			kind := pathEventEndpointChanged
+			if de.bestAddr.IsZero() {
+				kind = pathEventDirect
+			}
+			de.c.pathHist.add(de.publicKey, ipnstate.PathEvent{Kind: kind, Endpoint: sp.to.String()})
+			de.onlyDERP = false
 			de.bestAddr = thisPong
 		}
 		if de.bestAddr.IPPort == thisPong.IPPort {
@@ -1688,3 +1688,108 @@ func epStrings(eps []tailcfg.Endpoint) (ret []string) {
 	}
 	return
 }
+
+func TestDERPReconnectBackoff(t *testing.T) {
+	var b derpReconnectBackoff
+	now := time.Now()
+	within := func(d, want time.Duration) bool {
+		return d >= want*3/4 && d <= want*5/4
+	}
+	for i, want := range []time.Duration{1, 2, 4, 8, 16, 32, 60, 60} {
+		want *= time.Second
+		if d := b.next(now); !within(d, want) {
+			t.Errorf("failure %d: backoff %v; want %v ±25%%", i+1, d, want)
+		}
+	}
+
+	// A connection that's only briefly up doesn't reset the backoff.
+	b.noteUp(now)
+	now = now.Add(derpBackoffResetAfter / 2)
+	if d := b.next(now); !within(d, derpBackoffMax) {
+		t.Errorf("after brief connection: backoff %v; want %v ±25%%", d, derpBackoffMax)
+	}
+
+	// But one that's up long enough does.
+	b.noteUp(now)
+	now = now.Add(derpBackoffResetAfter + time.Second)
+	if d := b.next(now); !within(d, derpBackoffMin) {
+		t.Errorf("after healthy connection: backoff %v; want %v ±25%%", d, derpBackoffMin)
+	}
+}
+
+// TestDERPReconnectAfterRestart tests that magicsock reconnects to a
+// DERP server that drops all its connections, as on restart, within
+// two reconnect backoff cycles.
+func TestDERPReconnectAfterRestart(t *testing.T) {
+	tstest.PanicOnLog()
+	tstest.ResourceCheck(t)
+
+	var serverPrivateKey key.Private
+	if _, err := crand.Read(serverPrivateKey[:]); err != nil {
+		t.Fatal(err)
+	}
+	d := derp.NewServer(serverPrivateKey, t.Logf)
+	defer d.Close()
+
+	httpsrv := httptest.NewUnstartedServer(derphttp.Handler(d))
+	httpsrv.Config.ErrorLog = logger.StdLogger(t.Logf)
+	httpsrv.Config.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	httpsrv.StartTLS()
+	defer httpsrv.Close()
+
+	stunAddr, stunCleanup := stuntest.ServeWithPacketListener(t, nettype.Std{})
+	defer stunCleanup()
+
+	derpMap := &tailcfg.DERPMap{
+		Regions: map[int]*tailcfg.DERPRegion{
+			1: {
+				RegionID:   1,
+				RegionCode: "test",
+				Nodes: []*tailcfg.DERPNode{
+					{
+						Name:             "t1",
+						RegionID:         1,
+						HostName:         "test-node.unused",
+						IPv4:             "127.0.0.1",
+						IPv6:             "none",
+						STUNPort:         stunAddr.Port,
+						DERPPort:         httpsrv.Listener.Addr().(*net.TCPAddr).Port,
+						InsecureForTests: true,
+						STUNTestIP:       "127.0.0.1",
+					},
+				},
+			},
+		},
+	}
+
+	connected := make(chan bool, 10)
+	logf := func(format string, args ...interface{}) {
+		if strings.HasPrefix(format, "magicsock: derp-%d connected") {
+			connected <- true
+		}
+		t.Logf(format, args...)
+	}
+
+	ms := newMagicStack(t, logf, nettype.Std{}, derpMap, true)
+	defer ms.Close()
+
+	select {
+	case <-connected:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for initial DERP connection")
+	}
+
+	// Simulate a server restart.
+	httpsrv.CloseClientConnections()
+
+	// The first reconnect attempt may race with the server
+	// closing the connection, so allow a second backoff cycle.
+	limit := (derpBackoffMin + 2*derpBackoffMin) * 5 / 4
+	start := time.Now()
+	select {
+	case <-connected:
+		t.Logf("reconnected after %v", time.Since(start).Round(time.Millisecond))
+	case <-time.After(limit + 2*time.Second):
+		t.Fatalf("didn't reconnect to DERP within two backoff cycles (%v)", limit)
+	}
+}
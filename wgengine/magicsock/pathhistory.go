@@ -0,0 +1,120 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+)
+
+const (
+	// maxPathEventsPerPeer is how many path events are kept for
+	// each peer. Older events are discarded.
+	maxPathEventsPerPeer = 128
+
+	// maxPathHistoryPeers is how many peers' path histories are
+	// kept. The least recently updated peer's is discarded.
+	maxPathHistoryPeers = 256
+
+	// rttSampleInterval is the minimum time between recorded
+	// latency samples for a peer.
+	rttSampleInterval = 30 * time.Second
+)
+
+// Path event kinds. See ipnstate.PathEvent.
+const (
+	pathEventDirect          = "direct"
+	pathEventEndpointChanged = "endpoint-changed"
+	pathEventDERP            = "derp"
+	pathEventRTT             = "rtt"
+)
+
+// pathHistory is a bounded per-peer history of path changes and
+// latency samples, for answering questions about past connectivity.
+//
+// The zero value is ready for use.
+type pathHistory struct {
+	mu    sync.Mutex
+	peers map[tailcfg.NodeKey]*list.Element // values are *peerPathHistory
+	lru   list.List                         // most recently updated first
+	now   func() time.Time                  // or nil for time.Now
+}
+
+// peerPathHistory is a ring buffer of a peer's path events.
+type peerPathHistory struct {
+	peer   tailcfg.NodeKey
+	events [maxPathEventsPerPeer]ipnstate.PathEvent
+	next   int // index in events to write next
+	n      int // number of valid events
+}
+
+// add records ev for peer, setting its time to now.
+func (h *pathHistory) add(peer tailcfg.NodeKey, ev ipnstate.PathEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.now != nil {
+		ev.Time = h.now()
+	} else {
+		ev.Time = time.Now()
+	}
+	if h.peers == nil {
+		h.peers = map[tailcfg.NodeKey]*list.Element{}
+	}
+
+	var ph *peerPathHistory
+	if e, ok := h.peers[peer]; ok {
+		h.lru.MoveToFront(e)
+		ph = e.Value.(*peerPathHistory)
+	} else {
+		if h.lru.Len() >= maxPathHistoryPeers {
+			oldest := h.lru.Back()
+			h.lru.Remove(oldest)
+			delete(h.peers, oldest.Value.(*peerPathHistory).peer)
+		}
+		ph = &peerPathHistory{peer: peer}
+		h.peers[peer] = h.lru.PushFront(ph)
+	}
+
+	ph.events[ph.next] = ev
+	ph.next = (ph.next + 1) % len(ph.events)
+	if ph.n < len(ph.events) {
+		ph.n++
+	}
+}
+
+// snapshot returns a copy of all peers' path histories, most
+// recently updated peer first.
+func (h *pathHistory) snapshot() []ipnstate.PeerPathHistory {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ret := make([]ipnstate.PeerPathHistory, 0, h.lru.Len())
+	for e := h.lru.Front(); e != nil; e = e.Next() {
+		ph := e.Value.(*peerPathHistory)
+		evs := make([]ipnstate.PathEvent, 0, ph.n)
+		start := ph.next - ph.n
+		if start < 0 {
+			start += len(ph.events)
+		}
+		for i := 0; i < ph.n; i++ {
+			evs = append(evs, ph.events[(start+i)%len(ph.events)])
+		}
+		ret = append(ret, ipnstate.PeerPathHistory{
+			PublicKey: ph.peer,
+			Events:    evs,
+		})
+	}
+	return ret
+}
+
+// PathHistory returns the recent history of path changes and latency
+// samples for the peers that have had any, most recently updated
+// first.
+func (c *Conn) PathHistory() []ipnstate.PeerPathHistory {
+	return c.pathHist.snapshot()
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/disco"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/stun"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstime/mono"
+)
+
+func TestPathHistoryRing(t *testing.T) {
+	var h pathHistory
+	peer := tailcfg.NodeKey{1}
+	for i := 0; i < maxPathEventsPerPeer+72; i++ {
+		h.add(peer, ipnstate.PathEvent{Kind: pathEventRTT, LatencySeconds: float64(i)})
+	}
+	got := h.snapshot()
+	if len(got) != 1 {
+		t.Fatalf("got %d peers; want 1", len(got))
+	}
+	evs := got[0].Events
+	if len(evs) != maxPathEventsPerPeer {
+		t.Fatalf("got %d events; want %d", len(evs), maxPathEventsPerPeer)
+	}
+	for i, ev := range evs {
+		if want := float64(72 + i); ev.LatencySeconds != want {
+			t.Fatalf("event %d = %v; want %v", i, ev.LatencySeconds, want)
+		}
+	}
+}
+
+func TestPathHistoryLRU(t *testing.T) {
+	var h pathHistory
+	for i := 0; i < maxPathHistoryPeers; i++ {
+		h.add(tailcfg.NodeKey{byte(i), byte(i >> 8)}, ipnstate.PathEvent{Kind: pathEventDERP})
+	}
+	// Touch the oldest peer so the second oldest is evicted instead.
+	h.add(tailcfg.NodeKey{0, 0}, ipnstate.PathEvent{Kind: pathEventDERP})
+	h.add(tailcfg.NodeKey{0xff, 0xff}, ipnstate.PathEvent{Kind: pathEventDERP})
+
+	got := h.snapshot()
+	if len(got) != maxPathHistoryPeers {
+		t.Fatalf("got %d peers; want %d", len(got), maxPathHistoryPeers)
+	}
+	peers := map[tailcfg.NodeKey]bool{}
+	for _, ph := range got {
+		peers[ph.PublicKey] = true
+	}
+	if !peers[tailcfg.NodeKey{0, 0}] {
+		t.Errorf("recently updated peer was evicted")
+	}
+	if peers[tailcfg.NodeKey{1, 0}] {
+		t.Errorf("least recently updated peer wasn't evicted")
+	}
+	if got[0].PublicKey != (tailcfg.NodeKey{0xff, 0xff}) {
+		t.Errorf("most recent peer = %v; want first", got[0].PublicKey)
+	}
+}
+
+// TestPathHistoryFlap tests that a peer's path history records it
+// flapping between DERP and direct paths.
+func TestPathHistoryFlap(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+
+	ep1 := netaddr.MustParseIPPort("1.2.3.4:41641")
+	ep2 := netaddr.MustParseIPPort("5.6.7.8:41641")
+	de := &discoEndpoint{
+		c:         c,
+		publicKey: tailcfg.NodeKey{1},
+		discoKey:  tailcfg.DiscoKey{2},
+		derpAddr:  netaddr.IPPortFrom(derpMagicIPAddr, 1),
+		sentPing:  map[stun.TxID]sentPing{},
+		endpointState: map[netaddr.IPPort]*endpointState{
+			ep1: {},
+			ep2: {},
+		},
+	}
+	pong := func(ep netaddr.IPPort, latency time.Duration) {
+		t.Helper()
+		txid := stun.NewTxID()
+		de.sentPing[txid] = sentPing{
+			to:      ep,
+			at:      mono.Now().Add(-latency),
+			timer:   time.NewTimer(time.Hour),
+			purpose: pingDiscovery,
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		de.handlePongConnLocked(&disco.Pong{TxID: [12]byte(txid), Src: ep}, ep)
+	}
+
+	de.addrForSendLocked(mono.Now()) // no direct path yet
+	pong(ep1, 50*time.Millisecond)   // direct path found
+	pong(ep2, 5*time.Millisecond)    // better direct path found
+	de.deleteEndpointLocked(ep2)     // direct path lost
+	de.addrForSendLocked(mono.Now())
+	pong(ep1, 50*time.Millisecond) // direct path found again
+
+	var kinds []string
+	for _, ph := range c.PathHistory() {
+		for _, ev := range ph.Events {
+			if ev.Kind == pathEventRTT && ev.LatencySeconds == 0 {
+				t.Errorf("rtt event without latency")
+			}
+			kinds = append(kinds, ev.Kind+" "+ev.Endpoint)
+		}
+	}
+	want := []string{
+		"derp ",
+		"rtt " + ep1.String(),
+		"direct " + ep1.String(),
+		"endpoint-changed " + ep2.String(),
+		"derp ",
+		"direct " + ep1.String(),
+	}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Errorf("events = %q; want %q", kinds, want)
+	}
+}
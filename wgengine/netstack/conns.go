@@ -0,0 +1,172 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netstack
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn/ipnstate"
+)
+
+// maxClosedConns is how many finished flows the conn table keeps.
+const maxClosedConns = 100
+
+// conn is a TCP or UDP flow being forwarded by netstack.
+//
+// Its byte counts are added to atomically by the goroutines copying
+// its data, so the copy loops never look anything up; the conn
+// table itself is only touched when a flow starts, changes state,
+// or ends. Readers sample the counts when they take a snapshot.
+type conn struct {
+	// txBytes and rxBytes are accessed atomically and are first
+	// for 64-bit alignment on 32-bit platforms.
+	txBytes int64 // from src, sent on to dst
+	rxBytes int64 // from dst, sent back to src
+
+	proto   string // "tcp" or "udp"
+	src     netaddr.IPPort
+	dst     netaddr.IPPort
+	started time.Time
+
+	// Guarded by connTable.mu.
+	state string
+	ended time.Time
+}
+
+// connTable tracks the flows netstack is forwarding, and a ring
+// buffer of the last maxClosedConns that finished.
+//
+// The zero value is ready for use.
+type connTable struct {
+	now func() time.Time // or nil for time.Now
+
+	mu     sync.Mutex
+	active map[*conn]bool
+	closed [maxClosedConns]ipnstate.NetstackConn
+	next   int // index in closed to write next
+	n      int // number of valid entries in closed
+}
+
+func (t *connTable) timeNow() time.Time {
+	if t.now != nil {
+		return t.now()
+	}
+	return time.Now()
+}
+
+// add starts tracking a new flow from src to dst in the given state.
+func (t *connTable) add(proto string, src, dst netaddr.IPPort, state string) *conn {
+	c := &conn{
+		proto:   proto,
+		src:     src,
+		dst:     dst,
+		started: t.timeNow(),
+		state:   state,
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.active == nil {
+		t.active = map[*conn]bool{}
+	}
+	t.active[c] = true
+	return c
+}
+
+// setState sets the state of the active flow c.
+func (t *connTable) setState(c *conn, state string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c.state = state
+}
+
+// remove stops tracking c, recording it in the closed history with
+// its final state.
+func (t *connTable) remove(c *conn, state string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.active[c] {
+		return
+	}
+	delete(t.active, c)
+	c.state = state
+	c.ended = t.timeNow()
+	t.closed[t.next] = t.statusLocked(c, c.ended)
+	t.next = (t.next + 1) % len(t.closed)
+	if t.n < len(t.closed) {
+		t.n++
+	}
+}
+
+// statusLocked returns the state of c as of now.
+// t.mu must be held.
+func (t *connTable) statusLocked(c *conn, now time.Time) ipnstate.NetstackConn {
+	end := now
+	if !c.ended.IsZero() {
+		end = c.ended
+	}
+	return ipnstate.NetstackConn{
+		Proto:      c.proto,
+		Src:        c.src,
+		Dst:        c.dst,
+		State:      c.state,
+		Started:    c.started,
+		Ended:      c.ended,
+		AgeSeconds: end.Sub(c.started).Seconds(),
+		TxBytes:    atomic.LoadInt64(&c.txBytes),
+		RxBytes:    atomic.LoadInt64(&c.rxBytes),
+	}
+}
+
+// snapshot returns the active flows, oldest first, and, if
+// withHistory, the closed ones too.
+func (t *connTable) snapshot(withHistory bool) *ipnstate.NetstackConns {
+	now := t.timeNow()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ret := &ipnstate.NetstackConns{
+		Active: make([]ipnstate.NetstackConn, 0, len(t.active)),
+	}
+	for c := range t.active {
+		ret.Active = append(ret.Active, t.statusLocked(c, now))
+	}
+	sort.Slice(ret.Active, func(i, j int) bool {
+		return ret.Active[i].Started.Before(ret.Active[j].Started)
+	})
+	if withHistory {
+		ret.Closed = make([]ipnstate.NetstackConn, 0, t.n)
+		start := t.next - t.n
+		if start < 0 {
+			start += len(t.closed)
+		}
+		for i := 0; i < t.n; i++ {
+			ret.Closed = append(ret.Closed, t.closed[(start+i)%len(t.closed)])
+		}
+	}
+	return ret
+}
+
+// countingWriter is an io.Writer that atomically adds the number of
+// bytes written through it to *n.
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (cw countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	atomic.AddInt64(cw.n, int64(n))
+	return n, err
+}
+
+// Conns returns the TCP and UDP flows netstack is forwarding and,
+// if withHistory, the last flows to have finished.
+func (ns *Impl) Conns(withHistory bool) *ipnstate.NetstackConns {
+	return ns.conns.snapshot(withHistory)
+}
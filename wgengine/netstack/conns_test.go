@@ -0,0 +1,94 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netstack
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+)
+
+func TestConnTable(t *testing.T) {
+	now := time.Unix(1000, 0)
+	ct := &connTable{now: func() time.Time { return now }}
+	src := netaddr.MustParseIPPort("100.101.102.103:4567")
+	dst1 := netaddr.MustParseIPPort("10.0.0.1:22")
+	dst2 := netaddr.MustParseIPPort("10.0.0.2:53")
+
+	c1 := ct.add("tcp", src, dst1, "dialing")
+	now = now.Add(time.Second)
+	c2 := ct.add("udp", src, dst2, "established")
+	ct.setState(c1, "established")
+
+	var buf bytes.Buffer
+	w := countingWriter{&buf, &c1.txBytes}
+	fmt.Fprintf(w, "hello")
+	w.Write([]byte(", world"))
+	if got := buf.String(); got != "hello, world" {
+		t.Errorf("countingWriter wrote %q", got)
+	}
+
+	now = now.Add(time.Second)
+	st := ct.snapshot(true)
+	if len(st.Active) != 2 || len(st.Closed) != 0 {
+		t.Fatalf("got %d active, %d closed; want 2, 0", len(st.Active), len(st.Closed))
+	}
+	a := st.Active[0]
+	if a.Proto != "tcp" || a.Src != src || a.Dst != dst1 || a.State != "established" {
+		t.Errorf("first active conn = %+v", a)
+	}
+	if a.TxBytes != 12 || a.RxBytes != 0 {
+		t.Errorf("first active conn bytes = %d tx, %d rx; want 12, 0", a.TxBytes, a.RxBytes)
+	}
+	if a.AgeSeconds != 2 || !a.Ended.IsZero() {
+		t.Errorf("first active conn age = %v, ended = %v; want 2, zero", a.AgeSeconds, a.Ended)
+	}
+	if st.Active[1].Proto != "udp" {
+		t.Errorf("second active conn = %+v; want the udp one", st.Active[1])
+	}
+
+	now = now.Add(time.Second)
+	ct.remove(c2, "closed")
+	ct.remove(c2, "closed") // no-op
+	now = now.Add(time.Minute)
+
+	st = ct.snapshot(false)
+	if len(st.Active) != 1 || st.Closed != nil {
+		t.Fatalf("without history: got %d active, %v closed; want 1, nil", len(st.Active), st.Closed)
+	}
+	st = ct.snapshot(true)
+	if len(st.Closed) != 1 {
+		t.Fatalf("got %d closed; want 1", len(st.Closed))
+	}
+	if c := st.Closed[0]; c.Dst != dst2 || c.State != "closed" || c.AgeSeconds != 2 || c.Ended.IsZero() {
+		t.Errorf("closed conn = %+v", c)
+	}
+}
+
+func TestConnTableHistoryWraps(t *testing.T) {
+	ct := new(connTable)
+	src := netaddr.MustParseIPPort("100.101.102.103:4567")
+	const n = maxClosedConns + 10
+	for i := 0; i < n; i++ {
+		dst := netaddr.IPPortFrom(netaddr.IPv4(10, 0, 0, 1), uint16(i))
+		ct.remove(ct.add("tcp", src, dst, "dialing"), "closed")
+	}
+	st := ct.snapshot(true)
+	if len(st.Active) != 0 {
+		t.Errorf("got %d active; want 0", len(st.Active))
+	}
+	if len(st.Closed) != maxClosedConns {
+		t.Fatalf("got %d closed; want %d", len(st.Closed), maxClosedConns)
+	}
+	if got, want := st.Closed[0].Dst.Port(), uint16(n-maxClosedConns); got != want {
+		t.Errorf("oldest closed port = %d; want %d", got, want)
+	}
+	if got, want := st.Closed[len(st.Closed)-1].Dst.Port(), uint16(n-1); got != want {
+		t.Errorf("newest closed port = %d; want %d", got, want)
+	}
+}
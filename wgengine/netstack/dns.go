@@ -0,0 +1,292 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netstack
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"inet.af/netaddr"
+	"inet.af/netstack/tcpip/adapters/gonet"
+	"tailscale.com/util/dnsname"
+)
+
+const (
+	// dnsIdleTimeout is how long a hijacked DNS flow is kept
+	// open without any queries.
+	dnsIdleTimeout = 30 * time.Second
+
+	// dnsForwardTimeout is how long to wait for an upstream
+	// resolver to answer a forwarded query.
+	dnsForwardTimeout = 5 * time.Second
+
+	// maxDNSPacketSize is the largest DNS response read from an
+	// upstream resolver.
+	maxDNSPacketSize = 4096
+
+	// magicDNSTTL is the TTL of answers for MagicDNS names.
+	magicDNSTTL = 600
+
+	// maxDNSQueriesInFlight is how many queries from one flow are
+	// answered at once. More are dropped, for the client to retry.
+	maxDNSQueriesInFlight = 64
+)
+
+// serveDNS answers the DNS queries from clientAddr to dstAddr:53 on
+// client. Queries for MagicDNS names are answered from ns.dns; all
+// others are forwarded to dstAddr, or to localhost if dstAddr is one
+// of this node's Tailscale IPs, as forwardUDP would.
+//
+// It's used instead of forwardUDP in userspace-networking mode, where
+// there's no OS resolver configuration for MagicDNS to hook into.
+// Each query is answered in its own goroutine, so one slow upstream
+// doesn't hold up the flow's other queries.
+func (ns *Impl) serveDNS(client *gonet.UDPConn, clientAddr, dstAddr netaddr.IPPort) {
+	defer client.Close()
+	isLocal := ns.isLocalIP(dstAddr.IP())
+	if !isLocal {
+		defer ns.removeSubnetAddress(dstAddr.IP())
+	}
+	upstream := dstAddr.UDPAddr()
+	if isLocal {
+		upstream = &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: int(dstAddr.Port())}
+	}
+	fc := ns.conns.add("udp", clientAddr, dstAddr, "dns")
+	defer ns.conns.remove(fc, "closed")
+
+	var wg sync.WaitGroup
+	defer wg.Wait() // before closing client
+	sem := make(chan struct{}, maxDNSQueriesInFlight)
+	buf := make([]byte, maxDNSPacketSize)
+	for {
+		client.SetReadDeadline(time.Now().Add(dnsIdleTimeout))
+		n, _, err := client.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		atomic.AddInt64(&fc.txBytes, int64(n))
+		select {
+		case sem <- struct{}{}:
+		default:
+			ns.logf("[v1] netstack: dropping DNS query from %v with %d in flight", clientAddr, maxDNSQueriesInFlight)
+			continue
+		}
+		query := append([]byte(nil), buf[:n]...)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			resp, err := ns.answerDNS(upstream, query)
+			if err != nil {
+				ns.logf("[v1] netstack: forwarding DNS query from %v to %v: %v", clientAddr, upstream, err)
+				return
+			}
+			if _, err := client.WriteTo(resp, clientAddr.UDPAddr()); err != nil {
+				ns.logf("[v1] netstack: writing DNS response to %v: %v", clientAddr, err)
+				return
+			}
+			atomic.AddInt64(&fc.rxBytes, int64(len(resp)))
+		}()
+	}
+}
+
+// answerDNS returns the response to query, from ns.dns if it's for a
+// MagicDNS name, or else from upstream.
+func (ns *Impl) answerDNS(upstream *net.UDPAddr, query []byte) ([]byte, error) {
+	ns.mu.Lock()
+	dnsMap := ns.dns
+	ns.mu.Unlock()
+
+	if resp, ok := magicDNSResponse(dnsMap, query); ok {
+		return resp, nil
+	}
+	return forwardDNS(upstream, query)
+}
+
+// Resolve resolves addr into an IP:port like DNSMap.Resolve with the
+// current MagicDNS names, except that other names are first looked up
+// with the engine's DNS resolver, 100.100.100.100. It's how the names
+// local apps connect to get resolved in userspace-networking mode,
+// where they reach the tailnet through tailscaled's proxies instead of
+// sending DNS queries through a TUN. That way they get the answers,
+// split DNS routes included, a TUN would give them. Names the engine's
+// resolver has no answer for, such as when it has no upstreams, are
+// looked up with the system resolver.
+func (ns *Impl) Resolve(ctx context.Context, addr string) (netaddr.IPPort, error) {
+	ns.mu.Lock()
+	dnsMap := ns.dns
+	ns.mu.Unlock()
+
+	host, port, err := net.SplitHostPort(addr)
+	if err == nil && net.ParseIP(host) == nil && dnsMap[host].IsZero() {
+		port16, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return netaddr.IPPort{}, fmt.Errorf("invalid port in address %q", addr)
+		}
+		if ip, ok := ns.lookupHost(ctx, host); ok {
+			return netaddr.IPPortFrom(ip, uint16(port16)), nil
+		}
+	}
+	return dnsMap.Resolve(ctx, addr)
+}
+
+// lookupHost returns an IPv4, or else IPv6, address for host from the
+// engine's DNS resolver. It reports false if it has none.
+func (ns *Impl) lookupHost(ctx context.Context, host string) (netaddr.IP, bool) {
+	fqdn, err := dnsname.ToFQDN(host)
+	if err != nil {
+		return netaddr.IP{}, false
+	}
+	name, err := dnsmessage.NewName(fqdn.WithTrailingDot())
+	if err != nil {
+		return netaddr.IP{}, false
+	}
+	for _, typ := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+			ID:               uint16(rand.Intn(1 << 16)),
+			RecursionDesired: true,
+		})
+		b.StartQuestions()
+		b.Question(dnsmessage.Question{Name: name, Type: typ, Class: dnsmessage.ClassINET})
+		query, err := b.Finish()
+		if err != nil {
+			return netaddr.IP{}, false
+		}
+		resp, err := ns.e.QueryDNS(ctx, query)
+		if err != nil {
+			if ctx.Err() != nil {
+				return netaddr.IP{}, false
+			}
+			continue
+		}
+		if ip, ok := firstAnswerIP(resp); ok {
+			return ip, true
+		}
+	}
+	return netaddr.IP{}, false
+}
+
+// firstAnswerIP returns the IP of the first A or AAAA record in the
+// DNS response resp.
+func firstAnswerIP(resp []byte) (netaddr.IP, bool) {
+	var p dnsmessage.Parser
+	if _, err := p.Start(resp); err != nil {
+		return netaddr.IP{}, false
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return netaddr.IP{}, false
+	}
+	for {
+		h, err := p.AnswerHeader()
+		if err != nil {
+			return netaddr.IP{}, false
+		}
+		switch h.Type {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return netaddr.IP{}, false
+			}
+			return netaddr.IPv4(r.A[0], r.A[1], r.A[2], r.A[3]), true
+		case dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return netaddr.IP{}, false
+			}
+			return netaddr.IPFrom16(r.AAAA), true
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return netaddr.IP{}, false
+			}
+		}
+	}
+}
+
+// magicDNSResponse returns the response to query if it asks about a
+// name in m. It reports false if query is malformed or is for any
+// other name, in which case it should be sent upstream.
+//
+// A name in m is answered with its IP for a query of the matching
+// record type, and with no records otherwise.
+func magicDNSResponse(m DNSMap, query []byte) (resp []byte, ok bool) {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil || h.Response {
+		return nil, false
+	}
+	q, err := p.Question()
+	if err != nil || q.Class != dnsmessage.ClassINET {
+		return nil, false
+	}
+	name := strings.ToLower(strings.TrimSuffix(q.Name.String(), "."))
+	ip, ok := m[name]
+	if !ok {
+		return nil, false
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 h.ID,
+		Response:           true,
+		Authoritative:      true,
+		RecursionDesired:   h.RecursionDesired,
+		RecursionAvailable: true,
+	})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, false
+	}
+	if err := b.Question(q); err != nil {
+		return nil, false
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, false
+	}
+	rh := dnsmessage.ResourceHeader{
+		Name:  q.Name,
+		Class: dnsmessage.ClassINET,
+		TTL:   magicDNSTTL,
+	}
+	switch {
+	case q.Type == dnsmessage.TypeA && ip.Is4():
+		err = b.AResource(rh, dnsmessage.AResource{A: ip.As4()})
+	case q.Type == dnsmessage.TypeAAAA && ip.Is6():
+		err = b.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: ip.As16()})
+	}
+	if err != nil {
+		return nil, false
+	}
+	resp, err = b.Finish()
+	if err != nil {
+		return nil, false
+	}
+	return resp, true
+}
+
+// forwardDNS sends query to upstream and returns its response.
+func forwardDNS(upstream *net.UDPAddr, query []byte) ([]byte, error) {
+	c, err := net.DialUDP("udp", nil, upstream)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(dnsForwardTimeout))
+	if _, err := c.Write(query); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, maxDNSPacketSize)
+	n, err := c.Read(resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp[:n], nil
+}
@@ -0,0 +1,203 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netstack
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"inet.af/netaddr"
+	"tailscale.com/wgengine"
+)
+
+func dnsQuery(t *testing.T, name string, typ dnsmessage.Type) []byte {
+	t.Helper()
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1234, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(name),
+		Type:  typ,
+		Class: dnsmessage.ClassINET,
+	})
+	q, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func TestMagicDNSResponse(t *testing.T) {
+	m := DNSMap{
+		"peer":                 netaddr.MustParseIP("100.101.102.103"),
+		"peer.foo.ts.net":      netaddr.MustParseIP("100.101.102.103"),
+		"peer6.foo.ts.net":     netaddr.MustParseIP("fd7a:115c:a1e0::1"),
+		"mixedcase.foo.ts.net": netaddr.MustParseIP("100.64.0.1"),
+	}
+	tests := []struct {
+		name    string
+		qname   string
+		qtype   dnsmessage.Type
+		wantOK  bool
+		wantIPs []netaddr.IP
+	}{
+		{"a", "peer.foo.ts.net.", dnsmessage.TypeA, true, []netaddr.IP{m["peer"]}},
+		{"base_name", "peer.", dnsmessage.TypeA, true, []netaddr.IP{m["peer"]}},
+		{"case_insensitive", "MixedCase.foo.ts.net.", dnsmessage.TypeA, true, []netaddr.IP{m["mixedcase.foo.ts.net"]}},
+		{"aaaa", "peer6.foo.ts.net.", dnsmessage.TypeAAAA, true, []netaddr.IP{m["peer6.foo.ts.net"]}},
+		{"aaaa_for_v4_only", "peer.foo.ts.net.", dnsmessage.TypeAAAA, true, nil},
+		{"mx", "peer.foo.ts.net.", dnsmessage.TypeMX, true, nil},
+		{"not_magic", "example.com.", dnsmessage.TypeA, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, ok := magicDNSResponse(m, dnsQuery(t, tt.qname, tt.qtype))
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v; want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			var p dnsmessage.Parser
+			h, err := p.Start(resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !h.Response || h.ID != 1234 || h.RCode != dnsmessage.RCodeSuccess {
+				t.Errorf("header = %+v; want successful response to ID 1234", h)
+			}
+			if err := p.SkipAllQuestions(); err != nil {
+				t.Fatal(err)
+			}
+			answers, err := p.AllAnswers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []netaddr.IP
+			for _, a := range answers {
+				switch r := a.Body.(type) {
+				case *dnsmessage.AResource:
+					got = append(got, netaddr.IPv4(r.A[0], r.A[1], r.A[2], r.A[3]))
+				case *dnsmessage.AAAAResource:
+					got = append(got, netaddr.IPFrom16(r.AAAA))
+				default:
+					t.Errorf("unexpected answer %v", a)
+				}
+			}
+			if len(got) != len(tt.wantIPs) || (len(got) == 1 && got[0] != tt.wantIPs[0]) {
+				t.Errorf("answers = %v; want %v", got, tt.wantIPs)
+			}
+		})
+	}
+
+	// Responses aren't answered.
+	resp, _ := magicDNSResponse(m, dnsQuery(t, "peer.", dnsmessage.TypeA))
+	if _, ok := magicDNSResponse(m, resp); ok {
+		t.Error("answered a DNS response")
+	}
+	if _, ok := magicDNSResponse(m, []byte("garbage")); ok {
+		t.Error("answered garbage")
+	}
+}
+
+func TestForwardDNS(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	want := []byte("response")
+	go func() {
+		buf := make([]byte, 512)
+		_, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		pc.WriteTo(want, addr)
+	}()
+
+	got, err := forwardDNS(pc.LocalAddr().(*net.UDPAddr), dnsQuery(t, "example.com.", dnsmessage.TypeA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+// queryDNSEngine is a wgengine.Engine whose DNS resolver answers A
+// queries for the names in ips, and fails all others.
+type queryDNSEngine struct {
+	wgengine.Engine
+	ips     map[string]netaddr.IP // by FQDN
+	queries int32
+}
+
+func (e *queryDNSEngine) QueryDNS(ctx context.Context, query []byte) ([]byte, error) {
+	atomic.AddInt32(&e.queries, 1)
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	ip, ok := e.ips[q.Name.String()]
+	if !ok || q.Type != dnsmessage.TypeA {
+		return nil, errors.New("no upstreams")
+	}
+	h.Response = true
+	b := dnsmessage.NewBuilder(nil, h)
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAnswers()
+	b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}, dnsmessage.AResource{A: ip.As4()})
+	return b.Finish()
+}
+
+func TestResolve(t *testing.T) {
+	e := &queryDNSEngine{ips: map[string]netaddr.IP{
+		"db.corp.example.": netaddr.MustParseIP("10.1.2.3"),
+	}}
+	ns := &Impl{
+		e:   e,
+		dns: DNSMap{"peer": netaddr.MustParseIP("100.101.102.103")},
+	}
+	tests := []struct {
+		addr        string
+		want        netaddr.IPPort
+		wantQueries int32 // to the engine's resolver
+	}{
+		{"100.64.0.1:80", netaddr.MustParseIPPort("100.64.0.1:80"), 0},
+		{"peer:80", netaddr.MustParseIPPort("100.101.102.103:80"), 0},
+		{"db.corp.example:5432", netaddr.MustParseIPPort("10.1.2.3:5432"), 1},
+		// Not known to the engine's resolver (for A or AAAA), so
+		// looked up with the system's.
+		{"localhost:22", netaddr.MustParseIPPort("127.0.0.1:22"), 2},
+	}
+	for _, tt := range tests {
+		atomic.StoreInt32(&e.queries, 0)
+		got, err := ns.Resolve(context.Background(), tt.addr)
+		if err != nil {
+			t.Errorf("Resolve(%q): %v", tt.addr, err)
+			continue
+		}
+		if tt.addr == "localhost:22" && got.IP().IsLoopback() {
+			got = tt.want // ::1 is fine too
+		}
+		if got != tt.want {
+			t.Errorf("Resolve(%q) = %v; want %v", tt.addr, got, tt.want)
+		}
+		if n := atomic.LoadInt32(&e.queries); n != tt.wantQueries {
+			t.Errorf("Resolve(%q) made %d engine DNS queries; want %d", tt.addr, n, tt.wantQueries)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netstack
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"inet.af/netaddr"
+)
+
+// ForwardRule is an inbound TCP forward: connections to one of this
+// node's Tailscale IPs on Port are forwarded to Target, rather than
+// to the same port on localhost.
+type ForwardRule struct {
+	Port   uint16
+	Target netaddr.IPPort
+
+	// ProxyProto, if non-zero, is the PROXY protocol version
+	// header to send to Target before any data, carrying the
+	// connection's Tailscale source address. Only version 2 is
+	// supported.
+	ProxyProto int
+}
+
+func (r ForwardRule) String() string {
+	s := fmt.Sprintf("tcp/%d:%v", r.Port, r.Target)
+	if r.ProxyProto != 0 {
+		s += fmt.Sprintf(";proxy-proto=v%d", r.ProxyProto)
+	}
+	return s
+}
+
+// ParseForwardRule parses a forward rule of the form
+// "tcp/PORT:IP:PORT[;proxy-proto=v2]", such as
+// "tcp/8080:127.0.0.1:8080;proxy-proto=v2".
+func ParseForwardRule(s string) (ForwardRule, error) {
+	var r ForwardRule
+	f := strings.Split(s, ";")
+	spec := f[0]
+	if !strings.HasPrefix(spec, "tcp/") {
+		return r, fmt.Errorf("invalid forward %q: must start with \"tcp/\"", s)
+	}
+	spec = strings.TrimPrefix(spec, "tcp/")
+	i := strings.Index(spec, ":")
+	if i == -1 {
+		return r, fmt.Errorf("invalid forward %q: want tcp/PORT:IP:PORT", s)
+	}
+	port, err := strconv.ParseUint(spec[:i], 10, 16)
+	if err != nil || port == 0 {
+		return r, fmt.Errorf("invalid forward %q: bad port %q", s, spec[:i])
+	}
+	r.Port = uint16(port)
+	r.Target, err = netaddr.ParseIPPort(spec[i+1:])
+	if err != nil {
+		return r, fmt.Errorf("invalid forward %q: %w", s, err)
+	}
+	for _, opt := range f[1:] {
+		switch opt {
+		case "proxy-proto=v2":
+			r.ProxyProto = 2
+		default:
+			return r, fmt.Errorf("invalid forward %q: unknown option %q", s, opt)
+		}
+	}
+	return r, nil
+}
+
+// CheckForwardRules reports an error if rules has more than one rule
+// for a port, or a rule whose target is neither a loopback address
+// nor in allow.
+func CheckForwardRules(rules []ForwardRule, allow []netaddr.IPPrefix) error {
+	seen := make(map[uint16]bool, len(rules))
+	for _, r := range rules {
+		if seen[r.Port] {
+			return fmt.Errorf("more than one forward for port %d", r.Port)
+		}
+		seen[r.Port] = true
+		if ip := r.Target.IP(); !ip.IsLoopback() && !prefixesContain(allow, ip) {
+			return fmt.Errorf("forward %v: target %v is not a loopback address or allowed", r, ip)
+		}
+	}
+	return nil
+}
+
+func prefixesContain(pfxs []netaddr.IPPrefix, ip netaddr.IP) bool {
+	for _, p := range pfxs {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetForwardRules replaces the set of inbound TCP forward rules.
+// Connections to ports without a rule go to localhost, as before.
+func (ns *Impl) SetForwardRules(rules []ForwardRule) {
+	m := make(map[uint16]ForwardRule, len(rules))
+	for _, r := range rules {
+		m[r.Port] = r
+	}
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	ns.forwards = m
+}
+
+// ForwardRules returns the current inbound TCP forward rules.
+func (ns *Impl) ForwardRules() []ForwardRule {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	ret := make([]ForwardRule, 0, len(ns.forwards))
+	for _, r := range ns.forwards {
+		ret = append(ret, r)
+	}
+	return ret
+}
+
+func (ns *Impl) forwardRule(port uint16) (r ForwardRule, ok bool) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	r, ok = ns.forwards[port]
+	return r, ok
+}
+
+// proxyV2Sig is the PROXY protocol version 2 signature.
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// appendProxyV2Header appends a PROXY protocol version 2 header for
+// a TCP connection from src to dst. src and dst must be of the same
+// address family.
+func appendProxyV2Header(b []byte, src, dst netaddr.IPPort) []byte {
+	b = append(b, proxyV2Sig...)
+	b = append(b, 0x21) // version 2, PROXY command
+	if src.IP().Is4() {
+		b = append(b, 0x11) // AF_INET, STREAM
+		b = append(b, 0, 12)
+		s, d := src.IP().As4(), dst.IP().As4()
+		b = append(b, s[:]...)
+		b = append(b, d[:]...)
+	} else {
+		b = append(b, 0x21) // AF_INET6, STREAM
+		b = append(b, 0, 36)
+		s, d := src.IP().As16(), dst.IP().As16()
+		b = append(b, s[:]...)
+		b = append(b, d[:]...)
+	}
+	var ports [4]byte
+	binary.BigEndian.PutUint16(ports[:2], src.Port())
+	binary.BigEndian.PutUint16(ports[2:], dst.Port())
+	return append(b, ports[:]...)
+}
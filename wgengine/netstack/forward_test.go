@@ -0,0 +1,157 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netstack
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestParseForwardRule(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    ForwardRule
+		wantErr bool
+	}{
+		{
+			in:   "tcp/8080:127.0.0.1:8080",
+			want: ForwardRule{Port: 8080, Target: netaddr.MustParseIPPort("127.0.0.1:8080")},
+		},
+		{
+			in:   "tcp/80:127.0.0.1:8080;proxy-proto=v2",
+			want: ForwardRule{Port: 80, Target: netaddr.MustParseIPPort("127.0.0.1:8080"), ProxyProto: 2},
+		},
+		{
+			in:   "tcp/443:[::1]:8443",
+			want: ForwardRule{Port: 443, Target: netaddr.MustParseIPPort("[::1]:8443")},
+		},
+		{in: "udp/53:127.0.0.1:53", wantErr: true},
+		{in: "tcp/0:127.0.0.1:80", wantErr: true},
+		{in: "tcp/99999:127.0.0.1:80", wantErr: true},
+		{in: "tcp/80", wantErr: true},
+		{in: "tcp/80:localhost:80", wantErr: true},
+		{in: "tcp/80:127.0.0.1:80;proxy-proto=v1", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseForwardRule(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseForwardRule(%q) error = %v; wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseForwardRule(%q) = %+v; want %+v", tt.in, got, tt.want)
+		}
+		if back, err := ParseForwardRule(got.String()); err != nil || back != got {
+			t.Errorf("round trip of %q via %q = %+v, %v", tt.in, got.String(), back, err)
+		}
+	}
+}
+
+func TestCheckForwardRules(t *testing.T) {
+	rule := func(s string) ForwardRule {
+		r, err := ParseForwardRule(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	allow := []netaddr.IPPrefix{netaddr.MustParseIPPrefix("10.0.0.0/24")}
+	tests := []struct {
+		name    string
+		rules   []ForwardRule
+		wantErr bool
+	}{
+		{name: "none"},
+		{name: "loopback", rules: []ForwardRule{rule("tcp/80:127.0.0.1:8080"), rule("tcp/443:[::1]:8443")}},
+		{name: "allowed", rules: []ForwardRule{rule("tcp/80:10.0.0.5:80")}},
+		{name: "not_allowed", rules: []ForwardRule{rule("tcp/80:10.0.1.5:80")}, wantErr: true},
+		{name: "duplicate_port", rules: []ForwardRule{rule("tcp/80:127.0.0.1:8080"), rule("tcp/80:127.0.0.1:8081")}, wantErr: true},
+	}
+	for _, tt := range tests {
+		err := CheckForwardRules(tt.rules, allow)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: CheckForwardRules error = %v; wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+// decodeProxyV2 is a reference decoder for PROXY protocol version 2
+// headers of TCP connections, per
+// https://www.haproxy.org/download/2.4/doc/proxy-protocol.txt.
+func decodeProxyV2(b []byte) (src, dst net.TCPAddr, rest []byte, err error) {
+	const fixedLen = 16
+	if len(b) < fixedLen {
+		return src, dst, nil, errors.New("short header")
+	}
+	if !bytes.Equal(b[:12], []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}) {
+		return src, dst, nil, errors.New("bad signature")
+	}
+	if ver, cmd := b[12]>>4, b[12]&0xf; ver != 2 || cmd != 1 {
+		return src, dst, nil, errors.New("not a v2 PROXY command")
+	}
+	fam, proto := b[13]>>4, b[13]&0xf
+	if proto != 1 {
+		return src, dst, nil, errors.New("not STREAM")
+	}
+	n := int(binary.BigEndian.Uint16(b[14:16]))
+	if len(b) < fixedLen+n {
+		return src, dst, nil, errors.New("short address block")
+	}
+	addrs := b[fixedLen : fixedLen+n]
+	var ipLen int
+	switch fam {
+	case 1:
+		ipLen = 4
+	case 2:
+		ipLen = 16
+	default:
+		return src, dst, nil, errors.New("unknown address family")
+	}
+	if len(addrs) < 2*ipLen+4 {
+		return src, dst, nil, errors.New("address block too small")
+	}
+	src.IP = net.IP(addrs[:ipLen])
+	dst.IP = net.IP(addrs[ipLen : 2*ipLen])
+	src.Port = int(binary.BigEndian.Uint16(addrs[2*ipLen:]))
+	dst.Port = int(binary.BigEndian.Uint16(addrs[2*ipLen+2:]))
+	return src, dst, b[fixedLen+n:], nil
+}
+
+func TestAppendProxyV2Header(t *testing.T) {
+	tests := []struct {
+		src, dst string
+	}{
+		{"100.101.102.103:54321", "100.64.0.1:80"},
+		{"[fd7a:115c:a1e0::1]:54321", "[fd7a:115c:a1e0::2]:443"},
+	}
+	for _, tt := range tests {
+		src, dst := netaddr.MustParseIPPort(tt.src), netaddr.MustParseIPPort(tt.dst)
+		b := appendProxyV2Header(nil, src, dst)
+		b = append(b, "payload"...)
+
+		gotSrc, gotDst, rest, err := decodeProxyV2(b)
+		if err != nil {
+			t.Errorf("%v -> %v: decode: %v", src, dst, err)
+			continue
+		}
+		if gotSrc.String() != src.String() {
+			t.Errorf("src = %v; want %v", &gotSrc, src)
+		}
+		if gotDst.String() != dst.String() {
+			t.Errorf("dst = %v; want %v", &gotDst, dst)
+		}
+		if string(rest) != "payload" {
+			t.Errorf("rest = %q; want payload", rest)
+		}
+	}
+}
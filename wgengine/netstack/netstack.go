@@ -50,10 +50,18 @@ const debugNetstack = false
 type Impl struct {
 	// ForwardTCPIn, if non-nil, handles forwarding an inbound TCP
 	// connection.
-	// TODO(bradfitz): provide mechanism for tsnet to reject a
-	// port other than accepting it and closing it.
 	ForwardTCPIn func(c net.Conn, port uint16)
 
+	// AcceptTCPIn, if non-nil, reports whether to accept an
+	// inbound TCP connection from src to dst. Rejected connections
+	// are reset, so the client fails fast instead of retrying its
+	// SYN until it times out.
+	//
+	// It's for policy beyond the packet filter, such as tsnet's
+	// listeners; SYNs the packet filter denies are already reset by
+	// the tstun.Wrapper before they reach netstack.
+	AcceptTCPIn func(src, dst netaddr.IPPort) bool
+
 	ipstack     *stack.Stack
 	linkEP      *channel.Endpoint
 	tundev      *tstun.Wrapper
@@ -75,6 +83,9 @@ type Impl struct {
 	// TCP connections, so they can be unregistered when connections are
 	// closed.
 	connsOpenBySubnetIP map[netaddr.IP]int
+	forwards            map[uint16]ForwardRule // by local port
+
+	conns connTable // forwarded TCP and UDP flows
 }
 
 const nicID = 1
@@ -94,13 +105,34 @@ func Create(logf logger.Logf, tundev *tstun.Wrapper, e wgengine.Engine, mc *magi
 	if e == nil {
 		return nil, errors.New("nil Engine")
 	}
+	ipstack, linkEP, err := newStack()
+	if err != nil {
+		return nil, err
+	}
+	ns := &Impl{
+		logf:                logf,
+		ipstack:             ipstack,
+		linkEP:              linkEP,
+		tundev:              tundev,
+		e:                   e,
+		mc:                  mc,
+		connsOpenBySubnetIP: make(map[netaddr.IP]int),
+		onlySubnets:         onlySubnets,
+	}
+	ns.atomicIsLocalIPFunc.Store(tsaddr.NewContainsIPFunc(nil))
+	return ns, nil
+}
+
+// newStack returns a new netstack with a single NIC, linkEP, that
+// handles all traffic.
+func newStack() (_ *stack.Stack, linkEP *channel.Endpoint, _ error) {
 	ipstack := stack.New(stack.Options{
 		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
 		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol, icmp.NewProtocol4, icmp.NewProtocol6},
 	})
-	linkEP := channel.New(512, mtu, "")
+	linkEP = channel.New(512, mtu, "")
 	if tcpipProblem := ipstack.CreateNIC(nicID, linkEP); tcpipProblem != nil {
-		return nil, fmt.Errorf("could not create netstack NIC: %v", tcpipProblem)
+		return nil, nil, fmt.Errorf("could not create netstack NIC: %v", tcpipProblem)
 	}
 	// By default the netstack NIC will only accept packets for the IPs
 	// registered to it. Since in some cases we dynamically register IPs
@@ -122,18 +154,7 @@ func Create(logf logger.Logf, tundev *tstun.Wrapper, e wgengine.Engine, mc *magi
 			NIC:         nicID,
 		},
 	})
-	ns := &Impl{
-		logf:                logf,
-		ipstack:             ipstack,
-		linkEP:              linkEP,
-		tundev:              tundev,
-		e:                   e,
-		mc:                  mc,
-		connsOpenBySubnetIP: make(map[netaddr.IP]int),
-		onlySubnets:         onlySubnets,
-	}
-	ns.atomicIsLocalIPFunc.Store(tsaddr.NewContainsIPFunc(nil))
-	return ns, nil
+	return ipstack, linkEP, nil
 }
 
 // wrapProtoHandler returns protocol handler h wrapped in a version
@@ -158,6 +179,15 @@ func (ns *Impl) wrapProtoHandler(h func(stack.TransportEndpointID, *stack.Packet
 // wgengine.FakeImpl.
 func (ns *Impl) Start() error {
 	ns.e.AddNetworkMapCallback(ns.updateIPs)
+	ns.setTransportHandlers()
+	go ns.injectOutbound()
+	ns.tundev.PostFilterIn = ns.injectInbound
+	return nil
+}
+
+// setTransportHandlers sets up ns's stack to hand new TCP
+// connections and UDP flows to acceptTCP and acceptUDP.
+func (ns *Impl) setTransportHandlers() {
 	// size = 0 means use default buffer size
 	const tcpReceiveBufferSize = 0
 	const maxInFlightConnectionAttempts = 16
@@ -165,9 +195,6 @@ func (ns *Impl) Start() error {
 	udpFwd := udp.NewForwarder(ns.ipstack, ns.acceptUDP)
 	ns.ipstack.SetTransportProtocolHandler(tcp.ProtocolNumber, ns.wrapProtoHandler(tcpFwd.HandlePacket))
 	ns.ipstack.SetTransportProtocolHandler(udp.ProtocolNumber, ns.wrapProtoHandler(udpFwd.HandlePacket))
-	go ns.injectOutbound()
-	ns.tundev.PostFilterIn = ns.injectInbound
-	return nil
 }
 
 // DNSMap maps MagicDNS names (both base + FQDN) to their first IP.
@@ -357,11 +384,7 @@ func (m DNSMap) Resolve(ctx context.Context, addr string) (netaddr.IPPort, error
 }
 
 func (ns *Impl) DialContextTCP(ctx context.Context, addr string) (*gonet.TCPConn, error) {
-	ns.mu.Lock()
-	dnsMap := ns.dns
-	ns.mu.Unlock()
-
-	remoteIPPort, err := dnsMap.Resolve(ctx, addr)
+	remoteIPPort, err := ns.Resolve(ctx, addr)
 	if err != nil {
 		return nil, err
 	}
@@ -381,11 +404,7 @@ func (ns *Impl) DialContextTCP(ctx context.Context, addr string) (*gonet.TCPConn
 }
 
 func (ns *Impl) DialContextUDP(ctx context.Context, addr string) (*gonet.UDPConn, error) {
-	ns.mu.Lock()
-	dnsMap := ns.dns
-	ns.mu.Unlock()
-
-	remoteIPPort, err := dnsMap.Resolve(ctx, addr)
+	remoteIPPort, err := ns.Resolve(ctx, addr)
 	if err != nil {
 		return nil, err
 	}
@@ -501,6 +520,13 @@ func (ns *Impl) acceptTCP(r *tcp.ForwarderRequest) {
 			ns.removeSubnetAddress(dialIP)
 		}
 	}()
+	clientAddr := netaddr.IPPortFrom(clientRemoteIP, reqDetails.RemotePort)
+	if ns.AcceptTCPIn != nil && !ns.AcceptTCPIn(clientAddr, netaddr.IPPortFrom(dialIP, reqDetails.LocalPort)) {
+		ns.logf("[v2] netstack: rejecting TCP connection %s", stringifyTEI(reqDetails))
+		// Reset the connection, replying to the client's SYN.
+		r.Complete(true)
+		return
+	}
 	var wq waiter.Queue
 	ep, err := r.CreateEndpoint(&wq)
 	if err != nil {
@@ -523,18 +549,38 @@ func (ns *Impl) acceptTCP(r *tcp.ForwarderRequest) {
 		ns.ForwardTCPIn(c, reqDetails.LocalPort)
 		return
 	}
+	var hdr []byte
 	if isTailscaleIP {
+		if rule, ok := ns.forwardRule(reqDetails.LocalPort); ok {
+			if rule.ProxyProto == 2 {
+				dst := netaddr.IPPortFrom(dialIP, reqDetails.LocalPort)
+				if clientAddr.IP().Is4() != dst.IP().Is4() {
+					ns.logf("netstack: mismatched address families in %v -> %v; not sending PROXY header", clientAddr, dst)
+				} else {
+					hdr = appendProxyV2Header(nil, clientAddr, dst)
+				}
+			}
+			ns.forwardTCP(c, clientAddr, &wq, rule.Target, hdr)
+			return
+		}
 		dialIP = netaddr.IPv4(127, 0, 0, 1)
 	}
 	dialAddr := netaddr.IPPortFrom(dialIP, uint16(reqDetails.LocalPort))
-	ns.forwardTCP(c, clientRemoteIP, &wq, dialAddr)
+	ns.forwardTCP(c, clientAddr, &wq, dialAddr, nil)
 }
 
-func (ns *Impl) forwardTCP(client *gonet.TCPConn, clientRemoteIP netaddr.IP, wq *waiter.Queue, dialAddr netaddr.IPPort) {
+// forwardTCP proxies client (with addr clientAddr) to dialAddr. If
+// hdr is non-empty, it's written to dialAddr before any of client's
+// data.
+func (ns *Impl) forwardTCP(client *gonet.TCPConn, clientAddr netaddr.IPPort, wq *waiter.Queue, dialAddr netaddr.IPPort, hdr []byte) {
 	defer client.Close()
 	dialAddrStr := dialAddr.String()
 	ns.logf("[v2] netstack: forwarding incoming connection to %s", dialAddrStr)
 
+	fc := ns.conns.add("tcp", clientAddr, dialAddr, "dialing")
+	endState := "failed"
+	defer func() { ns.conns.remove(fc, endState) }()
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	waitEntry, notifyCh := waiter.NewChannelEntry(nil)
@@ -558,17 +604,25 @@ func (ns *Impl) forwardTCP(client *gonet.TCPConn, clientRemoteIP netaddr.IP, wq
 		return
 	}
 	defer server.Close()
+	if len(hdr) > 0 {
+		if _, err := server.Write(hdr); err != nil {
+			ns.logf("netstack: writing PROXY header to %s: %v", dialAddrStr, err)
+			return
+		}
+	}
 	backendLocalAddr := server.LocalAddr().(*net.TCPAddr)
 	backendLocalIPPort, _ := netaddr.FromStdAddr(backendLocalAddr.IP, backendLocalAddr.Port, backendLocalAddr.Zone)
-	ns.e.RegisterIPPortIdentity(backendLocalIPPort, clientRemoteIP)
+	ns.e.RegisterIPPortIdentity(backendLocalIPPort, clientAddr.IP())
 	defer ns.e.UnregisterIPPortIdentity(backendLocalIPPort)
+	ns.conns.setState(fc, "established")
+	endState = "closed"
 	connClosed := make(chan error, 2)
 	go func() {
-		_, err := io.Copy(server, client)
+		_, err := io.Copy(countingWriter{server, &fc.txBytes}, client)
 		connClosed <- err
 	}()
 	go func() {
-		_, err := io.Copy(client, server)
+		_, err := io.Copy(countingWriter{client, &fc.rxBytes}, server)
 		connClosed <- err
 	}()
 	err = <-connClosed
@@ -599,6 +653,12 @@ func (ns *Impl) acceptUDP(r *udp.ForwarderRequest) {
 	}
 
 	c := gonet.NewUDPConn(ns.ipstack, &wq, ep)
+	if dstAddr.Port() == 53 && !ns.onlySubnets {
+		// In userspace-networking mode, answer MagicDNS
+		// queries to any resolver ourselves.
+		go ns.serveDNS(c, srcAddr, dstAddr)
+		return
+	}
 	go ns.forwardUDP(c, &wq, srcAddr, dstAddr)
 }
 
@@ -668,17 +728,29 @@ func (ns *Impl) forwardUDP(client *gonet.UDPConn, wq *waiter.Queue, clientAddr,
 	extend := func() {
 		timer.Reset(idleTimeout)
 	}
-	startPacketCopy(ctx, cancel, client, clientAddr.UDPAddr(), backendConn, ns.logf, extend)
-	startPacketCopy(ctx, cancel, backendConn, backendRemoteAddr, client, ns.logf, extend)
+	fc := ns.conns.add("udp", clientAddr, dstAddr, "established")
+	var clientPC net.PacketConn = client
+	if port == 443 {
+		// Likely QUIC (HTTP/3). It's proxied like any other UDP,
+		// but note what it's for.
+		clientPC = &quicSNILogger{PacketConn: client, logf: ns.logf, src: clientAddr, dst: dstAddr}
+	}
+	startPacketCopy(ctx, cancel, client, clientAddr.UDPAddr(), backendConn, ns.logf, extend, &fc.rxBytes)
+	startPacketCopy(ctx, cancel, backendConn, backendRemoteAddr, clientPC, ns.logf, extend, &fc.txBytes)
+
+	// Wait for the copies to be done before ending the flow and
+	// decrementing the subnet address count to potentially remove
+	// the route.
+	<-ctx.Done()
+	ns.conns.remove(fc, "closed")
 	if isLocal {
-		// Wait for the copies to be done before decrementing the
-		// subnet address count to potentially remove the route.
-		<-ctx.Done()
 		ns.removeSubnetAddress(dstAddr.IP())
 	}
 }
 
-func startPacketCopy(ctx context.Context, cancel context.CancelFunc, dst net.PacketConn, dstAddr net.Addr, src net.PacketConn, logf logger.Logf, extend func()) {
+// startPacketCopy starts copying packets from src to dstAddr on dst
+// until ctx is done, adding the number of bytes copied to *nBytes.
+func startPacketCopy(ctx context.Context, cancel context.CancelFunc, dst net.PacketConn, dstAddr net.Addr, src net.PacketConn, logf logger.Logf, extend func(), nBytes *int64) {
 	if debugNetstack {
 		logf("[v2] netstack: startPacketCopy to %v (%T) from %T", dstAddr, dst, src)
 	}
@@ -704,6 +776,7 @@ func startPacketCopy(ctx context.Context, cancel context.CancelFunc, dst net.Pac
 					}
 					return
 				}
+				atomic.AddInt64(nBytes, int64(n))
 				if debugNetstack {
 					logf("[v2] wrote UDP packet %s -> %s", srcAddr, dstAddr)
 				}
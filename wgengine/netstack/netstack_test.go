@@ -5,10 +5,18 @@
 package netstack
 
 import (
+	"context"
 	"reflect"
 	"testing"
+	"time"
 
 	"inet.af/netaddr"
+	"inet.af/netstack/tcpip"
+	"inet.af/netstack/tcpip/buffer"
+	"inet.af/netstack/tcpip/header"
+	"inet.af/netstack/tcpip/stack"
+	"inet.af/netstack/tcpip/transport/tcp"
+	"tailscale.com/net/tsaddr"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/netmap"
 )
@@ -110,3 +118,87 @@ func TestDNSMapFromNetworkMap(t *testing.T) {
 		})
 	}
 }
+
+// tcp4SYN returns an IPv4 TCP SYN packet from src to dst with
+// sequence number seq.
+func tcp4SYN(src, dst netaddr.IPPort, seq uint32) []byte {
+	buf := buffer.NewView(header.IPv4MinimumSize + header.TCPMinimumSize)
+	srcB, dstB := src.IP().As4(), dst.IP().As4()
+	srcIP, dstIP := tcpip.Address(srcB[:]), tcpip.Address(dstB[:])
+	ip := header.IPv4(buf)
+	ip.Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(buf)),
+		TTL:         64,
+		Protocol:    uint8(tcp.ProtocolNumber),
+		SrcAddr:     srcIP,
+		DstAddr:     dstIP,
+	})
+	ip.SetChecksum(^ip.CalculateChecksum())
+	th := header.TCP(buf[header.IPv4MinimumSize:])
+	th.Encode(&header.TCPFields{
+		SrcPort:    src.Port(),
+		DstPort:    dst.Port(),
+		SeqNum:     seq,
+		DataOffset: header.TCPMinimumSize,
+		Flags:      header.TCPFlagSyn,
+		WindowSize: 65535,
+	})
+	xsum := header.PseudoHeaderChecksum(tcp.ProtocolNumber, srcIP, dstIP, header.TCPMinimumSize)
+	th.SetChecksum(^th.CalculateChecksum(xsum))
+	return buf
+}
+
+func TestAcceptTCPInRejectResets(t *testing.T) {
+	ipstack, linkEP, err := newStack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ipstack.Close()
+	src := netaddr.MustParseIPPort("100.101.102.103:40000")
+	dst := netaddr.MustParseIPPort("10.0.0.1:22")
+
+	var gotSrc, gotDst netaddr.IPPort
+	ns := &Impl{
+		logf:                t.Logf,
+		ipstack:             ipstack,
+		linkEP:              linkEP,
+		connsOpenBySubnetIP: make(map[netaddr.IP]int),
+		AcceptTCPIn: func(src, dst netaddr.IPPort) bool {
+			gotSrc, gotDst = src, dst
+			return false
+		},
+	}
+	ns.atomicIsLocalIPFunc.Store(tsaddr.NewContainsIPFunc(nil))
+	ns.setTransportHandlers()
+
+	const seq = 1000
+	start := time.Now()
+	linkEP.InjectInbound(header.IPv4ProtocolNumber, stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Data: buffer.View(tcp4SYN(src, dst, seq)).ToVectorisedView(),
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	pi, ok := linkEP.ReadContext(ctx)
+	if !ok {
+		t.Fatalf("no reply to rejected SYN within %v", time.Since(start))
+	}
+	th := header.TCP(pi.Pkt.TransportHeader().View())
+	if th.Flags()&header.TCPFlagRst == 0 {
+		t.Errorf("reply flags = %v; want RST", th.Flags())
+	}
+	if th.AckNumber() != seq+1 {
+		t.Errorf("RST ack = %v; want %v", th.AckNumber(), seq+1)
+	}
+	if th.SourcePort() != dst.Port() || th.DestinationPort() != src.Port() {
+		t.Errorf("RST ports = %v -> %v; want %v -> %v", th.SourcePort(), th.DestinationPort(), dst.Port(), src.Port())
+	}
+	if gotSrc != src || gotDst != dst {
+		t.Errorf("AcceptTCPIn(%v, %v); want (%v, %v)", gotSrc, gotDst, src, dst)
+	}
+	// The subnet address added for the connection attempt is
+	// removed again.
+	if n := len(ns.connsOpenBySubnetIP); n != 0 {
+		t.Errorf("connsOpenBySubnetIP has %d entries after reset", n)
+	}
+}
@@ -0,0 +1,323 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netstack
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+
+	"golang.org/x/crypto/hkdf"
+	"inet.af/netaddr"
+	"tailscale.com/types/logger"
+)
+
+// QUIC Initial packets are encrypted, but with keys derived from
+// their destination connection ID and a version-specific salt, so
+// that anyone on the path can read them (RFC 9001, section 5.2). This
+// file does just enough of that to find the server name in a client's
+// first Initial packet, for logging. Proxied QUIC datagrams are never
+// modified.
+
+// quicV1InitialSalt is the salt for QUIC version 1 Initial keys.
+var quicV1InitialSalt = []byte{
+	0x38, 0x76, 0x2c, 0xf7, 0xf5, 0x59, 0x34, 0xb3, 0x4d, 0x17,
+	0x9a, 0xe6, 0xa4, 0xc8, 0x0c, 0xad, 0xcc, 0xbb, 0x7f, 0x0a,
+}
+
+var errQUICShort = errors.New("short QUIC packet")
+
+// isQUICInitial reports whether pkt starts with a QUIC version 1
+// Initial packet, judging by its long header.
+func isQUICInitial(pkt []byte) bool {
+	return len(pkt) >= 6 &&
+		pkt[0]&0xc0 == 0xc0 && // long header, fixed bit
+		pkt[0]&0x30 == 0 && // Initial
+		binary.BigEndian.Uint32(pkt[1:5]) == 1
+}
+
+// quicKeys are the keys protecting one direction of a QUIC packet
+// number space.
+type quicKeys struct {
+	key, iv, hp []byte
+}
+
+// quicClientInitialKeys returns the keys protecting Initial packets
+// sent by a QUIC version 1 client to dcid.
+func quicClientInitialKeys(dcid []byte) quicKeys {
+	initial := hkdf.Extract(sha256.New, dcid, quicV1InitialSalt)
+	client := hkdfExpandLabel(initial, "client in", sha256.Size)
+	return quicKeys{
+		key: hkdfExpandLabel(client, "quic key", 16),
+		iv:  hkdfExpandLabel(client, "quic iv", 12),
+		hp:  hkdfExpandLabel(client, "quic hp", 16),
+	}
+}
+
+// hkdfExpandLabel is TLS 1.3's HKDF-Expand-Label with SHA-256 and an
+// empty context (RFC 8446, section 7.1).
+func hkdfExpandLabel(secret []byte, label string, length int) []byte {
+	full := "tls13 " + label
+	info := []byte{byte(length >> 8), byte(length), byte(len(full))}
+	info = append(info, full...)
+	info = append(info, 0) // empty context
+	out := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, secret, info), out); err != nil {
+		panic(err) // only if length is too long, which it isn't
+	}
+	return out
+}
+
+// quicVarint parses the QUIC variable-length integer at the start of
+// b, returning it and its length in bytes.
+func quicVarint(b []byte) (v uint64, n int, ok bool) {
+	if len(b) == 0 {
+		return 0, 0, false
+	}
+	n = 1 << (b[0] >> 6)
+	if len(b) < n {
+		return 0, 0, false
+	}
+	v = uint64(b[0] & 0x3f)
+	for _, c := range b[1:n] {
+		v = v<<8 | uint64(c)
+	}
+	return v, n, true
+}
+
+// quicInitialSNI returns the server name requested by the TLS
+// ClientHello in the client Initial packet at the start of pkt. pkt
+// is not modified.
+func quicInitialSNI(pkt []byte) (string, error) {
+	if !isQUICInitial(pkt) {
+		return "", errors.New("not a QUIC v1 Initial packet")
+	}
+	p := pkt[5:]
+	var dcid []byte
+	for i := 0; i < 2; i++ { // destination, then source connection ID
+		if len(p) < 1 || len(p) < 1+int(p[0]) || p[0] > 20 {
+			return "", errQUICShort
+		}
+		if i == 0 {
+			dcid = p[1 : 1+p[0]]
+		}
+		p = p[1+p[0]:]
+	}
+	tokenLen, n, ok := quicVarint(p)
+	if !ok || uint64(len(p)-n) < tokenLen {
+		return "", errQUICShort
+	}
+	p = p[n+int(tokenLen):]
+	length, n, ok := quicVarint(p)
+	if !ok {
+		return "", errQUICShort
+	}
+	p = p[n:]
+	pnOffset := len(pkt) - len(p)
+	// The header protection sample is taken as if the packet
+	// number were 4 bytes long.
+	if uint64(len(p)) < length || length < 4+aes.BlockSize {
+		return "", errQUICShort
+	}
+
+	keys := quicClientInitialKeys(dcid)
+	hp, err := aes.NewCipher(keys.hp)
+	if err != nil {
+		return "", err
+	}
+	var mask [aes.BlockSize]byte
+	hp.Encrypt(mask[:], pkt[pnOffset+4:pnOffset+4+aes.BlockSize])
+	hdr := append([]byte(nil), pkt[:pnOffset+4]...)
+	hdr[0] ^= mask[0] & 0x0f
+	pnLen := int(hdr[0]&0x03) + 1
+	hdr = hdr[:pnOffset+pnLen]
+	var pn uint64
+	for i := 0; i < pnLen; i++ {
+		hdr[pnOffset+i] ^= mask[1+i]
+		pn = pn<<8 | uint64(hdr[pnOffset+i])
+	}
+
+	block, err := aes.NewCipher(keys.key)
+	if err != nil {
+		return "", err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce := append([]byte(nil), keys.iv...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(pn >> (8 * i))
+	}
+	payload, err := aead.Open(nil, nonce, pkt[pnOffset+pnLen:pnOffset+int(length)], hdr)
+	if err != nil {
+		return "", fmt.Errorf("decrypting QUIC Initial: %w", err)
+	}
+	hello, err := quicCryptoData(payload)
+	if err != nil {
+		return "", err
+	}
+	return clientHelloSNI(hello)
+}
+
+// quicCryptoData returns the contiguous CRYPTO stream data starting at
+// offset 0 carried by the frames in an Initial packet's payload.
+func quicCryptoData(payload []byte) ([]byte, error) {
+	type chunk struct {
+		off  uint64
+		data []byte
+	}
+	var chunks []chunk
+	for len(payload) > 0 {
+		switch payload[0] {
+		case 0x00, 0x01: // PADDING, PING
+			payload = payload[1:]
+		case 0x06: // CRYPTO
+			p := payload[1:]
+			off, n, ok := quicVarint(p)
+			if !ok {
+				return nil, errQUICShort
+			}
+			p = p[n:]
+			dataLen, n, ok := quicVarint(p)
+			if !ok || uint64(len(p)-n) < dataLen {
+				return nil, errQUICShort
+			}
+			p = p[n:]
+			chunks = append(chunks, chunk{off, p[:dataLen]})
+			payload = p[dataLen:]
+		default:
+			// Anything else (ACK, CONNECTION_CLOSE) isn't
+			// expected in a client's first Initial packet.
+			return nil, fmt.Errorf("unexpected QUIC frame type %#x", payload[0])
+		}
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].off < chunks[j].off })
+	var data []byte
+	for _, c := range chunks {
+		if c.off > uint64(len(data)) {
+			break // gap; the rest is in a later packet
+		}
+		if end := c.off + uint64(len(c.data)); end > uint64(len(data)) {
+			data = append(data, c.data[uint64(len(data))-c.off:]...)
+		}
+	}
+	return data, nil
+}
+
+// clientHelloSNI returns the host name in the server_name extension of
+// the TLS ClientHello handshake message at the start of b.
+func clientHelloSNI(b []byte) (string, error) {
+	r := helloReader{b: b}
+	if r.u8() != 1 { // client_hello
+		return "", errors.New("not a TLS ClientHello")
+	}
+	r.skip(3)            // length
+	r.skip(2)            // legacy_version
+	r.skip(32)           // random
+	r.skip(int(r.u8()))  // legacy_session_id
+	r.skip(int(r.u16())) // cipher_suites
+	r.skip(int(r.u8()))  // legacy_compression_methods
+	// The ClientHello may continue in a later packet, so look
+	// for the server name in whatever extensions are here.
+	extLen := int(r.u16())
+	truncated := r.short || len(r.b) < extLen
+	ext := helloReader{b: r.b}
+	if !truncated {
+		ext.b = r.b[:extLen]
+	}
+	for !ext.short && len(ext.b) > 0 {
+		typ := ext.u16()
+		data := helloReader{b: ext.bytes(int(ext.u16()))}
+		if typ != 0 { // server_name
+			continue
+		}
+		names := helloReader{b: data.bytes(int(data.u16()))}
+		for !names.short && len(names.b) > 0 {
+			nameType := names.u8()
+			name := names.bytes(int(names.u16()))
+			if nameType == 0 && !names.short { // host_name
+				return string(name), nil
+			}
+		}
+		break
+	}
+	if truncated || ext.short {
+		return "", errors.New("truncated TLS ClientHello")
+	}
+	return "", errors.New("no server_name in TLS ClientHello")
+}
+
+// helloReader reads big-endian fields from b. Reads past the end of b
+// set short and return zero values.
+type helloReader struct {
+	b     []byte
+	short bool
+}
+
+func (r *helloReader) bytes(n int) []byte {
+	if len(r.b) < n {
+		r.short = true
+		r.b = nil
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *helloReader) skip(n int) { r.bytes(n) }
+
+func (r *helloReader) u8() uint8 {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *helloReader) u16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+// maxQUICSniffPackets is how many of a UDP flow's first client
+// datagrams quicSNILogger looks at for a QUIC Initial packet.
+const maxQUICSniffPackets = 3
+
+// quicSNILogger is a net.PacketConn that logs the server name of the
+// first QUIC Initial packet read from it, if any, for debugging
+// proxied QUIC (HTTP/3) flows.
+type quicSNILogger struct {
+	net.PacketConn
+	logf     logger.Logf
+	src, dst netaddr.IPPort
+	seen     int // packets inspected; only touched by the reading goroutine
+}
+
+func (c *quicSNILogger) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if err != nil || c.seen >= maxQUICSniffPackets {
+		return n, addr, err
+	}
+	c.seen++
+	if !isQUICInitial(p[:n]) {
+		return n, addr, err
+	}
+	c.seen = maxQUICSniffPackets
+	if sni, serr := quicInitialSNI(p[:n]); serr == nil {
+		c.logf("[v1] netstack: QUIC connection from %v to %v for %q", c.src, c.dst, sni)
+	} else {
+		c.logf("[v2] netstack: QUIC Initial from %v to %v without server name: %v", c.src, c.dst, serr)
+	}
+	return n, addr, err
+}
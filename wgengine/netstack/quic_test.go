@@ -0,0 +1,222 @@
+// Copyright (c) 2021 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package netstack
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestQUICClientInitialKeys(t *testing.T) {
+	// From RFC 9001, Appendix A.1.
+	dcid, _ := hex.DecodeString("8394c8f03e515708")
+	k := quicClientInitialKeys(dcid)
+	for _, tt := range []struct {
+		name      string
+		got, want []byte
+	}{
+		{"key", k.key, mustHex(t, "1f369613dd76d5467730efcbe3b1a22d")},
+		{"iv", k.iv, mustHex(t, "fa044b2f42a3fd3b46fb255c")},
+		{"hp", k.hp, mustHex(t, "9f50449e04a0e810283a1e9933adedd2")},
+	} {
+		if !bytes.Equal(tt.got, tt.want) {
+			t.Errorf("%s = %x; want %x", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// testClientHello returns the ClientHello handshake message that
+// crypto/tls sends to serverName.
+func testClientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	go tls.Client(c, &tls.Config{ServerName: serverName}).Handshake()
+	var hdr [5]byte // TLS record header
+	if _, err := io.ReadFull(s, hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(hdr[3:]))
+	if _, err := io.ReadFull(s, msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// cryptoFrame returns a QUIC CRYPTO frame carrying data at off.
+func cryptoFrame(off int, data []byte) []byte {
+	f := []byte{0x06, 0x40 | byte(off>>8), byte(off), 0x40 | byte(len(data)>>8), byte(len(data))}
+	return append(f, data...)
+}
+
+// sealQUICInitial returns a protected QUIC version 1 client Initial
+// packet to dcid with the given frames, padded to 1200 bytes as
+// clients do.
+func sealQUICInitial(t *testing.T, dcid []byte, frames []byte) []byte {
+	t.Helper()
+	const pnLen = 2
+	const pn = 0x0102
+	scid := []byte{1, 2, 3, 4}
+	hdrLen := 1 + 4 + 1 + len(dcid) + 1 + len(scid) + 1 + 2 + pnLen
+	payload := append([]byte(nil), frames...)
+	for hdrLen+len(payload)+16 < 1200 {
+		payload = append(payload, 0) // PADDING
+	}
+	length := pnLen + len(payload) + 16
+
+	hdr := []byte{0xc0 | (pnLen - 1), 0, 0, 0, 1, byte(len(dcid))}
+	hdr = append(hdr, dcid...)
+	hdr = append(hdr, byte(len(scid)))
+	hdr = append(hdr, scid...)
+	hdr = append(hdr, 0) // no token
+	hdr = append(hdr, 0x40|byte(length>>8), byte(length))
+	pnOffset := len(hdr)
+	hdr = append(hdr, pn>>8, pn&0xff)
+
+	k := quicClientInitialKeys(dcid)
+	block, err := aes.NewCipher(k.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := append([]byte(nil), k.iv...)
+	nonce[len(nonce)-1] ^= pn & 0xff
+	nonce[len(nonce)-2] ^= pn >> 8
+	pkt := aead.Seal(hdr, nonce, payload, hdr)
+
+	hp, err := aes.NewCipher(k.hp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mask [16]byte
+	hp.Encrypt(mask[:], pkt[pnOffset+4:pnOffset+4+16])
+	pkt[0] ^= mask[0] & 0x0f
+	for i := 0; i < pnLen; i++ {
+		pkt[pnOffset+i] ^= mask[1+i]
+	}
+	return pkt
+}
+
+func TestQUICInitialSNI(t *testing.T) {
+	const name = "service.example.com"
+	hello := testClientHello(t, name)
+	dcid := mustHex(t, "0011223344556677")
+	half := len(hello) / 2
+
+	tests := []struct {
+		name    string
+		frames  []byte
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "one_frame",
+			frames: cryptoFrame(0, hello),
+			want:   name,
+		},
+		{
+			name: "split_reordered",
+			frames: append(append([]byte{0x01}, // PING
+				cryptoFrame(half, hello[half:])...),
+				cryptoFrame(0, hello[:half])...),
+			want: name,
+		},
+		{
+			// The rest of the ClientHello is in a later packet.
+			name:   "first_part_only",
+			frames: cryptoFrame(0, hello[:len(hello)-20]),
+			want:   name,
+		},
+		{
+			name:    "too_short_for_extensions",
+			frames:  cryptoFrame(0, hello[:40]),
+			wantErr: true,
+		},
+		{
+			name:    "gap_at_start",
+			frames:  cryptoFrame(10, hello[10:]),
+			wantErr: true,
+		},
+		{
+			name:    "ack_frame",
+			frames:  append([]byte{0x02, 0, 0, 0, 0}, cryptoFrame(0, hello)...),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pkt := sealQUICInitial(t, dcid, tt.frames)
+			if !isQUICInitial(pkt) {
+				t.Fatal("isQUICInitial = false")
+			}
+			orig := append([]byte(nil), pkt...)
+			got, err := quicInitialSNI(pkt)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("quicInitialSNI = %q, %v; want error %v", got, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("quicInitialSNI = %q; want %q", got, tt.want)
+			}
+			if !bytes.Equal(pkt, orig) {
+				t.Error("quicInitialSNI modified the packet")
+			}
+		})
+	}
+
+	t.Run("corrupt", func(t *testing.T) {
+		pkt := sealQUICInitial(t, dcid, cryptoFrame(0, hello))
+		pkt[len(pkt)-1] ^= 1
+		if _, err := quicInitialSNI(pkt); err == nil {
+			t.Error("corrupt packet decrypted")
+		}
+	})
+	t.Run("truncated_datagram", func(t *testing.T) {
+		pkt := sealQUICInitial(t, dcid, cryptoFrame(0, hello))
+		if _, err := quicInitialSNI(pkt[:100]); err == nil {
+			t.Error("truncated packet parsed")
+		}
+	})
+}
+
+func TestIsQUICInitial(t *testing.T) {
+	tests := []struct {
+		name string
+		pkt  []byte
+		want bool
+	}{
+		{"initial", []byte{0xc3, 0, 0, 0, 1, 8}, true},
+		{"handshake", []byte{0xe3, 0, 0, 0, 1, 8}, false},
+		{"short_header", []byte{0x43, 0, 0, 0, 1, 8}, false},
+		{"version_negotiation", []byte{0xc3, 0, 0, 0, 0, 8}, false},
+		{"draft_29", []byte{0xc3, 0xff, 0, 0, 29, 8}, false},
+		{"dns", []byte{0x12, 0x34, 0x01, 0x00, 0x00, 0x01}, false},
+		{"tiny", []byte{0xc3}, false},
+	}
+	for _, tt := range tests {
+		if got := isQUICInitial(tt.pkt); got != tt.want {
+			t.Errorf("%s: isQUICInitial = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
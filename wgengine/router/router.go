@@ -7,6 +7,9 @@
 package router
 
 import (
+	"fmt"
+	"runtime"
+
 	"golang.zx2c4.com/wireguard/tun"
 	"inet.af/netaddr"
 	"tailscale.com/types/logger"
@@ -40,6 +43,33 @@ func New(logf logger.Logf, tundev tun.Device, linkMon *monitor.Mon) (Router, err
 	return newUserspaceRouter(logf, tundev, linkMon)
 }
 
+// NewWithSecondary is like New, but routes within secondaryPrefixes
+// point at the secondary tun device instead of tundev. It's only
+// supported on Linux.
+func NewWithSecondary(logf logger.Logf, tundev, secondary tun.Device, secondaryPrefixes []netaddr.IPPrefix, linkMon *monitor.Mon) (Router, error) {
+	secondaryName, err := secondary.Name()
+	if err != nil {
+		return nil, err
+	}
+	r, err := New(logf, tundev, linkMon)
+	if err != nil {
+		return nil, err
+	}
+	sr, ok := r.(secondaryDeviceSetter)
+	if !ok {
+		r.Close()
+		return nil, fmt.Errorf("secondary tun devices not supported on %s", runtime.GOOS)
+	}
+	sr.setSecondaryDevice(secondaryName, secondaryPrefixes)
+	return r, nil
+}
+
+// secondaryDeviceSetter is implemented by Routers that can route
+// some prefixes to a second tun device.
+type secondaryDeviceSetter interface {
+	setSecondaryDevice(tunname string, prefixes []netaddr.IPPrefix)
+}
+
 // Cleanup restores the system network configuration to its original state
 // in case the Tailscale daemon terminated without closing the router.
 // No other state needs to be instantiated before this runs.
@@ -101,6 +101,8 @@ type linuxRouter struct {
 	closed           syncs.AtomicBool
 	logf             func(fmt string, args ...interface{})
 	tunname          string
+	secondaryTun     string             // or empty if none
+	secondaryRoutes  []netaddr.IPPrefix // routed via secondaryTun
 	linkMon          *monitor.Mon
 	unregLinkMon     func()
 	addrs            map[netaddr.IPPrefix]bool
@@ -185,6 +187,22 @@ func newUserspaceRouterAdvanced(logf logger.Logf, tunname string, linkMon *monit
 	return r, nil
 }
 
+func (r *linuxRouter) setSecondaryDevice(tunname string, prefixes []netaddr.IPPrefix) {
+	r.secondaryTun = tunname
+	r.secondaryRoutes = append([]netaddr.IPPrefix(nil), prefixes...)
+}
+
+// routeDev returns the name of the tunnel interface that routes for
+// cidr should point to.
+func (r *linuxRouter) routeDev(cidr netaddr.IPPrefix) string {
+	for _, p := range r.secondaryRoutes {
+		if p.Bits() <= cidr.Bits() && p.Contains(cidr.IP()) {
+			return r.secondaryTun
+		}
+	}
+	return r.tunname
+}
+
 // onIPRuleDeleted is the callback from the link monitor for when an IP policy
 // rule is deleted. See Issue 1591.
 //
@@ -511,7 +529,7 @@ func (r *linuxRouter) delLoopbackRule(addr netaddr.IP) error {
 // interface. Fails if the route already exists, or if adding the
 // route fails.
 func (r *linuxRouter) addRoute(cidr netaddr.IPPrefix) error {
-	return r.addRouteDef([]string{normalizeCIDR(cidr), "dev", r.tunname}, cidr)
+	return r.addRouteDef([]string{normalizeCIDR(cidr), "dev", r.routeDev(cidr)}, cidr)
 }
 
 // addThrowRoute adds a throw route for the provided cidr.
@@ -540,7 +558,7 @@ func (r *linuxRouter) addRouteDef(routeDef []string, cidr netaddr.IPPrefix) erro
 // interface. Fails if the route doesn't exist, or if removing the
 // route fails.
 func (r *linuxRouter) delRoute(cidr netaddr.IPPrefix) error {
-	return r.delRouteDef([]string{normalizeCIDR(cidr), "dev", r.tunname}, cidr)
+	return r.delRouteDef([]string{normalizeCIDR(cidr), "dev", r.routeDev(cidr)}, cidr)
 }
 
 // delThrowRoute removes the throw route for the cidr. Fails if the route
@@ -594,13 +612,24 @@ func (r *linuxRouter) hasRoute(routeDef []string, cidr netaddr.IPPrefix) (bool,
 	return len(out) > 0, nil
 }
 
-// upInterface brings up the tunnel interface.
+// upInterface brings up the tunnel interface(s).
 func (r *linuxRouter) upInterface() error {
-	return r.cmd.run("ip", "link", "set", "dev", r.tunname, "up")
+	if err := r.cmd.run("ip", "link", "set", "dev", r.tunname, "up"); err != nil {
+		return err
+	}
+	if r.secondaryTun != "" {
+		return r.cmd.run("ip", "link", "set", "dev", r.secondaryTun, "up")
+	}
+	return nil
 }
 
-// downInterface sets the tunnel interface administratively down.
+// downInterface sets the tunnel interface(s) administratively down.
 func (r *linuxRouter) downInterface() error {
+	if r.secondaryTun != "" {
+		if err := r.cmd.run("ip", "link", "set", "dev", r.secondaryTun, "down"); err != nil {
+			return err
+		}
+	}
 	return r.cmd.run("ip", "link", "set", "dev", r.tunname, "down")
 }
 
@@ -1174,8 +1203,48 @@ func normalizeCIDR(cidr netaddr.IPPrefix) string {
 	return cidr.Masked().String()
 }
 
+// cleanup removes the netfilter chains, hooks and policy routing
+// rules that a previous tailscaled may have left behind if it didn't
+// exit cleanly.
 func cleanup(logf logger.Logf, interfaceName string) {
-	// TODO(dmytro): clean up iptables.
+	ipt4, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
+		logf("cleanup: can't run iptables: %v", err)
+		return
+	}
+	var ipt6 netfilterRunner
+	supportsV6 := checkIPv6() == nil
+	if supportsV6 {
+		ipt, err := iptables.NewWithProtocol(iptables.ProtocolIPv6)
+		if err != nil {
+			logf("cleanup: can't run ip6tables: %v", err)
+			supportsV6 = false
+		} else {
+			ipt6 = ipt
+		}
+	}
+	cmd := osCommandRunner{
+		ambientCapNetAdmin: distro.Get() == distro.Synology,
+	}
+	r := &linuxRouter{
+		logf:            logf,
+		tunname:         interfaceName,
+		ipRuleAvailable: cmd.run("ip", "rule") == nil,
+		v6Available:     supportsV6,
+		v6NATAvailable:  supportsV6 && supportsV6NAT(),
+		ipt4:            ipt4,
+		ipt6:            ipt6,
+		cmd:             cmd,
+	}
+	if err := r.delIPRules(); err != nil {
+		logf("cleanup: %v", err)
+	}
+	if err := r.delNetfilterHooks(); err != nil {
+		logf("cleanup: %v", err)
+	}
+	if err := r.delNetfilterChains(); err != nil {
+		logf("cleanup: %v", err)
+	}
 }
 
 // checkIPv6 checks whether the system appears to have a working IPv6
@@ -358,6 +358,30 @@ ip route add throw 192.168.0.0/24 table 52` + basic,
 	}
 }
 
+func TestSecondaryDeviceRoutes(t *testing.T) {
+	fake := NewFakeOS(t)
+	r, err := newUserspaceRouterAdvanced(t.Logf, "tailscale0", nil, fake.netfilter4, fake.netfilter6, fake, true, true)
+	if err != nil {
+		t.Fatalf("failed to create router: %v", err)
+	}
+	r.(secondaryDeviceSetter).setSecondaryDevice("tailscale1", mustCIDRs("10.1.0.0/16"))
+	if err := r.Set(&Config{
+		LocalAddrs:    mustCIDRs("100.101.102.103/10"),
+		Routes:        mustCIDRs("100.100.100.100/32", "10.1.2.0/24", "10.0.0.0/8"),
+		NetfilterMode: netfilterOff,
+	}); err != nil {
+		t.Fatalf("failed to set router config: %v", err)
+	}
+	want := []string{
+		"10.0.0.0/8 dev tailscale0 table 52",
+		"10.1.2.0/24 dev tailscale1 table 52",
+		"100.100.100.100/32 dev tailscale0 table 52",
+	}
+	if diff := cmp.Diff(fake.routes, want); diff != "" {
+		t.Errorf("unexpected routes (-got+want):\n%s", diff)
+	}
+}
+
 type fakeNetfilter struct {
 	t *testing.T
 	n map[string][]string
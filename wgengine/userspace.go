@@ -7,6 +7,7 @@ package wgengine
 import (
 	"bufio"
 	"bytes"
+	"context"
 	crand "crypto/rand"
 	"errors"
 	"fmt"
@@ -131,6 +132,9 @@ type userspaceEngine struct {
 	tsIPByIPPort        map[netaddr.IPPort]netaddr.IP          // allows registration of IP:ports as belonging to a certain Tailscale IP for whois lookups
 	pongCallback        map[[8]byte]func(packet.TSMPPongReply) // for TSMP pong responses
 
+	opsMu   sync.Mutex
+	lastOps map[string]OpStatus // by operation name; see LastOps
+
 	// Lock ordering: magicsock.Conn.mu, wgLock, then mu.
 }
 
@@ -143,6 +147,48 @@ func (e *userspaceEngine) GetInternals() (_ *tstun.Wrapper, _ *magicsock.Conn, o
 	return e.tundev, e.magicConn, true
 }
 
+// OpStatus is the outcome of the most recent run of an engine
+// operation.
+type OpStatus struct {
+	Start    time.Time
+	Duration time.Duration
+	Err      string `json:",omitempty"` // empty on success
+}
+
+// OpStatusGetter is implemented by Engines that record the outcome of
+// their operations, for debugging.
+type OpStatusGetter interface {
+	// LastOps returns the most recent run of each operation that
+	// has run, keyed by name: "reconfig", "set-network-map",
+	// "router" and "dns".
+	LastOps() map[string]OpStatus
+}
+
+func (e *userspaceEngine) LastOps() map[string]OpStatus {
+	e.opsMu.Lock()
+	defer e.opsMu.Unlock()
+	ret := make(map[string]OpStatus, len(e.lastOps))
+	for k, v := range e.lastOps {
+		ret[k] = v
+	}
+	return ret
+}
+
+// noteOp records the outcome of the operation name, which began at
+// start, for LastOps.
+func (e *userspaceEngine) noteOp(name string, start time.Time, err error) {
+	st := OpStatus{Start: start, Duration: time.Since(start)}
+	if err != nil {
+		st.Err = err.Error()
+	}
+	e.opsMu.Lock()
+	defer e.opsMu.Unlock()
+	if e.lastOps == nil {
+		e.lastOps = map[string]OpStatus{}
+	}
+	e.lastOps[name] = st
+}
+
 // Config is the engine configuration.
 type Config struct {
 	// Tun is the device used by the Engine to exchange packets with
@@ -154,6 +200,16 @@ type Config struct {
 	// require ethernet headers.
 	IsTAP bool
 
+	// SecondaryTun optionally is a second device that packets
+	// destined to SecondaryPrefixes are written to, rather than
+	// Tun. Packets read from it are handled like those read from
+	// Tun. It's only supported on Linux, with a non-TAP Tun.
+	SecondaryTun tun.Device
+
+	// SecondaryPrefixes are the destination prefixes whose packets
+	// are written to SecondaryTun.
+	SecondaryPrefixes []netaddr.IPPrefix
+
 	// Router interfaces the Engine to the OS network stack.
 	// If nil, a fake Router that does nothing is used.
 	Router router.Router
@@ -174,6 +230,14 @@ type Config struct {
 	// reply to ICMP pings, without involving the OS.
 	// Used in "fake" mode for development.
 	RespondToPing bool
+
+	// DeviceLogging is whether wireguard-go's verbose device logging
+	// starts out on. It can be changed later with SetDeviceLogging.
+	DeviceLogging bool
+
+	// PacketLogging is whether to log every packet through the TUN
+	// device (or netstack), regardless of other logging verbosity.
+	PacketLogging bool
 }
 
 func NewFakeUserspaceEngine(logf logger.Logf, listenPort uint16) (Engine, error) {
@@ -227,6 +291,15 @@ func NewUserspaceEngine(logf logger.Logf, conf Config) (_ Engine, reterr error)
 		logf("[v1] using fake (no-op) tun device")
 		conf.Tun = tstun.NewFake()
 	}
+	if conf.SecondaryTun != nil {
+		if runtime.GOOS != "linux" {
+			return nil, fmt.Errorf("secondary tun devices not supported on %s", runtime.GOOS)
+		}
+		if conf.IsTAP {
+			return nil, errors.New("secondary tun devices not supported with TAP")
+		}
+		conf.Tun = tstun.NewMulti(conf.Tun, conf.SecondaryTun, conf.SecondaryPrefixes)
+	}
 	if conf.Router == nil {
 		logf("[v1] using fake (no-op) OS network configurator")
 		conf.Router = router.NewFake(logf)
@@ -247,6 +320,7 @@ func NewUserspaceEngine(logf logger.Logf, conf Config) (_ Engine, reterr error)
 		tsTUNDev = tstun.Wrap(logf, conf.Tun)
 	}
 	closePool.add(tsTUNDev)
+	tsTUNDev.SetPacketLogging(conf.PacketLogging)
 
 	e := &userspaceEngine{
 		timeNow:        mono.Now,
@@ -326,6 +400,7 @@ func NewUserspaceEngine(logf logger.Logf, conf Config) (_ Engine, reterr error)
 	}
 
 	e.wgLogger = wglog.NewLogger(logf)
+	e.wgLogger.SetVerbose(conf.DeviceLogging)
 	e.tundev.OnTSMPPongReceived = func(pong packet.TSMPPongReply) {
 		e.mu.Lock()
 		defer e.mu.Unlock()
@@ -756,7 +831,7 @@ func (e *userspaceEngine) updateActivityMapsLocked(trackDisco []tailcfg.DiscoKey
 	e.tundev.SetDestIPActivityFuncs(e.destIPActivityFuncs)
 }
 
-func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config, dnsCfg *dns.Config, debug *tailcfg.Debug) error {
+func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config, dnsCfg *dns.Config, debug *tailcfg.Debug) (err error) {
 	if routerCfg == nil {
 		panic("routerCfg must not be nil")
 	}
@@ -764,6 +839,15 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 		panic("dnsCfg must not be nil")
 	}
 
+	start := time.Now()
+	defer func() {
+		opErr := err
+		if opErr == ErrNoChanges {
+			opErr = nil
+		}
+		e.noteOp("reconfig", start, opErr)
+	}()
+
 	e.isLocalAddr.Store(tsaddr.NewContainsIPFunc(routerCfg.LocalAddrs))
 
 	e.wgLock.Lock()
@@ -840,7 +924,9 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 
 	if routerChanged {
 		e.logf("wgengine: Reconfig: configuring router")
+		t0 := time.Now()
 		err := e.router.Set(routerCfg)
+		e.noteOp("router", t0, err)
 		health.SetRouterHealth(err)
 		if err != nil {
 			return err
@@ -849,7 +935,9 @@ func (e *userspaceEngine) Reconfig(cfg *wgcfg.Config, routerCfg *router.Config,
 		// DNS managers refuse to apply settings if the device has no
 		// assigned address.
 		e.logf("wgengine: Reconfig: configuring DNS")
+		t0 = time.Now()
 		err = e.dns.Set(*dnsCfg)
+		e.noteOp("dns", t0, err)
 		health.SetDNSHealth(err)
 		if err != nil {
 			return err
@@ -1103,6 +1191,9 @@ func (e *userspaceEngine) linkChange(changed bool, cur *interfaces.State) {
 
 	health.SetAnyInterfaceUp(up)
 	e.magicConn.SetNetworkUp(up)
+	if changed {
+		e.magicConn.NoteLinkChange()
+	}
 
 	// Hacky workaround for Linux DNS issue 2458: on
 	// suspend/resume or whenever NetworkManager is started, it
@@ -1153,6 +1244,7 @@ func (e *userspaceEngine) SetDERPMap(dm *tailcfg.DERPMap) {
 }
 
 func (e *userspaceEngine) SetNetworkMap(nm *netmap.NetworkMap) {
+	defer e.noteOp("set-network-map", time.Now(), nil)
 	e.magicConn.SetNetworkMap(nm)
 	e.mu.Lock()
 	e.netMap = nm
@@ -1336,6 +1428,26 @@ func (e *userspaceEngine) WhoIsIPPort(ipport netaddr.IPPort) (tsIP netaddr.IP, o
 	return tsIP, false
 }
 
+func (e *userspaceEngine) SetDNSQueryLogging(d time.Duration) {
+	e.dns.SetQueryLogging(d)
+}
+
+func (e *userspaceEngine) DNSQueryLog() ipnstate.DNSQueryLog {
+	return e.dns.QueryLog()
+}
+
+func (e *userspaceEngine) QueryDNS(ctx context.Context, query []byte) ([]byte, error) {
+	return e.dns.Query(ctx, query)
+}
+
+func (e *userspaceEngine) SetDeviceLogging(on bool) {
+	e.wgLogger.SetVerbose(on)
+}
+
+func (e *userspaceEngine) DeviceLogging() bool {
+	return e.wgLogger.Verbose()
+}
+
 // peerForIP returns the Node in the wireguard config
 // that's responsible for handling the given IP address.
 //
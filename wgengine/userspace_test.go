@@ -6,12 +6,15 @@ package wgengine
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 
 	"go4.org/mem"
 	"inet.af/netaddr"
+	"tailscale.com/health"
 	"tailscale.com/net/dns"
 	"tailscale.com/net/tstun"
 	"tailscale.com/tailcfg"
@@ -130,6 +133,64 @@ func TestUserspaceEngineReconfig(t *testing.T) {
 	}
 }
 
+// failingRouter is a router.Router whose Set returns err.
+type failingRouter struct {
+	router.Router
+	err error
+}
+
+func (r *failingRouter) Set(*router.Config) error { return r.err }
+
+func TestReconfigRouterHealth(t *testing.T) {
+	r := &failingRouter{Router: router.NewFake(t.Logf), err: errors.New("operation not permitted")}
+	e, err := NewUserspaceEngine(t.Logf, Config{Router: r})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	defer health.SetRouterHealth(nil)
+
+	hasWarning := func() bool {
+		for _, w := range health.Warnings() {
+			if strings.HasPrefix(w, "route configuration failing since ") && strings.HasSuffix(w, ": operation not permitted") {
+				return true
+			}
+		}
+		return false
+	}
+	routerCfg := func(ip string) *router.Config {
+		return &router.Config{LocalAddrs: []netaddr.IPPrefix{netaddr.MustParseIPPrefix(ip + "/32")}}
+	}
+
+	if err := e.Reconfig(&wgcfg.Config{}, routerCfg("100.64.0.1"), &dns.Config{}, nil); err == nil {
+		t.Fatal("Reconfig succeeded with failing router")
+	}
+	if !hasWarning() {
+		t.Errorf("no route configuration warning; got %q", health.Warnings())
+	}
+	ops := e.(OpStatusGetter).LastOps()
+	if got := ops["router"].Err; got != "operation not permitted" {
+		t.Errorf("router op error = %q; want the router's error", got)
+	}
+	if got := ops["reconfig"].Err; got == "" {
+		t.Errorf("reconfig op has no error")
+	}
+
+	r.err = nil
+	if err := e.Reconfig(&wgcfg.Config{}, routerCfg("100.64.0.2"), &dns.Config{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if hasWarning() {
+		t.Errorf("route configuration warning still present: %q", health.Warnings())
+	}
+	ops = e.(OpStatusGetter).LastOps()
+	for _, name := range []string{"reconfig", "router", "dns"} {
+		if op, ok := ops[name]; !ok || op.Err != "" || op.Start.IsZero() {
+			t.Errorf("op %q = %+v, %v; want recent success", name, op, ok)
+		}
+	}
+}
+
 func TestUserspaceEnginePortReconfig(t *testing.T) {
 	const defaultPort = 49983
 	// Keep making a wgengine until we find an unused port
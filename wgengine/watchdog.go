@@ -5,6 +5,7 @@
 package wgengine
 
 import (
+	"context"
 	"log"
 	"os"
 	"runtime/pprof"
@@ -129,6 +130,24 @@ func (e *watchdogEngine) WhoIsIPPort(ipp netaddr.IPPort) (tsIP netaddr.IP, ok bo
 	e.watchdog("UnregisterIPPortIdentity", func() { tsIP, ok = e.wrap.WhoIsIPPort(ipp) })
 	return tsIP, ok
 }
+func (e *watchdogEngine) SetDNSQueryLogging(d time.Duration) {
+	e.watchdog("SetDNSQueryLogging", func() { e.wrap.SetDNSQueryLogging(d) })
+}
+func (e *watchdogEngine) DNSQueryLog() (ql ipnstate.DNSQueryLog) {
+	e.watchdog("DNSQueryLog", func() { ql = e.wrap.DNSQueryLog() })
+	return ql
+}
+func (e *watchdogEngine) QueryDNS(ctx context.Context, query []byte) (res []byte, err error) {
+	e.watchdog("QueryDNS", func() { res, err = e.wrap.QueryDNS(ctx, query) })
+	return res, err
+}
+func (e *watchdogEngine) SetDeviceLogging(on bool) {
+	e.watchdog("SetDeviceLogging", func() { e.wrap.SetDeviceLogging(on) })
+}
+func (e *watchdogEngine) DeviceLogging() (on bool) {
+	e.watchdog("DeviceLogging", func() { on = e.wrap.DeviceLogging() })
+	return on
+}
 func (e *watchdogEngine) Close() {
 	e.watchdog("Close", e.wrap.Close)
 }
@@ -138,6 +157,12 @@ func (e *watchdogEngine) GetInternals() (tw *tstun.Wrapper, c *magicsock.Conn, o
 	}
 	return
 }
+func (e *watchdogEngine) LastOps() map[string]OpStatus {
+	if g, ok := e.wrap.(OpStatusGetter); ok {
+		return g.LastOps()
+	}
+	return nil
+}
 func (e *watchdogEngine) Wait() {
 	e.wrap.Wait()
 }
@@ -5,7 +5,9 @@
 package wgengine
 
 import (
+	"context"
 	"errors"
+	"time"
 
 	"inet.af/netaddr"
 	"tailscale.com/ipn/ipnstate"
@@ -149,4 +151,25 @@ type Engine interface {
 	// WhoIsIPPort looks up an IP:port in the temporary registrations,
 	// and returns a matching Tailscale IP, if it exists.
 	WhoIsIPPort(netaddr.IPPort) (netaddr.IP, bool)
+
+	// SetDNSQueryLogging turns logging of the queries handled by
+	// the in-engine DNS resolver on for the given duration, or off
+	// if it's zero or negative.
+	SetDNSQueryLogging(time.Duration)
+
+	// DNSQueryLog returns the in-engine DNS resolver's query log.
+	DNSQueryLog() ipnstate.DNSQueryLog
+
+	// QueryDNS answers the DNS query with the in-engine DNS
+	// resolver, as if it were sent to 100.100.100.100, and returns
+	// the response.
+	QueryDNS(ctx context.Context, query []byte) ([]byte, error)
+
+	// SetDeviceLogging turns wireguard-go's verbose device logging
+	// (handshakes, keepalives, and such) on or off.
+	SetDeviceLogging(bool)
+
+	// DeviceLogging reports whether wireguard-go's verbose device
+	// logging is on.
+	DeviceLogging() bool
 }
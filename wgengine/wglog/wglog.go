@@ -7,9 +7,12 @@ package wglog
 
 import (
 	"fmt"
+	"reflect"
+	"regexp"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"golang.zx2c4.com/wireguard/device"
 	"tailscale.com/types/logger"
@@ -22,6 +25,7 @@ import (
 type Logger struct {
 	DeviceLogger *device.Logger
 	replace      atomic.Value            // of map[string]string
+	verbose      int32                   // atomic; 1 if wireguard-go's verbose logs are logged
 	mu           sync.Mutex              // protects strs
 	strs         map[wgkey.Key]*strCache // cached strs used to populate replace
 }
@@ -38,56 +42,142 @@ type strCache struct {
 func NewLogger(logf logger.Logf) *Logger {
 	ret := new(Logger)
 	wrapper := func(format string, args ...interface{}) {
-		if strings.Contains(format, "Routine:") && !strings.Contains(format, "receive incoming") {
-			// wireguard-go logs as it starts and stops routines.
-			// Drop those; there are a lot of them, and they're just noise.
+		if dropLine(format) {
 			return
 		}
-		if strings.Contains(format, "Failed to send data packet") {
-			// Drop. See https://github.com/tailscale/tailscale/issues/1239.
-			return
-		}
-		if strings.Contains(format, "Interface up requested") || strings.Contains(format, "Interface down requested") {
-			// Drop. Logs 1/s constantly while the tun device is open.
-			// See https://github.com/tailscale/tailscale/issues/1388.
-			return
-		}
-		replace, _ := ret.replace.Load().(map[string]string)
-		if replace == nil {
-			// No replacements specified; log as originally planned.
-			logf(format, args...)
-			return
-		}
-		// Duplicate the args slice so that we can modify it.
-		// This is not always required, but the code required to avoid it is not worth the complexity.
-		newargs := make([]interface{}, len(args))
-		copy(newargs, args)
-		for i, arg := range newargs {
-			// We want to replace *device.Peer args with the Tailscale-formatted version of themselves.
-			// Using *device.Peer directly makes this hard to test, so we string any fmt.Stringers,
-			// and if the string ends up looking exactly like a known Peer, we replace it.
-			// This is slightly imprecise, in that we don't check the formatting verb. Oh well.
-			s, ok := arg.(fmt.Stringer)
-			if !ok {
-				continue
-			}
-			wgStr := s.String()
-			tsStr, ok := replace[wgStr]
-			if !ok {
-				continue
-			}
-			newargs[i] = tsStr
-		}
-		logf(format, newargs...)
+		logf(format, ret.rewritePeers(args)...)
 	}
+	// wireguard-go's verbose logs (handshakes, keepalives, and
+	// such) are only logged once enabled with SetVerbose. They're
+	// formatted and scrubbed of key material here, and rate-limited
+	// separately from, and instead of by, logf's rate limiter.
+	// Having been asked for explicitly, they're logged without a
+	// [v2] prefix, so they're shown regardless of --verbose.
+	verbosef := logger.RateLimitedFn(func(format string, args ...interface{}) {
+		args = ret.rewritePeers(args)
+		for i, arg := range args {
+			args[i] = redactKey(arg)
+		}
+		logf(VerbosePrefix+"%s", scrubKeys(fmt.Sprintf(format, args...)))
+	}, time.Second, 10, 100)
 	ret.DeviceLogger = &device.Logger{
-		Verbosef: logger.WithPrefix(wrapper, "[v2] "),
-		Errorf:   wrapper,
+		Verbosef: func(format string, args ...interface{}) {
+			if atomic.LoadInt32(&ret.verbose) != 0 && !dropLine(format) {
+				verbosef(format, args...)
+			}
+		},
+		Errorf: wrapper,
 	}
 	ret.strs = make(map[wgkey.Key]*strCache)
 	return ret
 }
 
+// dropLine reports whether wireguard-go log lines with the given
+// format are noise, not worth logging.
+func dropLine(format string) bool {
+	if strings.Contains(format, "Routine:") && !strings.Contains(format, "receive incoming") {
+		// wireguard-go logs as it starts and stops routines.
+		// Drop those; there are a lot of them, and they're just noise.
+		return true
+	}
+	if strings.Contains(format, "Failed to send data packet") {
+		// Drop. See https://github.com/tailscale/tailscale/issues/1239.
+		return true
+	}
+	if strings.Contains(format, "Interface up requested") || strings.Contains(format, "Interface down requested") {
+		// Drop. Logs 1/s constantly while the tun device is open.
+		// See https://github.com/tailscale/tailscale/issues/1388.
+		return true
+	}
+	return false
+}
+
+// rewritePeers returns a copy of args with the wireguard-go peers
+// set by SetPeers rewritten in Tailscale format.
+func (x *Logger) rewritePeers(args []interface{}) []interface{} {
+	// Duplicate the args slice so that we can modify it.
+	// This is not always required, but the code required to avoid it is not worth the complexity.
+	newargs := make([]interface{}, len(args))
+	copy(newargs, args)
+	replace, _ := x.replace.Load().(map[string]string)
+	if replace == nil {
+		// No replacements specified; log as originally planned.
+		return newargs
+	}
+	for i, arg := range newargs {
+		// We want to replace *device.Peer args with the Tailscale-formatted version of themselves.
+		// Using *device.Peer directly makes this hard to test, so we string any fmt.Stringers,
+		// and if the string ends up looking exactly like a known Peer, we replace it.
+		// This is slightly imprecise, in that we don't check the formatting verb. Oh well.
+		s, ok := arg.(fmt.Stringer)
+		if !ok {
+			continue
+		}
+		wgStr := s.String()
+		tsStr, ok := replace[wgStr]
+		if !ok {
+			continue
+		}
+		newargs[i] = tsStr
+	}
+	return newargs
+}
+
+// VerbosePrefix is the prefix of wireguard-go's verbose log lines.
+const VerbosePrefix = "wgdev: "
+
+// SetVerbose sets whether wireguard-go's verbose logs are logged.
+// SetVerbose is safe for concurrent use.
+func (x *Logger) SetVerbose(v bool) {
+	var n int32
+	if v {
+		n = 1
+	}
+	atomic.StoreInt32(&x.verbose, n)
+}
+
+// Verbose reports whether wireguard-go's verbose logs are logged.
+func (x *Logger) Verbose() bool {
+	return atomic.LoadInt32(&x.verbose) != 0
+}
+
+// redactKey returns arg, or if it's a key, a redacted form of it:
+// public keys are shortened as by wgkey.Key.ShortString, and anything
+// else key-sized (private, ephemeral, and preshared keys, as arrays or
+// byte slices) is left out entirely. Peers, which wireguard-go prints
+// by their already-truncated public keys, are left as they are.
+// Keys already formatted as text are caught by scrubKeys.
+func redactKey(arg interface{}) interface{} {
+	v := reflect.ValueOf(arg)
+	if v.Kind() == reflect.Ptr && !v.IsNil() {
+		v = v.Elem()
+	}
+	if (v.Kind() != reflect.Array && v.Kind() != reflect.Slice) || v.Type().Elem().Kind() != reflect.Uint8 || v.Len() != wgkey.Size {
+		return arg
+	}
+	if v.Kind() == reflect.Slice {
+		return "[redacted]"
+	}
+	if v.Type() == keyType || strings.Contains(v.Type().Name(), "Public") {
+		var k wgkey.Key
+		reflect.Copy(reflect.ValueOf(&k).Elem(), v)
+		return k.ShortString()
+	}
+	return "[redacted]"
+}
+
+var keyType = reflect.TypeOf(wgkey.Key{})
+
+// keyText matches keys formatted as text: 64 hex digits, as in
+// wireguard-go's UAPI, or 44 characters of padded base64.
+var keyText = regexp.MustCompile(`\b[0-9a-fA-F]{64}\b|[A-Za-z0-9+/]{43}=`)
+
+// scrubKeys returns s with any keys formatted as text, such as by a
+// key's String method or passed in as strings, replaced by "[redacted]".
+func scrubKeys(s string) string {
+	return keyText.ReplaceAllLiteralString(s, "[redacted]")
+}
+
 // SetPeers adjusts x to rewrite the peer public keys found in peers.
 // SetPeers is safe for concurrent use.
 func (x *Logger) SetPeers(peers []wgcfg.Peer) {
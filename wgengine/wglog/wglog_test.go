@@ -6,6 +6,8 @@ package wglog_test
 
 import (
 	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 
 	"tailscale.com/types/logger"
@@ -64,6 +66,63 @@ func TestLogger(t *testing.T) {
 	}
 }
 
+func TestVerboseLogging(t *testing.T) {
+	var logs []string
+	logf := func(format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	x := wglog.NewLogger(logf)
+	peerKey, err := wgkey.ParseHex("20c4c1ae54e1fd37cab6e9a532ca20646aff496796cc41d4519560e5e82bee53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	x.SetPeers([]wgcfg.Peer{{PublicKey: peerKey}})
+	privKey, err := wgkey.NewPrivate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handshake := func() {
+		x.DeviceLogger.Verbosef("%v - Sending handshake initiation", stringer("peer(IMTB…r7lM)"))
+		x.DeviceLogger.Verbosef("%v - Received handshake response from %v", stringer("peer(IMTB…r7lM)"), peerKey)
+		x.DeviceLogger.Verbosef("%v - ephemeral %v, static %v", stringer("peer(IMTB…r7lM)"), privKey, &privKey)
+		x.DeviceLogger.Verbosef("%v - preshared %v", stringer("peer(IMTB…r7lM)"), privKey[:])
+		x.DeviceLogger.Verbosef("%v - private_key=%s, key %s", stringer("peer(IMTB…r7lM)"), privKey.HexString(), stringer(privKey.String()))
+	}
+
+	handshake()
+	if len(logs) != 0 {
+		t.Fatalf("logged %q with verbose logging off", logs)
+	}
+
+	x.SetVerbose(true)
+	handshake()
+	want := []string{
+		"wgdev: [IMTBr] - Sending handshake initiation",
+		"wgdev: [IMTBr] - Received handshake response from [IMTBr]",
+		"wgdev: [IMTBr] - ephemeral [redacted], static [redacted]",
+		"wgdev: [IMTBr] - preshared [redacted]",
+		"wgdev: [IMTBr] - private_key=[redacted], key [redacted]",
+	}
+	if !reflect.DeepEqual(logs, want) {
+		t.Errorf("got logs %q; want %q", logs, want)
+	}
+	for _, l := range logs {
+		for _, secret := range []string{peerKey.HexString(), peerKey.Base64(), privKey.HexString(), privKey.String()} {
+			if strings.Contains(l, secret) {
+				t.Errorf("log line %q contains a full key", l)
+			}
+		}
+	}
+
+	x.SetVerbose(false)
+	logs = nil
+	handshake()
+	if len(logs) != 0 {
+		t.Errorf("logged %q after turning verbose logging off", logs)
+	}
+}
+
 func stringer(s string) stringerString {
 	return stringerString(s)
 }